@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/discovery"
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/watch"
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/workflow"
 )
 
@@ -27,7 +39,7 @@ func loadConfiguration(configPath string) (*config.Config, error) {
 	return config.LoadOrDefault()
 }
 
-func runRenameOnly(cfg *config.Config, targetPath string, dryRun bool) error {
+func runRenameOnly(ctx context.Context, cfg *config.Config, targetPath string, dryRun bool) error {
 	path := cfg.TargetPath
 	if targetPath != "" {
 		path = targetPath
@@ -37,15 +49,21 @@ func runRenameOnly(cfg *config.Config, targetPath string, dryRun bool) error {
 		path = "."
 	}
 
+	if path == config.AutoDetect {
+		cardPath, err := workflow.ResolveCardPath(cfg, path, card.RoleMain, cfg.Body)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(cardPath, "DCIM")
+	}
+
 	if dryRun {
-		log.Println("=== DRY RUN MODE ===")
-		log.Println("No actual changes will be made")
 		log.Printf("Would rename directories in: %s", path)
 		return nil
 	}
 
 	log.Printf("Renaming directories in: %s", path)
-	if err := rename.Directories(path); err != nil {
+	if err := rename.Directories(ctx, path); err != nil {
 		return fmt.Errorf("failed to rename directories: %w", err)
 	}
 
@@ -53,16 +71,318 @@ func runRenameOnly(cfg *config.Config, targetPath string, dryRun bool) error {
 	return nil
 }
 
+func listCards(cfg *config.Config) error {
+	cards, err := discovery.Find()
+	if err != nil {
+		return err
+	}
+
+	registry, err := card.LoadRegistry(cfg.RegistryPath())
+	if err != nil {
+		return err
+	}
+
+	if len(cards) == 0 {
+		fmt.Println("No Sony cards found")
+		return nil
+	}
+	for _, c := range cards {
+		registered := "unregistered"
+		if id, err := card.ReadIdentity(c.MountPoint); err == nil {
+			if entry, ok := registry.Lookup(id.ID); ok {
+				registered = fmt.Sprintf("%s card of %s", entry.Role, entry.Body)
+			}
+		}
+		fmt.Printf("%-16s %-40s %8.1f GB %6d photos  [%s]  %s\n",
+			c.Label, c.MountPoint, float64(c.Size)/1e9, c.PhotoCount, strings.Join(c.Markers, ", "), registered)
+	}
+	return nil
+}
+
+func registerCard(cfg *config.Config, path, role, body string) error {
+	path, err := cardPath(path)
+	if err != nil {
+		return err
+	}
+
+	id, err := workflow.RegisterCard(cfg, path, role, body)
+	if err != nil {
+		return err
+	}
+	log.Printf("Registered card %s at %s as the %s card of %s", id.ID, path, role, body)
+	return nil
+}
+
+// cardPath resolves "auto" to the single mounted Sony card
+func cardPath(path string) (string, error) {
+	if path != config.AutoDetect {
+		return path, nil
+	}
+	cards, err := discovery.Find()
+	if err != nil {
+		return "", err
+	}
+	detected, err := discovery.SelectOne(cards)
+	if err != nil {
+		return "", err
+	}
+	return detected.MountPoint, nil
+}
+
+func showState(cfg *config.Config, path string) error {
+	path, err := cardPath(path)
+	if err != nil {
+		return err
+	}
+	state, err := workflow.LoadCardState(cfg, path, false)
+	if err != nil {
+		return err
+	}
+	if state.CardID == "" {
+		fmt.Printf("Card at %s has no identity file; nothing was imported in keep-on-card mode\n", path)
+		return nil
+	}
+
+	fmt.Printf("Card %s at %s: %d files imported", state.CardID, path, state.Len())
+	if !state.Updated.IsZero() {
+		fmt.Printf(", last import %s", state.Updated.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Println()
+	for _, e := range state.Entries() {
+		fmt.Printf("  %s  %10d  %s\n", e.Imported.Local().Format("2006-01-02 15:04"), e.Size, e.Path)
+	}
+	return nil
+}
+
+func resetState(cfg *config.Config, path string, dryRun bool) error {
+	path, err := cardPath(path)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		log.Printf("[DRY RUN] Would reset the import history of the card at %s", path)
+		return nil
+	}
+	id, err := workflow.ResetCardState(cfg, path)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reset the import history of card %s; the next run imports all its files", id)
+	return nil
+}
+
+func restoreQuarantine(ctx context.Context, cfg *config.Config, path string, dryRun bool) error {
+	path, err := cardPath(path)
+	if err != nil {
+		return err
+	}
+	restored, err := workflow.RestoreQuarantine(ctx, cfg, path, dryRun)
+	if err != nil {
+		return err
+	}
+	if restored == 0 {
+		log.Printf("No quarantined files for the card at %s", path)
+		return nil
+	}
+	log.Printf("Restored %d files to %s", restored, path)
+	return nil
+}
+
+func restoreDestination(ctx context.Context, cfg *config.Config, name, dir string, dryRun bool) error {
+	if dir == "" {
+		return fmt.Errorf("-restore-destination requires -restore-to <directory>")
+	}
+	restored, err := workflow.RestoreDestination(ctx, cfg, name, dir, dryRun)
+	log.Printf("Restored %d files to %s", restored, dir)
+	return err
+}
+
+func runPrune(ctx context.Context, cfg *config.Config, before string, dryRun bool) error {
+	if before == "" {
+		return fmt.Errorf("-prune requires -before yyyy-mm-dd")
+	}
+	day, err := time.ParseInLocation("2006-01-02", before, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid -before date %q (expected yyyy-mm-dd)", before)
+	}
+
+	pruned, err := workflow.Prune(ctx, cfg, day, dryRun)
+	log.Printf("Pruned %d folders dated before %s", len(pruned), before)
+	return err
+}
+
+func runRepair(ctx context.Context, cfg *config.Config, dryRun bool) error {
+	report, err := workflow.RepairArchive(ctx, cfg, dryRun)
+	if report != nil {
+		log.Printf("Checked %d folders: %d damaged files, %d repaired, %d lost",
+			report.Folders, len(report.Damaged), len(report.Repaired), len(report.Lost))
+	}
+	return err
+}
+
+func runDedupe(ctx context.Context, cfg *config.Config) error {
+	groups, err := workflow.RunDedupe(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		fmt.Printf("%d identical files:\n", len(group))
+		for _, path := range group {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+	return nil
+}
+
+func runWatch(ctx context.Context, cfg *config.Config, dryRun bool) error {
+	opts := watch.Options{
+		Roots:      cfg.Watch.Roots,
+		Interval:   cfg.Watch.Interval,
+		Debounce:   cfg.Watch.Debounce,
+		StatusFile: cfg.Watch.StatusFile,
+		Accept: func(mountPoint string) bool {
+			entry, ok, err := workflow.RegisteredCard(cfg, mountPoint)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+				return false
+			}
+			if !ok {
+				log.Printf("Ignoring %s: not a registered card", mountPoint)
+				return false
+			}
+			log.Printf("Found %s card of %s at %s", entry.Role, entry.Body, mountPoint)
+			return true
+		},
+		Import: func(mountPoint string) error {
+			return workflow.ImportCard(ctx, cfg, mountPoint, dryRun)
+		},
+	}
+	if len(opts.Roots) == 0 {
+		opts.Roots = watch.DefaultRoots(runtime.GOOS)
+	}
+	if opts.Interval == 0 {
+		opts.Interval = 5 * time.Second
+	}
+	if opts.Debounce == 0 {
+		opts.Debounce = 3 * time.Second
+	}
+	if opts.StatusFile == "" {
+		opts.StatusFile = filepath.Join(config.Dir(), "watch-status.json")
+	}
+
+	return watch.New(opts).Run(ctx)
+}
+
+// splitList splits a comma-separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// applyFilterFlags overrides the configured filter with the criteria given on the command line
+func applyFilterFlags(filter *config.FilterConfig, flags config.FilterConfig) {
+	if len(flags.Extensions) > 0 {
+		filter.Extensions = flags.Extensions
+	}
+	if len(flags.ExcludeExtensions) > 0 {
+		filter.ExcludeExtensions = flags.ExcludeExtensions
+	}
+	if len(flags.Include) > 0 {
+		filter.Include = flags.Include
+	}
+	if len(flags.Exclude) > 0 {
+		filter.Exclude = flags.Exclude
+	}
+	if flags.From != "" {
+		filter.From = flags.From
+	}
+	if flags.To != "" {
+		filter.To = flags.To
+	}
+	if flags.MinSize != "" {
+		filter.MinSize = flags.MinSize
+	}
+	if flags.MaxSize != "" {
+		filter.MaxSize = flags.MaxSize
+	}
+}
+
+// interruptContext returns a context cancelled by the first SIGINT or SIGTERM,
+// so the running operation can finish or roll back the current file and stop.
+// A second signal terminates the process immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received %v, stopping after the current file (repeat to quit immediately)", sig)
+		cancel()
+	}()
+	return ctx
+}
+
+// fatal logs the failure of operation and exits.
+// An interrupted operation exits with status 130, as a shell does after Ctrl-C.
+func fatal(operation string, err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Printf("%s interrupted: %v", operation, err)
+		os.Exit(130)
+	}
+	log.Fatalf("%s failed: %v", operation, err)
+}
+
 func main() {
 	// Command line flags
 	configPath := flag.String("config", "", "Path to configuration file")
 	targetPath := flag.String("path", "", "Target path to rename directories (overrides config)")
 	createConfig := flag.Bool("create-config", false, "Create a default configuration file")
 	workflowFlag := flag.Bool("workflow", false, "Run full workflow: copy, rename, and delete")
-	backupCleanup := flag.Bool("backup-cleanup", false, "Delete files from backup SD card and eject")
+	backupCleanup := flag.Bool("backup-cleanup", false, "Delete archived files from backup SD card and eject")
+	listCardsFlag := flag.Bool("list-cards", false, "List mounted Sony cards")
+	registerCardPath := flag.String("register-card", "", "Register the card mounted at this path (or \"auto\")")
+	role := flag.String("role", card.RoleMain, "Card role for -register-card: main or backup")
+	body := flag.String("body", "", "Camera body for -register-card")
+	watchFlag := flag.Bool("watch", false, "Watch for registered cards and import them when mounted")
+	dedupe := flag.Bool("dedupe", false, "List duplicate files already present in the destination archive")
+	keepOnCard := flag.Bool("keep-on-card", false, "Leave photos on the card and import only files not imported before")
+	showStatePath := flag.String("show-state", "", "Show the keep-on-card import history of the card at this path (or \"auto\")")
+	resetStatePath := flag.String("reset-state", "", "Forget the keep-on-card import history of the card at this path (or \"auto\")")
+	restoreQuarantinePath := flag.String("restore-quarantine", "", "Move quarantined files back to the card at this path (or \"auto\")")
+	restoreDestinationName := flag.String("restore-destination", "", "Copy the folders of this destination back to -restore-to, decrypting encrypted ones")
+	restoreTo := flag.String("restore-to", "", "Directory receiving the folders restored with -restore-destination")
+	prune := flag.Bool("prune", false, "Remove archive date folders dated before -before (to the trash with use_trash)")
+	before := flag.String("before", "", "Cut-off date for -prune (yyyy-mm-dd)")
+	repair := flag.Bool("repair", false, "Check the archive against its parity files and rebuild damaged files")
 	dryRun := flag.Bool("dry-run", false, "Show what would be done without making any changes")
+	var filterFlags config.FilterConfig
+	extensions := flag.String("ext", "", "Only import these extensions, comma-separated (e.g. arw,mp4)")
+	excludeExtensions := flag.String("exclude-ext", "", "Never import these extensions, comma-separated")
+	include := flag.String("include", "", "Only import paths matching these glob patterns, comma-separated")
+	exclude := flag.String("exclude", "", "Never import paths matching these glob patterns, comma-separated")
+	flag.StringVar(&filterFlags.From, "from", "", "Only import files captured on or after this date (yyyy-mm-dd)")
+	flag.StringVar(&filterFlags.To, "to", "", "Only import files captured on or before this date (yyyy-mm-dd)")
+	flag.StringVar(&filterFlags.MinSize, "min-size", "", "Only import files of at least this size (e.g. 500K)")
+	flag.StringVar(&filterFlags.MaxSize, "max-size", "", "Only import files of at most this size (e.g. 4GB)")
 	flag.Parse()
 
+	filterFlags.Extensions = splitList(*extensions)
+	filterFlags.ExcludeExtensions = splitList(*excludeExtensions)
+	filterFlags.Include = splitList(*include)
+	filterFlags.Exclude = splitList(*exclude)
+
+	if *dryRun {
+		log.Println("=== DRY RUN MODE ===")
+		log.Println("No actual changes will be made")
+	}
+
 	// Create default config if requested
 	if *createConfig {
 		if err := handleCreateConfig(); err != nil {
@@ -77,30 +397,84 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	applyFilterFlags(&cfg.Filter, filterFlags)
+	if *keepOnCard {
+		cfg.KeepOnCard = true
+	}
+
+	if *listCardsFlag {
+		if err := listCards(cfg); err != nil {
+			log.Fatalf("Card detection failed: %v", err)
+		}
+		return
+	}
+
+	if *showStatePath != "" {
+		if err := showState(cfg, *showStatePath); err != nil {
+			log.Fatalf("Failed to show card state: %v", err)
+		}
+		return
+	}
+
+	if *resetStatePath != "" {
+		if err := resetState(cfg, *resetStatePath, *dryRun); err != nil {
+			log.Fatalf("Failed to reset card state: %v", err)
+		}
+		return
+	}
+
+	if *registerCardPath != "" {
+		if err := registerCard(cfg, *registerCardPath, *role, *body); err != nil {
+			log.Fatalf("Card registration failed: %v", err)
+		}
+		return
+	}
+
+	ctx := interruptContext()
+
+	if *restoreQuarantinePath != "" {
+		if err := restoreQuarantine(ctx, cfg, *restoreQuarantinePath, *dryRun); err != nil {
+			fatal("Restore", err)
+		}
+		return
+	}
+
 	// Execute based on command flags
 	if *workflowFlag {
-		if *dryRun {
-			log.Println("=== DRY RUN MODE ===")
-			log.Println("No actual changes will be made")
-		}
 		log.Println("Starting workflow: copy, rename, and delete")
-		if err := workflow.Run(cfg, *dryRun); err != nil {
-			log.Fatalf("Workflow failed: %v", err)
+		if err := workflow.Run(ctx, cfg, *dryRun); err != nil {
+			fatal("Workflow", err)
 		}
 		log.Println("Workflow completed successfully")
 	} else if *backupCleanup {
-		if *dryRun {
-			log.Println("=== DRY RUN MODE ===")
-			log.Println("No actual changes will be made")
-		}
 		log.Println("Starting backup cleanup")
-		if err := workflow.RunBackupCleanup(cfg, *dryRun); err != nil {
-			log.Fatalf("Backup cleanup failed: %v", err)
+		if err := workflow.RunBackupCleanup(ctx, cfg, *dryRun); err != nil {
+			fatal("Backup cleanup", err)
 		}
 		log.Println("Backup cleanup completed successfully")
+	} else if *watchFlag {
+		if err := runWatch(ctx, cfg, *dryRun); err != nil {
+			log.Fatalf("Watch failed: %v", err)
+		}
+	} else if *restoreDestinationName != "" {
+		if err := restoreDestination(ctx, cfg, *restoreDestinationName, *restoreTo, *dryRun); err != nil {
+			fatal("Restore", err)
+		}
+	} else if *prune {
+		if err := runPrune(ctx, cfg, *before, *dryRun); err != nil {
+			fatal("Prune", err)
+		}
+	} else if *repair {
+		if err := runRepair(ctx, cfg, *dryRun); err != nil {
+			fatal("Repair", err)
+		}
+	} else if *dedupe {
+		if err := runDedupe(ctx, cfg); err != nil {
+			fatal("Dedupe report", err)
+		}
 	} else {
-		if err := runRenameOnly(cfg, *targetPath, *dryRun); err != nil {
-			log.Fatal(err)
+		if err := runRenameOnly(ctx, cfg, *targetPath, *dryRun); err != nil {
+			fatal("Rename", err)
 		}
 	}
 }
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
@@ -9,7 +10,7 @@ import (
 
 func main() {
 	// Rename directories in current directory
-	if err := rename.Directories("."); err != nil {
+	if err := rename.Directories(context.Background(), "."); err != nil {
 		log.Fatalf("Failed to rename directories: %v", err)
 	}
 
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
@@ -19,7 +20,7 @@ func main() {
 	log.Println("=== DRY RUN MODE ===")
 	log.Println("Showing what would be done without making changes...")
 
-	if err := workflow.Run(cfg, true); err != nil {
+	if err := workflow.Run(context.Background(), cfg, true); err != nil {
 		log.Fatalf("Workflow failed: %v", err)
 	}
 
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
@@ -17,7 +18,7 @@ func main() {
 
 	// Use configured path
 	log.Printf("Renaming directories in: %s", cfg.TargetPath)
-	if err := rename.Directories(cfg.TargetPath); err != nil {
+	if err := rename.Directories(context.Background(), cfg.TargetPath); err != nil {
 		log.Fatalf("Failed to rename directories: %v", err)
 	}
 
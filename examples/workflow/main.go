@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
@@ -17,7 +18,7 @@ func main() {
 
 	// Run full workflow (copy, rename, delete)
 	log.Println("Starting workflow...")
-	if err := workflow.Run(cfg, false); err != nil {
+	if err := workflow.Run(context.Background(), cfg, false); err != nil {
 		log.Fatalf("Workflow failed: %v", err)
 	}
 
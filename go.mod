@@ -1,5 +1,17 @@
 module github.com/shunichi-ikebuchi/rename-sony-photos-directories
 
-go 1.25
+go 1.25.0
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	github.com/klauspost/reedsolomon v1.14.2
+	github.com/pkg/sftp v1.13.10
+	golang.org/x/crypto v0.50.0
+	golang.org/x/net v0.53.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.3.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.43.0 // indirect
+)
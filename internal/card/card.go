@@ -0,0 +1,156 @@
+// Package card identifies physical camera cards and maps them to their role and camera body.
+package card
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// IdentityFileName is the marker file written to the root of a registered card
+const IdentityFileName = ".rename-sony-photos-card.yaml"
+
+// Roles a card can be registered with
+const (
+	RoleMain   = "main"
+	RoleBackup = "backup"
+)
+
+// ErrNoIdentity is returned when a card has no identity file
+var ErrNoIdentity = errors.New("card has no identity file")
+
+// Identity is the content of the identity file on a card
+type Identity struct {
+	ID      string    `yaml:"id"`
+	Created time.Time `yaml:"created"`
+}
+
+// ReadIdentity reads the identity file from the card mounted at mountPoint
+func ReadIdentity(mountPoint string) (Identity, error) {
+	data, err := os.ReadFile(filepath.Join(mountPoint, IdentityFileName))
+	if os.IsNotExist(err) {
+		return Identity{}, ErrNoIdentity
+	}
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to read card identity: %w", err)
+	}
+
+	var id Identity
+	if err := yaml.Unmarshal(data, &id); err != nil {
+		return Identity{}, fmt.Errorf("failed to parse card identity: %w", err)
+	}
+	if id.ID == "" {
+		return Identity{}, fmt.Errorf("card identity file in %s has no id", mountPoint)
+	}
+	return id, nil
+}
+
+// EnsureIdentity returns the identity of the card, writing a new one if the card has none
+func EnsureIdentity(mountPoint string) (Identity, error) {
+	id, err := ReadIdentity(mountPoint)
+	if !errors.Is(err, ErrNoIdentity) {
+		return id, err
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return Identity{}, fmt.Errorf("failed to generate card id: %w", err)
+	}
+	id = Identity{ID: hex.EncodeToString(buf), Created: time.Now().UTC().Truncate(time.Second)}
+
+	data, err := yaml.Marshal(id)
+	if err != nil {
+		return Identity{}, fmt.Errorf("failed to marshal card identity: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(mountPoint, IdentityFileName), data, 0644); err != nil {
+		return Identity{}, fmt.Errorf("failed to write card identity: %w", err)
+	}
+	return id, nil
+}
+
+// Entry describes a registered card
+type Entry struct {
+	Role  string `yaml:"role"`
+	Body  string `yaml:"body,omitempty"`
+	Label string `yaml:"label,omitempty"`
+}
+
+// Registry maps card IDs to their role and camera body
+type Registry struct {
+	Cards map[string]Entry `yaml:"cards"`
+}
+
+// LoadRegistry reads the registry file. A missing file yields an empty registry.
+func LoadRegistry(path string) (*Registry, error) {
+	registry := &Registry{Cards: make(map[string]Entry)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read card registry: %w", err)
+	}
+	if err := yaml.Unmarshal(data, registry); err != nil {
+		return nil, fmt.Errorf("failed to parse card registry: %w", err)
+	}
+	if registry.Cards == nil {
+		registry.Cards = make(map[string]Entry)
+	}
+	return registry, nil
+}
+
+// Save writes the registry file, creating its directory if needed
+func (r *Registry) Save(path string) error {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal card registry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create registry directory: %w", err)
+	}
+	if err := storage.WriteFile(storage.Local{}, path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write card registry: %w", err)
+	}
+	return nil
+}
+
+// ValidateRole checks that role is RoleMain or RoleBackup
+func ValidateRole(role string) error {
+	if role != RoleMain && role != RoleBackup {
+		return fmt.Errorf("invalid card role %q (expected %s or %s)", role, RoleMain, RoleBackup)
+	}
+	return nil
+}
+
+// Register records the role and body of a card
+func (r *Registry) Register(id string, entry Entry) error {
+	if err := ValidateRole(entry.Role); err != nil {
+		return err
+	}
+	r.Cards[id] = entry
+	return nil
+}
+
+// Lookup returns the registry entry for a card ID
+func (r *Registry) Lookup(id string) (Entry, bool) {
+	entry, ok := r.Cards[id]
+	return entry, ok
+}
+
+// HasRole reports whether any card is registered with role
+func (r *Registry) HasRole(role string) bool {
+	for _, entry := range r.Cards {
+		if entry.Role == role {
+			return true
+		}
+	}
+	return false
+}
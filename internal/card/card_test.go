@@ -0,0 +1,93 @@
+package card
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureIdentity(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "card-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(mountPoint)
+
+	if _, err := ReadIdentity(mountPoint); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("Expected ErrNoIdentity, got %v", err)
+	}
+
+	first, err := EnsureIdentity(mountPoint)
+	if err != nil {
+		t.Fatalf("EnsureIdentity failed: %v", err)
+	}
+	if len(first.ID) != 16 {
+		t.Errorf("Unexpected card id: %q", first.ID)
+	}
+
+	// The identity is stable once written
+	second, err := EnsureIdentity(mountPoint)
+	if err != nil {
+		t.Fatalf("EnsureIdentity failed: %v", err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("Identity changed: %s -> %s", first.ID, second.ID)
+	}
+
+	read, err := ReadIdentity(mountPoint)
+	if err != nil {
+		t.Fatalf("ReadIdentity failed: %v", err)
+	}
+	if read.ID != first.ID {
+		t.Errorf("ReadIdentity() = %s, want %s", read.ID, first.ID)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "registry-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "config", "cards.yaml")
+	registry, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadRegistry failed: %v", err)
+	}
+	if len(registry.Cards) != 0 {
+		t.Errorf("Expected empty registry, got %v", registry.Cards)
+	}
+
+	if err := registry.Register("abc", Entry{Role: "spare"}); err == nil {
+		t.Error("Expected error for invalid role")
+	}
+	if err := registry.Register("abc", Entry{Role: RoleMain, Body: "a7iii", Label: "1-1"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := registry.Register("def", Entry{Role: RoleBackup, Body: "a7iii"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := registry.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := LoadRegistry(path)
+	if err != nil {
+		t.Fatalf("LoadRegistry failed: %v", err)
+	}
+	entry, ok := loaded.Lookup("abc")
+	if !ok {
+		t.Fatal("Registered card not found")
+	}
+	if entry.Role != RoleMain || entry.Body != "a7iii" || entry.Label != "1-1" {
+		t.Errorf("Unexpected entry: %+v", entry)
+	}
+	if _, ok := loaded.Lookup("unknown"); ok {
+		t.Error("Unknown card should not be found")
+	}
+	if !loaded.HasRole(RoleBackup) || (&Registry{}).HasRole(RoleMain) {
+		t.Error("HasRole should report registered roles only")
+	}
+}
@@ -0,0 +1,142 @@
+// Package cardstate remembers which files of a card have already been imported,
+// so cards that keep their photos can be imported incrementally.
+package cardstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// Entry describes one imported file
+type Entry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Hash     string    `json:"hash"`
+	Imported time.Time `json:"imported"`
+}
+
+type fileFormat struct {
+	Version int       `json:"version"`
+	CardID  string    `json:"card_id"`
+	Updated time.Time `json:"updated"`
+	Entries []Entry   `json:"entries"`
+}
+
+// State is the import history of one card.
+// Paths are relative to the card root using forward slashes.
+type State struct {
+	CardID  string
+	Updated time.Time
+	path    string
+	entries map[string]Entry
+}
+
+// New returns an empty state stored at path
+func New(path, cardID string) *State {
+	return &State{CardID: cardID, path: path, entries: make(map[string]Entry)}
+}
+
+// Load reads the state stored at path. A missing file yields an empty state.
+func Load(path, cardID string) (*State, error) {
+	s := New(path, cardID)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read card state: %w", err)
+	}
+
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse card state: %w", err)
+	}
+	if file.CardID != "" && file.CardID != cardID {
+		return nil, fmt.Errorf("card state %s belongs to card %s, not %s", path, file.CardID, cardID)
+	}
+	s.Updated = file.Updated
+	for _, e := range file.Entries {
+		s.entries[e.Path] = e
+	}
+	return s, nil
+}
+
+// Save writes the state to disk, replacing the previous file atomically
+func (s *State) Save() error {
+	s.Updated = time.Now().UTC().Truncate(time.Second)
+	file := fileFormat{Version: 1, CardID: s.CardID, Updated: s.Updated, Entries: s.Entries()}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal card state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create card state directory: %w", err)
+	}
+	if err := storage.WriteFile(storage.Local{}, s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write card state: %w", err)
+	}
+	return nil
+}
+
+// Entries returns the imported files sorted by path
+func (s *State) Entries() []Entry {
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Path < entries[b].Path })
+	return entries
+}
+
+// Len returns the number of imported files
+func (s *State) Len() int {
+	return len(s.entries)
+}
+
+// Imported reports whether the file at rel was already imported.
+// A file with the recorded path, size and modification time is imported; when only
+// the modification time differs, the content hash decides.
+func (s *State) Imported(rel, path string, info os.FileInfo) (bool, error) {
+	e, ok := s.entries[filepath.ToSlash(rel)]
+	if !ok || e.Size != info.Size() {
+		return false, nil
+	}
+	if e.ModTime.Equal(info.ModTime()) {
+		return true, nil
+	}
+
+	hash, err := checksum.File(path)
+	if err != nil {
+		return false, err
+	}
+	return hash == e.Hash, nil
+}
+
+// Record marks the file at rel as imported
+func (s *State) Record(rel, path string, info os.FileInfo) error {
+	hash, err := checksum.File(path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	s.entries[rel] = Entry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), Hash: hash, Imported: time.Now().UTC().Truncate(time.Second)}
+	return nil
+}
+
+// Reset removes the state file at path. A missing file is not an error.
+func Reset(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove card state: %w", err)
+	}
+	return nil
+}
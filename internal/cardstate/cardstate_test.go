@@ -0,0 +1,84 @@
+package cardstate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "cardstate-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	photo := filepath.Join(tmpDir, "DSC00001.JPG")
+	if err := os.WriteFile(photo, []byte("photo"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	info, err := os.Stat(photo)
+	if err != nil {
+		t.Fatalf("Failed to stat test file: %v", err)
+	}
+
+	statePath := filepath.Join(tmpDir, "state", "card1.json")
+	state, err := Load(statePath, "card1")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if imported, _ := state.Imported("DCIM/02512310/DSC00001.JPG", photo, info); imported {
+		t.Error("Empty state should not report imported files")
+	}
+	if err := state.Record("DCIM/02512310/DSC00001.JPG", photo, info); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := state.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load(statePath, "card1")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.Len() != 1 || loaded.Updated.IsZero() {
+		t.Fatalf("Unexpected loaded state: %+v", loaded.Entries())
+	}
+	if imported, err := loaded.Imported("DCIM/02512310/DSC00001.JPG", photo, info); err != nil || !imported {
+		t.Errorf("Imported() = %v, %v for a recorded file", imported, err)
+	}
+
+	// A changed modification time with the same content is still the same file
+	later := info.ModTime().Add(time.Hour)
+	if err := os.Chtimes(photo, later, later); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	info, _ = os.Stat(photo)
+	if imported, _ := loaded.Imported("DCIM/02512310/DSC00001.JPG", photo, info); !imported {
+		t.Error("File with unchanged content should still be imported")
+	}
+
+	// New content under the same name is a new file
+	if err := os.WriteFile(photo, []byte("other"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite test file: %v", err)
+	}
+	info, _ = os.Stat(photo)
+	if imported, _ := loaded.Imported("DCIM/02512310/DSC00001.JPG", photo, info); imported {
+		t.Error("File with new content should not be imported")
+	}
+
+	if _, err := Load(statePath, "card2"); err == nil {
+		t.Error("Expected error when loading the state of another card")
+	}
+
+	if err := Reset(statePath); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if err := Reset(statePath); err != nil {
+		t.Errorf("Reset of a missing state failed: %v", err)
+	}
+	if loaded, _ := Load(statePath, "card1"); loaded.Len() != 0 {
+		t.Error("State should be empty after reset")
+	}
+}
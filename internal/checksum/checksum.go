@@ -0,0 +1,61 @@
+// Package checksum provides content hashing helpers for photo files.
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// File returns the hex-encoded SHA-256 digest of the file at path.
+func File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file for hashing: %w", err)
+	}
+	defer f.Close()
+
+	hash, err := Reader(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash file %s: %w", path, err)
+	}
+	return hash, nil
+}
+
+// Reader returns the hex-encoded SHA-256 digest of everything read from r.
+func Reader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Identical reports whether two files have the same size and SHA-256 digest.
+// The size is compared first so differing files are usually rejected without reading them.
+func Identical(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", a, err)
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", b, err)
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	hashA, err := File(a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := File(b)
+	if err != nil {
+		return false, err
+	}
+
+	return hashA == hashB, nil
+}
@@ -0,0 +1,76 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "checksum-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	sum, err := File(path)
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+
+	expected := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if sum != expected {
+		t.Errorf("File() = %s, want %s", sum, expected)
+	}
+
+	if _, err := File(filepath.Join(tmpDir, "missing.txt")); err == nil {
+		t.Error("Expected error for missing file, got nil")
+	}
+}
+
+func TestIdentical(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "checksum-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]string{
+		"a.txt": "same content",
+		"b.txt": "same content",
+		"c.txt": "other content",
+		"d.txt": "other CONTENT",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		a, b     string
+		expected bool
+	}{
+		{"same content", "a.txt", "b.txt", true},
+		{"different size", "a.txt", "c.txt", false},
+		{"same size different content", "c.txt", "d.txt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Identical(filepath.Join(tmpDir, tt.a), filepath.Join(tmpDir, tt.b))
+			if err != nil {
+				t.Fatalf("Identical failed: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Identical(%s, %s) = %v, want %v", tt.a, tt.b, result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+// Package clip finds XAVC video clips on Sony cards and reads their metadata.
+package clip
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// Directories of a Sony card holding video, relative to the card root
+var (
+	RootDir  = filepath.Join("PRIVATE", "M4ROOT")
+	ClipDir  = filepath.Join(RootDir, "CLIP")
+	ProxyDir = filepath.Join(RootDir, "SUB")
+	// ThumbnailDir holds the thumbnails the camera shows in playback
+	ThumbnailDir = filepath.Join(RootDir, "THMBNL")
+	// ProfileFile is the index of the clips the camera plays back
+	ProfileFile = filepath.Join(RootDir, "MEDIAPRO.XML")
+)
+
+// Clip is one recorded video with its sidecar files
+type Clip struct {
+	// Name is the clip name shared by all its files, e.g. C0001
+	Name string
+	// Video is the path of the main video file
+	Video string
+	// Metadata is the path of the XML sidecar, empty when missing
+	Metadata string
+	// Proxies are the low-resolution copies in the SUB directory
+	Proxies []string
+	// Thumbnails are the playback thumbnails in the THMBNL directory. They are not imported.
+	Thumbnails []string
+	// Date is the recording date from the XML sidecar, or the modification time of the video
+	Date time.Time
+}
+
+// Files returns every file belonging to the clip
+func (c Clip) Files() []string {
+	files := []string{c.Video}
+	if c.Metadata != "" {
+		files = append(files, c.Metadata)
+	}
+	return append(files, c.Proxies...)
+}
+
+// Scan returns the clips recorded on the card mounted at root in fsys.
+// A card without a PRIVATE/M4ROOT/CLIP directory has no clips.
+func Scan(fsys storage.FS, root string) ([]Clip, error) {
+	clipDir := filepath.Join(root, ClipDir)
+	entries, err := fsys.ReadDir(clipDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clip directory: %w", err)
+	}
+
+	var sidecars []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".xml") {
+			sidecars = append(sidecars, entry.Name())
+		}
+	}
+
+	proxies, err := fsys.ReadDir(filepath.Join(root, ProxyDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read proxy directory: %w", err)
+	}
+	thumbnails, err := fsys.ReadDir(filepath.Join(root, ThumbnailDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read thumbnail directory: %w", err)
+	}
+
+	var clips []Clip
+	for _, entry := range entries {
+		if entry.IsDir() || !isVideo(entry.Name()) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		c := Clip{Name: name, Video: filepath.Join(clipDir, entry.Name())}
+
+		// Sidecars are named <clip>M01.XML, proxies <clip>S03.MP4, thumbnails <clip>T01.JPG
+		for _, sidecar := range sidecars {
+			if strings.HasPrefix(strings.ToUpper(sidecar), strings.ToUpper(name)+"M") {
+				c.Metadata = filepath.Join(clipDir, sidecar)
+				break
+			}
+		}
+		for _, proxy := range proxies {
+			if !proxy.IsDir() && strings.HasPrefix(strings.ToUpper(proxy.Name()), strings.ToUpper(name)+"S") {
+				c.Proxies = append(c.Proxies, filepath.Join(root, ProxyDir, proxy.Name()))
+			}
+		}
+		for _, thumbnail := range thumbnails {
+			if !thumbnail.IsDir() && strings.HasPrefix(strings.ToUpper(thumbnail.Name()), strings.ToUpper(name)+"T") {
+				c.Thumbnails = append(c.Thumbnails, filepath.Join(root, ThumbnailDir, thumbnail.Name()))
+			}
+		}
+
+		if c.Date, err = clipDate(fsys, c); err != nil {
+			return nil, err
+		}
+		clips = append(clips, c)
+	}
+
+	sort.Slice(clips, func(i, j int) bool { return clips[i].Name < clips[j].Name })
+	return clips, nil
+}
+
+// clipDate reads the recording date of c, falling back to the modification time of the video
+func clipDate(fsys storage.FS, c Clip) (time.Time, error) {
+	if c.Metadata != "" {
+		date, err := CreationDate(fsys, c.Metadata)
+		if err == nil {
+			return date, nil
+		}
+		log.Printf("Warning: %v; using the file time of %s", err, c.Video)
+	}
+
+	info, err := fsys.Stat(c.Video)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat clip: %w", err)
+	}
+	return info.ModTime(), nil
+}
+
+// nonRealTimeMeta is the part of a Sony clip sidecar holding the recording date
+type nonRealTimeMeta struct {
+	CreationDate struct {
+		Value string `xml:"value,attr"`
+	} `xml:"CreationDate"`
+}
+
+// CreationDate returns the recording date from a clip's XML sidecar in fsys.
+// The time keeps the offset recorded by the camera, so its date is the local date of the recording.
+func CreationDate(fsys storage.FS, path string) (time.Time, error) {
+	data, err := storage.ReadFile(fsys, path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read clip metadata: %w", err)
+	}
+
+	var meta nonRealTimeMeta
+	if err := xml.Unmarshal(data, &meta); err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse clip metadata %s: %w", path, err)
+	}
+	if meta.CreationDate.Value == "" {
+		return time.Time{}, fmt.Errorf("no CreationDate in clip metadata %s", path)
+	}
+
+	date, err := time.Parse(time.RFC3339, meta.CreationDate.Value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid CreationDate in clip metadata %s: %w", path, err)
+	}
+	return date, nil
+}
+
+// materialEntry matches one clip of MEDIAPRO.XML with the line it is on, capturing its URI
+var materialEntry = regexp.MustCompile(`(?s)[ \t]*<Material\b[^>]*?\buri="([^"]*)"[^>]*?(?:/>|>.*?</Material>)[ \t]*\r?\n?`)
+
+// RemoveFromProfile drops the named clips from the MEDIAPRO.XML index of the card at root,
+// so that the camera does not list clips whose files were removed. The rest of the file
+// is kept as written by the camera. A card without the index is left alone.
+func RemoveFromProfile(fsys storage.FS, root string, names []string) error {
+	profile := filepath.Join(root, ProfileFile)
+	data, err := storage.ReadFile(fsys, profile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read clip index: %w", err)
+	}
+
+	removed := make(map[string]bool)
+	for _, name := range names {
+		removed[strings.ToUpper(name)] = true
+	}
+	changed := false
+	updated := materialEntry.ReplaceAllFunc(data, func(entry []byte) []byte {
+		// URIs are relative to M4ROOT, e.g. ./Clip/C0001.MP4
+		base := path.Base(string(materialEntry.FindSubmatch(entry)[1]))
+		name := strings.TrimSuffix(base, path.Ext(base))
+		if !removed[strings.ToUpper(name)] {
+			return entry
+		}
+		changed = true
+		return nil
+	})
+	if !changed {
+		return nil
+	}
+	if err := storage.WriteFile(fsys, profile, updated, 0644); err != nil {
+		return fmt.Errorf("failed to update clip index: %w", err)
+	}
+	return nil
+}
+
+func isVideo(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".mxf", ".mts":
+		return true
+	}
+	return false
+}
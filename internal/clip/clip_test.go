@@ -0,0 +1,158 @@
+package clip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+const sidecar = `<?xml version="1.0" encoding="UTF-8"?>
+<NonRealTimeMeta xmlns="urn:schemas-professionalDisc:nonRealTimeMeta:ver.2.20" lastUpdate="2025-12-31T23:40:12+09:00">
+	<Duration value="1234"/>
+	<CreationDate value="2025-12-31T23:30:00+09:00"/>
+	<Device manufacturer="Sony" modelName="ILCE-7M4"/>
+</NonRealTimeMeta>
+`
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+}
+
+func TestCreationDate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "clip-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		wantErr  bool
+	}{
+		{"sony sidecar", sidecar, "2025-12-31", false},
+		{"missing element", `<NonRealTimeMeta></NonRealTimeMeta>`, "", true},
+		{"invalid date", `<NonRealTimeMeta><CreationDate value="yesterday"/></NonRealTimeMeta>`, "", true},
+		{"not xml", `garbage`, "", true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, filepath.Base(tt.name)+".XML")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to write sidecar %d: %v", i, err)
+			}
+			date, err := CreationDate(storage.Local{}, path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreationDate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// The date is the one recorded by the camera, not converted to the local time zone
+			if err == nil && date.Format("2006-01-02") != tt.expected {
+				t.Errorf("CreationDate() = %s, want %s", date.Format("2006-01-02"), tt.expected)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "clip-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeFiles(t, tmpDir, map[string]string{
+		"PRIVATE/M4ROOT/CLIP/C0001.MP4":      "video 1",
+		"PRIVATE/M4ROOT/CLIP/C0001M01.XML":   sidecar,
+		"PRIVATE/M4ROOT/CLIP/C0002.MP4":      "video 2",
+		"PRIVATE/M4ROOT/SUB/C0001S03.MP4":    "proxy 1",
+		"PRIVATE/M4ROOT/THMBNL/C0001T01.JPG": "thumbnail",
+		"PRIVATE/M4ROOT/MEDIAPRO.XML":        "<MediaProfile/>",
+	})
+	modTime := time.Date(2024, 6, 15, 12, 0, 0, 0, time.Local)
+	if err := os.Chtimes(filepath.Join(tmpDir, "PRIVATE/M4ROOT/CLIP/C0002.MP4"), modTime, modTime); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+
+	clips, err := Scan(storage.Local{}, tmpDir)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(clips) != 2 {
+		t.Fatalf("Expected 2 clips, got %+v", clips)
+	}
+
+	if clips[0].Name != "C0001" || len(clips[0].Files()) != 3 || len(clips[0].Thumbnails) != 1 {
+		t.Errorf("Unexpected first clip: %+v", clips[0])
+	}
+	if clips[0].Date.Format("2006-01-02") != "2025-12-31" {
+		t.Errorf("Expected date from sidecar, got %s", clips[0].Date)
+	}
+	if clips[1].Metadata != "" || !clips[1].Date.Equal(modTime) {
+		t.Errorf("Clip without sidecar should use the file time: %+v", clips[1])
+	}
+
+	// A card without video has no clips
+	clips, err = Scan(storage.Local{}, filepath.Join(tmpDir, "PRIVATE"))
+	if err != nil || len(clips) != 0 {
+		t.Errorf("Scan() = %v, %v for a card without clips", clips, err)
+	}
+}
+
+const profile = `<?xml version="1.0" encoding="UTF-8"?>
+<MediaProfile xmlns="http://xmlns.sony.net/pro/metadata/mediaprofile" version="2.00">
+	<Contents>
+		<Material uri="./Clip/C0001.MP4" type="MP4" dur="1234">
+			<RelevantInfo uri="./Clip/C0001M01.XML" type="XML"/>
+			<RelevantInfo uri="./THMBNL/C0001T01.JPG" type="JPEG"/>
+		</Material>
+		<Material uri="./Clip/C0002.MP4" type="MP4" dur="42"/>
+		<Material uri="./Clip/C0003.MP4" type="MP4" dur="99">
+			<RelevantInfo uri="./Clip/C0003M01.XML" type="XML"/>
+		</Material>
+	</Contents>
+</MediaProfile>
+`
+
+func TestRemoveFromProfile(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeFiles(t, tmpDir, map[string]string{"PRIVATE/M4ROOT/MEDIAPRO.XML": profile})
+
+	if err := RemoveFromProfile(storage.Local{}, tmpDir, []string{"C0001", "c0002"}); err != nil {
+		t.Fatalf("RemoveFromProfile failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, ProfileFile))
+	if err != nil {
+		t.Fatalf("Failed to read clip index: %v", err)
+	}
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<MediaProfile xmlns="http://xmlns.sony.net/pro/metadata/mediaprofile" version="2.00">
+	<Contents>
+		<Material uri="./Clip/C0003.MP4" type="MP4" dur="99">
+			<RelevantInfo uri="./Clip/C0003M01.XML" type="XML"/>
+		</Material>
+	</Contents>
+</MediaProfile>
+`
+	if string(data) != expected {
+		t.Errorf("Unexpected clip index:\n%s", data)
+	}
+
+	// A card without the index is left alone
+	if err := RemoveFromProfile(storage.Local{}, t.TempDir(), []string{"C0003"}); err != nil {
+		t.Errorf("RemoveFromProfile failed without an index: %v", err)
+	}
+}
@@ -5,16 +5,230 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// AutoDetect as TargetPath or BackupPath selects the mounted Sony card automatically
+const AutoDetect = "auto"
+
 // Config holds the application configuration
 type Config struct {
 	TargetPath      string `yaml:"target_path"`
 	BackupPath      string `yaml:"backup_path"`
 	DestinationPath string `yaml:"destination_path"`
 	TmpDir          string `yaml:"tmp_dir"`
+	// ConflictPolicy controls how files that already exist in the destination are handled:
+	// keep-both (default), overwrite, skip or abort. Identical files are always skipped.
+	ConflictPolicy string `yaml:"conflict_policy"`
+	// IndexPath is the content-hash index of the archive.
+	// Empty means .rename-sony-photos-index.json inside DestinationPath.
+	IndexPath string `yaml:"index_path,omitempty"`
+	// Body is the camera body whose cards this configuration imports.
+	// When set, only cards registered for this body are accepted.
+	Body string `yaml:"body,omitempty"`
+	// CardRegistry is the file mapping card IDs to roles and bodies.
+	// Empty means cards.yaml in the configuration directory.
+	CardRegistry string `yaml:"card_registry,omitempty"`
+	// Sources lists the cards to import in a single run. When empty, TargetPath and
+	// BackupPath describe a single main card and its backup.
+	Sources []Source `yaml:"sources,omitempty"`
+	// Watch configures the -watch daemon
+	Watch WatchConfig `yaml:"watch,omitempty"`
+	// Hooks maps workflow stage names (copy, verify, rename, archive, catalog, upload, parity,
+	// delete, cleanup, eject) to commands run before and after the stage
+	Hooks map[string]StageHooks `yaml:"hooks,omitempty"`
+	// Pipeline overrides the stages run on main and backup cards
+	Pipeline PipelineConfig `yaml:"pipeline,omitempty"`
+	// Filter restricts which files are imported and deleted from the cards
+	Filter FilterConfig `yaml:"filter,omitempty"`
+	// KeepOnCard leaves the photos on main cards and imports only files not imported before
+	KeepOnCard bool `yaml:"keep_on_card,omitempty"`
+	// CardStateDir holds the per-card import history used by KeepOnCard.
+	// Empty means the state directory in the configuration directory.
+	CardStateDir string `yaml:"card_state_dir,omitempty"`
+	// Quarantine moves files removed from cards to a holding area instead of deleting them
+	Quarantine QuarantineConfig `yaml:"quarantine,omitempty"`
+	// UseTrash moves the cleaned temporary files and pruned archive folders to the desktop trash
+	UseTrash bool `yaml:"use_trash,omitempty"`
+	// S3 is an S3-compatible bucket that receives an offsite copy of the imported folders.
+	// It is a shorthand for a required entry of Destinations.
+	S3 *S3Config `yaml:"s3,omitempty"`
+	// SFTP is a directory on an SSH server, such as a NAS, that receives an offsite copy of the imported folders.
+	// It is a shorthand for a required entry of Destinations.
+	SFTP *SFTPConfig `yaml:"sftp,omitempty"`
+	// WebDAV is a collection on a WebDAV server, such as a Nextcloud share, that receives an offsite copy of the imported folders.
+	// It is a shorthand for a required entry of Destinations.
+	WebDAV *WebDAVConfig `yaml:"webdav,omitempty"`
+	// Destinations lists further copies of the imported folders, such as an external drive,
+	// written after the archive in DestinationPath
+	Destinations []DestinationConfig `yaml:"destinations,omitempty"`
+	// Parity configures the parity stage, which protects the archived date folders with Reed-Solomon parity
+	Parity ParityConfig `yaml:"parity,omitempty"`
+}
+
+// ParityConfig controls the parity files written by the parity stage
+type ParityConfig struct {
+	// Redundancy is the size of the parity in percent of each folder (default 10, at most 100).
+	// Damage to roughly this share of a folder can be repaired.
+	Redundancy int `yaml:"redundancy,omitempty"`
+}
+
+// DestinationConfig describes one further copy of the imported folders.
+// Exactly one of Path, S3, SFTP and WebDAV is set.
+type DestinationConfig struct {
+	// Name identifies the destination in logs (default: its path or kind)
+	Name string `yaml:"name,omitempty"`
+	// Path is a local directory, such as an external drive
+	Path   string        `yaml:"path,omitempty"`
+	S3     *S3Config     `yaml:"s3,omitempty"`
+	SFTP   *SFTPConfig   `yaml:"sftp,omitempty"`
+	WebDAV *WebDAVConfig `yaml:"webdav,omitempty"`
+	// FolderTemplate names the date folders in this destination, like Source.FolderTemplate.
+	// Empty keeps the names used in DestinationPath.
+	FolderTemplate string `yaml:"folder_template,omitempty"`
+	// Optional destinations that fail or are unavailable are reported, but do not keep the photos on the card
+	Optional bool `yaml:"optional,omitempty"`
+	// Encryption, when set, stores the files encrypted under random names with an encrypted manifest
+	Encryption *EncryptionConfig `yaml:"encryption,omitempty"`
+}
+
+// EncryptionConfig describes the key of an encrypted destination
+type EncryptionConfig struct {
+	// Passphrase defaults to ENCRYPTION_PASSPHRASE. Without it the files cannot be restored.
+	Passphrase string `yaml:"passphrase,omitempty"`
+}
+
+// WebDAVConfig describes a collection on a WebDAV server reached with basic authentication
+type WebDAVConfig struct {
+	// URL is the collection receiving the date folders,
+	// e.g. https://cloud.example.com/remote.php/dav/files/alice/Photos
+	URL  string `yaml:"url"`
+	User string `yaml:"user,omitempty"`
+	// Password defaults to WEBDAV_PASSWORD; Nextcloud app passwords work here
+	Password string `yaml:"password,omitempty"`
+	// ChunkURL is the collection of Nextcloud chunked uploads,
+	// e.g. https://cloud.example.com/remote.php/dav/uploads/alice.
+	// Without it every file is sent with a single request.
+	ChunkURL string `yaml:"chunk_url,omitempty"`
+	// ChunkSizeMB is the size of the chunks of chunked uploads (default 10, minimum 5).
+	// Smaller files are sent with a single request.
+	ChunkSizeMB int `yaml:"chunk_size_mb,omitempty"`
+}
+
+// SFTPConfig describes a directory on an SSH server reached over SFTP with key-based login
+type SFTPConfig struct {
+	// Host is the server name or address with an optional port, e.g. nas.local:2222 (default port 22)
+	Host string `yaml:"host"`
+	User string `yaml:"user"`
+	// KeyFile is the private key used to log in (default ~/.ssh/id_ed25519)
+	KeyFile string `yaml:"key_file,omitempty"`
+	// KeyPassphrase decrypts KeyFile when it is encrypted
+	KeyPassphrase string `yaml:"key_passphrase,omitempty"`
+	// KnownHosts lists the trusted server keys (default ~/.ssh/known_hosts)
+	KnownHosts string `yaml:"known_hosts,omitempty"`
+	// Path is the remote directory receiving the date folders
+	Path string `yaml:"path"`
+}
+
+// S3Config describes an S3-compatible bucket (AWS, MinIO, Ceph, Wasabi) addressed path-style
+type S3Config struct {
+	// Endpoint is the URL of the service, e.g. https://s3.wasabisys.com
+	Endpoint string `yaml:"endpoint"`
+	// Region signs the requests (default us-east-1)
+	Region string `yaml:"region,omitempty"`
+	Bucket string `yaml:"bucket"`
+	// Prefix is prepended to every key, e.g. "photos" for photos/2025-12-31/DSC00001.JPG
+	Prefix string `yaml:"prefix,omitempty"`
+	// AccessKeyID and SecretAccessKey default to AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+	// PartSizeMB is the size of the parts of multipart uploads (default 16, minimum 5).
+	// Smaller files are uploaded with a single request.
+	PartSizeMB int `yaml:"part_size_mb,omitempty"`
+}
+
+// QuarantineConfig controls where removed card files are kept and for how long
+type QuarantineConfig struct {
+	// Location is "card" for a hidden directory on the card itself or "local" for Dir.
+	// Empty deletes removed files immediately.
+	Location string `yaml:"location,omitempty"`
+	// Dir is the local holding directory. Empty means the quarantine directory in the configuration directory.
+	Dir string `yaml:"dir,omitempty"`
+	// RetentionDays purges batches older than this many days; 0 keeps them
+	RetentionDays int `yaml:"retention_days,omitempty"`
+	// PurgeVerified purges batches whose files all have an identical copy in the archive
+	PurgeVerified bool `yaml:"purge_verified,omitempty"`
+}
+
+// FilterConfig selects the files of a card that are processed. Files that do not
+// match are neither imported nor deleted. Empty fields do not restrict anything.
+type FilterConfig struct {
+	// Extensions to import, e.g. [arw, mp4]
+	Extensions []string `yaml:"extensions,omitempty"`
+	// ExcludeExtensions are never imported
+	ExcludeExtensions []string `yaml:"exclude_extensions,omitempty"`
+	// Include and Exclude are glob patterns on paths relative to the card root,
+	// or on file names when the pattern has no slash
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	// From and To limit the capture date (yyyy-mm-dd, inclusive)
+	From string `yaml:"from,omitempty"`
+	To   string `yaml:"to,omitempty"`
+	// MinSize and MaxSize limit the file size, e.g. 500K or 4GB
+	MinSize string `yaml:"min_size,omitempty"`
+	MaxSize string `yaml:"max_size,omitempty"`
+}
+
+// PipelineConfig lists the stages run on each card role, in order.
+// An empty list means the default pipeline of the role.
+type PipelineConfig struct {
+	Main   []string `yaml:"main,omitempty"`
+	Backup []string `yaml:"backup,omitempty"`
+}
+
+// StageHooks lists the commands run around one workflow stage
+type StageHooks struct {
+	// Pre hooks run before the stage; a failing pre hook aborts the stage
+	Pre []Hook `yaml:"pre,omitempty"`
+	// Post hooks run after the stage; failures are reported as warnings
+	Post []Hook `yaml:"post,omitempty"`
+}
+
+// Hook is a shell command run around a workflow stage
+type Hook struct {
+	Command string        `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Source describes one card imported by the workflow
+type Source struct {
+	// Name identifies the source in logs and reports
+	Name string `yaml:"name"`
+	// Path is the mount point of the card, or AutoDetect
+	Path string `yaml:"path"`
+	// Body is the camera body the card belongs to
+	Body string `yaml:"body,omitempty"`
+	// Role is "main" (alias "primary") for cards that are imported,
+	// or "backup" for cards that are verified against the archive and cleared
+	Role string `yaml:"role"`
+	// FolderTemplate names the date folders, e.g. "{yyyy}-{mm}-{dd}_{body}"
+	FolderTemplate string `yaml:"folder_template,omitempty"`
+	// Subfolder is the directory below DestinationPath that receives this card's folders
+	Subfolder string `yaml:"subfolder,omitempty"`
+}
+
+// WatchConfig holds the settings of the -watch daemon
+type WatchConfig struct {
+	// Roots are the directories in which cards are mounted. Empty means the platform default.
+	Roots []string `yaml:"roots,omitempty"`
+	// Interval between two scans of Roots (default 5s)
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Debounce is how long a new mount must stay present before it is imported (default 3s)
+	Debounce time.Duration `yaml:"debounce,omitempty"`
+	// StatusFile receives the daemon state. Empty means watch-status.json in the configuration directory.
+	StatusFile string `yaml:"status_file,omitempty"`
 }
 
 // Default returns the default configuration
@@ -23,10 +237,11 @@ func Default() *Config {
 	tmpDir := filepath.Join(homeDir, "Pictures", "tmp")
 
 	return &Config{
-		TargetPath:      "/Volumes/1-1",
-		BackupPath:      "/Volumes/1-2",
+		TargetPath:      AutoDetect,
+		BackupPath:      AutoDetect,
 		DestinationPath: "/Volumes/a7iii",
 		TmpDir:          tmpDir,
+		ConflictPolicy:  "keep-both",
 	}
 }
 
@@ -59,6 +274,40 @@ func Save(config *Config, configPath string) error {
 	return nil
 }
 
+// Dir returns the per-user configuration directory (~/.config/rename-sony-photos)
+func Dir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(homeDir, ".config", "rename-sony-photos")
+}
+
+// RegistryPath returns the location of the card registry
+func (c *Config) RegistryPath() string {
+	if c.CardRegistry != "" {
+		return c.CardRegistry
+	}
+	return filepath.Join(Dir(), "cards.yaml")
+}
+
+// CardStatePath returns the location of the import history of a card
+func (c *Config) CardStatePath(cardID string) string {
+	dir := c.CardStateDir
+	if dir == "" {
+		dir = filepath.Join(Dir(), "state")
+	}
+	return filepath.Join(dir, cardID+".json")
+}
+
+// QuarantineDir returns the local quarantine directory
+func (c *Config) QuarantineDir() string {
+	if c.Quarantine.Dir != "" {
+		return c.Quarantine.Dir
+	}
+	return filepath.Join(Dir(), "quarantine")
+}
+
 // GetPath returns the configuration file path.
 // It looks for config in the following order:
 // 1. ./config.yaml (current directory)
@@ -70,12 +319,9 @@ func GetPath() string {
 	}
 
 	// Check ~/.config directory
-	homeDir, err := os.UserHomeDir()
-	if err == nil {
-		configPath := filepath.Join(homeDir, ".config", "rename-sony-photos", "config.yaml")
-		if _, err := os.Stat(configPath); err == nil {
-			return configPath
-		}
+	configPath := filepath.Join(Dir(), "config.yaml")
+	if _, err := os.Stat(configPath); err == nil {
+		return configPath
 	}
 
 	return ""
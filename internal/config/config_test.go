@@ -9,11 +9,11 @@ import (
 func TestDefaultConfig(t *testing.T) {
 	config := Default()
 
-	if config.TargetPath != "/Volumes/1-1" {
-		t.Errorf("Expected TargetPath to be /Volumes/1-1, got %s", config.TargetPath)
+	if config.TargetPath != AutoDetect {
+		t.Errorf("Expected TargetPath to be %s, got %s", AutoDetect, config.TargetPath)
 	}
-	if config.BackupPath != "/Volumes/1-2" {
-		t.Errorf("Expected BackupPath to be /Volumes/1-2, got %s", config.BackupPath)
+	if config.BackupPath != AutoDetect {
+		t.Errorf("Expected BackupPath to be %s, got %s", AutoDetect, config.BackupPath)
 	}
 	if config.DestinationPath != "/Volumes/a7iii" {
 		t.Errorf("Expected DestinationPath to be /Volumes/a7iii, got %s", config.DestinationPath)
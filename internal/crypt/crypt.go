@@ -0,0 +1,199 @@
+// Package crypt encrypts the files of a destination at rest. Every file is sealed with
+// AES-256-GCM in chunks, under a key derived from a passphrase and a random salt of the
+// file, and stored under a random name; an encrypted manifest maps the stored objects
+// back to their paths, sizes, times and digests.
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// chunkSize is the plaintext size of every chunk but the last
+	chunkSize = 64 << 10
+	// fileMagic starts every encrypted file, followed by the salt of the file
+	fileMagic = "RSPENC1\n"
+	saltSize  = 16
+	keySize   = 32
+)
+
+// ErrAuth is returned when encrypted data fails authentication, because the passphrase
+// is wrong or the data was damaged or truncated
+var ErrAuth = errors.New("decryption failed: wrong passphrase or damaged data")
+
+// deriveKey returns the master key of passphrase with scrypt at cost 2^logN
+func deriveKey(passphrase string, salt []byte, logN uint8) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<logN, 8, 1, keySize)
+}
+
+// fileCipher returns the AEAD of the file with salt, keyed from the master key
+func fileCipher(master, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, master, salt, []byte("rename-sony-photos-directories file")), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce numbers the chunks of a file and marks the last one, so chunks cannot be
+// reordered, dropped or appended without failing authentication
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Writer encrypts the data written to it. Close must be called to seal the last chunk.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+}
+
+// NewWriter writes the header of a new file with a random salt to w and returns a
+// Writer encrypting into w under master
+func NewWriter(w io.Writer, master []byte) (*Writer, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileCipher(master, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(fileMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is sealed only once more data follows, so the last chunk is never empty
+		// unless the whole file is
+		if len(w.buf) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk; it does not close the underlying writer
+func (w *Writer) Close() error {
+	return w.seal(true)
+}
+
+func (w *Writer) seal(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.counter, last), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Reader decrypts a file written by Writer. Read fails with ErrAuth when a chunk does not
+// authenticate and with io.ErrUnexpectedEOF when the file ends before its last chunk.
+type Reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	sealed  []byte
+	plain   []byte
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+// NewReader reads the header of the file in r and returns a Reader decrypting it with master
+func NewReader(r io.Reader, master []byte) (*Reader, error) {
+	header := make([]byte, len(fileMagic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("not an encrypted file")
+		}
+		return nil, err
+	}
+	if string(header[:len(fileMagic)]) != fileMagic {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	aead, err := fileCipher(master, header[len(fileMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+		plain:  make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the following chunk into buf, setting err to io.EOF after the last one
+func (r *Reader) next() {
+	n, err := io.ReadFull(r.r, r.sealed)
+	switch {
+	case err == io.EOF:
+		r.err = io.ErrUnexpectedEOF
+		return
+	case err != nil && err != io.ErrUnexpectedEOF:
+		r.err = err
+		return
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			r.err = err
+			return
+		}
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], chunkNonce(r.counter, last), r.sealed[:n], nil)
+	if err != nil {
+		r.err = ErrAuth
+		return
+	}
+	r.counter++
+	r.buf = plain
+	if last {
+		r.err = io.EOF
+	}
+}
@@ -0,0 +1,93 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestStream(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, keySize)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plain := make([]byte, size)
+		for i := range plain {
+			plain[i] = byte(i * 31)
+		}
+
+		sealed := encrypt(t, key, plain)
+		if size > 16 && bytes.Contains(sealed, plain[:16]) {
+			t.Errorf("size %d: encrypted file contains the plaintext", size)
+		}
+		got, err := decrypt(key, sealed)
+		if err != nil {
+			t.Fatalf("Failed to decrypt %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted %d bytes that differ from the plaintext", size, len(got))
+		}
+		if again := encrypt(t, key, plain); bytes.Equal(again, sealed) {
+			t.Errorf("size %d: two encryptions of the same content are identical", size)
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, keySize)
+	sealed := encrypt(t, key, bytes.Repeat([]byte("photo"), chunkSize+1))
+	header := len(fileMagic) + saltSize
+	chunk := chunkSize + 16
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[header+chunk+10] ^= 1
+
+	tests := []struct {
+		name    string
+		key     []byte
+		data    []byte
+		wantErr error
+	}{
+		{"wrong key", bytes.Repeat([]byte{8}, keySize), sealed, ErrAuth},
+		{"flipped bit", key, flipped, ErrAuth},
+		{"truncated at a chunk boundary", key, sealed[:header+2*chunk], ErrAuth},
+		{"missing last chunk", key, sealed[:len(sealed)-(len(sealed)-header)%chunk], ErrAuth},
+		{"only the header", key, sealed[:header], io.ErrUnexpectedEOF},
+		{"appended data", key, append(append([]byte(nil), sealed...), 0), ErrAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(tt.key, tt.data); !errors.Is(err, tt.wantErr) {
+				t.Errorf("decrypt() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := decrypt(key, []byte("DSC00001.JPG content")); err == nil {
+		t.Error("A file that is not encrypted should be refused")
+	}
+}
@@ -0,0 +1,637 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+const (
+	// ManifestName is the name of the encrypted manifest in the root
+	ManifestName = "manifest.rspenc"
+	// dataDir holds the encrypted objects, spread over 256 subdirectories
+	dataDir = "data"
+)
+
+var (
+	errNotDir   = errors.New("not a directory")
+	errIsDir    = errors.New("is a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// FS presents the files encrypted below Root of Inner as a plain tree. Paths are cleaned
+// slash or OS paths relative to the root of the tree. Changes to the tree are kept in
+// memory until Flush writes the manifest; objects replaced or removed are only deleted
+// from Inner after that, so the stored manifest never lists a missing object.
+// FS implements storage.Uploader and storage.Hasher.
+type FS struct {
+	Inner storage.FS
+	Root  string
+
+	mu      sync.Mutex
+	header  keyHeader
+	key     []byte
+	files   map[string]*entry
+	dirs    map[string]bool
+	dirty   bool
+	garbage []string
+}
+
+// New opens the encrypted tree below root of inner, reading its manifest with the
+// passphrase of cfg. A root without a manifest starts an empty tree.
+func New(inner storage.FS, root string, cfg config.EncryptionConfig) (*FS, error) {
+	passphrase := cfg.Passphrase
+	if passphrase == "" {
+		passphrase = os.Getenv("ENCRYPTION_PASSPHRASE")
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("encryption passphrase is missing: set passphrase or ENCRYPTION_PASSPHRASE")
+	}
+
+	f := &FS{Inner: inner, Root: root, dirs: make(map[string]bool)}
+	data, err := storage.ReadFile(inner, f.path(ManifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		if f.header, err = newKeyHeader(); err != nil {
+			return nil, err
+		}
+		if f.key, err = deriveKey(passphrase, f.header.salt, f.header.logN); err != nil {
+			return nil, err
+		}
+		f.files = make(map[string]*entry)
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	m, header, key, err := decodeManifest(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt manifest: %w", err)
+	}
+	f.header, f.key, f.files = header, key, m.Files
+	for _, dir := range m.Dirs {
+		f.dirs[dir] = true
+	}
+	return f, nil
+}
+
+// path returns the path in Inner of the slash path name below the root
+func (f *FS) path(name string) string {
+	return filepath.Join(f.Root, filepath.FromSlash(name))
+}
+
+// clean returns the slash path of name relative to the root of the tree; "" is the root
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// parent returns the directory of the cleaned path name
+func parent(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// isDir reports whether the cleaned path name is a directory; the caller holds mu
+func (f *FS) isDir(name string) bool {
+	return name == "" || f.dirs[name]
+}
+
+// addParents records the directories above the cleaned path name; the caller holds mu
+func (f *FS) addParents(name string) error {
+	for dir := parent(name); dir != ""; dir = parent(dir) {
+		if _, ok := f.files[dir]; ok {
+			return errNotDir
+		}
+		f.dirs[dir] = true
+	}
+	return nil
+}
+
+// hasChildren reports whether anything is stored below the cleaned directory dir; the caller holds mu
+func (f *FS) hasChildren(dir string) bool {
+	for name := range f.files {
+		if parent(name) == dir {
+			return true
+		}
+	}
+	for name := range f.dirs {
+		if parent(name) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir := clean(name)
+	if _, ok := f.files[dir]; ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	if !f.isDir(dir) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for p, e := range f.files {
+		if parent(p) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(e.info(p)))
+		}
+	}
+	for p := range f.dirs {
+		if parent(p) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(dirInfo(p)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := clean(name)
+	if e, ok := f.files[p]; ok {
+		return e.info(p), nil
+	}
+	if f.isDir(p) {
+		return dirInfo(p), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// Open decrypts the file name. Reading fails when the object does not authenticate or
+// its content does not match the size and digest in the manifest.
+func (f *FS) Open(name string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	e, ok := f.files[clean(name)]
+	var stored entry
+	if ok {
+		stored = *e
+	}
+	f.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	rc, err := f.Inner.Open(f.path(stored.Object))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open encrypted object of %s: %w", name, err)
+	}
+	dec, err := NewReader(rc, f.key)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+	}
+	return &fileReader{Reader: dec, rc: rc, name: name, entry: stored, hash: sha256.New()}, nil
+}
+
+// Create encrypts the file name into a temporary file and stores it when closed.
+// It fails if name already exists.
+func (f *FS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	f.mu.Lock()
+	p := clean(name)
+	_, exists := f.files[p]
+	exists = exists || f.isDir(p)
+	f.mu.Unlock()
+	if exists {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+
+	s, err := f.newSealer()
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{fs: f, name: name, sealer: s}, nil
+}
+
+// Upload encrypts r and stores it as name, replacing an existing file
+func (f *FS) Upload(ctx context.Context, name string, r io.Reader, meta storage.FileMeta) error {
+	s, err := f.newSealer()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(s, r); err != nil {
+		s.discard()
+		return err
+	}
+	return f.commit(ctx, name, s, meta.ModTime)
+}
+
+func (f *FS) MkdirAll(name string, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := clean(name)
+	if p == "" || f.dirs[p] {
+		return nil
+	}
+	if _, ok := f.files[p]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+	}
+	if err := f.addParents(p); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	f.dirs[p] = true
+	f.dirty = true
+	return nil
+}
+
+// Rename moves a file or a directory in the manifest; the objects are not touched
+func (f *FS) Rename(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldp, newp := clean(oldname), clean(newname)
+	if oldp == newp {
+		return nil
+	}
+	pathErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if e, ok := f.files[oldp]; ok {
+		if f.isDir(newp) {
+			return pathErr(errIsDir)
+		}
+		if err := f.addParents(newp); err != nil {
+			return pathErr(err)
+		}
+		if replaced, ok := f.files[newp]; ok {
+			f.garbage = append(f.garbage, replaced.Object)
+		}
+		f.files[newp] = e
+		delete(f.files, oldp)
+		f.dirty = true
+		return nil
+	}
+
+	if oldp == "" || !f.dirs[oldp] {
+		return pathErr(fs.ErrNotExist)
+	}
+	if _, ok := f.files[newp]; ok {
+		return pathErr(errNotDir)
+	}
+	if f.isDir(newp) && f.hasChildren(newp) {
+		return pathErr(errNotEmpty)
+	}
+	if strings.HasPrefix(newp+"/", oldp+"/") {
+		return pathErr(fs.ErrInvalid)
+	}
+	if err := f.addParents(newp); err != nil {
+		return pathErr(err)
+	}
+	for p, e := range f.files {
+		if strings.HasPrefix(p, oldp+"/") {
+			f.files[newp+strings.TrimPrefix(p, oldp)] = e
+			delete(f.files, p)
+		}
+	}
+	for p := range f.dirs {
+		if p == oldp || strings.HasPrefix(p, oldp+"/") {
+			f.dirs[newp+strings.TrimPrefix(p, oldp)] = true
+			delete(f.dirs, p)
+		}
+	}
+	f.dirty = true
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := clean(name)
+	if e, ok := f.files[p]; ok {
+		f.garbage = append(f.garbage, e.Object)
+		delete(f.files, p)
+		f.dirty = true
+		return nil
+	}
+	if !f.isDir(p) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if p == "" || f.hasChildren(p) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(f.dirs, p)
+	f.dirty = true
+	return nil
+}
+
+// RemoveAll removes name and everything below it; it refuses to remove the root
+func (f *FS) RemoveAll(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := clean(name)
+	if p == "" {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrPermission}
+	}
+	for fp, e := range f.files {
+		if fp == p || strings.HasPrefix(fp, p+"/") {
+			f.garbage = append(f.garbage, e.Object)
+			delete(f.files, fp)
+			f.dirty = true
+		}
+	}
+	for dp := range f.dirs {
+		if dp == p || strings.HasPrefix(dp, p+"/") {
+			delete(f.dirs, dp)
+			f.dirty = true
+		}
+	}
+	return nil
+}
+
+// Chtimes records the modification time of a file; directories have none
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := clean(name)
+	if e, ok := f.files[p]; ok {
+		e.ModTime = mtime
+		f.dirty = true
+		return nil
+	}
+	if f.isDir(p) {
+		return nil
+	}
+	return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+}
+
+// SHA256 returns the digest of name recorded in the manifest once the stored object is
+// known to be intact: by the digest Inner keeps of it when Inner is a storage.Hasher,
+// otherwise by decrypting it
+func (f *FS) SHA256(name string) (string, error) {
+	f.mu.Lock()
+	e, ok := f.files[clean(name)]
+	var stored entry
+	if ok {
+		stored = *e
+	}
+	f.mu.Unlock()
+	if !ok {
+		return "", &fs.PathError{Op: "sha256", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if hasher, ok := f.Inner.(storage.Hasher); ok {
+		if digest, err := hasher.SHA256(f.path(stored.Object)); err == nil && digest == stored.StoredSHA256 {
+			return stored.SHA256, nil
+		}
+	}
+	rc, err := f.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return "", err
+	}
+	return stored.SHA256, nil
+}
+
+// Flush writes the manifest when the tree changed, then deletes the objects it no longer lists
+func (f *FS) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return nil
+	}
+	data, err := encodeManifest(f.files, f.dirs, f.header, f.key)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt manifest: %w", err)
+	}
+	if uploader, ok := f.Inner.(storage.Uploader); ok {
+		err = uploader.Upload(context.Background(), f.path(ManifestName), bytes.NewReader(data), storage.FileMeta{ModTime: time.Now()})
+	} else {
+		err = storage.WriteFile(f.Inner, f.path(ManifestName), data, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	f.dirty = false
+
+	for _, object := range f.garbage {
+		if err := f.Inner.Remove(f.path(object)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: failed to remove unused encrypted object %s: %v", object, err)
+		}
+	}
+	f.garbage = nil
+	return nil
+}
+
+// Close writes the manifest and closes Inner when it holds a connection
+func (f *FS) Close() error {
+	err := f.Flush()
+	if closer, ok := f.Inner.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+// commit stores the sealed content as the object of a new random name and records it as name
+func (f *FS) commit(ctx context.Context, name string, s *sealer, modTime time.Time) error {
+	defer s.discard()
+	if err := s.enc.Close(); err != nil {
+		return fmt.Errorf("failed to encrypt %s: %w", name, err)
+	}
+	if _, err := s.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	object, err := newObjectName()
+	if err != nil {
+		return err
+	}
+	storedDigest := hex.EncodeToString(s.stored.Sum(nil))
+	if err := f.store(ctx, object, s.tmp, storedDigest); err != nil {
+		return fmt.Errorf("failed to store %s: %w", name, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := clean(name)
+	if f.isDir(p) {
+		f.garbage = append(f.garbage, object)
+		return &fs.PathError{Op: "create", Path: name, Err: errIsDir}
+	}
+	if err := f.addParents(p); err != nil {
+		f.garbage = append(f.garbage, object)
+		return &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	if replaced, ok := f.files[p]; ok {
+		f.garbage = append(f.garbage, replaced.Object)
+	}
+	f.files[p] = &entry{
+		Object:       object,
+		Size:         s.size,
+		ModTime:      modTime,
+		SHA256:       hex.EncodeToString(s.plain.Sum(nil)),
+		StoredSHA256: storedDigest,
+	}
+	f.dirty = true
+	return nil
+}
+
+// store writes the encrypted content r to object in Inner
+func (f *FS) store(ctx context.Context, object string, r io.Reader, digest string) error {
+	target := f.path(object)
+	if uploader, ok := f.Inner.(storage.Uploader); ok {
+		return uploader.Upload(ctx, target, r, storage.FileMeta{SHA256: digest})
+	}
+
+	if err := f.Inner.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	w, err := f.Inner.Create(target, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		f.Inner.Remove(target)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Inner.Remove(target)
+		return err
+	}
+	return nil
+}
+
+// newObjectName returns a random object path such as data/3f/3f9c...
+func newObjectName() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(buf)
+	return path.Join(dataDir, name[:2], name), nil
+}
+
+// sealer encrypts a file into a temporary file, recording the digests of the
+// content and of the encrypted result
+type sealer struct {
+	tmp    *os.File
+	enc    *Writer
+	plain  hash.Hash
+	stored hash.Hash
+	size   int64
+}
+
+func (f *FS) newSealer() (*sealer, error) {
+	tmp, err := os.CreateTemp("", "rename-sony-photos-*.rspenc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	s := &sealer{tmp: tmp, plain: sha256.New(), stored: sha256.New()}
+	if s.enc, err = NewWriter(io.MultiWriter(tmp, s.stored), f.key); err != nil {
+		s.discard()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	n, err := s.enc.Write(p)
+	s.plain.Write(p[:n])
+	s.size += int64(n)
+	return n, err
+}
+
+// discard removes the temporary file
+func (s *sealer) discard() {
+	s.tmp.Close()
+	os.Remove(s.tmp.Name())
+}
+
+// fileWriter stores the file written through Create when closed
+type fileWriter struct {
+	fs     *FS
+	name   string
+	sealer *sealer
+	closed bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.sealer.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.fs.commit(context.Background(), w.name, w.sealer, time.Now())
+}
+
+// fileReader decrypts an object and checks the content against the manifest at the end
+type fileReader struct {
+	*Reader
+	rc    io.ReadCloser
+	name  string
+	entry entry
+	hash  hash.Hash
+	size  int64
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("failed to decrypt %s: %w", r.name, err)
+	}
+	if err == io.EOF && (r.size != r.entry.Size || hex.EncodeToString(r.hash.Sum(nil)) != r.entry.SHA256) {
+		return n, fmt.Errorf("content of %s does not match the manifest", r.name)
+	}
+	return n, err
+}
+
+func (r *fileReader) Close() error {
+	return r.rc.Close()
+}
+
+// info returns the file info of the entry at the cleaned path name
+func (e *entry) info(name string) fs.FileInfo {
+	return fileInfo{name: path.Base(name), size: e.Size, mode: 0644, modTime: e.ModTime}
+}
+
+// dirInfo returns the file info of the directory at the cleaned path name
+func dirInfo(name string) fs.FileInfo {
+	if name == "" {
+		name = "/"
+	}
+	return fileInfo{name: path.Base(name), mode: fs.ModeDir | 0755}
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() any           { return nil }
@@ -0,0 +1,236 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+var testConfig = config.EncryptionConfig{Passphrase: "correct horse battery staple"}
+
+// innerFiles returns the paths of the files stored in inner
+func innerFiles(t *testing.T, inner storage.FS) []string {
+	t.Helper()
+	var names []string
+	err := storage.WalkDir(inner, "/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk inner store: %v", err)
+	}
+	return names
+}
+
+// tree returns the paths and contents of the files of fsys
+func tree(t *testing.T, fsys storage.FS) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := storage.WalkDir(fsys, "/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := storage.ReadFile(fsys, name)
+		files[filepath.ToSlash(name)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk encrypted tree: %v", err)
+	}
+	return files
+}
+
+func TestFS(t *testing.T) {
+	inner := storage.NewMem()
+	f, err := New(inner, "/vault", testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open empty vault: %v", err)
+	}
+	modTime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+	if err := f.Upload(t.Context(), "/a7iv/2025-12-31/DSC00001.JPG", strings.NewReader("photo 1"), storage.FileMeta{ModTime: modTime}); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	w, err := f.Create("/a7iv/2025-12-31/DSC00002.JPG.partial", 0644)
+	if err != nil {
+		t.Fatalf("Failed to create: %v", err)
+	}
+	w.Write([]byte("photo 2"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if err := f.Rename("/a7iv/2025-12-31/DSC00002.JPG.partial", "/a7iv/2025-12-31/DSC00002.JPG"); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	if err := f.MkdirAll("/a7iv/2026-01-01", 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if _, err := f.Create("/a7iv/2025-12-31/DSC00001.JPG", 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create() of an existing file error = %v, want ErrExist", err)
+	}
+
+	if names := innerFiles(t, inner); len(names) != 2 {
+		t.Errorf("Objects before Flush = %v, want the 2 objects and no manifest", names)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Failed to close vault: %v", err)
+	}
+	for _, name := range innerFiles(t, inner) {
+		data, _ := storage.ReadFile(inner, name)
+		if strings.Contains(name, "DSC") || strings.Contains(name, "2025") || bytes.Contains(data, []byte("photo")) || bytes.Contains(data, []byte("DSC")) {
+			t.Errorf("Stored file %s reveals names or content", name)
+		}
+	}
+
+	reopened, err := New(inner, "/vault", testConfig)
+	if err != nil {
+		t.Fatalf("Failed to reopen vault: %v", err)
+	}
+	want := map[string]string{
+		"/a7iv/2025-12-31/DSC00001.JPG": "photo 1",
+		"/a7iv/2025-12-31/DSC00002.JPG": "photo 2",
+	}
+	if got := tree(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("Reopened tree = %v, want %v", got, want)
+	}
+	if info, err := reopened.Stat("/a7iv/2026-01-01"); err != nil || !info.IsDir() {
+		t.Errorf("Empty directory was not kept: %v, %v", info, err)
+	}
+	if info, err := reopened.Stat("a7iv/2025-12-31/DSC00001.JPG"); err != nil || !info.ModTime().Equal(modTime) || info.Size() != 7 {
+		t.Errorf("Stat() = %v, %v, want size 7 and time %v", info, err, modTime)
+	}
+	sum := sha256.Sum256([]byte("photo 1"))
+	if digest, err := reopened.SHA256("/a7iv/2025-12-31/DSC00001.JPG"); err != nil || digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("SHA256() = %q, %v", digest, err)
+	}
+
+	if _, err := New(inner, "/vault", config.EncryptionConfig{Passphrase: "wrong"}); !errors.Is(err, ErrAuth) {
+		t.Errorf("Opening with a wrong passphrase error = %v, want ErrAuth", err)
+	}
+	if _, err := New(inner, "/vault", config.EncryptionConfig{}); err == nil {
+		t.Error("Opening without a passphrase should fail")
+	}
+}
+
+func TestFSRemoveKeepsObjectsUntilFlush(t *testing.T) {
+	inner := storage.NewMem()
+	f, err := New(inner, "/", testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	for _, name := range []string{"/a/1.JPG", "/a/2.JPG", "/b/3.JPG"} {
+		if err := f.Upload(t.Context(), name, strings.NewReader(name), storage.FileMeta{}); err != nil {
+			t.Fatalf("Failed to upload %s: %v", name, err)
+		}
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	if err := f.Remove("/a"); err == nil {
+		t.Error("Removing a non-empty directory should fail")
+	}
+	if err := f.Upload(t.Context(), "/a/1.JPG", strings.NewReader("replaced"), storage.FileMeta{}); err != nil {
+		t.Fatalf("Failed to replace: %v", err)
+	}
+	if err := f.RemoveAll("/b"); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if err := f.RemoveAll("/"); err == nil {
+		t.Error("Removing the root should be refused")
+	}
+
+	// The stored manifest still lists the old objects until the next Flush
+	if got := len(innerFiles(t, inner)); got != 5 {
+		t.Errorf("Stored files before Flush = %d, want 5", got)
+	}
+	stale, err := New(inner, "/", testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open stored manifest: %v", err)
+	}
+	if got := tree(t, stale); len(got) != 3 || got["/a/1.JPG"] != "/a/1.JPG" {
+		t.Errorf("Stored tree before Flush = %v", got)
+	}
+
+	if err := f.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if got := len(innerFiles(t, inner)); got != 3 {
+		t.Errorf("Stored files after Flush = %d, want the manifest and 2 objects", got)
+	}
+	want := map[string]string{"/a/1.JPG": "replaced", "/a/2.JPG": "/a/2.JPG"}
+	if got := tree(t, f); !reflect.DeepEqual(got, want) {
+		t.Errorf("Tree = %v, want %v", got, want)
+	}
+	if _, err := f.Stat("/b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat() of removed directory error = %v", err)
+	}
+}
+
+func TestFSRenameDirectory(t *testing.T) {
+	f, err := New(storage.NewMem(), "/", testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	f.Upload(t.Context(), "/10251231/DSC00001.JPG", strings.NewReader("photo"), storage.FileMeta{})
+	f.MkdirAll("/10251231/sub", 0755)
+	f.MkdirAll("/2025-12-31", 0755)
+
+	if err := f.Rename("/10251231", "/2025-12-31"); err != nil {
+		t.Fatalf("Failed to rename directory: %v", err)
+	}
+	entries, err := f.ReadDir("/2025-12-31")
+	if err != nil {
+		t.Fatalf("Failed to read renamed directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"DSC00001.JPG", "sub"}) {
+		t.Errorf("Renamed directory lists %v", names)
+	}
+	if _, err := f.Stat("/10251231"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Old directory still exists: %v", err)
+	}
+	if err := f.Rename("/2025-12-31", "/2025-12-31/sub/inside"); err == nil {
+		t.Error("Moving a directory into itself should fail")
+	}
+}
+
+func TestFSDamagedObject(t *testing.T) {
+	inner := storage.NewMem()
+	f, err := New(inner, "/", testConfig)
+	if err != nil {
+		t.Fatalf("Failed to open vault: %v", err)
+	}
+	if err := f.Upload(t.Context(), "/DSC00001.JPG", strings.NewReader("photo"), storage.FileMeta{}); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+
+	object := f.path(f.files["DSC00001.JPG"].Object)
+	data, _ := storage.ReadFile(inner, object)
+	data[len(data)-1] ^= 1
+	inner.AddFile(object, data, time.Now())
+
+	if _, err := f.SHA256("/DSC00001.JPG"); !errors.Is(err, ErrAuth) {
+		t.Errorf("SHA256() of a damaged object error = %v, want ErrAuth", err)
+	}
+	if _, err := storage.ReadFile(f, "/DSC00001.JPG"); !errors.Is(err, ErrAuth) {
+		t.Errorf("Reading a damaged object error = %v, want ErrAuth", err)
+	}
+}
@@ -0,0 +1,126 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// manifestMagic starts the manifest, followed by the scrypt cost and salt in clear
+	manifestMagic = "RSPMAN1\n"
+	// defaultLogN is the scrypt cost of new manifests
+	defaultLogN = 15
+	// maxLogN bounds the cost read from a manifest, so a damaged one cannot exhaust memory
+	maxLogN         = 22
+	manifestSaltLen = 32
+)
+
+// entry describes a stored file
+type entry struct {
+	// Object is the slash path of the encrypted file below the root
+	Object  string    `json:"object"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// SHA256 is the hex digest of the content
+	SHA256 string `json:"sha256"`
+	// StoredSHA256 is the hex digest of the encrypted object
+	StoredSHA256 string `json:"stored_sha256"`
+}
+
+// manifest lists the files and directories of an encrypted destination by slash path
+type manifest struct {
+	Dirs  []string          `json:"dirs"`
+	Files map[string]*entry `json:"files"`
+}
+
+// keyHeader holds the parameters deriving the master key from the passphrase
+type keyHeader struct {
+	logN uint8
+	salt []byte
+}
+
+// newKeyHeader returns the parameters of a new manifest with a random salt
+func newKeyHeader() (keyHeader, error) {
+	salt := make([]byte, manifestSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return keyHeader{}, err
+	}
+	return keyHeader{logN: defaultLogN, salt: salt}, nil
+}
+
+// readKeyHeader reads the clear header of a manifest
+func readKeyHeader(r io.Reader) (keyHeader, error) {
+	header := make([]byte, len(manifestMagic)+1+manifestSaltLen)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(manifestMagic)]) != manifestMagic {
+		return keyHeader{}, fmt.Errorf("not an encrypted manifest")
+	}
+	kh := keyHeader{logN: header[len(manifestMagic)], salt: header[len(manifestMagic)+1:]}
+	if kh.logN < 10 || kh.logN > maxLogN {
+		return keyHeader{}, fmt.Errorf("unsupported manifest key cost %d", kh.logN)
+	}
+	return kh, nil
+}
+
+// decodeManifest decrypts a manifest with passphrase, returning it with its key header and master key
+func decodeManifest(data []byte, passphrase string) (*manifest, keyHeader, []byte, error) {
+	r := bytes.NewReader(data)
+	kh, err := readKeyHeader(r)
+	if err != nil {
+		return nil, keyHeader{}, nil, err
+	}
+	key, err := deriveKey(passphrase, kh.salt, kh.logN)
+	if err != nil {
+		return nil, keyHeader{}, nil, err
+	}
+	dec, err := NewReader(r, key)
+	if err != nil {
+		return nil, keyHeader{}, nil, err
+	}
+	plain, err := io.ReadAll(dec)
+	if err != nil {
+		return nil, keyHeader{}, nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(plain, m); err != nil {
+		return nil, keyHeader{}, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]*entry)
+	}
+	return m, kh, key, nil
+}
+
+// encodeManifest encrypts the manifest of files and dirs under key
+func encodeManifest(files map[string]*entry, dirs map[string]bool, kh keyHeader, key []byte) ([]byte, error) {
+	m := manifest{Files: files}
+	for dir := range dirs {
+		m.Dirs = append(m.Dirs, dir)
+	}
+	sort.Strings(m.Dirs)
+	plain, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(manifestMagic)
+	buf.WriteByte(kh.logN)
+	buf.Write(kh.salt)
+	enc, err := NewWriter(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(plain); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
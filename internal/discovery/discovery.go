@@ -0,0 +1,169 @@
+// Package discovery finds mounted Sony camera cards.
+package discovery
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/volume"
+)
+
+// sonyMarkers are directories that Sony bodies create next to DCIM when formatting a card
+var sonyMarkers = []string{
+	filepath.Join("PRIVATE", "SONY"),
+	filepath.Join("PRIVATE", "M4ROOT"),
+}
+
+// photoExtensions are the still image formats written by Sony bodies
+var photoExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".arw":  true,
+	".hif":  true,
+	".heif": true,
+}
+
+// removableFSTypes are filesystems used on camera cards. Other mounts are not inspected.
+var removableFSTypes = map[string]bool{
+	"vfat":    true,
+	"msdos":   true,
+	"exfat":   true,
+	"fuseblk": true,
+	"ntfs":    true,
+	"ntfs3":   true,
+}
+
+// Card describes a mounted volume that looks like a Sony camera card
+type Card struct {
+	MountPoint string
+	Label      string
+	// Size is the capacity of the volume in bytes, or 0 if unknown
+	Size       int64
+	PhotoCount int
+	// Markers lists the Sony directories found on the card
+	Markers []string
+}
+
+// DCIM returns the path of the card's DCIM directory
+func (c Card) DCIM() string {
+	return filepath.Join(c.MountPoint, "DCIM")
+}
+
+// Find scans the mount points of the current system for Sony cards
+func Find() ([]Card, error) {
+	mountPoints, err := MountPoints(runtime.GOOS, volume.DefaultMountTable, "/Volumes")
+	if err != nil {
+		return nil, err
+	}
+	return Scan(mountPoints), nil
+}
+
+// MountPoints lists the volumes that may hold a camera card.
+// On Linux they come from the mount table, on macOS from the volumes directory.
+func MountPoints(goos, mountTable, volumesDir string) ([]string, error) {
+	switch goos {
+	case "linux":
+		mounts, err := volume.ReadMounts(mountTable)
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, m := range mounts {
+			if removableFSTypes[m.FSType] {
+				paths = append(paths, m.MountPoint)
+			}
+		}
+		return paths, nil
+	case "darwin":
+		entries, err := os.ReadDir(volumesDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list volumes: %w", err)
+		}
+		var paths []string
+		for _, entry := range entries {
+			paths = append(paths, filepath.Join(volumesDir, entry.Name()))
+		}
+		return paths, nil
+	default:
+		return nil, fmt.Errorf("card detection is not supported on %s", goos)
+	}
+}
+
+// Scan inspects each mount point and returns the ones that are Sony cards, sorted by mount point
+func Scan(mountPoints []string) []Card {
+	var cards []Card
+	for _, mountPoint := range mountPoints {
+		card, ok := Inspect(mountPoint)
+		if ok {
+			cards = append(cards, card)
+		}
+	}
+	sort.Slice(cards, func(i, j int) bool { return cards[i].MountPoint < cards[j].MountPoint })
+	return cards
+}
+
+// Inspect reports whether mountPoint holds a DCIM directory plus at least one Sony marker
+func Inspect(mountPoint string) (Card, bool) {
+	if !isDir(filepath.Join(mountPoint, "DCIM")) {
+		return Card{}, false
+	}
+
+	var markers []string
+	for _, marker := range sonyMarkers {
+		if isDir(filepath.Join(mountPoint, marker)) {
+			markers = append(markers, filepath.ToSlash(marker))
+		}
+	}
+	if len(markers) == 0 {
+		return Card{}, false
+	}
+
+	card := Card{
+		MountPoint: mountPoint,
+		Label:      filepath.Base(mountPoint),
+		Size:       volumeSize(mountPoint),
+		Markers:    markers,
+	}
+	card.PhotoCount = countPhotos(card.DCIM())
+	return card, true
+}
+
+// SelectOne returns the only card in cards, or an error describing why none could be chosen
+func SelectOne(cards []Card) (Card, error) {
+	switch len(cards) {
+	case 0:
+		return Card{}, fmt.Errorf("no Sony card found")
+	case 1:
+		return cards[0], nil
+	default:
+		var names []string
+		for _, c := range cards {
+			names = append(names, c.MountPoint)
+		}
+		return Card{}, fmt.Errorf("found %d Sony cards, set the path explicitly: %s", len(cards), strings.Join(names, ", "))
+	}
+}
+
+func countPhotos(dir string) int {
+	count := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && !strings.HasPrefix(d.Name(), ".") && photoExtensions[strings.ToLower(filepath.Ext(d.Name()))] {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
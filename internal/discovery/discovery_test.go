@@ -0,0 +1,135 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func makeCard(t *testing.T, root string, dirs []string, files []string) string {
+	t.Helper()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	for _, file := range files {
+		path := filepath.Join(root, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("photo"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	return root
+}
+
+func TestScan(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "discovery-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	stills := makeCard(t, filepath.Join(tmpDir, "1-1"),
+		[]string{"PRIVATE/SONY"},
+		[]string{"DCIM/10051231/DSC00001.JPG", "DCIM/10051231/DSC00001.ARW", "DCIM/10051231/._DSC00001.JPG", "DCIM/10051231/NOTE.TXT"})
+	video := makeCard(t, filepath.Join(tmpDir, "1-2"),
+		[]string{"DCIM", "PRIVATE/M4ROOT/CLIP"}, nil)
+	makeCard(t, filepath.Join(tmpDir, "usb-stick"), []string{"DCIM"}, nil)
+	makeCard(t, filepath.Join(tmpDir, "other"), []string{"PRIVATE/SONY"}, nil)
+
+	cards := Scan([]string{
+		filepath.Join(tmpDir, "usb-stick"),
+		video,
+		stills,
+		filepath.Join(tmpDir, "other"),
+		filepath.Join(tmpDir, "missing"),
+	})
+
+	if len(cards) != 2 {
+		t.Fatalf("Expected 2 cards, got %+v", cards)
+	}
+	if cards[0].MountPoint != stills || cards[0].Label != "1-1" {
+		t.Errorf("Unexpected first card: %+v", cards[0])
+	}
+	if cards[0].PhotoCount != 2 {
+		t.Errorf("Expected 2 photos, got %d", cards[0].PhotoCount)
+	}
+	if !reflect.DeepEqual(cards[1].Markers, []string{"PRIVATE/M4ROOT"}) {
+		t.Errorf("Unexpected markers: %v", cards[1].Markers)
+	}
+	if cards[0].DCIM() != filepath.Join(stills, "DCIM") {
+		t.Errorf("Unexpected DCIM path: %s", cards[0].DCIM())
+	}
+}
+
+func TestMountPointsLinux(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "discovery-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	table := filepath.Join(tmpDir, "mounts")
+	content := `/dev/nvme0n1p2 / ext4 rw 0 0
+tmpfs /run tmpfs rw 0 0
+/dev/sdb1 /run/media/alice/SONY\040CARD exfat rw 0 0
+/dev/sdc1 /media/alice/BACKUP vfat rw 0 0
+`
+	if err := os.WriteFile(table, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write mount table: %v", err)
+	}
+
+	paths, err := MountPoints("linux", table, "")
+	if err != nil {
+		t.Fatalf("MountPoints failed: %v", err)
+	}
+
+	expected := []string{"/run/media/alice/SONY CARD", "/media/alice/BACKUP"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("MountPoints() = %v, want %v", paths, expected)
+	}
+}
+
+func TestMountPointsDarwin(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "discovery-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{"1-1", "Macintosh HD"} {
+		if err := os.Mkdir(filepath.Join(tmpDir, name), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	paths, err := MountPoints("darwin", "", tmpDir)
+	if err != nil {
+		t.Fatalf("MountPoints failed: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("Expected 2 volumes, got %v", paths)
+	}
+}
+
+func TestSelectOne(t *testing.T) {
+	if _, err := SelectOne(nil); err == nil {
+		t.Error("Expected error when no card is mounted")
+	}
+
+	card, err := SelectOne([]Card{{MountPoint: "/Volumes/1-1"}})
+	if err != nil {
+		t.Fatalf("SelectOne failed: %v", err)
+	}
+	if card.MountPoint != "/Volumes/1-1" {
+		t.Errorf("Unexpected card: %+v", card)
+	}
+
+	if _, err := SelectOne([]Card{{MountPoint: "/Volumes/1-1"}, {MountPoint: "/Volumes/1-2"}}); err == nil {
+		t.Error("Expected error when several cards are mounted")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package discovery
+
+// volumeSize is not implemented on this platform
+func volumeSize(path string) int64 {
+	return 0
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package discovery
+
+import "syscall"
+
+// volumeSize returns the capacity of the filesystem containing path
+func volumeSize(path string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	return int64(st.Blocks) * int64(st.Bsize)
+}
@@ -0,0 +1,203 @@
+// Package filter selects which files of a card are imported.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+const dateLayout = "2006-01-02"
+
+// File describes a file considered for import
+type File struct {
+	// RelPath is the path relative to the card root, e.g. DCIM/02512310/DSC00001.ARW
+	RelPath string
+	Size    int64
+	// Date is the capture date of the file
+	Date time.Time
+}
+
+// Filter decides which files are imported. The zero value accepts every file.
+type Filter struct {
+	Extensions        []string
+	ExcludeExtensions []string
+	Include           []string
+	Exclude           []string
+	// From and To are inclusive capture days in yyyy-mm-dd form
+	From, To string
+	// MinSize and MaxSize are in bytes; zero means no limit
+	MinSize, MaxSize int64
+}
+
+// New parses the filter settings of the configuration
+func New(cfg config.FilterConfig) (*Filter, error) {
+	f := &Filter{
+		Extensions:        normalizeExtensions(cfg.Extensions),
+		ExcludeExtensions: normalizeExtensions(cfg.ExcludeExtensions),
+		Include:           cfg.Include,
+		Exclude:           cfg.Exclude,
+	}
+
+	for _, pattern := range append(append([]string{}, cfg.Include...), cfg.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %w", pattern, err)
+		}
+	}
+
+	var err error
+	if f.From, err = parseDate(cfg.From); err != nil {
+		return nil, err
+	}
+	if f.To, err = parseDate(cfg.To); err != nil {
+		return nil, err
+	}
+	if f.From != "" && f.To != "" && f.From > f.To {
+		return nil, fmt.Errorf("filter date range is empty: %s is after %s", f.From, f.To)
+	}
+
+	if f.MinSize, err = ParseSize(cfg.MinSize); err != nil {
+		return nil, err
+	}
+	if f.MaxSize, err = ParseSize(cfg.MaxSize); err != nil {
+		return nil, err
+	}
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return nil, fmt.Errorf("filter size range is empty: min_size %s is above max_size %s", cfg.MinSize, cfg.MaxSize)
+	}
+	return f, nil
+}
+
+// Empty reports whether the filter accepts every file
+func (f *Filter) Empty() bool {
+	return f == nil || (len(f.Extensions) == 0 && len(f.ExcludeExtensions) == 0 &&
+		len(f.Include) == 0 && len(f.Exclude) == 0 &&
+		f.From == "" && f.To == "" && f.MinSize == 0 && f.MaxSize == 0)
+}
+
+// Match reports whether file passes every configured criterion
+func (f *Filter) Match(file File) bool {
+	if f.Empty() {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(file.RelPath))
+	if len(f.Extensions) > 0 && !contains(f.Extensions, ext) {
+		return false
+	}
+	if contains(f.ExcludeExtensions, ext) {
+		return false
+	}
+
+	rel := filepath.ToSlash(file.RelPath)
+	if len(f.Include) > 0 && !matchAny(f.Include, rel) {
+		return false
+	}
+	if matchAny(f.Exclude, rel) {
+		return false
+	}
+
+	day := file.Date.Format(dateLayout)
+	if f.From != "" && day < f.From {
+		return false
+	}
+	if f.To != "" && day > f.To {
+		return false
+	}
+
+	if f.MinSize > 0 && file.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && file.Size > f.MaxSize {
+		return false
+	}
+	return true
+}
+
+// matchAny matches rel against glob patterns. Patterns without a slash match the file name only.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		target := rel
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSize parses sizes such as 500, 800K, 10MB or 1.5GiB. Units are powers of 1024.
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	upper := strings.ToUpper(value)
+	upper = strings.TrimSuffix(strings.TrimSuffix(upper, "IB"), "B")
+	multiplier := int64(1)
+	if n := len(upper); n > 0 {
+		switch upper[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			upper = upper[:n-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(upper), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+func parseDate(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	date, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid filter date %q (expected yyyy-mm-dd)", value)
+	}
+	return date.Format(dateLayout), nil
+}
+
+// normalizeExtensions lower-cases extensions and adds the leading dot
+func normalizeExtensions(extensions []string) []string {
+	var normalized []string
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
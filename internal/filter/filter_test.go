@@ -0,0 +1,93 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"", 0, false},
+		{"500", 500, false},
+		{"800K", 800 << 10, false},
+		{"10MB", 10 << 20, false},
+		{"1.5GiB", 3 << 29, false},
+		{"2g", 2 << 30, false},
+		{"ten", 0, true},
+		{"-1M", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			size, err := ParseSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if size != tt.expected {
+				t.Errorf("ParseSize(%q) = %d, want %d", tt.input, size, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.FilterConfig
+	}{
+		{"bad date", config.FilterConfig{From: "31.12.2025"}},
+		{"empty date range", config.FilterConfig{From: "2025-12-31", To: "2025-12-01"}},
+		{"bad size", config.FilterConfig{MinSize: "big"}},
+		{"empty size range", config.FilterConfig{MinSize: "2M", MaxSize: "1M"}},
+		{"bad pattern", config.FilterConfig{Include: []string{"[a-"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	raw := File{RelPath: "DCIM/02512310/DSC00001.ARW", Size: 25 << 20, Date: time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)}
+	jpeg := File{RelPath: "DCIM/02512310/DSC00001.JPG", Size: 8 << 20, Date: raw.Date}
+	video := File{RelPath: "PRIVATE/M4ROOT/CLIP/C0001.MP4", Size: 2 << 30, Date: time.Date(2026, 1, 2, 23, 30, 0, 0, time.FixedZone("JST", 9*3600))}
+
+	tests := []struct {
+		name     string
+		cfg      config.FilterConfig
+		expected []bool // raw, jpeg, video
+	}{
+		{"empty", config.FilterConfig{}, []bool{true, true, true}},
+		{"raw only", config.FilterConfig{Extensions: []string{"ARW"}}, []bool{true, false, false}},
+		{"no jpeg", config.FilterConfig{ExcludeExtensions: []string{".jpg"}}, []bool{true, false, true}},
+		{"videos by path", config.FilterConfig{Include: []string{"PRIVATE/M4ROOT/CLIP/*"}}, []bool{false, false, true}},
+		{"exclude by name", config.FilterConfig{Exclude: []string{"DSC*"}}, []bool{false, false, true}},
+		{"one day", config.FilterConfig{From: "2025-12-31", To: "2025-12-31"}, []bool{true, true, false}},
+		{"recorded date is local to the camera", config.FilterConfig{From: "2026-01-02"}, []bool{false, false, true}},
+		{"size range", config.FilterConfig{MinSize: "10M", MaxSize: "1G"}, []bool{true, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.cfg)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			for i, file := range []File{raw, jpeg, video} {
+				if got := f.Match(file); got != tt.expected[i] {
+					t.Errorf("Match(%s) = %v, want %v", file.RelPath, got, tt.expected[i])
+				}
+			}
+		})
+	}
+}
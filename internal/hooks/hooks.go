@@ -0,0 +1,142 @@
+// Package hooks runs user-defined commands around workflow stages.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+// Phases of a stage at which hooks run
+const (
+	PhasePre  = "pre"
+	PhasePost = "post"
+)
+
+// EnvPrefix is prepended to the names of the environment variables passed to hooks
+const EnvPrefix = "SONY_PHOTOS_"
+
+// DefaultTimeout limits hooks that do not set their own timeout
+const DefaultTimeout = 5 * time.Minute
+
+// Payload describes the running stage. It is written as JSON to the hook's stdin
+// and its main fields are also exported as environment variables.
+type Payload struct {
+	RunID       string         `json:"run_id"`
+	Stage       string         `json:"stage"`
+	Phase       string         `json:"phase"`
+	Source      string         `json:"source,omitempty"`
+	Body        string         `json:"body,omitempty"`
+	Role        string         `json:"role,omitempty"`
+	CardPath    string         `json:"card_path,omitempty"`
+	TmpDir      string         `json:"tmp_dir,omitempty"`
+	Destination string         `json:"destination,omitempty"`
+	DryRun      bool           `json:"dry_run"`
+	Counts      map[string]int `json:"counts,omitempty"`
+	// Error is set for post hooks when the stage failed
+	Error string `json:"error,omitempty"`
+}
+
+// Env returns the payload as environment variables
+func (p Payload) Env() []string {
+	env := []string{
+		EnvPrefix + "RUN_ID=" + p.RunID,
+		EnvPrefix + "STAGE=" + p.Stage,
+		EnvPrefix + "PHASE=" + p.Phase,
+		EnvPrefix + "SOURCE=" + p.Source,
+		EnvPrefix + "BODY=" + p.Body,
+		EnvPrefix + "ROLE=" + p.Role,
+		EnvPrefix + "CARD_PATH=" + p.CardPath,
+		EnvPrefix + "TMP_DIR=" + p.TmpDir,
+		EnvPrefix + "DESTINATION=" + p.Destination,
+		EnvPrefix + "DRY_RUN=" + strconv.FormatBool(p.DryRun),
+		EnvPrefix + "ERROR=" + p.Error,
+	}
+	for name, count := range p.Counts {
+		env = append(env, fmt.Sprintf("%sCOUNT_%s=%d", EnvPrefix, envName(name), count))
+	}
+	return env
+}
+
+// RunPhase runs the hooks of one phase in order.
+// Pre hooks stop at the first failure and return it; post hooks all run and
+// their failures are returned together.
+func RunPhase(ctx context.Context, hooks []config.Hook, payload Payload) error {
+	var errs []error
+	for _, hook := range hooks {
+		if payload.DryRun {
+			log.Printf("[DRY RUN] Would run %s-%s hook: %s", payload.Phase, payload.Stage, hook.Command)
+			continue
+		}
+
+		log.Printf("Running %s-%s hook: %s", payload.Phase, payload.Stage, hook.Command)
+		if err := Run(ctx, hook, payload); err != nil {
+			if payload.Phase == PhasePre {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run executes a single hook through the platform shell
+func Run(ctx context.Context, hook config.Hook, payload Payload) error {
+	stdin, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hook payload: %w", err)
+	}
+
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, hook.Command)
+	cmd.Env = append(os.Environ(), payload.Env()...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	// Do not wait for children of the shell that keep the output open after a timeout
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("%s-%s hook output:\n%s", payload.Phase, payload.Stage, bytes.TrimRight(output, "\n"))
+	}
+	if err != nil {
+		return fmt.Errorf("%s-%s hook %q failed: %w", payload.Phase, payload.Stage, hook.Command, err)
+	}
+	return nil
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// envName converts a counter name such as "skipped-identical" to SKIPPED_IDENTICAL
+func envName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
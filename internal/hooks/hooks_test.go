@@ -0,0 +1,124 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestRunPassesPayload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands use sh")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "hooks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	stdinFile := filepath.Join(tmpDir, "stdin.json")
+	envFile := filepath.Join(tmpDir, "env.txt")
+	hook := config.Hook{Command: "cat > " + stdinFile + " && env > " + envFile}
+	payload := Payload{
+		RunID:  "20251231-101500-abcdef",
+		Stage:  "archive",
+		Phase:  PhasePost,
+		Source: "a7iv",
+		Counts: map[string]int{"skipped-identical": 2},
+	}
+
+	if err := Run(context.Background(), hook, payload); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	data, err := os.ReadFile(stdinFile)
+	if err != nil {
+		t.Fatalf("Failed to read stdin file: %v", err)
+	}
+	var received Payload
+	if err := json.Unmarshal(data, &received); err != nil {
+		t.Fatalf("Failed to parse payload: %v", err)
+	}
+	if received.RunID != payload.RunID || received.Counts["skipped-identical"] != 2 {
+		t.Errorf("Unexpected payload: %+v", received)
+	}
+
+	env, err := os.ReadFile(envFile)
+	if err != nil {
+		t.Fatalf("Failed to read env file: %v", err)
+	}
+	for _, expected := range []string{
+		"SONY_PHOTOS_STAGE=archive",
+		"SONY_PHOTOS_PHASE=post",
+		"SONY_PHOTOS_SOURCE=a7iv",
+		"SONY_PHOTOS_COUNT_SKIPPED_IDENTICAL=2",
+	} {
+		if !strings.Contains(string(env), expected) {
+			t.Errorf("Environment does not contain %s", expected)
+		}
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands use sh")
+	}
+
+	hook := config.Hook{Command: "sleep 5", Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if err := Run(context.Background(), hook, Payload{Stage: "copy", Phase: PhasePre}); err == nil {
+		t.Error("Expected error for a hook exceeding its timeout")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Error("Hook was not stopped at its timeout")
+	}
+}
+
+func TestRunPhase(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands use sh")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "hooks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	marker := filepath.Join(tmpDir, "marker")
+	hooks := []config.Hook{{Command: "exit 1"}, {Command: "touch " + marker}}
+
+	tests := []struct {
+		name       string
+		phase      string
+		dryRun     bool
+		wantErr    bool
+		wantMarker bool
+	}{
+		{"pre stops at first failure", PhasePre, false, true, false},
+		{"post runs all hooks", PhasePost, false, true, true},
+		{"dry run only logs", PhasePre, true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(marker)
+			err := RunPhase(context.Background(), hooks, Payload{Stage: "copy", Phase: tt.phase, DryRun: tt.dryRun})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RunPhase() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, statErr := os.Stat(marker)
+			if (statErr == nil) != tt.wantMarker {
+				t.Errorf("Second hook ran = %v, want %v", statErr == nil, tt.wantMarker)
+			}
+		})
+	}
+}
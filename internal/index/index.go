@@ -0,0 +1,234 @@
+// Package index maintains a persistent content-hash index of the photo archive.
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// DefaultFileName is the name of the index file stored at the root of the archive
+const DefaultFileName = ".rename-sony-photos-index.json"
+
+// Entry describes one archived file
+type Entry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+type fileFormat struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// Index maps content hashes to the archived files under Root.
+// Paths are stored relative to Root using forward slashes.
+type Index struct {
+	Root    string
+	path    string
+	entries map[string]Entry
+	byHash  map[string][]string
+}
+
+// Load reads the index stored at indexPath for the archive at root.
+// A missing index file yields an empty index.
+func Load(root, indexPath string) (*Index, error) {
+	idx := &Index{
+		Root:    root,
+		path:    indexPath,
+		entries: make(map[string]Entry),
+		byHash:  make(map[string][]string),
+	}
+
+	data, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index file: %w", err)
+	}
+
+	var file fileFormat
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse index file: %w", err)
+	}
+	for _, e := range file.Entries {
+		idx.put(e)
+	}
+
+	return idx, nil
+}
+
+// Save writes the index to disk, replacing the previous file atomically.
+// The new file is synced before it replaces the old one.
+func (i *Index) Save() error {
+	file := fileFormat{Version: 1, Entries: make([]Entry, 0, len(i.entries))}
+	for _, e := range i.entries {
+		file.Entries = append(file.Entries, e)
+	}
+	sort.Slice(file.Entries, func(a, b int) bool { return file.Entries[a].Path < file.Entries[b].Path })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	if err := storage.WriteFile(storage.Local{}, i.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	return nil
+}
+
+// Refresh walks Root and brings the index up to date.
+// Files whose size and modification time are unchanged keep their recorded hash;
+// new or modified files are hashed and entries for removed files are dropped.
+// A cancelled ctx stops the walk between two files.
+func (i *Index) Refresh(ctx context.Context) error {
+	seen := make(map[string]bool)
+	hashed := 0
+
+	err := filepath.WalkDir(i.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != i.Root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := i.rel(path)
+		if err != nil {
+			return err
+		}
+		seen[rel] = true
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if e, ok := i.entries[rel]; ok && e.Size == info.Size() && e.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+
+		hash, err := checksum.File(path)
+		if err != nil {
+			return err
+		}
+		hashed++
+		i.put(Entry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), Hash: hash})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan archive %s: %w", i.Root, err)
+	}
+
+	for rel := range i.entries {
+		if !seen[rel] {
+			i.remove(rel)
+		}
+	}
+
+	if hashed > 0 {
+		log.Printf("Indexed %d new or changed files in %s", hashed, i.Root)
+	}
+	return nil
+}
+
+// Add records a file that has just been written under Root
+func (i *Index) Add(path, hash string) error {
+	rel, err := i.rel(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	i.put(Entry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), Hash: hash})
+	return nil
+}
+
+// Lookup returns the absolute paths of archived files with the given hash
+func (i *Index) Lookup(hash string) []string {
+	var paths []string
+	for _, rel := range i.byHash[hash] {
+		paths = append(paths, filepath.Join(i.Root, filepath.FromSlash(rel)))
+	}
+	return paths
+}
+
+// Len returns the number of indexed files
+func (i *Index) Len() int {
+	return len(i.entries)
+}
+
+// Duplicates returns groups of absolute paths that share the same content.
+// Groups and the paths inside them are sorted.
+func (i *Index) Duplicates() [][]string {
+	var groups [][]string
+	for hash, rels := range i.byHash {
+		if len(rels) > 1 {
+			groups = append(groups, i.Lookup(hash))
+		}
+	}
+	for _, g := range groups {
+		sort.Strings(g)
+	}
+	sort.Slice(groups, func(a, b int) bool { return groups[a][0] < groups[b][0] })
+	return groups
+}
+
+func (i *Index) rel(path string) (string, error) {
+	rel, err := filepath.Rel(i.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside of archive %s", path, i.Root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (i *Index) put(e Entry) {
+	i.remove(e.Path)
+	i.entries[e.Path] = e
+	i.byHash[e.Hash] = append(i.byHash[e.Hash], e.Path)
+}
+
+func (i *Index) remove(rel string) {
+	e, ok := i.entries[rel]
+	if !ok {
+		return
+	}
+	delete(i.entries, rel)
+
+	paths := i.byHash[e.Hash]
+	for n, p := range paths {
+		if p == rel {
+			paths = append(paths[:n], paths[n+1:]...)
+			break
+		}
+	}
+	if len(paths) == 0 {
+		delete(i.byHash, e.Hash)
+	} else {
+		i.byHash[e.Hash] = paths
+	}
+}
@@ -0,0 +1,129 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+}
+
+func TestRefreshAndLookup(t *testing.T) {
+	root, err := os.MkdirTemp("", "index-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFiles(t, root, map[string]string{
+		"2025-12-30/DSC00001.JPG": "photo one",
+		"2025-12-31/DSC00001.JPG": "photo two",
+		"2025-12-31/COPY.JPG":     "photo one",
+		".hidden/ignored.JPG":     "photo one",
+	})
+
+	indexPath := filepath.Join(root, DefaultFileName)
+	idx, err := Load(root, indexPath)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := idx.Refresh(t.Context()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+
+	if idx.Len() != 3 {
+		t.Errorf("Expected 3 indexed files, got %d", idx.Len())
+	}
+
+	hash, err := checksum.File(filepath.Join(root, "2025-12-30", "DSC00001.JPG"))
+	if err != nil {
+		t.Fatalf("Failed to hash file: %v", err)
+	}
+	if matches := idx.Lookup(hash); len(matches) != 2 {
+		t.Errorf("Expected 2 matches for duplicated content, got %v", matches)
+	}
+
+	groups := idx.Duplicates()
+	if len(groups) != 1 || len(groups[0]) != 2 {
+		t.Fatalf("Expected one duplicate group of 2 files, got %v", groups)
+	}
+
+	if err := idx.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Removing a file must drop it from the reloaded index on refresh
+	if err := os.Remove(filepath.Join(root, "2025-12-31", "COPY.JPG")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	reloaded, err := Load(root, indexPath)
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if reloaded.Len() != 3 {
+		t.Errorf("Expected 3 entries after reload, got %d", reloaded.Len())
+	}
+	if err := reloaded.Refresh(t.Context()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if reloaded.Len() != 2 {
+		t.Errorf("Expected 2 entries after refresh, got %d", reloaded.Len())
+	}
+	if len(reloaded.Duplicates()) != 0 {
+		t.Errorf("Expected no duplicates after removal, got %v", reloaded.Duplicates())
+	}
+}
+
+func TestRefreshStopsWhenCancelled(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"2025-12-30/DSC00001.JPG": "photo one",
+	})
+
+	idx, err := Load(root, filepath.Join(root, DefaultFileName))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := idx.Refresh(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancelled refresh, got %v", err)
+	}
+	if idx.Len() != 0 {
+		t.Errorf("Expected nothing indexed after cancellation, got %d entries", idx.Len())
+	}
+}
+
+func TestAddOutsideRoot(t *testing.T) {
+	root, err := os.MkdirTemp("", "index-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	idx, err := Load(filepath.Join(root, "archive"), filepath.Join(root, DefaultFileName))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	writeFiles(t, root, map[string]string{"outside.JPG": "photo"})
+	if err := idx.Add(filepath.Join(root, "outside.JPG"), "hash"); err == nil {
+		t.Error("Expected error when adding a file outside of the archive")
+	}
+}
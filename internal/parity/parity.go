@@ -0,0 +1,573 @@
+// Package parity protects the files of a folder with Reed-Solomon parity, in the manner
+// of PAR2. The files of the folder, in path order, form one stream that is split into
+// at most 128 equal data shards, and parity shards are computed over them cell by cell.
+// A hidden file in the folder keeps the parity cells after a header that lists every
+// file with its SHA-256 digest and the CRC of every cell. Damaged cells are found by
+// their CRC and rebuilt from the others as long as no column of cells has more damaged
+// cells than there are parity shards, so damage confined to a few shards, such as a
+// lost file or a range of bad sectors, is repairable whatever its size within them.
+package parity
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+const (
+	// FileName is the parity file kept in every protected folder
+	FileName = ".rename-sony-photos-parity"
+	// DefaultRedundancy is the parity size in percent of the folder when none is configured
+	DefaultRedundancy = 10
+	// MaxRedundancy is the largest redundancy accepted, in percent
+	MaxRedundancy = 100
+
+	magic         = "RSPPAR1\n"
+	cellSize      = 64 << 10
+	maxDataShards = 128
+	// maxHeaderSize bounds the header read from a damaged parity file
+	maxHeaderSize = 1 << 30
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// File is a protected file of a folder
+type File struct {
+	// Path is the slash path relative to the folder
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// header describes the parity file
+type header struct {
+	CellSize     int64  `json:"cell_size"`
+	ShardSize    int64  `json:"shard_size"`
+	DataShards   int    `json:"data_shards"`
+	ParityShards int    `json:"parity_shards"`
+	Files        []File `json:"files"`
+	// CRCs holds the big-endian CRC-32C of every cell, column by column, data shards first
+	CRCs []byte `json:"crcs"`
+}
+
+// columns returns the number of cells in every shard
+func (h *header) columns() int {
+	return int(h.ShardSize / h.CellSize)
+}
+
+// crc returns the recorded CRC of the cell of shard in column
+func (h *header) crc(column, shard int) uint32 {
+	i := (column*(h.DataShards+h.ParityShards) + shard) * 4
+	return binary.BigEndian.Uint32(h.CRCs[i:])
+}
+
+// layout returns the number of data and parity shards and the shard size protecting
+// total bytes with redundancy percent
+func layout(total int64, redundancy int) (data, parity int, shardSize int64) {
+	cells := (total + cellSize - 1) / cellSize
+	data = int(min(cells, maxDataShards))
+	columns := (cells + int64(data) - 1) / int64(data)
+	parity = max(1, (data*redundancy+99)/100)
+	return data, parity, columns * cellSize
+}
+
+// ValidateRedundancy checks a configured redundancy; 0 selects DefaultRedundancy
+func ValidateRedundancy(redundancy int) error {
+	if redundancy < 0 || redundancy > MaxRedundancy {
+		return fmt.Errorf("parity redundancy must be between 1 and %d percent", MaxRedundancy)
+	}
+	return nil
+}
+
+// Create writes the parity file of dir in fsys with redundancy percent of the size of
+// its files, replacing an existing one. Hidden files are not protected. A folder
+// without content gets no parity file.
+func Create(ctx context.Context, fsys storage.FS, dir string, redundancy int) error {
+	if redundancy == 0 {
+		redundancy = DefaultRedundancy
+	}
+	if err := ValidateRedundancy(redundancy); err != nil {
+		return err
+	}
+	files, err := listFiles(ctx, fsys, dir)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, FileName)
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	if total == 0 {
+		if err := fsys.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale parity file: %w", err)
+		}
+		return nil
+	}
+
+	h := &header{CellSize: cellSize, Files: files}
+	h.DataShards, h.ParityShards, h.ShardSize = layout(total, redundancy)
+	enc, err := reedsolomon.New(h.DataShards, h.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	// The parity cells are only known with the header, which precedes them in the file
+	cells, err := os.CreateTemp("", "rename-sony-photos-parity-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		cells.Close()
+		os.Remove(cells.Name())
+	}()
+
+	streams := openStreams(fsys, dir, h)
+	defer closeStreams(streams)
+	shards := newShards(h)
+	for column := 0; column < h.columns(); column++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for i, s := range streams {
+			// Parity over zeros read in place of a failing file would protect nothing
+			if s.read(shards[i]); s.err != nil {
+				return s.err
+			}
+		}
+		if err := enc.Encode(shards); err != nil {
+			return fmt.Errorf("failed to compute parity: %w", err)
+		}
+		for _, shard := range shards {
+			h.CRCs = binary.BigEndian.AppendUint32(h.CRCs, crc32.Checksum(shard, crcTable))
+		}
+		for _, shard := range shards[h.DataShards:] {
+			if _, err := cells.Write(shard); err != nil {
+				return fmt.Errorf("failed to write parity: %w", err)
+			}
+		}
+	}
+	if _, err := cells.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeParityFile(fsys, target, h, cells)
+}
+
+// writeParityFile writes the header and the parity cells of r to target through a temporary name
+func writeParityFile(fsys storage.FS, target string, h *header, r io.Reader) error {
+	encoded, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(encoded)
+	prefix := append([]byte(magic), binary.BigEndian.AppendUint32(nil, uint32(len(encoded)))...)
+	prefix = append(append(prefix, encoded...), digest[:]...)
+
+	tmp := target + ".tmp"
+	if err := fsys.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	w, err := fsys.Create(tmp, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create parity file: %w", err)
+	}
+	if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(prefix), r)); err != nil {
+		w.Close()
+		fsys.Remove(tmp)
+		return fmt.Errorf("failed to write parity file: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		fsys.Remove(tmp)
+		return fmt.Errorf("failed to write parity file: %w", err)
+	}
+	if err := fsys.Rename(tmp, target); err != nil {
+		return fmt.Errorf("failed to move parity file into place: %w", err)
+	}
+	return nil
+}
+
+// readHeader reads the header of the parity file in r, leaving r at the first parity cell
+func readHeader(r io.Reader) (*header, error) {
+	prefix := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil || string(prefix[:len(magic)]) != magic {
+		return nil, fmt.Errorf("not a parity file")
+	}
+	size := binary.BigEndian.Uint32(prefix[len(magic):])
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("parity file header is damaged")
+	}
+	encoded := make([]byte, int(size)+sha256.Size)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, fmt.Errorf("parity file header is damaged: %w", err)
+	}
+	if digest := sha256.Sum256(encoded[:size]); !bytes.Equal(digest[:], encoded[size:]) {
+		return nil, fmt.Errorf("parity file header is damaged")
+	}
+
+	h := &header{}
+	if err := json.Unmarshal(encoded[:size], h); err != nil {
+		return nil, fmt.Errorf("parity file header is damaged: %w", err)
+	}
+	if h.CellSize <= 0 || h.ShardSize%h.CellSize != 0 || h.DataShards <= 0 || h.ParityShards <= 0 ||
+		len(h.CRCs) != h.columns()*(h.DataShards+h.ParityShards)*4 {
+		return nil, fmt.Errorf("parity file header is inconsistent")
+	}
+	return h, nil
+}
+
+// listFiles returns the files below dir in path order with their digests, skipping hidden ones
+func listFiles(ctx context.Context, fsys storage.FS, dir string) ([]File, error) {
+	var files []File
+	err := storage.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && name != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		digest, err := fileDigest(fsys, name)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime(), SHA256: digest})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// fileDigest returns the SHA-256 digest of name
+func fileDigest(fsys storage.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return checksum.Reader(f)
+}
+
+// newShards returns buffers for the cells of one column
+func newShards(h *header) [][]byte {
+	shards := make([][]byte, h.DataShards+h.ParityShards)
+	for i := range shards {
+		shards[i] = make([]byte, h.CellSize)
+	}
+	return shards
+}
+
+// stream reads the files of a folder as one sequence from an offset. Missing or short
+// files read as zeros, which fail the CRC of their cells, and the sequence is padded
+// with zeros to the end of the last shard. The first read failure is kept in err.
+type stream struct {
+	fsys  storage.FS
+	dir   string
+	files []File
+	// index is the current file and pos the offset in it
+	index int
+	pos   int64
+	rc    io.ReadCloser
+	// broken is set when the current file cannot be read further
+	broken bool
+	// err is the first failure to read a file; Create stops at it, Repair reads zeros
+	err error
+}
+
+// openStreams returns a stream at the start of every data shard
+func openStreams(fsys storage.FS, dir string, h *header) []*stream {
+	streams := make([]*stream, h.DataShards)
+	for i := range streams {
+		s := &stream{fsys: fsys, dir: dir, files: h.Files}
+		offset := int64(i) * h.ShardSize
+		for s.index < len(s.files) && offset >= s.files[s.index].Size {
+			offset -= s.files[s.index].Size
+			s.index++
+		}
+		s.pos = offset
+		streams[i] = s
+	}
+	return streams
+}
+
+func closeStreams(streams []*stream) {
+	for _, s := range streams {
+		s.close()
+	}
+}
+
+// read fills p with the following bytes of the sequence
+func (s *stream) read(p []byte) {
+	for n := 0; n < len(p); {
+		if s.index >= len(s.files) {
+			clear(p[n:])
+			return
+		}
+		remaining := s.files[s.index].Size - s.pos
+		if remaining == 0 {
+			s.close()
+			s.index++
+			s.pos = 0
+			s.broken = false
+			continue
+		}
+
+		want := int(min(int64(len(p)-n), remaining))
+		if s.rc == nil && !s.broken {
+			s.open()
+		}
+		got := 0
+		if s.rc != nil {
+			var err error
+			if got, err = io.ReadFull(s.rc, p[n:n+want]); err != nil {
+				s.fail(err)
+			}
+		}
+		clear(p[n+got : n+want])
+		n += want
+		s.pos += int64(want)
+	}
+}
+
+// open opens the current file at pos, seeking when the store allows it
+func (s *stream) open() {
+	rc, err := s.fsys.Open(filepath.Join(s.dir, filepath.FromSlash(s.files[s.index].Path)))
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	if seeker, ok := rc.(io.Seeker); ok {
+		_, err = seeker.Seek(s.pos, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, rc, s.pos)
+	}
+	if err != nil {
+		rc.Close()
+		s.fail(err)
+		return
+	}
+	s.rc = rc
+}
+
+// fail gives up reading the current file and records the first error
+func (s *stream) fail(err error) {
+	s.close()
+	s.broken = true
+	if s.err == nil {
+		s.err = fmt.Errorf("failed to read %s: %w", s.files[s.index].Path, err)
+	}
+}
+
+func (s *stream) close() {
+	if s.rc != nil {
+		s.rc.Close()
+		s.rc = nil
+	}
+}
+
+// Result reports the check of a folder
+type Result struct {
+	// Damaged lists the files, relative to the folder, that no longer match their digest
+	Damaged []string
+	// Repaired maps the damaged files that were rebuilt to temporary files holding their
+	// content with the original modification time; Cleanup removes them
+	Repaired map[string]string
+	// Lost lists the damaged files that could not be rebuilt
+	Lost []string
+}
+
+// Cleanup removes the temporary files of the repaired content
+func (r *Result) Cleanup() {
+	for _, tmp := range r.Repaired {
+		os.Remove(tmp)
+	}
+}
+
+// Repair checks the files of dir in fsys against its parity file and rebuilds the damaged
+// ones into temporary files, leaving the folder untouched
+func Repair(ctx context.Context, fsys storage.FS, dir string) (*Result, error) {
+	f, err := fsys.Open(filepath.Join(dir, FileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open parity file: %w", err)
+	}
+	defer f.Close()
+	h, err := readHeader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Repaired: make(map[string]string)}
+	for _, file := range h.Files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if info, err := fsys.Stat(name); err != nil || info.Size() != file.Size {
+			result.Damaged = append(result.Damaged, file.Path)
+		} else if digest, err := fileDigest(fsys, name); err != nil || digest != file.SHA256 {
+			result.Damaged = append(result.Damaged, file.Path)
+		}
+	}
+	if len(result.Damaged) == 0 {
+		return result, nil
+	}
+
+	rebuilt, err := rebuild(ctx, fsys, dir, h, f, result.Damaged)
+	if err != nil {
+		for _, tmp := range rebuilt {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		return nil, err
+	}
+	for _, file := range h.Files {
+		tmp, ok := rebuilt[file.Path]
+		if !ok {
+			continue
+		}
+		tmp.Close()
+		// Temporary files are private; repaired files get the usual permissions
+		os.Chmod(tmp.Name(), 0644)
+		os.Chtimes(tmp.Name(), file.ModTime, file.ModTime)
+		if digest, err := checksum.File(tmp.Name()); err == nil && digest == file.SHA256 {
+			result.Repaired[file.Path] = tmp.Name()
+		} else {
+			os.Remove(tmp.Name())
+			result.Lost = append(result.Lost, file.Path)
+		}
+	}
+	return result, nil
+}
+
+// rebuild reconstructs the content of the damaged files, column by column, into
+// temporary files; cells that cannot be rebuilt are left as zeros
+func rebuild(ctx context.Context, fsys storage.FS, dir string, h *header, parityCells io.Reader, damaged []string) (map[string]*os.File, error) {
+	enc, err := reedsolomon.New(h.DataShards, h.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	// The range of every damaged file in the sequence
+	type span struct {
+		tmp        *os.File
+		start, end int64
+	}
+	isDamaged := make(map[string]bool)
+	for _, p := range damaged {
+		isDamaged[p] = true
+	}
+	rebuilt := make(map[string]*os.File)
+	var spans []span
+	var offset int64
+	for _, file := range h.Files {
+		if isDamaged[file.Path] {
+			tmp, err := os.CreateTemp("", "rename-sony-photos-repair-*"+path.Ext(file.Path))
+			if err != nil {
+				return rebuilt, fmt.Errorf("failed to create temporary file: %w", err)
+			}
+			rebuilt[file.Path] = tmp
+			if err := tmp.Truncate(file.Size); err != nil {
+				return rebuilt, err
+			}
+			spans = append(spans, span{tmp: tmp, start: offset, end: offset + file.Size})
+		}
+		offset += file.Size
+	}
+
+	streams := openStreams(fsys, dir, h)
+	defer closeStreams(streams)
+	shards := newShards(h)
+	buffers := append([][]byte(nil), shards...)
+	parityOK := true
+	for column := 0; column < h.columns(); column++ {
+		if err := ctx.Err(); err != nil {
+			return rebuilt, err
+		}
+		for i := range shards {
+			shards[i] = buffers[i]
+		}
+		for i, s := range streams {
+			s.read(shards[i])
+		}
+		for _, shard := range shards[h.DataShards:] {
+			// A truncated parity file loses the cells after the damage
+			if parityOK {
+				if _, err := io.ReadFull(parityCells, shard); err != nil {
+					parityOK = false
+				}
+			}
+			if !parityOK {
+				clear(shard)
+			}
+		}
+
+		erased := 0
+		for i, shard := range shards {
+			if crc32.Checksum(shard, crcTable) != h.crc(column, i) {
+				shards[i] = shard[:0]
+				erased++
+			}
+		}
+		if erased > 0 && erased <= h.ParityShards {
+			if err := enc.ReconstructData(shards); err != nil {
+				return rebuilt, fmt.Errorf("failed to rebuild column %d: %w", column, err)
+			}
+		}
+
+		for i, shard := range shards[:h.DataShards] {
+			if len(shard) == 0 {
+				continue
+			}
+			cellStart := int64(i)*h.ShardSize + int64(column)*h.CellSize
+			cellEnd := cellStart + h.CellSize
+			for _, sp := range spans {
+				start, end := max(cellStart, sp.start), min(cellEnd, sp.end)
+				if start >= end {
+					continue
+				}
+				if _, err := sp.tmp.WriteAt(shard[start-cellStart:end-cellStart], start-sp.start); err != nil {
+					return rebuilt, fmt.Errorf("failed to write repaired content: %w", err)
+				}
+			}
+		}
+	}
+	return rebuilt, nil
+}
@@ -0,0 +1,263 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// writeFolder writes files of the given sizes with random content to a new folder
+func writeFolder(t *testing.T, sizes map[string]int) (string, map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	contents := make(map[string][]byte)
+	for name, size := range sizes {
+		data := make([]byte, size)
+		rng.Read(data)
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		contents[name] = data
+	}
+	return dir, contents
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		total      int64
+		redundancy int
+		data       int
+		parity     int
+		shardSize  int64
+	}{
+		{1, 10, 1, 1, cellSize},
+		{10 * cellSize, 10, 10, 1, cellSize},
+		{128 * cellSize, 10, 128, 13, cellSize},
+		{129 * cellSize, 10, 128, 13, 2 * cellSize},
+		{1000 * cellSize, 100, 128, 128, 8 * cellSize},
+	}
+
+	for _, tt := range tests {
+		data, parity, shardSize := layout(tt.total, tt.redundancy)
+		if data != tt.data || parity != tt.parity || shardSize != tt.shardSize {
+			t.Errorf("layout(%d, %d) = %d, %d, %d, want %d, %d, %d",
+				tt.total, tt.redundancy, data, parity, shardSize, tt.data, tt.parity, tt.shardSize)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	// 40 photos of 200 KiB and a 3 MiB clip: 128 data shards of two cells and 13 parity shards at 10%
+	sizes := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		sizes[fmt.Sprintf("DSC/DSC%05d.JPG", i)] = 200 << 10
+	}
+	sizes["clips/C0001.MP4"] = 3 << 20
+	var tenPhotos []string
+	for i := 0; i < 10; i++ {
+		tenPhotos = append(tenPhotos, fmt.Sprintf("DSC/DSC%05d.JPG", i))
+	}
+
+	tests := []struct {
+		name       string
+		damage     func(dir string)
+		wantDamage []string
+		wantLost   []string
+	}{
+		{
+			name:   "intact",
+			damage: func(dir string) {},
+		},
+		{
+			name: "flipped bytes",
+			damage: func(dir string) {
+				path := filepath.Join(dir, "DSC", "DSC00003.JPG")
+				data, _ := os.ReadFile(path)
+				data[1000] ^= 0xff
+				data[150<<10] ^= 0x01
+				os.WriteFile(path, data, 0644)
+			},
+			wantDamage: []string{"DSC/DSC00003.JPG"},
+		},
+		{
+			name: "missing and truncated photos",
+			damage: func(dir string) {
+				os.Remove(filepath.Join(dir, "DSC", "DSC00011.JPG"))
+				os.Truncate(filepath.Join(dir, "DSC", "DSC00039.JPG"), 1000)
+			},
+			wantDamage: []string{"DSC/DSC00011.JPG", "DSC/DSC00039.JPG"},
+		},
+		{
+			name: "bad sectors in a clip",
+			damage: func(dir string) {
+				path := filepath.Join(dir, "clips", "C0001.MP4")
+				data, _ := os.ReadFile(path)
+				clear(data[1<<20 : 1<<20+300<<10])
+				os.WriteFile(path, data, 0644)
+			},
+			wantDamage: []string{"clips/C0001.MP4"},
+		},
+		{
+			name: "more damage than parity",
+			damage: func(dir string) {
+				// 2000 KiB span 16 shards of 128 KiB, more than the 13 parity shards
+				for i := 0; i < 10; i++ {
+					os.WriteFile(filepath.Join(dir, filepath.FromSlash(tenPhotos[i])), make([]byte, 200<<10), 0644)
+				}
+			},
+			wantDamage: tenPhotos,
+			wantLost:   tenPhotos,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, contents := writeFolder(t, sizes)
+			modTime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.Local)
+			os.Chtimes(filepath.Join(dir, "DSC", "DSC00011.JPG"), modTime, modTime)
+			if err := Create(t.Context(), storage.Local{}, dir, 10); err != nil {
+				t.Fatalf("Failed to create parity: %v", err)
+			}
+			tt.damage(dir)
+
+			result, err := Repair(t.Context(), storage.Local{}, dir)
+			if err != nil {
+				t.Fatalf("Failed to repair: %v", err)
+			}
+			defer result.Cleanup()
+			if !reflect.DeepEqual(result.Damaged, tt.wantDamage) {
+				t.Errorf("Damaged = %v, want %v", result.Damaged, tt.wantDamage)
+			}
+			if !reflect.DeepEqual(result.Lost, tt.wantLost) {
+				t.Errorf("Lost = %v, want %v", result.Lost, tt.wantLost)
+			}
+
+			var repaired []string
+			for name, tmp := range result.Repaired {
+				repaired = append(repaired, name)
+				data, err := os.ReadFile(tmp)
+				if err != nil || !bytes.Equal(data, contents[name]) {
+					t.Errorf("Repaired content of %s differs from the original", name)
+				}
+				if info, err := os.Stat(tmp); name == "DSC/DSC00011.JPG" && (err != nil || !info.ModTime().Equal(modTime)) {
+					t.Errorf("Repaired %s has time %v, want %v", name, info.ModTime(), modTime)
+				}
+			}
+			sort.Strings(repaired)
+			if want := len(tt.wantDamage) - len(tt.wantLost); len(repaired) != want {
+				t.Errorf("Repaired %v, want %d files", repaired, want)
+			}
+		})
+	}
+}
+
+func TestRepairDamagedParityFile(t *testing.T) {
+	dir, contents := writeFolder(t, map[string]int{"DSC00001.JPG": 300 << 10, "DSC00002.JPG": 300 << 10})
+	if err := Create(t.Context(), storage.Local{}, dir, 70); err != nil {
+		t.Fatalf("Failed to create parity: %v", err)
+	}
+	os.Remove(filepath.Join(dir, "DSC00001.JPG"))
+
+	// Damaged parity cells are skipped like damaged data cells
+	parityPath := filepath.Join(dir, FileName)
+	data, _ := os.ReadFile(parityPath)
+	data[len(data)-10] ^= 0xff
+	os.WriteFile(parityPath, data, 0644)
+
+	result, err := Repair(t.Context(), storage.Local{}, dir)
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	defer result.Cleanup()
+	if repaired, err := os.ReadFile(result.Repaired["DSC00001.JPG"]); err != nil || !bytes.Equal(repaired, contents["DSC00001.JPG"]) {
+		t.Errorf("Failed to rebuild the missing file: %v", err)
+	}
+
+	data[20] ^= 0xff
+	os.WriteFile(parityPath, data, 0644)
+	if _, err := Repair(t.Context(), storage.Local{}, dir); err == nil {
+		t.Error("A damaged parity header should be reported")
+	}
+}
+
+func TestCreateOnStorage(t *testing.T) {
+	// Stores without seeking are read from the start of each file
+	mem := storage.NewMem()
+	rng := rand.New(rand.NewSource(2))
+	photo := make([]byte, 5*cellSize+123)
+	rng.Read(photo)
+	mem.AddFile("/2025-12-31/DSC00001.ARW", photo, time.Now())
+	mem.AddFile("/2025-12-31/DSC00002.JPG", photo[:1000], time.Now())
+	mem.AddFile("/2025-12-31/.hidden", []byte("not protected"), time.Now())
+
+	if err := Create(t.Context(), mem, "/2025-12-31", 25); err != nil {
+		t.Fatalf("Failed to create parity: %v", err)
+	}
+	damaged := append([]byte(nil), photo...)
+	clear(damaged[cellSize : 2*cellSize])
+	mem.AddFile("/2025-12-31/DSC00001.ARW", damaged, time.Now())
+
+	result, err := Repair(t.Context(), mem, "/2025-12-31")
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	defer result.Cleanup()
+	if data, err := os.ReadFile(result.Repaired["DSC00001.ARW"]); err != nil || !bytes.Equal(data, photo) {
+		t.Errorf("Failed to rebuild the damaged file: %v", err)
+	}
+
+	empty := storage.NewMem()
+	empty.MkdirAll("/2026-01-01", 0755)
+	if err := Create(t.Context(), empty, "/2026-01-01", 0); err != nil {
+		t.Fatalf("Failed to handle an empty folder: %v", err)
+	}
+	if _, err := empty.Stat("/2026-01-01/" + FileName); err == nil {
+		t.Error("An empty folder should get no parity file")
+	}
+	if err := Create(t.Context(), mem, "/2025-12-31", 101); err == nil {
+		t.Error("A redundancy above 100% should be refused")
+	}
+}
+
+func TestCreateReadError(t *testing.T) {
+	mem := storage.NewMem()
+	photo := make([]byte, 3*cellSize)
+	rand.New(rand.NewSource(3)).Read(photo)
+	mem.AddFile("/2025-12-31/DSC00001.ARW", photo, time.Now())
+	if err := Create(t.Context(), mem, "/2025-12-31", 10); err != nil {
+		t.Fatalf("Failed to create parity: %v", err)
+	}
+	before, _ := storage.ReadFile(mem, "/2025-12-31/"+FileName)
+
+	// The file is hashed, then fails while its shards are read
+	opens := 0
+	mem.Fault = func(op storage.Op, name string) error {
+		if op == storage.OpOpen && filepath.Base(name) == "DSC00001.ARW" {
+			if opens++; opens > 1 {
+				return errors.New("I/O error")
+			}
+		}
+		return nil
+	}
+	if err := Create(t.Context(), mem, "/2025-12-31", 10); err == nil {
+		t.Fatal("Create should fail when a file cannot be read")
+	}
+	mem.Fault = nil
+	if after, _ := storage.ReadFile(mem, "/2025-12-31/"+FileName); !bytes.Equal(after, before) {
+		t.Error("A failed Create replaced the parity file")
+	}
+}
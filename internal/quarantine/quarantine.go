@@ -0,0 +1,256 @@
+// Package quarantine holds files removed from cards until they are no longer needed.
+package quarantine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// CardDirName is the quarantine directory at the root of a card
+const CardDirName = ".rename-sony-photos-quarantine"
+
+// ManifestFileName describes the files of a batch
+const ManifestFileName = "manifest.json"
+
+// Manifest records where the files of a batch came from
+type Manifest struct {
+	RunID    string    `json:"run_id"`
+	Source   string    `json:"source"`
+	CardID   string    `json:"card_id,omitempty"`
+	CardPath string    `json:"card_path"`
+	Created  time.Time `json:"created"`
+	// Files are paths relative to the card root using forward slashes
+	Files []string `json:"files"`
+}
+
+// Batch is the set of files quarantined from one card in one run
+type Batch struct {
+	// Dir contains the manifest and the files below a "files" subdirectory
+	Dir string
+	Manifest
+}
+
+// filesDir returns the directory holding the quarantined files of b
+func (b Batch) filesDir() string {
+	return filepath.Join(b.Dir, "files")
+}
+
+// Store is a quarantine area
+type Store struct {
+	Root string
+}
+
+// Open returns the quarantine area at root
+func Open(root string) *Store {
+	return &Store{Root: root}
+}
+
+// Move moves files from the card mounted at cardRoot into a new batch.
+// Files are renamed when the store is on the same file system and copied otherwise.
+func (s *Store) Move(manifest Manifest, cardRoot string, files []string, dryRun bool) (*Batch, error) {
+	name := manifest.RunID
+	if manifest.Source != "" {
+		name += "_" + manifest.Source
+	}
+	batch := &Batch{Dir: filepath.Join(s.Root, name), Manifest: manifest}
+	batch.CardPath = cardRoot
+	batch.Created = time.Now().UTC().Truncate(time.Second)
+	batch.Files = nil
+
+	for _, path := range files {
+		rel, err := filepath.Rel(cardRoot, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to quarantine %s: %w", path, err)
+		}
+		batch.Files = append(batch.Files, filepath.ToSlash(rel))
+	}
+	sort.Strings(batch.Files)
+
+	if dryRun {
+		for _, rel := range batch.Files {
+			log.Printf("[DRY RUN] Would quarantine %s in %s", rel, batch.Dir)
+		}
+		return batch, nil
+	}
+
+	if err := os.MkdirAll(batch.filesDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	// The manifest is written first so an interrupted move can still be restored
+	if err := batch.writeManifest(); err != nil {
+		return nil, err
+	}
+	for _, rel := range batch.Files {
+		src := filepath.Join(cardRoot, filepath.FromSlash(rel))
+		dst := filepath.Join(batch.filesDir(), filepath.FromSlash(rel))
+		if err := move(src, dst); err != nil {
+			return nil, fmt.Errorf("failed to quarantine %s: %w", rel, err)
+		}
+	}
+	return batch, nil
+}
+
+func (b *Batch) writeManifest() error {
+	data, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal quarantine manifest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(b.Dir, ManifestFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write quarantine manifest: %w", err)
+	}
+	return nil
+}
+
+// Batches returns the batches of the store, oldest first. A missing store has none.
+func (s *Store) Batches() ([]Batch, error) {
+	entries, err := os.ReadDir(s.Root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine: %w", err)
+	}
+
+	var batches []Batch
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s.Root, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quarantine manifest: %w", err)
+		}
+		batch := Batch{Dir: dir}
+		if err := json.Unmarshal(data, &batch.Manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse quarantine manifest %s: %w", dir, err)
+		}
+		batches = append(batches, batch)
+	}
+
+	sort.Slice(batches, func(i, j int) bool { return batches[i].Created.Before(batches[j].Created) })
+	return batches, nil
+}
+
+// Paths returns the current location of each quarantined file of b
+func (b Batch) Paths() []string {
+	paths := make([]string, 0, len(b.Files))
+	for _, rel := range b.Files {
+		paths = append(paths, filepath.Join(b.filesDir(), filepath.FromSlash(rel)))
+	}
+	return paths
+}
+
+// Restore moves the files of b back to the card mounted at cardRoot and removes the batch.
+// Files that already exist on the card are not overwritten. A cancelled ctx stops
+// between two files and keeps the batch, so a later restore picks up the rest.
+func (s *Store) Restore(ctx context.Context, b Batch, cardRoot string, dryRun bool) error {
+	var conflicts []string
+	for _, rel := range b.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src := filepath.Join(b.filesDir(), filepath.FromSlash(rel))
+		dst := filepath.Join(cardRoot, filepath.FromSlash(rel))
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			// Not moved yet when the quarantine was interrupted
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			conflicts = append(conflicts, rel)
+			continue
+		}
+		if dryRun {
+			log.Printf("[DRY RUN] Would restore %s", dst)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := move(src, dst); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", rel, err)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%d files already exist on the card and were left in %s", len(conflicts), b.Dir)
+	}
+	return s.Purge(b, dryRun)
+}
+
+// Purge deletes the batch and its files
+func (s *Store) Purge(b Batch, dryRun bool) error {
+	if dryRun {
+		log.Printf("[DRY RUN] Would purge quarantine batch: %s", b.Dir)
+		return nil
+	}
+	if err := os.RemoveAll(b.Dir); err != nil {
+		return fmt.Errorf("failed to purge quarantine batch: %w", err)
+	}
+	return nil
+}
+
+// move renames src to dst, copying across file systems
+func move(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	// Across file systems the copy is written to a temporary name and renamed,
+	// so that dst is either missing or complete
+	local := storage.Local{}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial-quarantine")
+	if err := copyTo(local, src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := local.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyTo copies src to the new file dst, synced to disk and with the time of src
+func copyTo(local storage.Local, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out, err := local.Create(dst, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,127 @@
+package quarantine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+}
+
+func TestMoveAndRestore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "quarantine-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cardRoot := filepath.Join(tmpDir, "card")
+	writeFiles(t, cardRoot, map[string]string{
+		"DCIM/02512310/DSC00001.JPG": "one",
+		"DCIM/02512310/DSC00002.JPG": "two",
+	})
+	files := []string{
+		filepath.Join(cardRoot, "DCIM", "02512310", "DSC00001.JPG"),
+		filepath.Join(cardRoot, "DCIM", "02512310", "DSC00002.JPG"),
+	}
+
+	store := Open(filepath.Join(tmpDir, "quarantine"))
+
+	// Dry run moves nothing
+	if _, err := store.Move(Manifest{RunID: "run1", Source: "main"}, cardRoot, files, true); err != nil {
+		t.Fatalf("Move with dry-run failed: %v", err)
+	}
+	if batches, _ := store.Batches(); len(batches) != 0 {
+		t.Fatal("Dry run should not create a batch")
+	}
+
+	batch, err := store.Move(Manifest{RunID: "run1", Source: "main", CardID: "abc"}, cardRoot, files, false)
+	if err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+	for _, path := range files {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should have been moved off the card", path)
+		}
+	}
+	for _, path := range batch.Paths() {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Quarantined file missing: %v", err)
+		}
+	}
+
+	batches, err := store.Batches()
+	if err != nil {
+		t.Fatalf("Batches failed: %v", err)
+	}
+	if len(batches) != 1 || batches[0].CardID != "abc" || len(batches[0].Files) != 2 || batches[0].Files[0] != "DCIM/02512310/DSC00001.JPG" {
+		t.Fatalf("Unexpected batches: %+v", batches)
+	}
+
+	// A file that reappeared on the card is not overwritten
+	writeFiles(t, cardRoot, map[string]string{"DCIM/02512310/DSC00002.JPG": "new two"})
+	if err := store.Restore(t.Context(), batches[0], cardRoot, false); err == nil {
+		t.Error("Expected error for a conflicting file")
+	}
+	data, _ := os.ReadFile(files[0])
+	if string(data) != "one" {
+		t.Errorf("Restored file has content %q", data)
+	}
+	data, _ = os.ReadFile(files[1])
+	if string(data) != "new two" {
+		t.Error("Existing file on the card must not be overwritten")
+	}
+	if batches, _ := store.Batches(); len(batches) != 1 {
+		t.Error("Batch with unrestored files must be kept")
+	}
+
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := store.Restore(t.Context(), batches[0], cardRoot, false); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	data, _ = os.ReadFile(files[1])
+	if string(data) != "two" {
+		t.Errorf("Restored file has content %q", data)
+	}
+	if batches, _ := store.Batches(); len(batches) != 0 {
+		t.Error("Restored batch should be removed")
+	}
+}
+
+func TestMoveLeavesNoPartialFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "card", "DSC00001.JPG")
+	writeFiles(t, tmpDir, map[string]string{
+		"card/DSC00001.JPG":         "photo",
+		"quarantine/DSC00001.JPG/x": "a directory in the way",
+	})
+
+	// The rename fails, and so does replacing the directory with the copy
+	dst := filepath.Join(tmpDir, "quarantine", "DSC00001.JPG")
+	if err := move(src, dst); err == nil {
+		t.Fatal("Expected move to fail")
+	}
+	if data, err := os.ReadFile(src); err != nil || string(data) != "photo" {
+		t.Errorf("Source must be kept after a failed move: %q, %v", data, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil {
+		t.Fatalf("Failed to read quarantine: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("No temporary file may be left behind, got %v", entries)
+	}
+}
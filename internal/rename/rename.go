@@ -2,17 +2,22 @@
 package rename
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 )
 
 const (
 	// ExpectedDirNameLength is the expected length of Sony camera directory names
 	ExpectedDirNameLength = 8 // Expected format: YYYMMDD (8 digits)
+
+	// DefaultTemplate is the folder naming template producing yyyy-mm-dd names
+	DefaultTemplate = "{yyyy}-{mm}-{dd}"
 )
 
 // IsValidDateDir checks if the directory name matches the expected Sony camera date format.
@@ -41,8 +46,52 @@ func ConvertDirName(name, currentCentury string) (string, error) {
 	return fmt.Sprintf("%s-%s-%s", year, month, day), nil
 }
 
+// ParseDirName returns the date encoded in a Sony camera directory name
+func ParseDirName(name, currentCentury string) (time.Time, error) {
+	converted, err := ConvertDirName(name, currentCentury)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := time.Parse("2006-01-02", converted)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date in directory name %s: %w", name, err)
+	}
+	return date, nil
+}
+
+// DirName returns the Sony camera directory name (0YYMMDD0) for a date
+func DirName(date time.Time) string {
+	return "0" + date.Format("060102") + "0"
+}
+
+// FormatName builds a folder name from a naming template.
+// Supported placeholders are {yyyy}, {yy}, {mm}, {dd} for the date and {key}
+// for every entry of vars (e.g. {body}).
+func FormatName(template string, date time.Time, vars map[string]string) string {
+	if template == "" {
+		template = DefaultTemplate
+	}
+
+	pairs := []string{
+		"{yyyy}", date.Format("2006"),
+		"{yy}", date.Format("06"),
+		"{mm}", date.Format("01"),
+		"{dd}", date.Format("02"),
+	}
+	for key, value := range vars {
+		pairs = append(pairs, "{"+key+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
 // Directories renames directories in the specified path from Sony camera format to yyyy-mm-dd format.
-func Directories(targetPath string) error {
+func Directories(ctx context.Context, targetPath string) error {
+	return DirectoriesWithTemplate(ctx, targetPath, DefaultTemplate, nil)
+}
+
+// DirectoriesWithTemplate renames directories in the specified path from Sony camera format
+// to names built with FormatName. A cancelled ctx stops it between two directories.
+func DirectoriesWithTemplate(ctx context.Context, targetPath, template string, vars map[string]string) error {
 	entries, err := os.ReadDir(targetPath)
 	if err != nil {
 		return fmt.Errorf("failed to read directory %s: %w", targetPath, err)
@@ -52,6 +101,9 @@ func Directories(targetPath string) error {
 	currentCentury := currentYear[:2] // First 2 digits (e.g., "20")
 
 	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if !entry.IsDir() {
 			continue
 		}
@@ -62,15 +114,21 @@ func Directories(targetPath string) error {
 			continue
 		}
 
-		newName, err := ConvertDirName(dirName, currentCentury)
+		date, err := ParseDirName(dirName, currentCentury)
 		if err != nil {
 			log.Printf("Error converting directory name %s: %v", dirName, err)
 			continue
 		}
+		newName := FormatName(template, date, vars)
 
 		oldPath := filepath.Join(targetPath, dirName)
 		newPath := filepath.Join(targetPath, newName)
 
+		// Templates such as {yyyy}/{mm}-{dd} nest the folder below new parents
+		if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+			log.Printf("Error creating parent directory of %s: %v", newPath, err)
+			continue
+		}
 		if err := os.Rename(oldPath, newPath); err != nil {
 			log.Printf("Error renaming %s to %s: %v", oldPath, newPath, err)
 			continue
@@ -1,9 +1,12 @@
 package rename
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestIsValidDateDir(t *testing.T) {
@@ -95,6 +98,44 @@ func TestConvertDirName(t *testing.T) {
 	}
 }
 
+func TestFormatName(t *testing.T) {
+	date := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		template string
+		vars     map[string]string
+		expected string
+	}{
+		{"default template", "", nil, "2025-12-31"},
+		{"compact", "{yyyy}{mm}{dd}", nil, "20251231"},
+		{"body suffix", "{yyyy}-{mm}-{dd}_{body}", map[string]string{"body": "a7iv"}, "2025-12-31_a7iv"},
+		{"nested by year", "{yyyy}/{yy}{mm}{dd}", nil, "2025/251231"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := FormatName(tt.template, date, tt.vars)
+			if result != tt.expected {
+				t.Errorf("FormatName(%q) = %q, want %q", tt.template, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDirName(t *testing.T) {
+	date := time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC)
+	name := DirName(date)
+	if name != "02512310" {
+		t.Errorf("DirName() = %q, want 02512310", name)
+	}
+
+	parsed, err := ParseDirName(name, "20")
+	if err != nil || !parsed.Equal(date) {
+		t.Errorf("ParseDirName(DirName()) = %v, %v", parsed, err)
+	}
+}
+
 func TestRenameDirectories(t *testing.T) {
 	// Create temporary directory for testing
 	tmpDir, err := os.MkdirTemp("", "rename-test-*")
@@ -125,7 +166,7 @@ func TestRenameDirectories(t *testing.T) {
 	}
 
 	// Run Directories
-	if err := Directories(tmpDir); err != nil {
+	if err := Directories(t.Context(), tmpDir); err != nil {
 		t.Fatalf("Directories failed: %v", err)
 	}
 
@@ -169,9 +210,49 @@ func TestRenameDirectories(t *testing.T) {
 	}
 }
 
+func TestRenameDirectoriesNestedTemplate(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"02512310", "02512300"} {
+		if err := os.Mkdir(filepath.Join(tmpDir, dir), 0755); err != nil {
+			t.Fatalf("Failed to create test directory %s: %v", dir, err)
+		}
+	}
+
+	if err := DirectoriesWithTemplate(t.Context(), tmpDir, "{yyyy}/{mm}-{dd}", nil); err != nil {
+		t.Fatalf("DirectoriesWithTemplate failed: %v", err)
+	}
+
+	for _, dir := range []string{"2025/12-31", "2025/12-30"} {
+		if _, err := os.Stat(filepath.Join(tmpDir, filepath.FromSlash(dir))); err != nil {
+			t.Errorf("Expected directory %s: %v", dir, err)
+		}
+	}
+	for _, dir := range []string{"02512310", "02512300"} {
+		if _, err := os.Stat(filepath.Join(tmpDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("Original directory %s should have been renamed", dir)
+		}
+	}
+}
+
 func TestRenameDirectoriesNonExistentPath(t *testing.T) {
-	err := Directories("/nonexistent/path")
+	err := Directories(t.Context(), "/nonexistent/path")
 	if err == nil {
 		t.Error("Expected error for non-existent path, got nil")
 	}
 }
+
+func TestRenameDirectoriesCancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmpDir, "02512310"), 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := Directories(ctx, tmpDir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "02512310")); err != nil {
+		t.Error("No directory should be renamed after cancellation")
+	}
+}
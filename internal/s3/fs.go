@@ -0,0 +1,346 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+const (
+	// DefaultPartSizeMB is the part size of multipart uploads when none is configured
+	DefaultPartSizeMB = 16
+	// MinPartSizeMB is the smallest part size accepted by S3 for all but the last part
+	MinPartSizeMB = 5
+)
+
+var errNotEmpty = errors.New("directory not empty")
+
+// FS stores files as objects of a bucket below Prefix, mapping the path
+// /2025-12-31/DSC00001.JPG to the key Prefix/2025-12-31/DSC00001.JPG.
+// Directories only exist through the keys of their files, so empty
+// directories are not kept. Files are written with Upload, which implements
+// storage.Uploader; their modification time and SHA-256 digest are kept as metadata.
+type FS struct {
+	Client *Client
+	// Prefix is prepended to every key, without leading or trailing slash
+	Prefix string
+	// PartSize is the size of the parts of multipart uploads
+	PartSize int64
+}
+
+// New returns the FS of the bucket described by cfg
+func New(cfg config.S3Config) (*FS, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+
+	client := &Client{
+		Endpoint:        endpoint,
+		Region:          cfg.Region,
+		Bucket:          cfg.Bucket,
+		AccessKeyID:     cfg.AccessKeyID,
+		SecretAccessKey: cfg.SecretAccessKey,
+	}
+	if client.Region == "" {
+		client.Region = "us-east-1"
+	}
+	if client.AccessKeyID == "" {
+		client.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if client.SecretAccessKey == "" {
+		client.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if client.AccessKeyID == "" || client.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 credentials are missing: set access_key_id and secret_access_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	partSize := cfg.PartSizeMB
+	if partSize == 0 {
+		partSize = DefaultPartSizeMB
+	}
+	if partSize < MinPartSizeMB {
+		return nil, fmt.Errorf("s3 part_size_mb must be at least %d", MinPartSizeMB)
+	}
+
+	return &FS{Client: client, Prefix: strings.Trim(cfg.Prefix, "/"), PartSize: int64(partSize) << 20}, nil
+}
+
+// String returns the s3:// URL of the bucket and prefix
+func (f *FS) String() string {
+	return "s3://" + path.Join(f.Client.Bucket, f.Prefix)
+}
+
+// key returns the object key of the path name
+func (f *FS) key(name string) string {
+	rel := strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+	if rel == "." {
+		rel = ""
+	}
+	return strings.Trim(path.Join(f.Prefix, rel), "/")
+}
+
+// dirPrefix returns the prefix shared by the keys below the directory key
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	key := f.key(name)
+	prefix := dirPrefix(key)
+	objects, dirs, err := f.Client.listObjects(context.Background(), prefix, "/", 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(objects) == 0 && len(dirs) == 0 && key != f.Prefix {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for _, obj := range objects {
+		if obj.Key == prefix {
+			// Directory placeholder created by other tools
+			continue
+		}
+		obj.ModTime = obj.LastModified
+		entries = append(entries, fs.FileInfoToDirEntry(fileInfo(obj)))
+	}
+	for _, dir := range dirs {
+		entries = append(entries, fs.FileInfoToDirEntry(dirInfo(strings.TrimSuffix(dir, "/"))))
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	key := f.key(name)
+	if key == f.Prefix {
+		return dirInfo(key), nil
+	}
+
+	obj, err := f.Client.headObject(context.Background(), key)
+	if err == nil {
+		return fileInfo(obj), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	objects, _, err := f.Client.listObjects(context.Background(), dirPrefix(key), "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(objects) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return dirInfo(key), nil
+}
+
+func (f *FS) Open(name string) (io.ReadCloser, error) {
+	body, err := f.Client.getObject(context.Background(), f.key(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return body, nil
+}
+
+// Create uploads the written content when the returned writer is closed.
+// It fails if name already exists.
+func (f *FS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if _, err := f.Client.headObject(context.Background(), f.key(name)); err == nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+
+	pr, pw := io.Pipe()
+	w := &uploadWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := f.Upload(context.Background(), name, pr, storage.FileMeta{ModTime: time.Now()})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// MkdirAll does nothing: directories exist through the keys of their files
+func (f *FS) MkdirAll(name string, perm fs.FileMode) error {
+	return nil
+}
+
+// Rename copies the objects of oldname to newname on the service, then deletes them
+func (f *FS) Rename(oldname, newname string) error {
+	ctx := context.Background()
+	oldKey, newKey := f.key(oldname), f.key(newname)
+	if _, err := f.Client.headObject(ctx, oldKey); err == nil {
+		if err := f.Client.copyObject(ctx, oldKey, newKey, nil); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		return f.Client.deleteObject(ctx, oldKey)
+	}
+
+	objects, _, err := f.Client.listObjects(ctx, dirPrefix(oldKey), "", 0)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if len(objects) == 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	for _, obj := range objects {
+		target := newKey + strings.TrimPrefix(obj.Key, oldKey)
+		if err := f.Client.copyObject(ctx, obj.Key, target, nil); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		if err := f.Client.deleteObject(ctx, obj.Key); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	ctx := context.Background()
+	key := f.key(name)
+	if _, err := f.Client.headObject(ctx, key); err == nil {
+		return f.Client.deleteObject(ctx, key)
+	}
+	objects, _, err := f.Client.listObjects(ctx, dirPrefix(key), "", 1)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if len(objects) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *FS) RemoveAll(name string) error {
+	ctx := context.Background()
+	key := f.key(name)
+	objects, _, err := f.Client.listObjects(ctx, dirPrefix(key), "", 0)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	for _, obj := range objects {
+		if err := f.Client.deleteObject(ctx, obj.Key); err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+	}
+	if key == f.Prefix {
+		return nil
+	}
+	if err := f.Client.deleteObject(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Chtimes rewrites the modification time kept in the metadata of name
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	ctx := context.Background()
+	key := f.key(name)
+	obj, err := f.Client.headObject(ctx, key)
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	meta := metaHeaders(storage.FileMeta{ModTime: mtime, SHA256: obj.SHA256})
+	if err := f.Client.copyObject(ctx, key, key, meta); err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Upload stores the content of r as name, replacing an existing object.
+// Every request carries the MD5 digest of its content, which the service verifies.
+func (f *FS) Upload(ctx context.Context, name string, r io.Reader, meta storage.FileMeta) error {
+	partSize := f.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSizeMB << 20
+	}
+	if err := f.Client.upload(ctx, f.key(name), r, partSize, metaHeaders(meta)); err != nil {
+		return &fs.PathError{Op: "upload", Path: name, Err: err}
+	}
+	return nil
+}
+
+// SHA256 returns the digest recorded when name was uploaded
+func (f *FS) SHA256(name string) (string, error) {
+	obj, err := f.Client.headObject(context.Background(), f.key(name))
+	if err != nil {
+		return "", &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return obj.SHA256, nil
+}
+
+// metaHeaders returns the metadata headers recording meta
+func metaHeaders(meta storage.FileMeta) http.Header {
+	header := http.Header{}
+	if !meta.ModTime.IsZero() {
+		header.Set(metaModTime, meta.ModTime.UTC().Format(time.RFC3339Nano))
+	}
+	if meta.SHA256 != "" {
+		header.Set(metaSHA256, meta.SHA256)
+	}
+	return header
+}
+
+// uploadWriter feeds the upload started by Create
+type uploadWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *uploadWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+func fileInfo(obj object) fs.FileInfo {
+	return objectInfo{name: path.Base(obj.Key), size: obj.Size, mode: 0644, modTime: obj.ModTime}
+}
+
+func dirInfo(key string) fs.FileInfo {
+	return objectInfo{name: path.Base("/" + key), mode: fs.ModeDir | 0755}
+}
+
+type objectInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i objectInfo) Name() string       { return i.name }
+func (i objectInfo) Size() int64        { return i.size }
+func (i objectInfo) Mode() fs.FileMode  { return i.mode }
+func (i objectInfo) ModTime() time.Time { return i.modTime }
+func (i objectInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i objectInfo) Sys() any           { return nil }
+
+// sortEntries orders directory entries by name
+func sortEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
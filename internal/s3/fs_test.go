@@ -0,0 +1,279 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/s3/s3test"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// newTestFS returns an FS on a stand-in server with 64-byte parts
+func newTestFS(t *testing.T) (*FS, *s3test.Server) {
+	t.Helper()
+	server := s3test.NewServer("archive", "test-key")
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL)
+	client := &Client{Endpoint: endpoint, Region: "us-east-1", Bucket: "archive", AccessKeyID: "test-key", SecretAccessKey: "secret"}
+	return &FS{Client: client, Prefix: "photos", PartSize: 64}, server
+}
+
+func upload(t *testing.T, fsys *FS, name, content string, meta storage.FileMeta) {
+	t.Helper()
+	if err := fsys.Upload(t.Context(), name, strings.NewReader(content), meta); err != nil {
+		t.Fatalf("Failed to upload %s: %v", name, err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	fsys, server := newTestFS(t)
+	mtime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+	upload(t, fsys, "/2025-12-31/DSC00001.JPG", "first", storage.FileMeta{ModTime: mtime, SHA256: "abc"})
+	upload(t, fsys, "/2025-12-31/DSC00002.JPG", "second", storage.FileMeta{ModTime: mtime})
+	upload(t, fsys, "/2026-01-01/DSC00003.JPG", "third", storage.FileMeta{ModTime: mtime})
+
+	if keys := server.Keys(); !reflect.DeepEqual(keys, []string{
+		"photos/2025-12-31/DSC00001.JPG", "photos/2025-12-31/DSC00002.JPG", "photos/2026-01-01/DSC00003.JPG",
+	}) {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	info, err := fsys.Stat("/2025-12-31/DSC00001.JPG")
+	if err != nil || info.Size() != 5 || info.IsDir() || !info.ModTime().Equal(mtime) {
+		t.Errorf("Unexpected file stat: %v, %v", info, err)
+	}
+	if info, err := fsys.Stat("/2025-12-31"); err != nil || !info.IsDir() {
+		t.Errorf("Prefix should be a directory: %v, %v", info, err)
+	}
+	if _, err := fsys.Stat("/2025-12-30"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if hash, err := fsys.SHA256("/2025-12-31/DSC00001.JPG"); err != nil || hash != "abc" {
+		t.Errorf("SHA256 = %q, %v", hash, err)
+	}
+
+	entries, err := fsys.ReadDir("/")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "2025-12-31" || !entries[0].IsDir() {
+		t.Errorf("Unexpected root entries: %v, %v", entries, err)
+	}
+	entries, err = fsys.ReadDir("/2025-12-31")
+	if err != nil || len(entries) != 2 || entries[1].Name() != "DSC00002.JPG" || entries[1].IsDir() {
+		t.Errorf("Unexpected folder entries: %v, %v", entries, err)
+	}
+
+	if data, err := storage.ReadFile(fsys, "/2025-12-31/DSC00002.JPG"); err != nil || string(data) != "second" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	if _, err := fsys.Create("/2025-12-31/DSC00001.JPG", 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create of an existing object should fail with fs.ErrExist, got %v", err)
+	}
+
+	later := mtime.Add(time.Hour)
+	if err := fsys.Chtimes("/2025-12-31/DSC00001.JPG", later, later); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if info, _ := fsys.Stat("/2025-12-31/DSC00001.JPG"); !info.ModTime().Equal(later) {
+		t.Errorf("ModTime = %v, want %v", info.ModTime(), later)
+	}
+	if hash, _ := fsys.SHA256("/2025-12-31/DSC00001.JPG"); hash != "abc" {
+		t.Errorf("Chtimes should keep the digest, got %q", hash)
+	}
+
+	if err := fsys.Rename("/2026-01-01", "/2026-01-02"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, ok := server.Object("photos/2026-01-02/DSC00003.JPG"); !ok {
+		t.Errorf("Renamed object missing: %v", server.Keys())
+	}
+	if err := fsys.Remove("/2025-12-31"); err == nil {
+		t.Error("Remove of a non-empty directory should fail")
+	}
+	if err := fsys.RemoveAll("/2025-12-31"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if keys := server.Keys(); !reflect.DeepEqual(keys, []string{"photos/2026-01-02/DSC00003.JPG"}) {
+		t.Errorf("Unexpected keys after RemoveAll: %v", keys)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	fsys, server := newTestFS(t)
+	w, err := fsys.Create("/catalog.json", 0644)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	content := bytes.Repeat([]byte("0123456789"), 20)
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if obj, ok := server.Object("photos/catalog.json"); !ok || !bytes.Equal(obj.Data, content) {
+		t.Errorf("Unexpected object: %v", ok)
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		etag  string
+		parts int
+	}{
+		{"single request", 63, "", 0},
+		{"exact parts", 128, "-2", 2},
+		{"short last part", 200, "-4", 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, server := newTestFS(t)
+			server.MinPartSize = 64
+			var mu sync.Mutex
+			parts := 0
+			server.Fault = func(r *http.Request) error {
+				if r.URL.Query().Has("partNumber") {
+					mu.Lock()
+					parts++
+					mu.Unlock()
+				}
+				return nil
+			}
+
+			content := bytes.Repeat([]byte("x"), tt.size)
+			if err := fsys.Upload(t.Context(), "/2025-12-31/C0001.MP4", bytes.NewReader(content), storage.FileMeta{SHA256: "abc"}); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			obj, ok := server.Object("photos/2025-12-31/C0001.MP4")
+			if !ok || !bytes.Equal(obj.Data, content) {
+				t.Fatalf("Uploaded object differs")
+			}
+			if tt.etag != "" && !strings.HasSuffix(strings.Trim(obj.ETag, `"`), tt.etag) {
+				t.Errorf("ETag = %s, want suffix %s", obj.ETag, tt.etag)
+			}
+			if parts != tt.parts {
+				t.Errorf("Uploaded %d parts, want %d", parts, tt.parts)
+			}
+			if obj.Meta.Get("X-Amz-Meta-Sha256") != "abc" {
+				t.Errorf("Digest metadata missing: %v", obj.Meta)
+			}
+		})
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	fsys, server := newTestFS(t)
+	sent := map[string]int{}
+	failPart := "3"
+	server.Fault = func(r *http.Request) error {
+		part := r.URL.Query().Get("partNumber")
+		if part == "" {
+			return nil
+		}
+		sent[part]++
+		if part == failPart {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16)
+	name := "/2025-12-31/C0001.MP4"
+	if err := fsys.Upload(t.Context(), name, bytes.NewReader(content), storage.FileMeta{SHA256: "abc"}); err == nil {
+		t.Fatal("Upload should fail when a part fails")
+	}
+	if server.Uploads() != 1 {
+		t.Fatalf("The failed upload should be kept for resuming, got %d uploads", server.Uploads())
+	}
+
+	failPart = ""
+	if err := fsys.Upload(t.Context(), name, bytes.NewReader(content), storage.FileMeta{SHA256: "def"}); err != nil {
+		t.Fatalf("Resumed upload failed: %v", err)
+	}
+	if sent["1"] != 1 || sent["2"] != 1 || sent["3"] != 2 || sent["4"] != 1 {
+		t.Errorf("Stored parts should not be sent again: %v", sent)
+	}
+	obj, ok := server.Object("photos/2025-12-31/C0001.MP4")
+	if !ok || !bytes.Equal(obj.Data, content) || server.Uploads() != 0 {
+		t.Fatalf("Resumed upload did not complete")
+	}
+	if obj.Meta.Get("X-Amz-Meta-Sha256") != "def" {
+		t.Errorf("Resumed upload should carry the new metadata, got %v", obj.Meta)
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	fsys, server := newTestFS(t)
+	// A proxy that corrupts the body is caught by the Content-MD5 check
+	server.Config.Handler = corrupt(server.Config.Handler)
+
+	err := fsys.Upload(t.Context(), "/DSC00001.JPG", strings.NewReader("photo"), storage.FileMeta{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != "BadDigest" {
+		t.Errorf("Expected BadDigest, got %v", err)
+	}
+	if _, ok := server.Object("photos/DSC00001.JPG"); ok {
+		t.Error("Corrupted upload should not be stored")
+	}
+}
+
+// corrupt flips the first byte of every request body and fixes the payload digest,
+// as a faulty network path that recomputes it would
+func corrupt(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestNew(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	valid := config.S3Config{Endpoint: "https://s3.example.com", Bucket: "archive", Prefix: "/photos/", AccessKeyID: "key", SecretAccessKey: "secret"}
+
+	tests := []struct {
+		name    string
+		modify  func(c *config.S3Config)
+		wantErr bool
+	}{
+		{"valid", func(c *config.S3Config) {}, false},
+		{"missing bucket", func(c *config.S3Config) { c.Bucket = "" }, true},
+		{"invalid endpoint", func(c *config.S3Config) { c.Endpoint = "s3.example.com" }, true},
+		{"missing credentials", func(c *config.S3Config) { c.SecretAccessKey = "" }, true},
+		{"part size too small", func(c *config.S3Config) { c.PartSizeMB = 4 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			fsys, err := New(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (fsys.Prefix != "photos" || fsys.PartSize != DefaultPartSizeMB<<20 || fsys.Client.Region != "us-east-1") {
+				t.Errorf("Unexpected defaults: %+v", fsys)
+			}
+		})
+	}
+}
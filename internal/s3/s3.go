@@ -0,0 +1,252 @@
+// Package s3 stores files in an S3-compatible bucket (AWS, MinIO, Ceph, Wasabi).
+// It signs requests itself, so it needs no SDK.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now is replaced in tests
+var now = time.Now
+
+// Client sends signed requests to one bucket addressed path-style (endpoint/bucket/key)
+type Client struct {
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	HTTP            *http.Client
+}
+
+// Error is an error response of the service
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// Is reports missing keys and uploads as fs.ErrNotExist
+func (e *Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// object is the metadata of a stored object
+type object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+	// ModTime and SHA256 come from the metadata written by Upload
+	ModTime time.Time `xml:"-"`
+	SHA256  string    `xml:"-"`
+}
+
+// Metadata headers written with every object
+const (
+	metaModTime = "X-Amz-Meta-Mtime"
+	metaSHA256  = "X-Amz-Meta-Sha256"
+)
+
+// do sends a signed request for key with body and returns the response of a 2xx status.
+// Other statuses are returned as *Error.
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *c.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := emptyHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	c.sign(req, payloadHash, now())
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		xml.Unmarshal(data, apiErr)
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// doXML sends a request and decodes the XML response into result
+func (c *Client) doXML(ctx context.Context, method, key string, query url.Values, body []byte, result any) error {
+	resp, err := c.do(ctx, method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", method, err)
+	}
+	return nil
+}
+
+// contentMD5 returns the headers asking the service to verify the MD5 digest of data
+func contentMD5(data []byte, header http.Header) (http.Header, string) {
+	sum := md5.Sum(data)
+	if header == nil {
+		header = http.Header{}
+	} else {
+		header = header.Clone()
+	}
+	header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	return header, hex.EncodeToString(sum[:])
+}
+
+// headObject returns the metadata of key
+func (c *Client) headObject(ctx context.Context, key string) (object, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return object{}, err
+	}
+	resp.Body.Close()
+
+	obj := object{Key: key, Size: resp.ContentLength, ETag: resp.Header.Get("ETag"), SHA256: resp.Header.Get(metaSHA256)}
+	obj.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	obj.ModTime = obj.LastModified
+	if mtime, err := time.Parse(time.RFC3339Nano, resp.Header.Get(metaModTime)); err == nil {
+		obj.ModTime = mtime
+	}
+	return obj, nil
+}
+
+// getObject returns the content of key
+func (c *Client) getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// putObject stores data as key and checks the digest the service computed
+func (c *Client) putObject(ctx context.Context, key string, data []byte, meta http.Header) error {
+	header, sum := contentMD5(data, meta)
+	resp, err := c.do(ctx, http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if etag := strings.Trim(resp.Header.Get("ETag"), `"`); etag != sum {
+		return fmt.Errorf("s3: checksum mismatch for %s: sent MD5 %s, stored %s", key, sum, etag)
+	}
+	return nil
+}
+
+// copyObject copies src to dst on the service. With meta set the metadata is replaced.
+func (c *Client) copyObject(ctx context.Context, src, dst string, meta http.Header) error {
+	header := http.Header{}
+	for name, values := range meta {
+		header[name] = values
+	}
+	header.Set("X-Amz-Copy-Source", escapePath("/"+c.Bucket+"/"+src))
+	if meta != nil {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	resp, err := c.do(ctx, http.MethodPut, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A copy can fail after the 200 status was sent; the body then holds an error
+	data, _ := io.ReadAll(resp.Body)
+	var apiErr Error
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		apiErr.StatusCode = resp.StatusCode
+		return &apiErr
+	}
+	return nil
+}
+
+// deleteObject removes key
+func (c *Client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents              []object `xml:"Contents"`
+	CommonPrefixes        []string `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// listObjects returns the objects below prefix and, with a delimiter, the common prefixes
+// of the keys grouped by it. A positive limit stops after that many objects.
+func (c *Client) listObjects(ctx context.Context, prefix, delimiter string, limit int) ([]object, []string, error) {
+	var objects []object
+	var prefixes []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if limit > 0 {
+		query.Set("max-keys", strconv.Itoa(limit))
+	}
+	for {
+		var page listBucketResult
+		if err := c.doXML(ctx, http.MethodGet, "", query, nil, &page); err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, page.Contents...)
+		prefixes = append(prefixes, page.CommonPrefixes...)
+		if !page.IsTruncated || page.NextContinuationToken == "" || (limit > 0 && len(objects) >= limit) {
+			return objects, prefixes, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
@@ -0,0 +1,449 @@
+// Package s3test provides an in-process stand-in for an S3-compatible service.
+// It implements the object, listing, copy and multipart requests used by package s3
+// with path-style addressing, and verifies the payload and MD5 digests it receives.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is a stored object
+type Object struct {
+	Data         []byte
+	ETag         string
+	Meta         http.Header
+	LastModified time.Time
+}
+
+type upload struct {
+	key   string
+	meta  http.Header
+	parts map[int][]byte
+	start time.Time
+}
+
+// Server is a single-bucket S3 service
+type Server struct {
+	*httptest.Server
+	Bucket      string
+	AccessKeyID string
+	// MinPartSize is the smallest size accepted for all but the last part of an upload
+	MinPartSize int
+	// Fault, when set, is called before every request; a non-nil error fails it with a 500 status
+	Fault func(r *http.Request) error
+
+	mu      sync.Mutex
+	objects map[string]*Object
+	uploads map[string]*upload
+	nextID  int
+}
+
+// NewServer starts a service holding an empty bucket that accepts requests signed by accessKeyID
+func NewServer(bucket, accessKeyID string) *Server {
+	s := &Server{
+		Bucket:      bucket,
+		AccessKeyID: accessKeyID,
+		objects:     make(map[string]*Object),
+		uploads:     make(map[string]*upload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Object returns the object stored as key
+func (s *Server) Object(key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[key]
+	if !ok {
+		return Object{}, false
+	}
+	return *obj, true
+}
+
+// PutObject stores data as key
+func (s *Server) PutObject(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = newObject(data, http.Header{})
+}
+
+// Keys returns the stored keys in order
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedKeys("")
+}
+
+// Uploads returns the number of unfinished multipart uploads
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func newObject(data []byte, meta http.Header) *Object {
+	sum := md5.Sum(data)
+	return &Object{Data: data, ETag: `"` + hex.EncodeToString(sum[:]) + `"`, Meta: meta, LastModified: time.Now().UTC()}
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.Fault != nil {
+		if err := s.Fault(r); err != nil {
+			writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "missing or unknown credentials")
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload digest does not match")
+		return
+	}
+	if digest := r.Header.Get("Content-Md5"); digest != "" {
+		sum := md5.Sum(body)
+		if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "BadDigest", "Content-MD5 does not match")
+			return
+		}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Has("uploads"):
+		s.listUploads(w, query)
+	case key == "" && r.Method == http.MethodGet:
+		s.listObjects(w, query)
+	case r.Method == http.MethodHead || (r.Method == http.MethodGet && !query.Has("uploadId")):
+		s.getObject(w, r, key)
+	case r.Method == http.MethodGet:
+		s.listParts(w, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, query, body)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copyObject(w, r, key)
+	case r.Method == http.MethodPut:
+		s.objects[key] = newObject(body, metadata(r.Header))
+		w.Header().Set("ETag", s.objects[key].ETag)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[id] = &upload{key: key, meta: metadata(r.Header), parts: map[int][]byte{}, start: time.Now().UTC()}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string   `xml:"Bucket"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Bucket: s.Bucket, Key: key, UploadID: id})
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.String())
+	}
+}
+
+// metadata returns the user metadata headers of a request
+func metadata(header http.Header) http.Header {
+	meta := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := s.objects[key]
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey", key)
+		return
+	}
+	for name, values := range obj.Meta {
+		w.Header()[name] = values
+	}
+	w.Header().Set("ETag", obj.ETag)
+	w.Header().Set("Last-Modified", obj.LastModified.Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+	if r.Method == http.MethodGet {
+		w.Write(obj.Data)
+	}
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	bucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	src, ok := s.objects[srcKey]
+	if bucket != s.Bucket || !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", source)
+		return
+	}
+
+	meta := src.Meta
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		meta = metadata(r.Header)
+	}
+	obj := &Object{Data: src.Data, ETag: src.ETag, Meta: meta, LastModified: time.Now().UTC()}
+	s.objects[key] = obj
+	writeXML(w, struct {
+		XMLName      xml.Name  `xml:"CopyObjectResult"`
+		ETag         string    `xml:"ETag"`
+		LastModified time.Time `xml:"LastModified"`
+	}{ETag: obj.ETag, LastModified: obj.LastModified})
+}
+
+type contents struct {
+	Key          string    `xml:"Key"`
+	Size         int       `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// sortedKeys returns the keys starting with prefix in order
+func (s *Server) sortedKeys(prefix string) []string {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := 1000
+	if value := query.Get("max-keys"); value != "" {
+		maxKeys, _ = strconv.Atoi(value)
+	}
+	after := query.Get("continuation-token")
+
+	var result struct {
+		XMLName               xml.Name   `xml:"ListBucketResult"`
+		Name                  string     `xml:"Name"`
+		Prefix                string     `xml:"Prefix"`
+		KeyCount              int        `xml:"KeyCount"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		Contents              []contents `xml:"Contents"`
+		CommonPrefixes        []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+	}
+	result.Name, result.Prefix = s.Bucket, prefix
+
+	seen := map[string]bool{}
+	for _, key := range s.sortedKeys(prefix) {
+		// A token ending with the delimiter is a common prefix already returned
+		if key <= after || (delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after)) {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, struct {
+						Prefix string `xml:"Prefix"`
+					}{common})
+					result.KeyCount++
+					result.NextContinuationToken = common
+				}
+				continue
+			}
+		}
+		obj := s.objects[key]
+		result.Contents = append(result.Contents, contents{Key: key, Size: len(obj.Data), ETag: obj.ETag, LastModified: obj.LastModified})
+		result.KeyCount++
+		result.NextContinuationToken = key
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+	writeXML(w, result)
+}
+
+func (s *Server) listUploads(w http.ResponseWriter, query url.Values) {
+	type entry struct {
+		Key       string    `xml:"Key"`
+		UploadID  string    `xml:"UploadId"`
+		Initiated time.Time `xml:"Initiated"`
+	}
+	var result struct {
+		XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket  string   `xml:"Bucket"`
+		Uploads []entry  `xml:"Upload"`
+	}
+	result.Bucket = s.Bucket
+	for id, up := range s.uploads {
+		if strings.HasPrefix(up.key, query.Get("prefix")) {
+			result.Uploads = append(result.Uploads, entry{Key: up.key, UploadID: id, Initiated: up.start})
+		}
+	}
+	sort.Slice(result.Uploads, func(i, j int) bool {
+		a, b := result.Uploads[i], result.Uploads[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Initiated.Before(b.Initiated) || (a.Initiated.Equal(b.Initiated) && a.UploadID < b.UploadID)
+	})
+	writeXML(w, result)
+}
+
+func (s *Server) listParts(w http.ResponseWriter, key, id string) {
+	up, ok := s.uploads[id]
+	if !ok || up.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+		Size       int    `xml:"Size"`
+	}
+	var result struct {
+		XMLName xml.Name `xml:"ListPartsResult"`
+		Parts   []part   `xml:"Part"`
+	}
+	for number, data := range up.parts {
+		sum := md5.Sum(data)
+		result.Parts = append(result.Parts, part{PartNumber: number, ETag: `"` + hex.EncodeToString(sum[:]) + `"`, Size: len(data)})
+	}
+	sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+	writeXML(w, result)
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, query url.Values, body []byte) {
+	up, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", query.Get("uploadId"))
+		return
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	up.parts[number] = body
+	sum := md5.Sum(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, key, id string, body []byte) {
+	up, ok := s.uploads[id]
+	if !ok || up.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "invalid part list")
+		return
+	}
+
+	var data, digests bytes.Buffer
+	for i, part := range request.Parts {
+		content, ok := up.parts[part.PartNumber]
+		sum := md5.Sum(content)
+		if !ok || strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d", part.PartNumber))
+			return
+		}
+		if i < len(request.Parts)-1 && len(content) < s.MinPartSize {
+			writeError(w, http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("part %d", part.PartNumber))
+			return
+		}
+		data.Write(content)
+		digests.Write(sum[:])
+	}
+
+	sum := md5.Sum(digests.Bytes())
+	obj := &Object{
+		Data:         data.Bytes(),
+		ETag:         fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(request.Parts)),
+		Meta:         up.meta,
+		LastModified: time.Now().UTC(),
+	}
+	s.objects[key] = obj
+	delete(s.uploads, id)
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: s.Bucket, Key: key, ETag: obj.ETag})
+}
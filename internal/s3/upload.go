@@ -0,0 +1,241 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type uploadedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size"`
+}
+
+type multipartUpload struct {
+	Key       string    `xml:"Key"`
+	UploadID  string    `xml:"UploadId"`
+	Initiated time.Time `xml:"Initiated"`
+}
+
+// createMultipartUpload starts a multipart upload of key with the metadata headers meta
+func (c *Client) createMultipartUpload(ctx context.Context, key string, meta http.Header) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, meta, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode multipart upload: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart stores one part and checks the digest the service computed
+func (c *Client) uploadPart(ctx context.Context, key, uploadID string, number int, data []byte) (string, error) {
+	header, sum := contentMD5(data, nil)
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := c.do(ctx, http.MethodPut, key, query, header, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if etag := strings.Trim(resp.Header.Get("ETag"), `"`); etag != sum {
+		return "", fmt.Errorf("s3: checksum mismatch for part %d of %s: sent MD5 %s, stored %s", number, key, sum, etag)
+	}
+	return sum, nil
+}
+
+// completeMultipartUpload assembles the parts and returns the ETag of the object
+func (c *Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		ETag string `xml:"ETag"`
+		Code string `xml:"Code"`
+	}
+	if err := c.doXML(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, &result); err != nil {
+		return "", err
+	}
+	// Like a copy, completion can fail after the 200 status was sent
+	if result.Code != "" {
+		return "", &Error{StatusCode: http.StatusOK, Code: result.Code}
+	}
+	return strings.Trim(result.ETag, `"`), nil
+}
+
+// listMultipartUploads returns the unfinished uploads of key, oldest first
+func (c *Client) listMultipartUploads(ctx context.Context, key string) ([]multipartUpload, error) {
+	var result struct {
+		Uploads []multipartUpload `xml:"Upload"`
+	}
+	if err := c.doXML(ctx, http.MethodGet, "", url.Values{"uploads": {""}, "prefix": {key}}, nil, &result); err != nil {
+		return nil, err
+	}
+	var uploads []multipartUpload
+	for _, upload := range result.Uploads {
+		if upload.Key == key {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
+
+// listParts returns the parts already stored for an upload
+func (c *Client) listParts(ctx context.Context, key, uploadID string) (map[int]uploadedPart, error) {
+	parts := make(map[int]uploadedPart)
+	query := url.Values{"uploadId": {uploadID}}
+	for {
+		var page struct {
+			Parts                []uploadedPart `xml:"Part"`
+			IsTruncated          bool           `xml:"IsTruncated"`
+			NextPartNumberMarker string         `xml:"NextPartNumberMarker"`
+		}
+		if err := c.doXML(ctx, http.MethodGet, key, query, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			part.ETag = strings.Trim(part.ETag, `"`)
+			parts[part.PartNumber] = part
+		}
+		if !page.IsTruncated || page.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		query.Set("part-number-marker", page.NextPartNumberMarker)
+	}
+}
+
+// upload stores the content of r as key. Content that fits in one part is sent with a
+// single request; larger content uses a multipart upload, which resumes an unfinished
+// upload of the same key by skipping the parts already stored with the same MD5 digest.
+// A failed multipart upload is left on the service so the next attempt can resume it.
+func (c *Client) upload(ctx context.Context, key string, r io.Reader, partSize int64, meta http.Header) error {
+	data, err := readPart(r, partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) < partSize {
+		return c.putObject(ctx, key, data, meta)
+	}
+
+	uploadID, stored, err := c.resumeUpload(ctx, key, meta)
+	if err != nil {
+		return err
+	}
+
+	var parts []completedPart
+	var digests []byte
+	for number := 1; ; number++ {
+		sum := md5.Sum(data)
+		etag := hex.EncodeToString(sum[:])
+		if part, ok := stored[number]; !ok || part.ETag != etag || part.Size != int64(len(data)) {
+			if _, err := c.uploadPart(ctx, key, uploadID, number, data); err != nil {
+				return fmt.Errorf("failed to upload part %d of %s: %w", number, key, err)
+			}
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: `"` + etag + `"`})
+		digests = append(digests, sum[:]...)
+
+		if int64(len(data)) < partSize {
+			break
+		}
+		if data, err = readPart(r, partSize); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	etag, err := c.completeMultipartUpload(ctx, key, uploadID, parts)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+
+	// The ETag of a multipart object is the MD5 digest of the part digests
+	sum := md5.Sum(digests)
+	if expected := fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(parts)); etag != expected {
+		c.deleteObject(ctx, key)
+		return fmt.Errorf("s3: checksum mismatch for %s: expected ETag %s, stored %s", key, expected, etag)
+	}
+
+	// A resumed upload keeps the metadata it was started with
+	if stored != nil {
+		obj, err := c.headObject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if obj.SHA256 != meta.Get(metaSHA256) || !obj.ModTime.Equal(parseModTime(meta)) {
+			return c.copyObject(ctx, key, key, meta)
+		}
+	}
+	return nil
+}
+
+// resumeUpload returns the most recent unfinished upload of key with its stored parts,
+// or starts a new upload
+func (c *Client) resumeUpload(ctx context.Context, key string, meta http.Header) (string, map[int]uploadedPart, error) {
+	uploads, err := c.listMultipartUploads(ctx, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list unfinished uploads: %w", err)
+	}
+	if len(uploads) > 0 {
+		latest := uploads[len(uploads)-1]
+		parts, err := c.listParts(ctx, key, latest.UploadID)
+		if err == nil {
+			log.Printf("Resuming upload of %s (%d parts already stored)", key, len(parts))
+			return latest.UploadID, parts, nil
+		}
+		// The upload may have been completed or aborted meanwhile
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+	}
+
+	uploadID, err := c.createMultipartUpload(ctx, key, meta)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+	return uploadID, nil, nil
+}
+
+// readPart reads up to size bytes; a short result means r is exhausted
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload content: %w", err)
+	}
+	return data, nil
+}
+
+// parseModTime returns the modification time in the metadata headers meta
+func parseModTime(meta http.Header) time.Time {
+	mtime, _ := time.Parse(time.RFC3339Nano, meta.Get(metaModTime))
+	return mtime
+}
@@ -0,0 +1,313 @@
+// Package sftp stores files in a directory of an SSH server over SFTP.
+package sftp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+// dialTimeout bounds the connection and the SSH handshake
+const dialTimeout = 30 * time.Second
+
+// FS stores files below Root on the server, mapping the path /2025-12-31/DSC00001.JPG
+// to Root/2025-12-31/DSC00001.JPG. Files written with Create are read back when
+// closed and checked against the size and SHA-256 digest of the written content,
+// which SHA256 then reports without reading them again.
+type FS struct {
+	Root string
+
+	name   string
+	conn   *ssh.Client
+	client *sftp.Client
+
+	mu sync.Mutex
+	// verified maps the remote paths written in this session to their digests
+	verified map[string]string
+}
+
+// Dial connects to the server described by cfg, authenticating with its key
+// and verifying the server key against known_hosts
+func Dial(cfg config.SFTPConfig) (*FS, error) {
+	if cfg.Host == "" || cfg.User == "" || cfg.Path == "" {
+		return nil, fmt.Errorf("sftp host, user and path are required")
+	}
+	homeDir, _ := os.UserHomeDir()
+	keyFile := cfg.KeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(homeDir, ".ssh", "id_ed25519")
+	}
+	knownHostsFile := cfg.KnownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sftp key: %w", err)
+	}
+	var signer ssh.Signer
+	if cfg.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(cfg.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sftp key %s: %w", keyFile, err)
+	}
+
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	addr := cfg.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         dialTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp on %s: %w", addr, err)
+	}
+	return &FS{Root: cfg.Path, name: fmt.Sprintf("sftp://%s@%s%s", cfg.User, addr, path.Clean("/"+cfg.Path)), conn: conn, client: client}, nil
+}
+
+// Close ends the session
+func (f *FS) Close() error {
+	f.client.Close()
+	return f.conn.Close()
+}
+
+// SHA256 returns the digest of name when it was written and verified in this session, or ""
+func (f *FS) SHA256(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.verified[f.remote(name)], nil
+}
+
+// forget drops the digests of remote and the files below it
+func (f *FS) forget(remote string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for name := range f.verified {
+		if name == remote || strings.HasPrefix(name, remote+"/") {
+			delete(f.verified, name)
+		}
+	}
+}
+
+// String returns the sftp:// URL of Root
+func (f *FS) String() string {
+	return f.name
+}
+
+// remote returns the server path of name
+func (f *FS) remote(name string) string {
+	return path.Join(f.Root, filepath.ToSlash(filepath.Clean(name)))
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := f.client.ReadDir(f.remote(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	info, err := f.client.Stat(f.remote(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (f *FS) Open(name string) (io.ReadCloser, error) {
+	file, err := f.client.Open(f.remote(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+// Create creates name exclusively. Close verifies the stored content.
+func (f *FS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	remote := f.remote(name)
+	file, err := f.client.OpenFile(remote, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// Servers report an existing file as a generic failure
+		if _, statErr := f.client.Stat(remote); statErr == nil {
+			err = fs.ErrExist
+		}
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		f.client.Remove(remote)
+		return nil, &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return &verifiedFile{fs: f, name: name, file: file, hash: sha256.New()}, nil
+}
+
+func (f *FS) MkdirAll(name string, perm fs.FileMode) error {
+	if err := f.client.MkdirAll(f.remote(name)); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Rename replaces newname atomically with the posix-rename extension when the server
+// supports it, otherwise it falls back to removing newname first
+func (f *FS) Rename(oldname, newname string) error {
+	oldRemote, newRemote := f.remote(oldname), f.remote(newname)
+	err := f.client.PosixRename(oldRemote, newRemote)
+	var status *sftp.StatusError
+	if errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		if _, statErr := f.client.Stat(newRemote); statErr == nil {
+			f.client.Remove(newRemote)
+		}
+		err = f.client.Rename(oldRemote, newRemote)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	f.forget(newRemote)
+	f.mu.Lock()
+	for name, digest := range f.verified {
+		if name == oldRemote || strings.HasPrefix(name, oldRemote+"/") {
+			delete(f.verified, name)
+			f.verified[newRemote+strings.TrimPrefix(name, oldRemote)] = digest
+		}
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	if err := f.client.Remove(f.remote(name)); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	f.forget(f.remote(name))
+	return nil
+}
+
+func (f *FS) RemoveAll(name string) error {
+	remote := f.remote(name)
+	if _, err := f.client.Lstat(remote); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err := f.client.RemoveAll(remote); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	f.forget(remote)
+	return nil
+}
+
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	if err := f.client.Chtimes(f.remote(name), atime, mtime); err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+// verify checks that the stored file name has the given size and SHA-256 digest
+func (f *FS) verify(name string, size int64, digest string) error {
+	info, err := f.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return fmt.Errorf("remote copy of %s has %d bytes, %d were written", name, info.Size(), size)
+	}
+
+	file, err := f.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stored, err := checksum.Reader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", name, err)
+	}
+	if stored != digest {
+		return fmt.Errorf("remote copy of %s differs from the written content", name)
+	}
+	return nil
+}
+
+// verifiedFile hashes the written content and verifies the stored copy on Close
+type verifiedFile struct {
+	fs   *FS
+	name string
+	file *sftp.File
+	hash hash.Hash
+	size int64
+}
+
+func (w *verifiedFile) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// ReadFrom lets io.Copy use the concurrent writes of the SFTP client
+func (w *verifiedFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := w.file.ReadFrom(io.TeeReader(r, w.hash))
+	w.size += n
+	return n, err
+}
+
+func (w *verifiedFile) Close() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(w.hash.Sum(nil))
+	if err := w.fs.verify(w.name, w.size, digest); err != nil {
+		return err
+	}
+
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	if w.fs.verified == nil {
+		w.fs.verified = make(map[string]string)
+	}
+	w.fs.verified[w.fs.remote(w.name)] = digest
+	return nil
+}
@@ -0,0 +1,180 @@
+package sftp
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/sftp/sftptest"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// newTestServer starts a server authorizing a new key and returns a configuration to reach it
+func newTestServer(t *testing.T) (config.SFTPConfig, *sftptest.Server) {
+	t.Helper()
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	public, err := sftptest.GenerateKey(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	server, err := sftptest.NewServer(public)
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(server.KnownHostsLine()+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	root := filepath.Join(dir, "nas")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	return config.SFTPConfig{Host: server.Addr, User: "photos", KeyFile: keyFile, KnownHosts: knownHosts, Path: filepath.ToSlash(root)}, server
+}
+
+func writeFile(t *testing.T, fsys storage.FS, name, content string) error {
+	t.Helper()
+	f, err := fsys.Create(name, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func TestFS(t *testing.T) {
+	cfg, _ := newTestServer(t)
+	fsys, err := Dial(cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer fsys.Close()
+
+	if err := fsys.MkdirAll("/2025-12-31", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := writeFile(t, fsys, "/2025-12-31/.DSC00001.JPG.partial-1", "photo"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := fsys.Rename("/2025-12-31/.DSC00001.JPG.partial-1", "/2025-12-31/DSC00001.JPG"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(cfg.Path, "2025-12-31", "DSC00001.JPG")); err != nil || string(data) != "photo" {
+		t.Errorf("Remote file = %q, %v", data, err)
+	}
+
+	// Rename replaces an existing file, as a local rename does
+	if err := writeFile(t, fsys, "/2025-12-31/.DSC00001.JPG.partial-2", "edited"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := fsys.Rename("/2025-12-31/.DSC00001.JPG.partial-2", "/2025-12-31/DSC00001.JPG"); err != nil {
+		t.Fatalf("Rename over an existing file failed: %v", err)
+	}
+	if data, err := storage.ReadFile(fsys, "/2025-12-31/DSC00001.JPG"); err != nil || string(data) != "edited" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	// The digest verified on write follows the file through the rename
+	if hash, err := fsys.SHA256("/2025-12-31/DSC00001.JPG"); err != nil || hash != sha256Hex("edited") {
+		t.Errorf("SHA256 = %q, %v", hash, err)
+	}
+
+	if err := writeFile(t, fsys, "/2025-12-31/DSC00001.JPG", "again"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create of an existing file should fail with fs.ErrExist, got %v", err)
+	}
+	if _, err := fsys.Stat("/2025-12-30"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+
+	mtime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+	if err := fsys.Chtimes("/2025-12-31/DSC00001.JPG", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if info, err := fsys.Stat("/2025-12-31/DSC00001.JPG"); err != nil || !info.ModTime().Equal(mtime) || info.Size() != 6 {
+		t.Errorf("Unexpected stat: %v, %v", info, err)
+	}
+
+	entries, err := fsys.ReadDir("/")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "2025-12-31" || !entries[0].IsDir() {
+		t.Errorf("Unexpected entries: %v, %v", entries, err)
+	}
+	if err := fsys.RemoveAll("/2025-12-31"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if hash, _ := fsys.SHA256("/2025-12-31/DSC00001.JPG"); hash != "" {
+		t.Errorf("Removed files should have no digest, got %q", hash)
+	}
+	if err := fsys.RemoveAll("/2025-12-31"); err != nil {
+		t.Errorf("RemoveAll of a missing directory should succeed: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cfg, _ := newTestServer(t)
+	fsys, err := Dial(cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer fsys.Close()
+	if err := writeFile(t, fsys, "/DSC00001.JPG", "photo"); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	digest := "f4b6a4bf0e0c1a3a0b0e1a8d6b1c5e8b7d1e2f3a4b5c6d7e8f9a0b1c2d3e4f5a"
+	if err := fsys.verify("/DSC00001.JPG", 4, digest); err == nil {
+		t.Error("A size mismatch should fail verification")
+	}
+	if err := fsys.verify("/DSC00001.JPG", 5, digest); err == nil {
+		t.Error("A digest mismatch should fail verification")
+	}
+}
+
+func TestDialRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, cfg *config.SFTPConfig)
+	}{
+		{"unknown host key", func(t *testing.T, cfg *config.SFTPConfig) {
+			other, _ := newTestServer(t)
+			cfg.KnownHosts = other.KnownHosts
+		}},
+		{"unauthorized key", func(t *testing.T, cfg *config.SFTPConfig) {
+			cfg.KeyFile = filepath.Join(t.TempDir(), "other")
+			if _, err := sftptest.GenerateKey(cfg.KeyFile); err != nil {
+				t.Fatalf("Failed to generate key: %v", err)
+			}
+		}},
+		{"missing known_hosts", func(t *testing.T, cfg *config.SFTPConfig) {
+			cfg.KnownHosts = filepath.Join(t.TempDir(), "missing")
+		}},
+		{"missing path", func(t *testing.T, cfg *config.SFTPConfig) { cfg.Path = "" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newTestServer(t)
+			tt.modify(t, &cfg)
+			if fsys, err := Dial(cfg); err == nil {
+				fsys.Close()
+				t.Error("Dial should fail")
+			}
+		})
+	}
+}
+
+func sha256Hex(content string) string {
+	hash, _ := checksum.Reader(strings.NewReader(content))
+	return hash
+}
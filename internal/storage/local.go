@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Local is the local file system. Paths are OS paths.
+type Local struct{}
+
+func (Local) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (Local) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (Local) Open(name string) (io.ReadCloser, error) { return os.Open(name) }
+
+// Create opens name exclusively and sets perm regardless of the umask
+func (Local) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return localFile{f}, nil
+}
+
+func (Local) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+
+// Rename moves oldname to newname and syncs the directory of newname,
+// so a completed rename survives a crash
+func (Local) Rename(oldname, newname string) error {
+	if err := os.Rename(oldname, newname); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newname))
+}
+
+func (Local) Remove(name string) error { return os.Remove(name) }
+
+func (Local) RemoveAll(name string) error { return os.RemoveAll(name) }
+
+func (Local) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// localFile syncs its content to disk when closed
+type localFile struct {
+	*os.File
+}
+
+func (f localFile) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return fmt.Errorf("failed to sync %s: %w", f.Name(), err)
+	}
+	return f.File.Close()
+}
+
+// syncDir flushes directory entries to disk
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory for sync: %w", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op names an operation of Mem for fault injection
+type Op string
+
+// Operations passed to Mem.Fault
+const (
+	OpReadDir Op = "readdir"
+	OpStat    Op = "stat"
+	OpOpen    Op = "open"
+	OpRead    Op = "read"
+	OpCreate  Op = "create"
+	OpWrite   Op = "write"
+	OpClose   Op = "close"
+	OpMkdir   Op = "mkdir"
+	OpRename  Op = "rename"
+	OpRemove  Op = "remove"
+	OpChtimes Op = "chtimes"
+)
+
+var (
+	errNotDir   = errors.New("not a directory")
+	errIsDir    = errors.New("is a directory")
+	errNotEmpty = errors.New("directory not empty")
+)
+
+// Mem is an in-memory FS for tests. Paths are cleaned with filepath.Clean;
+// the root of any path exists implicitly.
+type Mem struct {
+	// Fault, when set, is called before every operation and every Read and Write call
+	// with the path concerned; a non-nil error fails the call, simulating an I/O fault
+	Fault func(op Op, name string) error
+
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// NewMem returns an empty in-memory FS
+func NewMem() *Mem {
+	return &Mem{nodes: make(map[string]*memNode)}
+}
+
+// AddFile creates the file name with data and modTime, creating its parent directories
+func (m *Mem) AddFile(name string, data []byte, modTime time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	m.mkdirAll(filepath.Dir(name), 0755)
+	m.nodes[name] = &memNode{data: append([]byte(nil), data...), mode: 0644, modTime: modTime}
+}
+
+func (m *Mem) fault(op Op, name string) error {
+	if m.Fault == nil {
+		return nil
+	}
+	if err := m.Fault(op, name); err != nil {
+		return &fs.PathError{Op: string(op), Path: name, Err: err}
+	}
+	return nil
+}
+
+// lookup returns the node at the cleaned path name; roots are directories
+func (m *Mem) lookup(name string) (*memNode, bool) {
+	if filepath.Dir(name) == name {
+		return &memNode{dir: true, mode: fs.ModeDir | 0755}, true
+	}
+	node, ok := m.nodes[name]
+	return node, ok
+}
+
+// isParent reports whether the parent directory of name exists
+func (m *Mem) isParent(name string) bool {
+	parent, ok := m.lookup(filepath.Dir(name))
+	return ok && parent.dir
+}
+
+// children returns the paths directly below dir
+func (m *Mem) children(dir string) []string {
+	var names []string
+	for name := range m.nodes {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// descendants returns the paths below dir at any depth
+func (m *Mem) descendants(dir string) []string {
+	prefix := dir + string(filepath.Separator)
+	if strings.HasSuffix(dir, string(filepath.Separator)) {
+		prefix = dir
+	}
+	var names []string
+	for name := range m.nodes {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (m *Mem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := m.fault(OpReadDir, name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !node.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+
+	var entries []fs.DirEntry
+	for _, child := range m.children(name) {
+		entries = append(entries, fs.FileInfoToDirEntry(m.nodes[child].info(child)))
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (m *Mem) Stat(name string) (fs.FileInfo, error) {
+	if err := m.fault(OpStat, name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return node.info(name), nil
+}
+
+func (m *Mem) Open(name string) (io.ReadCloser, error) {
+	if err := m.fault(OpOpen, name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.dir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	return &memReader{mem: m, name: name, r: bytes.NewReader(append([]byte(nil), node.data...))}, nil
+}
+
+func (m *Mem) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if err := m.fault(OpCreate, name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.lookup(name); ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	}
+	if !m.isParent(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	m.nodes[name] = &memNode{mode: perm.Perm(), modTime: time.Now()}
+	return &memWriter{mem: m, name: name}, nil
+}
+
+func (m *Mem) MkdirAll(name string, perm fs.FileMode) error {
+	if err := m.fault(OpMkdir, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdirAll(filepath.Clean(name), perm)
+}
+
+func (m *Mem) mkdirAll(name string, perm fs.FileMode) error {
+	if node, ok := m.lookup(name); ok {
+		if !node.dir {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+	if err := m.mkdirAll(filepath.Dir(name), perm); err != nil {
+		return err
+	}
+	m.nodes[name] = &memNode{dir: true, mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (m *Mem) Rename(oldname, newname string) error {
+	if err := m.fault(OpRename, oldname); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := m.nodes[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if !m.isParent(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	if existing, ok := m.nodes[newname]; ok && existing.dir && len(m.children(newname)) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+
+	if node.dir {
+		for _, child := range m.descendants(oldname) {
+			m.nodes[newname+strings.TrimPrefix(child, oldname)] = m.nodes[child]
+			delete(m.nodes, child)
+		}
+	}
+	delete(m.nodes, oldname)
+	m.nodes[newname] = node
+	return nil
+}
+
+func (m *Mem) Remove(name string) error {
+	if err := m.fault(OpRemove, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.dir && len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *Mem) RemoveAll(name string) error {
+	if err := m.fault(OpRemove, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	for _, child := range m.descendants(name) {
+		delete(m.nodes, child)
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *Mem) Chtimes(name string, atime, mtime time.Time) error {
+	if err := m.fault(OpChtimes, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return memInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// memReader reads a snapshot of a file taken when it was opened
+type memReader struct {
+	mem  *Mem
+	name string
+	r    *bytes.Reader
+}
+
+func (r *memReader) Read(p []byte) (int, error) {
+	if err := r.mem.fault(OpRead, r.name); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func (r *memReader) Close() error { return nil }
+
+// memWriter appends to a file, so a failed copy leaves a partial file as a disk would
+type memWriter struct {
+	mem  *Mem
+	name string
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if err := w.mem.fault(OpWrite, w.name); err != nil {
+		return 0, err
+	}
+	w.mem.mu.Lock()
+	defer w.mem.mu.Unlock()
+
+	node, ok := w.mem.nodes[w.name]
+	if !ok {
+		return 0, &fs.PathError{Op: "write", Path: w.name, Err: fs.ErrNotExist}
+	}
+	node.data = append(node.data, p...)
+	node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error {
+	return w.mem.fault(OpClose, w.name)
+}
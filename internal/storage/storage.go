@@ -0,0 +1,138 @@
+// Package storage abstracts the file systems that cards are read from and archives are written to.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FS is a hierarchical file store addressed by slash or OS-style paths.
+// Errors for missing files satisfy errors.Is(err, fs.ErrNotExist).
+type FS interface {
+	// ReadDir lists the directory name sorted by file name
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	// Create creates the file name with perm and fails if it already exists.
+	// The content is durable once Close returns without error.
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	// Rename replaces newname with oldname atomically where the store allows it
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// FileMeta describes a file written with Uploader.Upload
+type FileMeta struct {
+	ModTime time.Time
+	// SHA256 is the hex digest of the content, when known
+	SHA256 string
+}
+
+// Uploader is implemented by stores that publish a file only once it is completely
+// written, such as object stores that cannot rename cheaply. Copies to such stores
+// write the final name directly instead of renaming a temporary file.
+type Uploader interface {
+	// Upload creates or replaces name with the content of r
+	Upload(ctx context.Context, name string, r io.Reader, meta FileMeta) error
+}
+
+// Hasher is implemented by stores that know the digest of their files without reading them
+type Hasher interface {
+	// SHA256 returns the hex digest of name, or "" when the store does not know it
+	SHA256(name string) (string, error)
+}
+
+// Flusher is implemented by stores that keep changes in memory until Flush writes them
+type Flusher interface {
+	Flush() error
+}
+
+// WalkDir walks the tree rooted at root like filepath.WalkDir, reading directories through fsys
+func WalkDir(fsys FS, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fsys FS, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		// Report the failure to read the directory, as filepath.WalkDir does
+		if err = fn(path, d, err); err != nil {
+			if err == filepath.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := walkDir(fsys, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile returns the content of the file name
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile replaces the file name with data.
+// The data is written to a temporary name first, so name is either unchanged or complete.
+func WriteFile(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	tmp := name + ".tmp"
+	if err := fsys.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f, err := fsys.Create(tmp, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		fsys.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	return fsys.Rename(tmp, name)
+}
+
+// sortEntries orders directory entries by name
+func sortEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
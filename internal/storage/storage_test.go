@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, fsys FS, name, content string) {
+	t.Helper()
+	if err := fsys.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	f, err := fsys.Create(name, 0640)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", name, err)
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Failed to close %s: %v", name, err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys func(t *testing.T) (FS, string)
+	}{
+		{"local", func(t *testing.T) (FS, string) { return Local{}, t.TempDir() }},
+		{"mem", func(t *testing.T) (FS, string) { return NewMem(), filepath.FromSlash("/card") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, root := tt.fsys(t)
+			photo := filepath.Join(root, "DCIM", "02512310", "DSC00002.JPG")
+			writeFile(t, fsys, photo, "photo")
+			writeFile(t, fsys, filepath.Join(root, "DCIM", "02512310", "DSC00001.JPG"), "first")
+
+			info, err := fsys.Stat(photo)
+			if err != nil || info.Size() != 5 || info.IsDir() || info.Mode().Perm() != 0640 {
+				t.Errorf("Unexpected stat: %v, %v", info, err)
+			}
+			if _, err := fsys.Stat(filepath.Join(root, "missing")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected fs.ErrNotExist, got %v", err)
+			}
+			if _, err := fsys.Create(photo, 0644); !errors.Is(err, fs.ErrExist) {
+				t.Errorf("Create of an existing file should fail with fs.ErrExist, got %v", err)
+			}
+
+			data, err := ReadFile(fsys, photo)
+			if err != nil || string(data) != "photo" {
+				t.Errorf("ReadFile = %q, %v", data, err)
+			}
+
+			mtime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+			if err := fsys.Chtimes(photo, mtime, mtime); err != nil {
+				t.Fatalf("Chtimes failed: %v", err)
+			}
+			if info, _ := fsys.Stat(photo); !info.ModTime().Equal(mtime) {
+				t.Errorf("ModTime = %v, want %v", info.ModTime(), mtime)
+			}
+
+			var walked []string
+			err = WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				rel, _ := filepath.Rel(root, path)
+				walked = append(walked, filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("WalkDir failed: %v", err)
+			}
+			expected := []string{".", "DCIM", "DCIM/02512310", "DCIM/02512310/DSC00001.JPG", "DCIM/02512310/DSC00002.JPG"}
+			if !reflect.DeepEqual(walked, expected) {
+				t.Errorf("WalkDir visited %v, want %v", walked, expected)
+			}
+
+			renamed := filepath.Join(root, "DCIM", "2025-12-31")
+			if err := fsys.Rename(filepath.Join(root, "DCIM", "02512310"), renamed); err != nil {
+				t.Fatalf("Rename failed: %v", err)
+			}
+			entries, err := fsys.ReadDir(renamed)
+			if err != nil || len(entries) != 2 || entries[0].Name() != "DSC00001.JPG" {
+				t.Errorf("Unexpected entries after rename: %v, %v", entries, err)
+			}
+
+			if err := WriteFile(fsys, filepath.Join(root, "catalog.json"), []byte("{}"), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			if err := WriteFile(fsys, filepath.Join(root, "catalog.json"), []byte("[]"), 0644); err != nil {
+				t.Fatalf("WriteFile replacing a file failed: %v", err)
+			}
+			if data, _ := ReadFile(fsys, filepath.Join(root, "catalog.json")); string(data) != "[]" {
+				t.Errorf("WriteFile should replace the content, got %q", data)
+			}
+
+			if err := fsys.Remove(renamed); err == nil {
+				t.Error("Remove of a non-empty directory should fail")
+			}
+			if err := fsys.RemoveAll(filepath.Join(root, "DCIM")); err != nil {
+				t.Fatalf("RemoveAll failed: %v", err)
+			}
+			entries, err = fsys.ReadDir(root)
+			if err != nil || len(entries) != 1 || entries[0].Name() != "catalog.json" {
+				t.Errorf("Unexpected entries after RemoveAll: %v, %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestMemFault(t *testing.T) {
+	errBadSector := errors.New("bad sector")
+	mem := NewMem()
+	mem.AddFile("/card/DCIM/02512310/DSC00001.JPG", []byte("photo"), time.Now())
+	mem.AddFile("/card/DCIM/02512310/DSC00002.JPG", []byte("photo"), time.Now())
+
+	mem.Fault = func(op Op, name string) error {
+		if op == OpRead && filepath.Base(name) == "DSC00002.JPG" {
+			return errBadSector
+		}
+		return nil
+	}
+
+	if _, err := ReadFile(mem, "/card/DCIM/02512310/DSC00001.JPG"); err != nil {
+		t.Errorf("Unaffected file should be readable: %v", err)
+	}
+	_, err := ReadFile(mem, "/card/DCIM/02512310/DSC00002.JPG")
+	if !errors.Is(err, errBadSector) {
+		t.Errorf("Expected injected fault, got %v", err)
+	}
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Op != "read" {
+		t.Errorf("Fault should be reported as a read error of the file: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd
+
+package trash
+
+// deviceID is not implemented on this platform
+func deviceID(path string) (uint64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package trash
+
+import "syscall"
+
+// deviceID returns the device holding path
+func deviceID(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
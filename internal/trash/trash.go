@@ -0,0 +1,194 @@
+// Package trash moves files to the desktop trash following the FreeDesktop.org Trash specification.
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported is returned on platforms without device information
+var ErrUnsupported = errors.New("trash is not supported on this platform")
+
+const infoSuffix = ".trashinfo"
+
+// Trash moves files into the home trash or into the trash directory of the volume holding them
+type Trash struct {
+	// Home is the home trash directory, usually $XDG_DATA_HOME/Trash
+	Home string
+	// UID names the per-volume trash directories (.Trash/$UID and .Trash-$UID)
+	UID int
+
+	device func(path string) (uint64, error)
+	now    func() time.Time
+}
+
+// New returns the trash of the current user
+func New() (*Trash, error) {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate home directory: %w", err)
+		}
+		dataHome = filepath.Join(homeDir, ".local", "share")
+	}
+	return &Trash{Home: filepath.Join(dataHome, "Trash"), UID: os.Getuid(), device: deviceID, now: time.Now}, nil
+}
+
+// Put moves path, a file or directory, to the trash
+func (t *Trash) Put(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return fmt.Errorf("failed to trash %s: %w", path, err)
+	}
+
+	trashDir, infoPath, err := t.trashFor(path)
+	if err != nil {
+		return fmt.Errorf("failed to find trash for %s: %w", path, err)
+	}
+
+	for _, dir := range []string{filepath.Join(trashDir, "files"), filepath.Join(trashDir, "info")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create trash directory: %w", err)
+		}
+	}
+
+	// The info file is created exclusively first; it reserves the name in files/
+	name, info, err := t.reserve(trashDir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	content := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", encodePath(infoPath), t.now().Format("2006-01-02T15:04:05"))
+	if _, err := info.WriteString(content); err != nil {
+		info.Close()
+		os.Remove(info.Name())
+		return fmt.Errorf("failed to write trash info: %w", err)
+	}
+	if err := info.Close(); err != nil {
+		os.Remove(info.Name())
+		return fmt.Errorf("failed to write trash info: %w", err)
+	}
+
+	if err := os.Rename(path, filepath.Join(trashDir, "files", name)); err != nil {
+		os.Remove(info.Name())
+		return fmt.Errorf("failed to move %s to trash: %w", path, err)
+	}
+	return nil
+}
+
+// reserve creates a unique info file for base in trashDir
+func (t *Trash) reserve(trashDir, base string) (string, *os.File, error) {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s.%d%s", stem, i, ext)
+		}
+		info, err := os.OpenFile(filepath.Join(trashDir, "info", name+infoSuffix), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			if _, err := os.Lstat(filepath.Join(trashDir, "files", name)); err == nil {
+				// Orphaned file without info; keep looking
+				info.Close()
+				os.Remove(info.Name())
+				continue
+			}
+			return name, info, nil
+		}
+		if !os.IsExist(err) {
+			return "", nil, fmt.Errorf("failed to create trash info: %w", err)
+		}
+	}
+}
+
+// trashFor returns the trash directory for path and the path to record in the info file.
+// Files on the volume of the home trash go to the home trash with their absolute path;
+// others go to the trash of their volume with a path relative to the volume's top directory.
+func (t *Trash) trashFor(path string) (string, string, error) {
+	if t.device == nil {
+		return t.Home, path, nil
+	}
+
+	dev, err := t.device(path)
+	if err != nil {
+		return "", "", err
+	}
+	homeDev, err := t.device(existingParent(t.Home))
+	if err != nil {
+		return "", "", err
+	}
+	if dev == homeDev {
+		return t.Home, path, nil
+	}
+
+	top, err := t.topDir(path, dev)
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(top, path)
+	if err != nil {
+		return "", "", err
+	}
+	uid := strconv.Itoa(t.UID)
+
+	// An administrator-created $topdir/.Trash must be a sticky directory and not a symlink
+	shared := filepath.Join(top, ".Trash")
+	if info, err := os.Lstat(shared); err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		dir := filepath.Join(shared, uid)
+		if err := os.MkdirAll(dir, 0700); err == nil {
+			return dir, rel, nil
+		}
+	}
+	return filepath.Join(top, ".Trash-"+uid), rel, nil
+}
+
+// topDir returns the mount point of the volume holding path
+func (t *Trash) topDir(path string, dev uint64) (string, error) {
+	dir := filepath.Dir(path)
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, nil
+		}
+		parentDev, err := t.device(parent)
+		if err != nil {
+			return "", err
+		}
+		if parentDev != dev {
+			return dir, nil
+		}
+		dir = parent
+	}
+}
+
+// existingParent returns path or its closest existing parent
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// encodePath percent-encodes each element of path as required for the Path key
+func encodePath(path string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,157 @@
+package trash
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readInfo(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read trash info: %v", err)
+	}
+	return string(data)
+}
+
+func TestPutHomeTrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(tmpDir, "data"))
+
+	trash, err := New()
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	trash.now = func() time.Time { return time.Date(2025, 12, 31, 22, 32, 8, 0, time.Local) }
+
+	dir := filepath.Join(tmpDir, "work dir")
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	if err := trash.Put(filepath.Join(dir, "a.jpg")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.jpg")); !os.IsNotExist(err) {
+		t.Error("Trashed file should be gone")
+	}
+
+	home := filepath.Join(tmpDir, "data", "Trash")
+	if data, err := os.ReadFile(filepath.Join(home, "files", "a.jpg")); err != nil || string(data) != "a.jpg" {
+		t.Errorf("Trashed file missing from home trash: %v", err)
+	}
+	info := readInfo(t, filepath.Join(home, "info", "a.jpg.trashinfo"))
+	expected := "[Trash Info]\nPath=" + filepath.ToSlash(filepath.Join(tmpDir, "work%20dir", "a.jpg")) + "\nDeletionDate=2025-12-31T22:32:08\n"
+	if info != expected {
+		t.Errorf("Unexpected trash info:\n%s\nwant:\n%s", info, expected)
+	}
+
+	// A second file with the same name gets a unique name
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("again"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := trash.Put(filepath.Join(dir, "a.jpg")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(home, "files", "a.2.jpg")); err != nil || string(data) != "again" {
+		t.Errorf("Second file missing from home trash: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "info", "a.2.jpg.trashinfo")); err != nil {
+		t.Errorf("Second info file missing: %v", err)
+	}
+
+	// Directories are trashed as a whole
+	if err := trash.Put(dir); err != nil {
+		t.Fatalf("Put of a directory failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "files", "work dir", "b.jpg")); err != nil {
+		t.Errorf("Trashed directory missing: %v", err)
+	}
+
+	if err := trash.Put(filepath.Join(tmpDir, "missing")); err == nil {
+		t.Error("Expected error for a missing file")
+	}
+}
+
+func TestPutVolumeTrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "media", "archive")
+	photo := filepath.Join(volume, "2025-12-31", "DSC00001.JPG")
+	if err := os.MkdirAll(filepath.Dir(photo), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(photo, []byte("photo"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// Everything below volume is on its own device
+	trash := &Trash{
+		Home: filepath.Join(tmpDir, "home", "Trash"),
+		UID:  1000,
+		now:  time.Now,
+		device: func(path string) (uint64, error) {
+			if path == volume || strings.HasPrefix(path, volume+string(filepath.Separator)) {
+				return 2, nil
+			}
+			return 1, nil
+		},
+	}
+
+	if err := trash.Put(photo); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	volumeTrash := filepath.Join(volume, ".Trash-1000")
+	if _, err := os.Stat(filepath.Join(volumeTrash, "files", "DSC00001.JPG")); err != nil {
+		t.Errorf("File should be in the volume trash: %v", err)
+	}
+	info := readInfo(t, filepath.Join(volumeTrash, "info", "DSC00001.JPG.trashinfo"))
+	if !strings.Contains(info, "\nPath=2025-12-31/DSC00001.JPG\n") {
+		t.Errorf("Volume trash info should hold a path relative to the volume:\n%s", info)
+	}
+	if _, err := os.Stat(trash.Home); !os.IsNotExist(err) {
+		t.Error("Home trash should not be used for files on another volume")
+	}
+}
+
+func TestPutSharedVolumeTrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	shared := filepath.Join(volume, ".Trash")
+	if err := os.MkdirAll(shared, 0777); err != nil {
+		t.Fatalf("Failed to create shared trash: %v", err)
+	}
+	if err := os.Chmod(shared, 0777|os.ModeSticky); err != nil {
+		t.Fatalf("Failed to set sticky bit: %v", err)
+	}
+	photo := filepath.Join(volume, "DSC00001.JPG")
+	if err := os.WriteFile(photo, []byte("photo"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	trash := &Trash{
+		Home: filepath.Join(tmpDir, "home", "Trash"),
+		UID:  1000,
+		now:  time.Now,
+		device: func(path string) (uint64, error) {
+			if strings.HasPrefix(path, volume) {
+				return 2, nil
+			}
+			return 1, nil
+		},
+	}
+	if err := trash.Put(photo); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(shared, "1000", "files", "DSC00001.JPG")); err != nil {
+		t.Errorf("File should be in the shared volume trash: %v", err)
+	}
+}
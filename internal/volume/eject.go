@@ -0,0 +1,107 @@
+package volume
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+)
+
+// CommandRunner runs external commands. It is replaced by a fake in tests.
+type CommandRunner interface {
+	// Run executes name with args and returns its combined output
+	Run(name string, args ...string) ([]byte, error)
+	// LookPath reports whether name is available, as exec.LookPath does
+	LookPath(name string) (string, error)
+}
+
+// ExecRunner runs commands with os/exec
+type ExecRunner struct{}
+
+// Run executes the command and returns its combined output
+func (ExecRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// LookPath searches for an executable in PATH
+func (ExecRunner) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+// Ejector releases a mounted volume so the card can be removed safely
+type Ejector interface {
+	Eject(mountPoint string) error
+}
+
+// NewEjector returns the Ejector for the given operating system (runtime.GOOS)
+func NewEjector(goos string, runner CommandRunner) Ejector {
+	switch goos {
+	case "darwin":
+		return &DarwinEjector{Runner: runner}
+	case "linux":
+		return &LinuxEjector{Runner: runner, MountTable: DefaultMountTable}
+	default:
+		return unsupportedEjector{goos: goos}
+	}
+}
+
+// DarwinEjector ejects volumes with diskutil
+type DarwinEjector struct {
+	Runner CommandRunner
+}
+
+// Eject runs "diskutil eject" on the mount point
+func (e *DarwinEjector) Eject(mountPoint string) error {
+	if output, err := e.Runner.Run("diskutil", "eject", mountPoint); err != nil {
+		return fmt.Errorf("failed to eject volume %s: %w\nOutput: %s", mountPoint, err, string(output))
+	}
+	return nil
+}
+
+// LinuxEjector unmounts a volume and powers off its drive.
+// The block device is resolved from MountTable. udisksctl is preferred because it
+// works without root and can power off the drive; umount is used as a fallback.
+type LinuxEjector struct {
+	Runner     CommandRunner
+	MountTable string
+}
+
+// Eject unmounts the volume at mountPoint and, if possible, powers off its drive
+func (e *LinuxEjector) Eject(mountPoint string) error {
+	mounts, err := ReadMounts(e.MountTable)
+	if err != nil {
+		return err
+	}
+	mount, err := FindMount(mounts, mountPoint)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device for %s: %w", mountPoint, err)
+	}
+	if !filepath.IsAbs(mount.Device) {
+		return fmt.Errorf("%s is not backed by a block device (%s)", mountPoint, mount.Device)
+	}
+
+	if _, err := e.Runner.LookPath("udisksctl"); err == nil {
+		if output, err := e.Runner.Run("udisksctl", "unmount", "-b", mount.Device); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w\nOutput: %s", mount.Device, err, string(output))
+		}
+		if output, err := e.Runner.Run("udisksctl", "power-off", "-b", mount.Device); err != nil {
+			return fmt.Errorf("failed to power off %s: %w\nOutput: %s", mount.Device, err, string(output))
+		}
+		return nil
+	}
+
+	if output, err := e.Runner.Run("umount", mount.MountPoint); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w\nOutput: %s", mount.MountPoint, err, string(output))
+	}
+	log.Printf("Unmounted %s; install udisks2 to also power off %s", mount.MountPoint, mount.Device)
+	return nil
+}
+
+type unsupportedEjector struct {
+	goos string
+}
+
+func (e unsupportedEjector) Eject(mountPoint string) error {
+	log.Printf("Eject not supported on %s, skipping", e.goos)
+	return nil
+}
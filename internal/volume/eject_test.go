@@ -0,0 +1,110 @@
+package volume
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRunner records commands instead of executing them
+type fakeRunner struct {
+	available map[string]bool
+	failOn    string
+	calls     []string
+}
+
+func (f *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	call := strings.Join(append([]string{name}, args...), " ")
+	f.calls = append(f.calls, call)
+	if f.failOn != "" && strings.HasPrefix(call, f.failOn) {
+		return []byte("target is busy"), errors.New("exit status 1")
+	}
+	return nil, nil
+}
+
+func (f *fakeRunner) LookPath(name string) (string, error) {
+	if f.available[name] {
+		return "/usr/bin/" + name, nil
+	}
+	return "", errors.New("executable file not found")
+}
+
+func TestLinuxEjectorUdisks(t *testing.T) {
+	runner := &fakeRunner{available: map[string]bool{"udisksctl": true}}
+	ejector := &LinuxEjector{Runner: runner, MountTable: writeMountTable(t)}
+
+	if err := ejector.Eject("/run/media/alice/SONY CARD"); err != nil {
+		t.Fatalf("Eject failed: %v", err)
+	}
+
+	expected := []string{
+		"udisksctl unmount -b /dev/sdb1",
+		"udisksctl power-off -b /dev/sdb1",
+	}
+	if !reflect.DeepEqual(runner.calls, expected) {
+		t.Errorf("Unexpected commands: %v, want %v", runner.calls, expected)
+	}
+}
+
+func TestLinuxEjectorUmountFallback(t *testing.T) {
+	runner := &fakeRunner{}
+	ejector := &LinuxEjector{Runner: runner, MountTable: writeMountTable(t)}
+
+	if err := ejector.Eject("/mnt/card"); err != nil {
+		t.Fatalf("Eject failed: %v", err)
+	}
+
+	expected := []string{"umount /mnt/card"}
+	if !reflect.DeepEqual(runner.calls, expected) {
+		t.Errorf("Unexpected commands: %v, want %v", runner.calls, expected)
+	}
+}
+
+func TestLinuxEjectorErrors(t *testing.T) {
+	table := writeMountTable(t)
+
+	// Unknown mount point: nothing is run
+	runner := &fakeRunner{available: map[string]bool{"udisksctl": true}}
+	ejector := &LinuxEjector{Runner: runner, MountTable: table}
+	if err := ejector.Eject("/media/other"); err == nil {
+		t.Error("Expected error for unknown mount point")
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("No commands should run for unknown mount point, got %v", runner.calls)
+	}
+
+	// A failing unmount stops before power-off
+	runner = &fakeRunner{available: map[string]bool{"udisksctl": true}, failOn: "udisksctl unmount"}
+	ejector = &LinuxEjector{Runner: runner, MountTable: table}
+	if err := ejector.Eject("/mnt/card"); err == nil {
+		t.Error("Expected error when unmount fails")
+	}
+	if len(runner.calls) != 1 {
+		t.Errorf("Power-off should not run after failed unmount, got %v", runner.calls)
+	}
+}
+
+func TestDarwinEjector(t *testing.T) {
+	runner := &fakeRunner{}
+	ejector := NewEjector("darwin", runner)
+
+	if err := ejector.Eject("/Volumes/1-1"); err != nil {
+		t.Fatalf("Eject failed: %v", err)
+	}
+
+	expected := []string{"diskutil eject /Volumes/1-1"}
+	if !reflect.DeepEqual(runner.calls, expected) {
+		t.Errorf("Unexpected commands: %v, want %v", runner.calls, expected)
+	}
+}
+
+func TestUnsupportedEjector(t *testing.T) {
+	runner := &fakeRunner{}
+	if err := NewEjector("windows", runner).Eject(`E:\`); err != nil {
+		t.Errorf("Unsupported platforms should not fail: %v", err)
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("No commands should run on unsupported platforms, got %v", runner.calls)
+	}
+}
@@ -0,0 +1,81 @@
+// Package volume provides access to mounted volumes: the mount table and ejecting removable media.
+package volume
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultMountTable is the Linux mount table of the current process
+const DefaultMountTable = "/proc/self/mounts"
+
+// Mount is one entry of the mount table
+type Mount struct {
+	Device     string
+	MountPoint string
+	FSType     string
+}
+
+// ReadMounts parses a mount table in /proc/mounts format
+func ReadMounts(path string) ([]Mount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+	defer f.Close()
+
+	var mounts []Mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mounts = append(mounts, Mount{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FSType:     fields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse mount table: %w", err)
+	}
+
+	return mounts, nil
+}
+
+// FindMount returns the mount table entry for mountPoint.
+// When a mount point appears several times the last (topmost) entry wins.
+func FindMount(mounts []Mount, mountPoint string) (Mount, error) {
+	target := filepath.Clean(mountPoint)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if filepath.Clean(mounts[i].MountPoint) == target {
+			return mounts[i], nil
+		}
+	}
+	return Mount{}, fmt.Errorf("%s is not a mount point", mountPoint)
+}
+
+// unescapeMountField decodes the octal escapes (e.g. \040 for a space) used in mount tables
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
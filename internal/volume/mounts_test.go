@@ -0,0 +1,82 @@
+package volume
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const sampleMountTable = `sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0
+/dev/nvme0n1p2 / ext4 rw,relatime 0 0
+/dev/sdb1 /run/media/alice/SONY\040CARD exfat rw,nosuid,nodev,relatime 0 0
+/dev/sdc1 /mnt/card vfat rw,relatime 0 0
+/dev/sdd1 /mnt/card exfat rw,relatime 0 0
+`
+
+func writeMountTable(t *testing.T) string {
+	t.Helper()
+	tmpDir, err := os.MkdirTemp("", "mounts-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	path := filepath.Join(tmpDir, "mounts")
+	if err := os.WriteFile(path, []byte(sampleMountTable), 0644); err != nil {
+		t.Fatalf("Failed to write mount table: %v", err)
+	}
+	return path
+}
+
+func TestReadMounts(t *testing.T) {
+	mounts, err := ReadMounts(writeMountTable(t))
+	if err != nil {
+		t.Fatalf("ReadMounts failed: %v", err)
+	}
+	if len(mounts) != 5 {
+		t.Fatalf("Expected 5 mounts, got %d", len(mounts))
+	}
+
+	if mounts[2].MountPoint != "/run/media/alice/SONY CARD" {
+		t.Errorf("Escaped mount point not decoded: %q", mounts[2].MountPoint)
+	}
+	if mounts[2].Device != "/dev/sdb1" || mounts[2].FSType != "exfat" {
+		t.Errorf("Unexpected mount entry: %+v", mounts[2])
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	mounts, err := ReadMounts(writeMountTable(t))
+	if err != nil {
+		t.Fatalf("ReadMounts failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		mountPoint  string
+		device      string
+		shouldError bool
+	}{
+		{"escaped path", "/run/media/alice/SONY CARD/", "/dev/sdb1", false},
+		{"stacked mounts use topmost", "/mnt/card", "/dev/sdd1", false},
+		{"not a mount point", "/mnt/card/DCIM", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mount, err := FindMount(mounts, tt.mountPoint)
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("FindMount(%q) expected error, got %+v", tt.mountPoint, mount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindMount(%q) unexpected error: %v", tt.mountPoint, err)
+			}
+			if mount.Device != tt.device {
+				t.Errorf("FindMount(%q) device = %s, want %s", tt.mountPoint, mount.Device, tt.device)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Package watch polls mount directories and imports known cards when they appear.
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Options configures a Watcher
+type Options struct {
+	// Roots are the directories in which volumes are mounted, e.g. /Volumes or /run/media/$USER
+	Roots []string
+	// Interval is the time between two scans of Roots
+	Interval time.Duration
+	// Debounce is how long a new mount point must stay present before it is imported
+	Debounce time.Duration
+	// StatusFile, when set, receives a JSON description of the watcher state after every change
+	StatusFile string
+	// Accept reports whether the volume at mountPoint is a card that should be imported
+	Accept func(mountPoint string) bool
+	// Import runs the workflow for the card at mountPoint
+	Import func(mountPoint string) error
+}
+
+// Result describes one finished import
+type Result struct {
+	MountPoint string    `json:"mount_point"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Status is written to Options.StatusFile
+type Status struct {
+	State      string    `json:"state"`
+	Current    string    `json:"current,omitempty"`
+	Pending    []string  `json:"pending,omitempty"`
+	LastImport *Result   `json:"last_import,omitempty"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Watcher states reported in Status.State
+const (
+	StateIdle      = "idle"
+	StateImporting = "importing"
+	StateStopped   = "stopped"
+)
+
+// maxRetryDelay bounds the time between two checks of a mount point that was not
+// accepted or failed to import
+const maxRetryDelay = time.Minute
+
+// retry schedules the next check of a mount point that was not accepted or failed to import
+type retry struct {
+	at    time.Time
+	delay time.Duration
+}
+
+// Watcher detects newly mounted cards and imports them one at a time
+type Watcher struct {
+	opts Options
+	now  func() time.Time
+
+	// firstSeen records when each present mount point was first observed
+	firstSeen map[string]time.Time
+	// handled holds mount points already imported while they stay mounted
+	handled map[string]bool
+	// retries holds the mount points not accepted or imported yet, which are checked
+	// again later as the card may still be mounting or be registered in the meantime,
+	// and a failed import may succeed once its cause is fixed
+	retries map[string]retry
+	status  Status
+}
+
+// New returns a Watcher for opts
+func New(opts Options) *Watcher {
+	return &Watcher{
+		opts:      opts,
+		now:       time.Now,
+		firstSeen: make(map[string]time.Time),
+		handled:   make(map[string]bool),
+		retries:   make(map[string]retry),
+		status:    Status{State: StateIdle},
+	}
+}
+
+// Run scans Roots every Interval until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) error {
+	log.Printf("Watching %v for cards", w.opts.Roots)
+	w.writeStatus()
+
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.Poll()
+
+		select {
+		case <-ctx.Done():
+			w.status.State = StateStopped
+			w.writeStatus()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll performs a single scan and imports every mount point that is stable and accepted.
+// Imports run sequentially in the calling goroutine.
+func (w *Watcher) Poll() {
+	now := w.now()
+	present := w.scan()
+
+	for mountPoint := range w.firstSeen {
+		if !present[mountPoint] {
+			delete(w.firstSeen, mountPoint)
+			delete(w.handled, mountPoint)
+			delete(w.retries, mountPoint)
+		}
+	}
+
+	var ready []string
+	w.status.Pending = nil
+	for mountPoint := range present {
+		seen, ok := w.firstSeen[mountPoint]
+		if !ok {
+			w.firstSeen[mountPoint] = now
+			seen = now
+		}
+		if w.handled[mountPoint] || now.Before(w.retries[mountPoint].at) {
+			continue
+		}
+		if now.Sub(seen) < w.opts.Debounce {
+			w.status.Pending = append(w.status.Pending, mountPoint)
+			continue
+		}
+		ready = append(ready, mountPoint)
+	}
+	sort.Strings(ready)
+	sort.Strings(w.status.Pending)
+
+	for _, mountPoint := range ready {
+		if !w.opts.Accept(mountPoint) {
+			w.backOff(mountPoint, now)
+			continue
+		}
+		if err := w.runImport(mountPoint); err != nil {
+			w.backOff(mountPoint, w.now())
+			continue
+		}
+		w.handled[mountPoint] = true
+		delete(w.retries, mountPoint)
+	}
+	w.writeStatus()
+}
+
+// backOff schedules the next check of a mount point that was not accepted or
+// failed to import, doubling the delay each time up to maxRetryDelay
+func (w *Watcher) backOff(mountPoint string, now time.Time) {
+	r := w.retries[mountPoint]
+	r.delay = min(max(2*r.delay, w.opts.Interval), maxRetryDelay)
+	r.at = now.Add(r.delay)
+	w.retries[mountPoint] = r
+}
+
+// runImport imports the card at mountPoint and records the result in the status
+func (w *Watcher) runImport(mountPoint string) error {
+	log.Printf("Card detected at %s, starting import", mountPoint)
+	w.status.State = StateImporting
+	w.status.Current = mountPoint
+	w.writeStatus()
+
+	result := &Result{MountPoint: mountPoint, Started: w.now()}
+	err := w.opts.Import(mountPoint)
+	if err != nil {
+		log.Printf("Import of %s failed: %v", mountPoint, err)
+		result.Error = err.Error()
+	} else {
+		log.Printf("Import of %s completed", mountPoint)
+	}
+	result.Finished = w.now()
+
+	w.status.State = StateIdle
+	w.status.Current = ""
+	w.status.LastImport = result
+	return err
+}
+
+// scan lists the directories directly below each root
+func (w *Watcher) scan() map[string]bool {
+	present := make(map[string]bool)
+	for _, root := range w.opts.Roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				present[filepath.Join(root, entry.Name())] = true
+			}
+		}
+	}
+	return present
+}
+
+func (w *Watcher) writeStatus() {
+	if w.opts.StatusFile == "" {
+		return
+	}
+	w.status.Updated = w.now()
+
+	if err := writeJSON(w.opts.StatusFile, w.status); err != nil {
+		log.Printf("Warning: failed to write status file: %v", err)
+	}
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal status: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create status directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write status file: %w", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadStatus reads a status file written by a Watcher
+func ReadStatus(path string) (Status, error) {
+	var status Status
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return status, fmt.Errorf("failed to read status file: %w", err)
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return status, fmt.Errorf("failed to parse status file: %w", err)
+	}
+	return status, nil
+}
+
+// DefaultRoots returns the usual mount directories for removable media on goos
+func DefaultRoots(goos string) []string {
+	switch goos {
+	case "darwin":
+		return []string{"/Volumes"}
+	case "linux":
+		user := os.Getenv("USER")
+		if user == "" {
+			return []string{"/media"}
+		}
+		return []string{filepath.Join("/run/media", user), filepath.Join("/media", user)}
+	default:
+		return nil
+	}
+}
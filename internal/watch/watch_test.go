@@ -0,0 +1,280 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestWatcher(t *testing.T, root string, imported *[]string) (*Watcher, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)}
+	w := New(Options{
+		Roots:      []string{root},
+		Interval:   time.Second,
+		Debounce:   3 * time.Second,
+		StatusFile: filepath.Join(root, "..", "status.json"),
+		Accept: func(mountPoint string) bool {
+			return filepath.Base(mountPoint) != "USB-STICK"
+		},
+		Import: func(mountPoint string) error {
+			*imported = append(*imported, filepath.Base(mountPoint))
+			if filepath.Base(mountPoint) == "BROKEN" {
+				return errors.New("copy failed")
+			}
+			return nil
+		},
+	})
+	w.now = clock.Now
+	return w, clock
+}
+
+func mount(t *testing.T, root, name string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+		t.Fatalf("Failed to simulate mount: %v", err)
+	}
+}
+
+func unmount(t *testing.T, root, name string) {
+	t.Helper()
+	if err := os.RemoveAll(filepath.Join(root, name)); err != nil {
+		t.Fatalf("Failed to simulate unmount: %v", err)
+	}
+}
+
+func TestPollDebounceAndSerialize(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "media")
+	var imported []string
+	w, clock := newTestWatcher(t, root, &imported)
+
+	// Missing roots are not an error
+	w.Poll()
+
+	mount(t, root, "1-1")
+	mount(t, root, "1-2")
+	mount(t, root, "USB-STICK")
+	w.Poll()
+	if len(imported) != 0 {
+		t.Fatalf("Nothing should be imported before the debounce delay, got %v", imported)
+	}
+
+	status, err := ReadStatus(filepath.Join(tmpDir, "status.json"))
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %v", err)
+	}
+	if len(status.Pending) != 3 {
+		t.Errorf("Expected 3 pending mounts, got %v", status.Pending)
+	}
+
+	clock.Advance(3 * time.Second)
+	w.Poll()
+	if !reflect.DeepEqual(imported, []string{"1-1", "1-2"}) {
+		t.Fatalf("Expected both cards imported in order, got %v", imported)
+	}
+
+	// Cards stay mounted: no second import
+	clock.Advance(10 * time.Second)
+	w.Poll()
+	if len(imported) != 2 {
+		t.Errorf("Mounted cards must not be imported twice, got %v", imported)
+	}
+
+	// Remounting a card imports it again after the debounce delay
+	unmount(t, root, "1-1")
+	w.Poll()
+	mount(t, root, "1-1")
+	w.Poll()
+	clock.Advance(time.Second)
+	w.Poll()
+	if len(imported) != 2 {
+		t.Errorf("Remounted card imported before debounce, got %v", imported)
+	}
+	clock.Advance(2 * time.Second)
+	w.Poll()
+	if !reflect.DeepEqual(imported, []string{"1-1", "1-2", "1-1"}) {
+		t.Errorf("Remounted card should be imported again, got %v", imported)
+	}
+}
+
+func TestPollFlappingMount(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "media")
+	var imported []string
+	w, clock := newTestWatcher(t, root, &imported)
+
+	// A mount that disappears during the debounce delay restarts the delay
+	mount(t, root, "1-1")
+	w.Poll()
+	clock.Advance(2 * time.Second)
+	unmount(t, root, "1-1")
+	w.Poll()
+	mount(t, root, "1-1")
+	clock.Advance(time.Second)
+	w.Poll()
+	clock.Advance(2 * time.Second)
+	w.Poll()
+	if len(imported) != 0 {
+		t.Fatalf("Flapping mount should not be imported yet, got %v", imported)
+	}
+
+	clock.Advance(time.Second)
+	w.Poll()
+	if len(imported) != 1 {
+		t.Errorf("Stable mount should be imported once, got %v", imported)
+	}
+}
+
+func TestPollRecordsFailures(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "media")
+	var imported []string
+	w, clock := newTestWatcher(t, root, &imported)
+
+	mount(t, root, "BROKEN")
+	w.Poll()
+	clock.Advance(5 * time.Second)
+	w.Poll()
+
+	status, err := ReadStatus(filepath.Join(tmpDir, "status.json"))
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %v", err)
+	}
+	if status.State != StateIdle {
+		t.Errorf("Expected idle state, got %s", status.State)
+	}
+	if status.LastImport == nil || status.LastImport.Error != "copy failed" {
+		t.Errorf("Expected failed last import, got %+v", status.LastImport)
+	}
+}
+
+func TestRunStopsOnCancel(t *testing.T) {
+	tmpDir := t.TempDir()
+	var imported []string
+	w, _ := newTestWatcher(t, filepath.Join(tmpDir, "media"), &imported)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	status, err := ReadStatus(filepath.Join(tmpDir, "status.json"))
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %v", err)
+	}
+	if status.State != StateStopped {
+		t.Errorf("Expected stopped state, got %s", status.State)
+	}
+}
+
+func TestPollRetriesRejectedMount(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "media")
+	var imported []string
+	w, clock := newTestWatcher(t, root, &imported)
+
+	// The card is not accepted until its registration can be read
+	accepted := false
+	checks := 0
+	w.opts.Accept = func(mountPoint string) bool {
+		checks++
+		return accepted
+	}
+
+	mount(t, root, "1-1")
+	w.Poll()
+	clock.Advance(3 * time.Second)
+	w.Poll()
+	if checks != 1 || len(imported) != 0 {
+		t.Fatalf("Expected one rejected check, got %d checks and imports %v", checks, imported)
+	}
+
+	// Checks back off: after 1s, then 2s later
+	clock.Advance(time.Second)
+	w.Poll()
+	clock.Advance(time.Second)
+	w.Poll()
+	if checks != 2 {
+		t.Errorf("Expected the second check to wait for the longer delay, got %d checks", checks)
+	}
+
+	accepted = true
+	clock.Advance(time.Second)
+	w.Poll()
+	if !reflect.DeepEqual(imported, []string{"1-1"}) {
+		t.Fatalf("Accepted card should be imported, got %v", imported)
+	}
+	clock.Advance(time.Minute)
+	w.Poll()
+	if len(imported) != 1 {
+		t.Errorf("Imported card must not be imported twice, got %v", imported)
+	}
+}
+
+func TestPollRetriesFailedImport(t *testing.T) {
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "media")
+	var imported []string
+	w, clock := newTestWatcher(t, root, &imported)
+
+	// The import fails until the destination is available again
+	failing := true
+	w.opts.Import = func(mountPoint string) error {
+		imported = append(imported, filepath.Base(mountPoint))
+		if failing {
+			return errors.New("destination not mounted")
+		}
+		return nil
+	}
+
+	mount(t, root, "1-1")
+	w.Poll()
+	clock.Advance(3 * time.Second)
+	w.Poll()
+	if len(imported) != 1 {
+		t.Fatalf("Expected one failed import, got %v", imported)
+	}
+
+	// Retries back off: after 1s, then 2s later
+	clock.Advance(time.Second)
+	w.Poll()
+	clock.Advance(time.Second)
+	w.Poll()
+	if len(imported) != 2 {
+		t.Errorf("Expected the second retry to wait for the longer delay, got %v", imported)
+	}
+
+	failing = false
+	clock.Advance(time.Second)
+	w.Poll()
+	if len(imported) != 3 {
+		t.Fatalf("Failed import should be retried, got %v", imported)
+	}
+	status, err := ReadStatus(filepath.Join(tmpDir, "status.json"))
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %v", err)
+	}
+	if status.LastImport == nil || status.LastImport.Error != "" {
+		t.Errorf("Expected a successful last import, got %+v", status.LastImport)
+	}
+
+	clock.Advance(time.Minute)
+	w.Poll()
+	if len(imported) != 3 {
+		t.Errorf("Imported card must not be imported again, got %v", imported)
+	}
+}
@@ -0,0 +1,106 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// assembledName is the virtual member of a chunked upload that is moved to the target
+const assembledName = ".file"
+
+// uploadChunked sends data and the rest of r as numbered chunks of a Nextcloud chunked
+// upload and moves the assembled file to target, returning its size. The upload
+// collection is named after the target and the digest of the content, so a failed
+// upload is resumed by the next attempt, which only sends the chunks not stored yet.
+// Nextcloud removes upload collections that are not resumed after a day.
+func (f *FS) uploadChunked(ctx context.Context, target string, data []byte, r io.Reader, chunkSize int64, meta storage.FileMeta) (int64, error) {
+	id := uploadID(target, meta.SHA256)
+	dir := join(f.ChunkRoot, id)
+	header := http.Header{"Destination": {target}}
+
+	stored, err := f.storedChunks(ctx, dir, header)
+	if err != nil {
+		return 0, err
+	}
+	if len(stored) > 0 {
+		log.Printf("Resuming upload of %s (%d chunks already stored)", base(target), len(stored))
+	}
+
+	var size int64
+	for number := 1; ; number++ {
+		name := fmt.Sprintf("%05d", number)
+		if stored[name] != int64(len(data)) {
+			if err := f.Client.put(ctx, join(f.ChunkRoot, id+"/"+name), header, bytes.NewReader(data), int64(len(data))); err != nil {
+				return 0, fmt.Errorf("failed to upload chunk %d of %s: %w", number, base(target), err)
+			}
+		}
+		size += int64(len(data))
+
+		if int64(len(data)) < chunkSize {
+			break
+		}
+		if data, err = readChunk(r, chunkSize); err != nil {
+			return 0, err
+		}
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	moveHeader := mtimeHeader(meta)
+	if moveHeader == nil {
+		moveHeader = http.Header{}
+	}
+	moveHeader.Set("OC-Total-Length", strconv.FormatInt(size, 10))
+	if err := f.Client.move(ctx, dir+"/"+assembledName, target, moveHeader); err != nil {
+		return 0, fmt.Errorf("failed to assemble %s: %w", base(target), err)
+	}
+	return size, nil
+}
+
+// storedChunks returns the sizes of the chunks already stored in the upload collection
+// dir, creating it when it does not exist
+func (f *FS) storedChunks(ctx context.Context, dir string, header http.Header) (map[string]int64, error) {
+	resources, err := f.Client.propfind(ctx, dir+"/", 1)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := f.Client.mkcol(ctx, dir, header); err != nil {
+			return nil, fmt.Errorf("failed to start chunked upload: %w", err)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploaded chunks: %w", err)
+	}
+
+	stored := make(map[string]int64)
+	for _, res := range resources {
+		if !res.Dir {
+			stored[base(res.Path)] = res.Size
+		}
+	}
+	return stored, nil
+}
+
+// uploadID names the upload collection of target. Content of unknown digest gets a
+// random name and is never resumed.
+func uploadID(target, digest string) string {
+	if digest == "" {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		return "rsp-" + hex.EncodeToString(buf)
+	}
+	sum := sha256.Sum256([]byte(target + "\n" + digest))
+	return "rsp-" + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,450 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+const (
+	// DefaultChunkSizeMB is the chunk size of chunked uploads when none is configured
+	DefaultChunkSizeMB = 10
+	// MinChunkSizeMB is the smallest chunk size accepted by Nextcloud for all but the last chunk
+	MinChunkSizeMB = 5
+)
+
+var errNotEmpty = errors.New("directory not empty")
+
+// FS stores files below the collection Root, mapping the path /2025-12-31/DSC00001.JPG
+// to Root/2025-12-31/DSC00001.JPG. Files are written with Upload, which implements
+// storage.Uploader: their content is sent to a temporary name and moved into place,
+// then read back once. Their modification time, the SHA-256 digest of the stored content
+// and the ETag the digest belongs to are kept as dead properties, so identical files are
+// recognized by size and ETag.
+type FS struct {
+	Client *Client
+	Root   *url.URL
+	// ChunkRoot is the collection of chunked uploads; nil sends every file with one request
+	ChunkRoot *url.URL
+	// ChunkSize is the size of the chunks of chunked uploads
+	ChunkSize int64
+
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+// New returns the FS of the collection described by cfg
+func New(cfg config.WebDAVConfig) (*FS, error) {
+	root, err := parseURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	f := &FS{
+		Client: &Client{User: cfg.User, Password: cfg.Password},
+		Root:   root,
+	}
+	if f.Client.Password == "" {
+		f.Client.Password = os.Getenv("WEBDAV_PASSWORD")
+	}
+
+	if cfg.ChunkURL != "" {
+		if f.ChunkRoot, err = parseURL(cfg.ChunkURL); err != nil {
+			return nil, err
+		}
+	}
+	chunkSize := cfg.ChunkSizeMB
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSizeMB
+	}
+	if chunkSize < MinChunkSizeMB {
+		return nil, fmt.Errorf("webdav chunk_size_mb must be at least %d", MinChunkSizeMB)
+	}
+	f.ChunkSize = int64(chunkSize) << 20
+	return f, nil
+}
+
+func parseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid webdav url %q", s)
+	}
+	return u, nil
+}
+
+// String returns the URL of Root
+func (f *FS) String() string {
+	u := *f.Root
+	u.User = nil
+	return u.String()
+}
+
+// name returns the slash-separated path of name below Root
+func (f *FS) name(name string) string {
+	rel := strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+	if rel == "." {
+		return ""
+	}
+	return rel
+}
+
+// url returns the URL of name
+func (f *FS) url(name string) string {
+	return join(f.Root, f.name(name))
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	target := f.url(name)
+	resources, err := f.Client.propfind(context.Background(), target+"/", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	// The response lists the collection itself next to its members
+	u, _ := url.Parse(target)
+	var entries []fs.DirEntry
+	for _, res := range resources {
+		if res.Path == strings.TrimSuffix(u.Path, "/") {
+			if !res.Dir {
+				return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+			}
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(resourceInfo(res)))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	res, err := f.Client.stat(context.Background(), f.url(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return resourceInfo(res), nil
+}
+
+func (f *FS) Open(name string) (io.ReadCloser, error) {
+	body, err := f.Client.get(context.Background(), f.url(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return body, nil
+}
+
+// Create uploads the written content when the returned writer is closed.
+// It fails if name already exists.
+func (f *FS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if _, err := f.Client.stat(context.Background(), f.url(name)); err == nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+
+	pr, pw := io.Pipe()
+	w := &uploadWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := f.Upload(context.Background(), name, pr, storage.FileMeta{ModTime: time.Now()})
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// MkdirAll creates the missing collections of name from the top down
+func (f *FS) MkdirAll(name string, perm fs.FileMode) error {
+	return f.mkdirAll(context.Background(), f.name(name))
+}
+
+func (f *FS) mkdirAll(ctx context.Context, rel string) error {
+	if rel == "" || rel == "." || f.knownDir(rel) {
+		return nil
+	}
+	if err := f.mkdirAll(ctx, path.Dir(rel)); err != nil {
+		return err
+	}
+
+	err := f.Client.mkcol(ctx, join(f.Root, rel), nil)
+	if errors.Is(err, fs.ErrExist) {
+		res, statErr := f.Client.stat(ctx, join(f.Root, rel))
+		if statErr != nil {
+			err = statErr
+		} else if res.Dir {
+			err = nil
+		}
+	}
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: rel, Err: err}
+	}
+	f.mu.Lock()
+	f.dirs[rel] = true
+	f.mu.Unlock()
+	return nil
+}
+
+// knownDir reports whether the collection rel was created or found before
+func (f *FS) knownDir(rel string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dirs == nil {
+		f.dirs = make(map[string]bool)
+	}
+	return f.dirs[rel]
+}
+
+// forgetDirs drops the collections at or below rel from the known ones
+func (f *FS) forgetDirs(rel string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for dir := range f.dirs {
+		if rel == "" || dir == rel || strings.HasPrefix(dir, rel+"/") {
+			delete(f.dirs, dir)
+		}
+	}
+}
+
+// Rename moves oldname to newname on the server, replacing newname
+func (f *FS) Rename(oldname, newname string) error {
+	if err := f.Client.move(context.Background(), f.url(oldname), f.url(newname), nil); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	f.forgetDirs(f.name(oldname))
+	f.forgetDirs(f.name(newname))
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	ctx := context.Background()
+	resources, err := f.Client.propfind(ctx, f.url(name), 1)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if len(resources) > 1 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+	}
+	if err := f.Client.delete(ctx, f.url(name)); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	f.forgetDirs(f.name(name))
+	return nil
+}
+
+func (f *FS) RemoveAll(name string) error {
+	rel := f.name(name)
+	if rel == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("refusing to remove the root collection")}
+	}
+	if err := f.Client.delete(context.Background(), f.url(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	f.forgetDirs(rel)
+	return nil
+}
+
+// Chtimes rewrites the modification time kept in the dead properties of name
+func (f *FS) Chtimes(name string, atime, mtime time.Time) error {
+	props := map[string]string{"mtime": mtime.UTC().Format(time.RFC3339Nano)}
+	if err := f.Client.proppatch(context.Background(), f.url(name), props); err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Upload stores the content of r as name, replacing an existing file. Content that
+// fits in one chunk is sent with a single PUT to a temporary name in the same
+// collection and moved into place; larger content uses a chunked upload when
+// ChunkRoot is set. The stored size is checked against the bytes sent, and the stored
+// content against meta.SHA256 when it is set.
+func (f *FS) Upload(ctx context.Context, name string, r io.Reader, meta storage.FileMeta) error {
+	if err := f.upload(ctx, name, r, meta); err != nil {
+		return &fs.PathError{Op: "upload", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FS) upload(ctx context.Context, name string, r io.Reader, meta storage.FileMeta) error {
+	rel := f.name(name)
+	if err := f.mkdirAll(ctx, path.Dir(rel)); err != nil {
+		return err
+	}
+	target := join(f.Root, rel)
+
+	chunkSize := f.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSizeMB << 20
+	}
+	data, err := readChunk(r, chunkSize)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	switch {
+	case int64(len(data)) < chunkSize:
+		size = int64(len(data))
+		err = f.putAndMove(ctx, target, bytes.NewReader(data), size, meta)
+	case f.ChunkRoot == nil:
+		counter := &countingReader{r: io.MultiReader(bytes.NewReader(data), r)}
+		err = f.putAndMove(ctx, target, counter, -1, meta)
+		size = counter.n
+	default:
+		size, err = f.uploadChunked(ctx, target, data, r, chunkSize, meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := f.Client.stat(ctx, target)
+	if err != nil {
+		return err
+	}
+	if res.Size != size {
+		return fmt.Errorf("webdav: stored %d bytes of %s, %d were sent", res.Size, rel, size)
+	}
+	// The stored content is read back once, so the recorded digest vouches for the
+	// copy on the server rather than for the content the client meant to send
+	digest, err := f.storedDigest(ctx, target)
+	if err != nil {
+		return err
+	}
+	if meta.SHA256 != "" && digest != meta.SHA256 {
+		return fmt.Errorf("webdav: stored content of %s differs from the content sent", rel)
+	}
+	props := map[string]string{"sha256": digest, "sha256-etag": res.ETag}
+	if !meta.ModTime.IsZero() {
+		props["mtime"] = meta.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	return f.Client.proppatch(ctx, target, props)
+}
+
+// storedDigest reads target back from the server and returns its SHA-256 digest
+func (f *FS) storedDigest(ctx context.Context, target string) (string, error) {
+	body, err := f.Client.get(ctx, target)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back %s: %w", base(target), err)
+	}
+	defer body.Close()
+	digest, err := checksum.Reader(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read back %s: %w", base(target), err)
+	}
+	return digest, nil
+}
+
+// putAndMove sends r to a temporary name next to target and moves it into place,
+// so target is never left incomplete
+func (f *FS) putAndMove(ctx context.Context, target string, r io.Reader, size int64, meta storage.FileMeta) error {
+	tmp := temporaryURL(target)
+	if err := f.Client.put(ctx, tmp, mtimeHeader(meta), r, size); err != nil {
+		f.Client.delete(context.Background(), tmp)
+		return fmt.Errorf("failed to send %s: %w", base(target), err)
+	}
+	if err := f.Client.move(ctx, tmp, target, nil); err != nil {
+		f.Client.delete(context.Background(), tmp)
+		return fmt.Errorf("failed to move %s into place: %w", base(target), err)
+	}
+	return nil
+}
+
+// SHA256 returns the digest of the content read back when name was uploaded,
+// or "" when the file was changed since, as told by its ETag
+func (f *FS) SHA256(name string) (string, error) {
+	res, err := f.Client.stat(context.Background(), f.url(name))
+	if err != nil {
+		return "", &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return res.SHA256, nil
+}
+
+// temporaryURL returns a unique hidden name next to target
+func temporaryURL(target string) string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	u, _ := url.Parse(target)
+	u.Path = path.Join(path.Dir(u.Path), "."+path.Base(u.Path)+".upload-"+hex.EncodeToString(buf))
+	u.RawPath = ""
+	return u.String()
+}
+
+// mtimeHeader returns the header Nextcloud reads the modification time of a file from
+func mtimeHeader(meta storage.FileMeta) http.Header {
+	if meta.ModTime.IsZero() {
+		return nil
+	}
+	return http.Header{"X-Oc-Mtime": {fmt.Sprint(meta.ModTime.Unix())}}
+}
+
+// readChunk reads up to size bytes; a short result means r is exhausted
+func readChunk(r io.Reader, size int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload content: %w", err)
+	}
+	return data, nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadWriter feeds the upload started by Create
+type uploadWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *uploadWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *uploadWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+func resourceInfo(res resource) fs.FileInfo {
+	info := fileInfo{name: base(res.Path), size: res.Size, mode: 0644, modTime: res.ModTime}
+	if res.Dir {
+		info.size, info.mode = 0, fs.ModeDir|0755
+	}
+	return info
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() any           { return nil }
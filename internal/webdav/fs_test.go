@@ -0,0 +1,314 @@
+package webdav
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/webdav/webdavtest"
+)
+
+// newTestFS returns an FS on a local server with 64-byte chunks
+func newTestFS(t *testing.T) (*FS, *webdavtest.Server) {
+	t.Helper()
+	server := webdavtest.NewServer("alice", "secret")
+	t.Cleanup(server.Close)
+
+	root, _ := url.Parse(server.FilesURL())
+	chunkRoot, _ := url.Parse(server.UploadsURL())
+	return &FS{Client: &Client{User: "alice", Password: "secret"}, Root: root, ChunkRoot: chunkRoot, ChunkSize: 64}, server
+}
+
+func upload(t *testing.T, fsys *FS, name, content string, meta storage.FileMeta) {
+	t.Helper()
+	if err := fsys.Upload(t.Context(), name, strings.NewReader(content), meta); err != nil {
+		t.Fatalf("Failed to upload %s: %v", name, err)
+	}
+}
+
+// digest returns the hex SHA-256 digest of content
+func digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestFS(t *testing.T) {
+	fsys, server := newTestFS(t)
+	mtime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+	upload(t, fsys, "/2025-12-31/DSC00001.JPG", "first", storage.FileMeta{ModTime: mtime, SHA256: digest("first")})
+	upload(t, fsys, "/2025-12-31/DSC00002.JPG", "second", storage.FileMeta{ModTime: mtime})
+	upload(t, fsys, "/2026-01-01/DSC00003.JPG", "third", storage.FileMeta{ModTime: mtime})
+
+	if names := server.Names("/files"); !reflect.DeepEqual(names, []string{
+		"2025-12-31/DSC00001.JPG", "2025-12-31/DSC00002.JPG", "2026-01-01/DSC00003.JPG",
+	}) {
+		t.Errorf("Unexpected files: %v", names)
+	}
+
+	info, err := fsys.Stat("/2025-12-31/DSC00001.JPG")
+	if err != nil || info.Size() != 5 || info.IsDir() || !info.ModTime().Equal(mtime) {
+		t.Errorf("Unexpected file stat: %v, %v", info, err)
+	}
+	if info, err := fsys.Stat("/2025-12-31"); err != nil || !info.IsDir() {
+		t.Errorf("Collection should be a directory: %v, %v", info, err)
+	}
+	if _, err := fsys.Stat("/2025-12-30"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+	if hash, err := fsys.SHA256("/2025-12-31/DSC00001.JPG"); err != nil || hash != digest("first") {
+		t.Errorf("SHA256 = %q, %v", hash, err)
+	}
+	if hash, err := fsys.SHA256("/2025-12-31/DSC00002.JPG"); err != nil || hash != digest("second") {
+		t.Errorf("SHA256 of a file uploaded without a digest = %q, %v", hash, err)
+	}
+
+	entries, err := fsys.ReadDir("/")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "2025-12-31" || !entries[0].IsDir() {
+		t.Errorf("Unexpected root entries: %v, %v", entries, err)
+	}
+	entries, err = fsys.ReadDir("/2025-12-31")
+	if err != nil || len(entries) != 2 || entries[1].Name() != "DSC00002.JPG" || entries[1].IsDir() {
+		t.Errorf("Unexpected folder entries: %v, %v", entries, err)
+	}
+	if _, err := fsys.ReadDir("/2025-12-31/DSC00001.JPG"); err == nil {
+		t.Error("ReadDir of a file should fail")
+	}
+
+	if data, err := storage.ReadFile(fsys, "/2025-12-31/DSC00002.JPG"); err != nil || string(data) != "second" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	if _, err := fsys.Create("/2025-12-31/DSC00001.JPG", 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create of an existing file should fail with fs.ErrExist, got %v", err)
+	}
+
+	later := mtime.Add(time.Hour)
+	if err := fsys.Chtimes("/2025-12-31/DSC00001.JPG", later, later); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if info, _ := fsys.Stat("/2025-12-31/DSC00001.JPG"); !info.ModTime().Equal(later) {
+		t.Errorf("ModTime = %v, want %v", info.ModTime(), later)
+	}
+	if hash, _ := fsys.SHA256("/2025-12-31/DSC00001.JPG"); hash != digest("first") {
+		t.Errorf("Chtimes should keep the digest, got %q", hash)
+	}
+
+	if err := fsys.Rename("/2026-01-01", "/2026-01-02"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, ok := server.File("2026-01-02/DSC00003.JPG"); !ok {
+		t.Errorf("Renamed file missing: %v", server.Names("/files"))
+	}
+	if err := fsys.Remove("/2025-12-31"); err == nil {
+		t.Error("Remove of a non-empty directory should fail")
+	}
+	if err := fsys.RemoveAll("/2025-12-31"); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := fsys.RemoveAll("/2025-12-31"); err != nil {
+		t.Errorf("RemoveAll of a missing directory should succeed: %v", err)
+	}
+	if names := server.Names("/files"); !reflect.DeepEqual(names, []string{"2026-01-02/DSC00003.JPG"}) {
+		t.Errorf("Unexpected files after RemoveAll: %v", names)
+	}
+
+	// Folders removed by RemoveAll are created again
+	upload(t, fsys, "/2025-12-31/DSC00001.JPG", "first", storage.FileMeta{ModTime: mtime})
+}
+
+func TestSHA256ChangedContent(t *testing.T) {
+	fsys, server := newTestFS(t)
+	upload(t, fsys, "/2025-12-31/DSC00001.JPG", "first", storage.FileMeta{SHA256: digest("first")})
+
+	// Another client replaces the content; the recorded digest no longer applies
+	time.Sleep(time.Millisecond)
+	if err := server.PutFile("2025-12-31/DSC00001.JPG", []byte("edited")); err != nil {
+		t.Fatalf("Failed to replace file: %v", err)
+	}
+	if hash, err := fsys.SHA256("/2025-12-31/DSC00001.JPG"); err != nil || hash != "" {
+		t.Errorf("SHA256 of changed content = %q, %v, want unknown", hash, err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	fsys, server := newTestFS(t)
+	w, err := fsys.Create("/catalog.json", 0644)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	content := bytes.Repeat([]byte("0123456789"), 20)
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if data, ok := server.File("catalog.json"); !ok || !bytes.Equal(data, content) {
+		t.Errorf("Unexpected file: %v", ok)
+	}
+}
+
+func TestUploadChunked(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkRoot bool
+		chunks    int
+	}{
+		{"single request", 63, true, 0},
+		{"exact chunks", 128, true, 2},
+		{"short last chunk", 200, true, 4},
+		{"without chunk collection", 200, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys, server := newTestFS(t)
+			if !tt.chunkRoot {
+				fsys.ChunkRoot = nil
+			}
+			var mu sync.Mutex
+			chunks := 0
+			server.Fault = func(r *http.Request) error {
+				if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, webdavtest.UploadsPath+"/") {
+					mu.Lock()
+					chunks++
+					mu.Unlock()
+				}
+				return nil
+			}
+
+			content := bytes.Repeat([]byte("x"), tt.size)
+			name := "/2025-12-31/C0001.MP4"
+			if err := fsys.Upload(t.Context(), name, bytes.NewReader(content), storage.FileMeta{SHA256: digest(string(content))}); err != nil {
+				t.Fatalf("Upload failed: %v", err)
+			}
+			if data, ok := server.File("2025-12-31/C0001.MP4"); !ok || !bytes.Equal(data, content) {
+				t.Fatalf("Uploaded file differs")
+			}
+			if chunks != tt.chunks {
+				t.Errorf("Uploaded %d chunks, want %d", chunks, tt.chunks)
+			}
+			if hash, _ := fsys.SHA256(name); hash != digest(string(content)) {
+				t.Errorf("Digest property missing, got %q", hash)
+			}
+			if names := server.Names(webdavtest.UploadsPath); len(names) != 0 {
+				t.Errorf("Chunks left behind: %v", names)
+			}
+			if names := server.Names("/files/2025-12-31"); !reflect.DeepEqual(names, []string{"C0001.MP4"}) {
+				t.Errorf("Temporary files left behind: %v", names)
+			}
+		})
+	}
+}
+
+func TestUploadChunkedResume(t *testing.T) {
+	fsys, server := newTestFS(t)
+	sent := map[string]int{}
+	failChunk := "00003"
+	server.Fault = func(r *http.Request) error {
+		if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, webdavtest.UploadsPath+"/") {
+			return nil
+		}
+		chunk := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		sent[chunk]++
+		if chunk == failChunk {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16)
+	name := "/2025-12-31/C0001.MP4"
+	meta := storage.FileMeta{SHA256: digest(string(content))}
+	if err := fsys.Upload(t.Context(), name, bytes.NewReader(content), meta); err == nil {
+		t.Fatal("Upload should fail when a chunk fails")
+	}
+	if _, ok := server.File("2025-12-31/C0001.MP4"); ok {
+		t.Fatal("A failed upload should not create the file")
+	}
+
+	failChunk = ""
+	if err := fsys.Upload(t.Context(), name, bytes.NewReader(content), meta); err != nil {
+		t.Fatalf("Resumed upload failed: %v", err)
+	}
+	if data, ok := server.File("2025-12-31/C0001.MP4"); !ok || !bytes.Equal(data, content) {
+		t.Fatal("Resumed file differs")
+	}
+	if want := map[string]int{"00001": 1, "00002": 1, "00003": 2, "00004": 1}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("Sent chunks %v, want %v", sent, want)
+	}
+}
+
+func TestUploadReadsBackContent(t *testing.T) {
+	fsys, _ := newTestFS(t)
+
+	// The digest of the content the caller meant to send is checked against the stored copy
+	err := fsys.Upload(t.Context(), "/2025-12-31/DSC00001.JPG", strings.NewReader("damaged"), storage.FileMeta{SHA256: digest("photo")})
+	if err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Errorf("Upload of content that does not match its digest = %v, want an error", err)
+	}
+}
+
+func TestUploadFailureKeepsTarget(t *testing.T) {
+	fsys, server := newTestFS(t)
+	upload(t, fsys, "/2025-12-31/DSC00001.JPG", "first", storage.FileMeta{})
+	server.Fault = func(r *http.Request) error {
+		if r.Method == "MOVE" {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+
+	if err := fsys.Upload(t.Context(), "/2025-12-31/DSC00001.JPG", strings.NewReader("second"), storage.FileMeta{}); err == nil {
+		t.Fatal("Upload should fail when the move fails")
+	}
+	if data, _ := server.File("2025-12-31/DSC00001.JPG"); string(data) != "first" {
+		t.Errorf("The existing file should be kept, got %q", data)
+	}
+	if names := server.Names("/files/2025-12-31"); !reflect.DeepEqual(names, []string{"DSC00001.JPG"}) {
+		t.Errorf("Temporary files left behind: %v", names)
+	}
+}
+
+func TestNew(t *testing.T) {
+	server := webdavtest.NewServer("alice", "secret")
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		cfg     config.WebDAVConfig
+		wantErr bool
+	}{
+		{"valid", config.WebDAVConfig{URL: server.FilesURL(), User: "alice", Password: "secret"}, false},
+		{"chunked", config.WebDAVConfig{URL: server.FilesURL(), ChunkURL: server.UploadsURL(), ChunkSizeMB: 5}, false},
+		{"missing url", config.WebDAVConfig{}, true},
+		{"not http", config.WebDAVConfig{URL: "ftp://example.com/photos"}, true},
+		{"invalid chunk url", config.WebDAVConfig{URL: server.FilesURL(), ChunkURL: "uploads"}, true},
+		{"small chunks", config.WebDAVConfig{URL: server.FilesURL(), ChunkSizeMB: 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	fsys, _ := New(config.WebDAVConfig{URL: server.FilesURL(), User: "alice", Password: "wrong"})
+	if _, err := fsys.Stat("/"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("A wrong password should be reported, got %v", err)
+	}
+}
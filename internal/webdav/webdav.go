@@ -0,0 +1,269 @@
+// Package webdav stores files in a collection of a WebDAV server, such as a Nextcloud share.
+// It uses the PUT, MKCOL, PROPFIND, PROPPATCH, MOVE and DELETE methods of RFC 4918
+// and the chunked uploads of Nextcloud.
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// propNS is the namespace of the dead properties written with every file
+const propNS = "https://github.com/shunichi-ikebuchi/rename-sony-photos-directories"
+
+// Client sends requests to one WebDAV server
+type Client struct {
+	User     string
+	Password string
+	HTTP     *http.Client
+}
+
+// Error is an unexpected status returned by the server
+type Error struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("webdav: %s returned HTTP %d", e.Method, e.StatusCode)
+}
+
+// Is reports missing resources as fs.ErrNotExist
+func (e *Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// resource is the state of a file or collection reported by PROPFIND
+type resource struct {
+	// Path is the unescaped URL path of the resource, without trailing slash
+	Path    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+	ETag    string
+	// SHA256 is the digest recorded by Upload, or "" when the content changed since
+	SHA256 string
+}
+
+// join returns the URL of the slash-separated name below base
+func join(base *url.URL, name string) string {
+	u := *base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(name, "/")
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// do sends a request to target and returns the response of a 2xx status.
+// Other statuses are returned as *Error. A body of unknown size is sent with size -1.
+func (c *Client) do(ctx context.Context, method, target string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		return nil, &Error{Method: method, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// send sends a request without reading the response body
+func (c *Client) send(ctx context.Context, method, target string, header http.Header, body []byte) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	resp, err := c.do(ctx, method, target, header, r, int64(len(body)))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:r="` + propNS + `"><d:prop>
+<d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/>
+<r:mtime/><r:sha256/><r:sha256-etag/>
+</d:prop></d:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+				ModTime       string `xml:"https://github.com/shunichi-ikebuchi/rename-sony-photos-directories mtime"`
+				SHA256        string `xml:"https://github.com/shunichi-ikebuchi/rename-sony-photos-directories sha256"`
+				SHA256ETag    string `xml:"https://github.com/shunichi-ikebuchi/rename-sony-photos-directories sha256-etag"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns target and, with depth 1, its members
+func (c *Client) propfind(ctx context.Context, target string, depth int) ([]resource, error) {
+	header := http.Header{"Depth": {strconv.Itoa(depth)}, "Content-Type": {"application/xml"}}
+	resp, err := c.do(ctx, "PROPFIND", target, header, strings.NewReader(propfindBody), int64(len(propfindBody)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode PROPFIND response: %w", err)
+	}
+
+	resources := make([]resource, 0, len(result.Responses))
+	for _, response := range result.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %q: %w", response.Href, err)
+		}
+		res := resource{Path: strings.TrimSuffix(href.Path, "/")}
+		var recordedETag string
+		for _, propstat := range response.Propstats {
+			// Properties the server does not know are reported with a 404 status
+			if !strings.Contains(propstat.Status, " 200") {
+				continue
+			}
+			prop := propstat.Prop
+			if prop.ResourceType.Collection != nil {
+				res.Dir = true
+			}
+			if prop.ContentLength != "" {
+				res.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+			if prop.LastModified != "" && res.ModTime.IsZero() {
+				res.ModTime, _ = http.ParseTime(prop.LastModified)
+			}
+			if mtime, err := time.Parse(time.RFC3339Nano, prop.ModTime); err == nil {
+				res.ModTime = mtime
+			}
+			if prop.ETag != "" {
+				res.ETag = prop.ETag
+			}
+			if prop.SHA256 != "" {
+				res.SHA256, recordedETag = prop.SHA256, prop.SHA256ETag
+			}
+		}
+		// The digest only describes the content it was recorded for
+		if res.ETag == "" || recordedETag != res.ETag {
+			res.SHA256 = ""
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
+// stat returns the resource target
+func (c *Client) stat(ctx context.Context, target string) (resource, error) {
+	resources, err := c.propfind(ctx, target, 0)
+	if err != nil {
+		return resource{}, err
+	}
+	if len(resources) == 0 {
+		return resource{}, fmt.Errorf("webdav: empty PROPFIND response for %s", target)
+	}
+	return resources[0], nil
+}
+
+// proppatch sets the dead properties of target. Servers that do not keep dead
+// properties refuse them individually; that is not an error.
+func (c *Client) proppatch(ctx context.Context, target string, props map[string]string) error {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	body.WriteString(`<d:propertyupdate xmlns:d="DAV:" xmlns:r="` + propNS + `"><d:set><d:prop>`)
+	for name, value := range props {
+		body.WriteString("<r:" + name + ">")
+		xml.EscapeText(&body, []byte(value))
+		body.WriteString("</r:" + name + ">")
+	}
+	body.WriteString(`</d:prop></d:set></d:propertyupdate>`)
+	return c.send(ctx, "PROPPATCH", target, http.Header{"Content-Type": {"application/xml"}}, []byte(body.String()))
+}
+
+// mkcol creates the collection target; an existing resource is reported as fs.ErrExist
+func (c *Client) mkcol(ctx context.Context, target string, header http.Header) error {
+	err := c.send(ctx, "MKCOL", target, header, nil)
+	if e, ok := err.(*Error); ok && e.StatusCode == http.StatusMethodNotAllowed {
+		return fs.ErrExist
+	}
+	return err
+}
+
+// put stores the content of r as target
+func (c *Client) put(ctx context.Context, target string, header http.Header, r io.Reader, size int64) error {
+	resp, err := c.do(ctx, http.MethodPut, target, header, r, size)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// move renames source to destination, replacing it
+func (c *Client) move(ctx context.Context, source, destination string, header http.Header) error {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Destination", destination)
+	header.Set("Overwrite", "T")
+	return c.send(ctx, "MOVE", source, header, nil)
+}
+
+// delete removes target with its members
+func (c *Client) delete(ctx context.Context, target string) error {
+	return c.send(ctx, http.MethodDelete, target, nil, nil)
+}
+
+// get returns the content of target
+func (c *Client) get(ctx context.Context, target string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, target, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// base returns the last element of the URL path p
+func base(p string) string {
+	return path.Base("/" + p)
+}
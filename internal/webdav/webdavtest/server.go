@@ -0,0 +1,195 @@
+// Package webdavtest runs an in-process WebDAV server for tests. It serves an in-memory
+// file system with the handler of golang.org/x/net/webdav, which keeps dead properties,
+// and assembles Nextcloud chunked uploads moved from the uploads collection.
+package webdavtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// FilesPath is the collection holding the files
+	FilesPath = "/files"
+	// UploadsPath is the collection holding the chunked uploads
+	UploadsPath = "/uploads"
+)
+
+// Server is a WebDAV server accepting one user
+type Server struct {
+	*httptest.Server
+	User     string
+	Password string
+	// Fault, when set, is called before every request; a non-nil error fails it with a 500 status
+	Fault func(r *http.Request) error
+
+	fs      webdav.FileSystem
+	handler *webdav.Handler
+}
+
+// NewServer starts a server with empty files and uploads collections
+func NewServer(user, password string) *Server {
+	s := &Server{User: user, Password: password, fs: webdav.NewMemFS()}
+	s.handler = &webdav.Handler{FileSystem: s.fs, LockSystem: webdav.NewMemLS()}
+	for _, dir := range []string{FilesPath, UploadsPath} {
+		s.fs.Mkdir(context.Background(), dir, 0755)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// FilesURL returns the URL of the files collection
+func (s *Server) FilesURL() string {
+	return s.URL + FilesPath
+}
+
+// UploadsURL returns the URL of the uploads collection
+func (s *Server) UploadsURL() string {
+	return s.URL + UploadsPath
+}
+
+// File returns the content of the file name below the files collection
+func (s *Server) File(name string) ([]byte, bool) {
+	f, err := s.fs.OpenFile(context.Background(), path.Join(FilesPath, name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	return data, err == nil
+}
+
+// PutFile stores data as name below the files collection, creating its parents
+func (s *Server) PutFile(name string, data []byte) error {
+	return s.writeFile(path.Join(FilesPath, name), data)
+}
+
+// Names returns the paths of the files below the collection root, in order
+func (s *Server) Names(root string) []string {
+	var names []string
+	s.walk(root, func(name string) {
+		names = append(names, strings.TrimPrefix(name, root+"/"))
+	})
+	sort.Strings(names)
+	return names
+}
+
+// walk calls fn with the path of every file below dir
+func (s *Server) walk(dir string, fn func(name string)) {
+	f, err := s.fs.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	infos, _ := f.Readdir(-1)
+	f.Close()
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			s.walk(name, fn)
+		} else {
+			fn(name)
+		}
+	}
+}
+
+func (s *Server) writeFile(name string, data []byte) error {
+	ctx := context.Background()
+	dir := "/"
+	for _, elem := range strings.Split(strings.Trim(path.Dir(name), "/"), "/") {
+		dir = path.Join(dir, elem)
+		s.fs.Mkdir(ctx, dir, 0755)
+	}
+	f, err := s.fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != s.User || password != s.Password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="webdavtest"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if s.Fault != nil {
+		if err := s.Fault(r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if r.Method == "MOVE" && strings.HasPrefix(r.URL.Path, UploadsPath+"/") && path.Base(r.URL.Path) == ".file" {
+		s.assemble(w, r)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// assemble concatenates the chunks of the upload collection in name order and
+// stores the result at the destination, as Nextcloud does
+func (s *Server) assemble(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	dir := path.Dir(r.URL.Path)
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(destination.Path, FilesPath+"/") {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+
+	f, err := s.fs.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	var data bytes.Buffer
+	for _, info := range infos {
+		chunk, err := s.fs.OpenFile(ctx, path.Join(dir, info.Name()), os.O_RDONLY, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		io.Copy(&data, chunk)
+		chunk.Close()
+	}
+	if total := r.Header.Get("OC-Total-Length"); total != "" && total != strconv.Itoa(data.Len()) {
+		http.Error(w, fmt.Sprintf("assembled %d bytes, expected %s", data.Len(), total), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.fs.Stat(ctx, path.Dir(destination.Path)); err != nil {
+		http.Error(w, "missing parent collection", http.StatusConflict)
+		return
+	}
+	s.fs.RemoveAll(ctx, destination.Path)
+	if err := s.writeFile(destination.Path, data.Bytes()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.fs.RemoveAll(ctx, dir)
+	w.WriteHeader(http.StatusCreated)
+}
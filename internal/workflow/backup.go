@@ -0,0 +1,130 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// ErrNotArchived is returned when files on the backup card have no identical copy in the archive
+var ErrNotArchived = errors.New("files on backup card are not archived")
+
+// BackupCheck is the result of comparing a backup card against the archive
+type BackupCheck struct {
+	// Archived maps each backup file to an identical archived copy
+	Archived map[string]string
+	// Unmatched lists backup files without an identical archived copy
+	Unmatched []string
+}
+
+// VerifyBackup hashes every file under dir and looks it up in the archive index.
+// Hidden files are ignored, as they are by the index.
+func VerifyBackup(ctx context.Context, fsys storage.FS, dir string, idx *index.Index) (*BackupCheck, error) {
+	check := &BackupCheck{Archived: make(map[string]string)}
+
+	err := storage.WalkDir(fsys, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hash, err := hashFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		archived, err := archivedCopy(idx, hash)
+		if err != nil {
+			return err
+		}
+		if archived != "" {
+			check.Archived[path] = archived
+		} else {
+			check.Unmatched = append(check.Unmatched, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify backup files: %w", err)
+	}
+
+	sort.Strings(check.Unmatched)
+	return check, nil
+}
+
+// RemoveArchived deletes the backup files that have an archived copy,
+// then removes directories under dir that became empty. dir itself is kept.
+// A cancelled ctx stops the deletion between two files.
+func RemoveArchived(ctx context.Context, fsys storage.FS, dir string, check *BackupCheck, dryRun bool) error {
+	paths := make([]string, 0, len(check.Archived))
+	for path := range check.Archived {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if dryRun {
+			log.Printf("[DRY RUN] Would delete %s (archived as %s)", path, check.Archived[path])
+			continue
+		}
+		if err := fsys.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+	return removeEmptyDirs(fsys, dir, dir)
+}
+
+// removeEmptyDirs removes empty directories of fsys below path, keeping root
+func removeEmptyDirs(fsys storage.FS, path, root string) error {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	empty := true
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			empty = false
+			continue
+		}
+		child := filepath.Join(path, entry.Name())
+		if err := removeEmptyDirs(fsys, child, root); err != nil {
+			return err
+		}
+		if _, err := fsys.Stat(child); err == nil {
+			empty = false
+		}
+	}
+
+	if empty && path != root {
+		if err := fsys.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package workflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func setupBackupCard(t *testing.T, archived, card map[string]string) *config.Config {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "backup-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	cfg := &config.Config{
+		BackupPath:      filepath.Join(tmpDir, "card"),
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+	}
+
+	write := func(root string, files map[string]string) {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		for name, content := range files {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("Failed to create dir: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+		}
+	}
+	write(cfg.DestinationPath, archived)
+	write(filepath.Join(cfg.BackupPath, "DCIM"), card)
+
+	return cfg
+}
+
+func TestRunBackupCleanupAllArchived(t *testing.T) {
+	cfg := setupBackupCard(t,
+		map[string]string{
+			"2025-12-31/DSC00001.JPG": "photo one",
+			"2025-12-31/DSC00002.ARW": "photo two",
+		},
+		map[string]string{
+			"10051231/DSC00001.JPG": "photo one",
+			"10051231/DSC00002.ARW": "photo two",
+		},
+	)
+
+	if err := RunBackupCleanup(t.Context(), cfg, false); err != nil {
+		t.Fatalf("RunBackupCleanup failed: %v", err)
+	}
+
+	dcim := filepath.Join(cfg.BackupPath, "DCIM")
+	entries, err := os.ReadDir(dcim)
+	if err != nil {
+		t.Fatalf("DCIM should still exist: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("DCIM should be empty, but has %d entries", len(entries))
+	}
+}
+
+func TestRunBackupCleanupKeepsUnmatched(t *testing.T) {
+	cfg := setupBackupCard(t,
+		map[string]string{
+			"2025-12-31/DSC00001.JPG": "photo one",
+		},
+		map[string]string{
+			"10051231/DSC00001.JPG": "photo one",
+			"10051231/DSC00002.JPG": "never imported",
+		},
+	)
+
+	err := RunBackupCleanup(t.Context(), cfg, false)
+	if !errors.Is(err, ErrNotArchived) {
+		t.Fatalf("Expected ErrNotArchived, got %v", err)
+	}
+
+	day := filepath.Join(cfg.BackupPath, "DCIM", "10051231")
+	if _, err := os.Stat(filepath.Join(day, "DSC00001.JPG")); !os.IsNotExist(err) {
+		t.Error("Archived file should have been deleted")
+	}
+	if _, err := os.Stat(filepath.Join(day, "DSC00002.JPG")); err != nil {
+		t.Errorf("Unmatched file should be left in place: %v", err)
+	}
+}
+
+func TestRunBackupCleanupDryRun(t *testing.T) {
+	cfg := setupBackupCard(t,
+		map[string]string{"2025-12-31/DSC00001.JPG": "photo one"},
+		map[string]string{"10051231/DSC00001.JPG": "photo one"},
+	)
+
+	if err := RunBackupCleanup(t.Context(), cfg, true); err != nil {
+		t.Fatalf("RunBackupCleanup with dry-run failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.BackupPath, "DCIM", "10051231", "DSC00001.JPG")); err != nil {
+		t.Errorf("File should still exist in dry-run mode: %v", err)
+	}
+}
+
+func TestRunBackupCleanupKeepsFilesWithDamagedArchiveCopy(t *testing.T) {
+	cfg := setupBackupCard(t,
+		map[string]string{"2025-12-31/DSC00001.JPG": "photo one"},
+		map[string]string{"10051231/DSC00001.JPG": "photo one"},
+	)
+	idx, err := OpenIndex(t.Context(), cfg)
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	if err := idx.Save(); err != nil {
+		t.Fatalf("Failed to save index: %v", err)
+	}
+
+	// Damage the archive copy without changing its size or time, so the index keeps its hash
+	archived := filepath.Join(cfg.DestinationPath, "2025-12-31", "DSC00001.JPG")
+	info, err := os.Stat(archived)
+	if err != nil {
+		t.Fatalf("Failed to stat archived file: %v", err)
+	}
+	if err := os.WriteFile(archived, []byte("photo 0ne"), 0644); err != nil {
+		t.Fatalf("Failed to damage archived file: %v", err)
+	}
+	if err := os.Chtimes(archived, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+
+	if err := RunBackupCleanup(t.Context(), cfg, false); !errors.Is(err, ErrNotArchived) {
+		t.Fatalf("Expected ErrNotArchived, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupPath, "DCIM", "10051231", "DSC00001.JPG")); err != nil {
+		t.Errorf("File whose archive copy is damaged should be left on the card: %v", err)
+	}
+}
+
+func TestRunBackupCleanupIgnoresDestinations(t *testing.T) {
+	cfg := setupBackupCard(t,
+		map[string]string{"2025-12-31/DSC00001.JPG": "photo one"},
+		map[string]string{"10051231/DSC00001.JPG": "photo one"},
+	)
+	// Backup cards are only verified against the archive, so an unreachable destination does not matter
+	cfg.Destinations = []config.DestinationConfig{{Name: "nas", Path: filepath.Join(cfg.DestinationPath, "..", "missing")}}
+
+	if err := RunBackupCleanup(t.Context(), cfg, false); err != nil {
+		t.Fatalf("RunBackupCleanup failed: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/clip"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// stageClips copies the XAVC clips of the card into the date folders of the staging directory,
+// next to the stills recorded on the same day
+func stageClips(ctx context.Context, state *RunState) error {
+	clips, err := clip.Scan(state.Card, state.Source.Path)
+	if err != nil {
+		return err
+	}
+	if len(clips) == 0 {
+		return nil
+	}
+
+	folders, err := dateFolders(state.TmpDir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copying video clips from %s to %s", filepath.Join(state.Source.Path, clip.RootDir), state.TmpDir)
+	state.StagedClips = map[string]string{}
+	state.Clips = nil
+	for _, c := range clips {
+		if state.selective() {
+			info, err := state.Card.Stat(c.Video)
+			if err != nil {
+				return fmt.Errorf("failed to stat clip: %w", err)
+			}
+			file := cardFile(state.Source.Path, c.Video, info)
+			file.Date = c.Date
+			if !state.Filter.Match(file) {
+				continue
+			}
+			imported, err := alreadyImported(state, c.Video, info)
+			if err != nil {
+				return err
+			}
+			if imported {
+				continue
+			}
+		}
+
+		state.Clips = append(state.Clips, c)
+		day := c.Date.Format("2006-01-02")
+		folder, ok := folders[day]
+		if !ok {
+			folder = rename.DirName(c.Date)
+			folders[day] = folder
+		}
+
+		for _, file := range c.Files() {
+			target := filepath.Join(state.TmpDir, folder, filepath.Base(file))
+			state.StagedClips[file] = target
+			if state.DryRun {
+				log.Printf("[DRY RUN] Would copy clip file: %s -> %s", file, target)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			if err := copyFile(ctx, state.Card, file, storage.Local{}, target); err != nil {
+				return fmt.Errorf("failed to copy clip %s: %w", c.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// dateFolders maps dates to the Sony date folders already present in dir
+func dateFolders(dir string) (map[string]string, error) {
+	folders := map[string]string{}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return folders, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staging directory: %w", err)
+	}
+
+	century := fmt.Sprintf("%d", time.Now().Year())[:2]
+	for _, entry := range entries {
+		if !entry.IsDir() || !rename.IsValidDateDir(entry.Name()) {
+			continue
+		}
+		date, err := rename.ParseDirName(entry.Name(), century)
+		if err != nil {
+			continue
+		}
+		folders[date.Format("2006-01-02")] = entry.Name()
+	}
+	return folders, nil
+}
+
+// deleteClips removes the staged clips from the card once they are dropped from its clip index
+func deleteClips(state *RunState) error {
+	if err := forgetClips(state); err != nil {
+		return err
+	}
+	for file := range state.StagedClips {
+		if state.DryRun {
+			log.Printf("[DRY RUN] Would delete clip file: %s", file)
+			continue
+		}
+		if err := state.Card.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete clip file: %w", err)
+		}
+	}
+	return nil
+}
+
+// forgetClips drops the staged clips from the clip index of the card and deletes their
+// thumbnails, so that the camera does not list clips whose files are taken off the card
+func forgetClips(state *RunState) error {
+	if len(state.Clips) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, c := range state.Clips {
+		names = append(names, c.Name)
+	}
+	if state.DryRun {
+		log.Printf("[DRY RUN] Would remove %d clips from the clip index: %s", len(names), filepath.Join(state.Source.Path, clip.ProfileFile))
+	} else if err := clip.RemoveFromProfile(state.Card, state.Source.Path, names); err != nil {
+		return err
+	}
+
+	for _, c := range state.Clips {
+		for _, thumbnail := range c.Thumbnails {
+			if state.DryRun {
+				log.Printf("[DRY RUN] Would delete clip thumbnail: %s", thumbnail)
+				continue
+			}
+			if err := state.Card.Remove(thumbnail); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to delete clip thumbnail: %w", err)
+			}
+		}
+	}
+	return nil
+}
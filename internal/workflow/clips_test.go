@@ -0,0 +1,108 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestRunImportsClips(t *testing.T) {
+	useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "clips-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		Pipeline: config.PipelineConfig{
+			Main: []string{StageCopy, StageVerify, StageRename, StageArchive, StageDelete, StageCleanup},
+		},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{
+		"DCIM/02512310/DSC00001.JPG":         "photo",
+		"PRIVATE/M4ROOT/CLIP/C0001.MP4":      "video same day",
+		"PRIVATE/M4ROOT/CLIP/C0001M01.XML":   `<NonRealTimeMeta><CreationDate value="2025-12-31T23:30:00+09:00"/></NonRealTimeMeta>`,
+		"PRIVATE/M4ROOT/SUB/C0001S03.MP4":    "proxy",
+		"PRIVATE/M4ROOT/CLIP/C0002.MP4":      "video other day",
+		"PRIVATE/M4ROOT/CLIP/C0002M01.XML":   `<NonRealTimeMeta><CreationDate value="2026-01-02T08:00:00+09:00"/></NonRealTimeMeta>`,
+		"PRIVATE/M4ROOT/THMBNL/C0001T01.JPG": "thumbnail",
+		"PRIVATE/M4ROOT/MEDIAPRO.XML": `<MediaProfile>
+	<Contents>
+		<Material uri="./Clip/C0001.MP4" type="MP4"/>
+		<Material uri="./Clip/C0002.MP4" type="MP4"/>
+	</Contents>
+</MediaProfile>
+`,
+	})
+
+	if err := Run(t.Context(), cfg, false); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"2025-12-31/DSC00001.JPG": "photo",
+		"2025-12-31/C0001.MP4":    "video same day",
+		"2025-12-31/C0001S03.MP4": "proxy",
+		"2026-01-02/C0002.MP4":    "video other day",
+	}
+	for name, content := range expected {
+		if got := readFile(t, filepath.Join(cfg.DestinationPath, filepath.FromSlash(name))); got != content {
+			t.Errorf("%s has content %q, want %q", name, got, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DestinationPath, "2025-12-31", "C0001M01.XML")); err != nil {
+		t.Errorf("Clip metadata was not archived: %v", err)
+	}
+
+	for _, name := range []string{"PRIVATE/M4ROOT/CLIP/C0001.MP4", "PRIVATE/M4ROOT/SUB/C0001S03.MP4", "PRIVATE/M4ROOT/CLIP/C0002M01.XML", "PRIVATE/M4ROOT/THMBNL/C0001T01.JPG"} {
+		if _, err := os.Stat(filepath.Join(cfg.TargetPath, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("Imported clip file %s should have been deleted from the card", name)
+		}
+	}
+	// The camera must not list the deleted clips
+	if got := readFile(t, filepath.Join(cfg.TargetPath, "PRIVATE", "M4ROOT", "MEDIAPRO.XML")); got != "<MediaProfile>\n\t<Contents>\n\t</Contents>\n</MediaProfile>\n" {
+		t.Errorf("Deleted clips should be removed from the card database, got %q", got)
+	}
+}
+
+func TestRunClipsDryRun(t *testing.T) {
+	useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "clips-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{
+		"DCIM/02512310/DSC00001.JPG":    "photo",
+		"PRIVATE/M4ROOT/CLIP/C0001.MP4": "video",
+	})
+
+	if _, err := RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), true); err != nil {
+		t.Fatalf("RunSources failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.TargetPath, "PRIVATE", "M4ROOT", "CLIP", "C0001.MP4")); err != nil {
+		t.Error("Clip should still exist in dry-run mode")
+	}
+	if _, err := os.Stat(cfg.TmpDir); !os.IsNotExist(err) {
+		t.Error("Staging directory should not be created in dry-run mode")
+	}
+}
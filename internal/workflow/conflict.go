@@ -0,0 +1,202 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// ConflictPolicy decides what happens when a file already exists in the destination
+// with different content. Identical files (same size and hash) are always skipped.
+type ConflictPolicy string
+
+const (
+	// ConflictKeepBoth copies the new file next to the existing one with a numeric suffix
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+	// ConflictOverwrite replaces the existing file
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictSkip leaves the existing file untouched and does not copy the new one
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictAbort stops the workflow at the first conflicting file
+	ConflictAbort ConflictPolicy = "abort"
+)
+
+// ErrConflict is returned when a conflicting file is found and the policy is ConflictAbort.
+var ErrConflict = errors.New("destination file already exists with different content")
+
+// ErrSkippedConflicts is returned by the delete stage when files skipped by ConflictSkip
+// have no archived copy, so the card is kept
+var ErrSkippedConflicts = errors.New("conflicting files were not archived")
+
+// ParseConflictPolicy converts a configuration value to a ConflictPolicy.
+// An empty value selects ConflictKeepBoth.
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case "":
+		return ConflictKeepBoth, nil
+	case ConflictKeepBoth, ConflictOverwrite, ConflictSkip, ConflictAbort:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy: %q", value)
+	}
+}
+
+// MergeOptions controls how MergeDir treats files that are already archived
+type MergeOptions struct {
+	// Policy resolves files that exist at the same destination path with different content
+	Policy ConflictPolicy
+	// Index, when set, is consulted to skip files archived anywhere under its root
+	// and is updated with every file written. It requires a destination on local disk.
+	Index *index.Index
+	// Summary receives every per-file decision
+	Summary *Summary
+}
+
+// MergeDir recursively copies src of srcFS into dst of dstFS, resolving existing files with opts.
+// When ctx is cancelled the file being copied is rolled back and ctx.Err() is returned.
+func MergeDir(ctx context.Context, srcFS storage.FS, src string, dstFS storage.FS, dst string, opts MergeOptions, dryRun bool) error {
+	if dryRun {
+		log.Printf("[DRY RUN] Would merge directory: %s -> %s (conflict policy: %s)", src, dst, opts.Policy)
+		return nil
+	}
+	entries, err := srcFS.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("failed to read source directory: %w", err)
+	}
+
+	if err := dstFS.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+
+		if entry.IsDir() {
+			if err := MergeDir(ctx, srcFS, srcPath, dstFS, dstPath, opts, false); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := mergeFile(ctx, srcFS, srcPath, dstFS, dstPath, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeFile copies a single file into dst according to opts
+func mergeFile(ctx context.Context, srcFS storage.FS, src string, dstFS storage.FS, dst string, opts MergeOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	summary := opts.Summary
+
+	var hash string
+	if opts.Index != nil {
+		var err error
+		if hash, err = hashFile(srcFS, src); err != nil {
+			return err
+		}
+		archived, err := archivedCopy(opts.Index, hash)
+		if err != nil {
+			return err
+		}
+		if archived != "" {
+			if archived == dst {
+				summary.record(src, dst, ActionSkippedIdentical)
+			} else {
+				summary.record(src, archived, ActionSkippedArchived)
+			}
+			return nil
+		}
+	}
+
+	target, action, err := resolveTarget(srcFS, src, dstFS, dst, opts.Policy)
+	if err != nil || target == "" {
+		summary.record(src, dst, action)
+		return err
+	}
+
+	if err := copyFile(ctx, srcFS, src, dstFS, target); err != nil {
+		return err
+	}
+	summary.record(src, target, action)
+
+	if opts.Index != nil {
+		if err := opts.Index.Add(target, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveTarget decides where src should be written when merging into dst.
+// An empty target means nothing is written; action describes the decision.
+func resolveTarget(srcFS storage.FS, src string, dstFS storage.FS, dst string, policy ConflictPolicy) (string, Action, error) {
+	if _, err := dstFS.Stat(dst); errors.Is(err, fs.ErrNotExist) {
+		return dst, ActionCopied, nil
+	} else if err != nil {
+		return "", ActionAborted, fmt.Errorf("failed to check destination file: %w", err)
+	}
+
+	same, err := identical(srcFS, src, dstFS, dst)
+	if err != nil {
+		return "", ActionAborted, fmt.Errorf("failed to compare %s with %s: %w", src, dst, err)
+	}
+	if same {
+		return "", ActionSkippedIdentical, nil
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		return dst, ActionOverwritten, nil
+	case ConflictSkip:
+		return "", ActionSkippedConflict, nil
+	case ConflictAbort:
+		return "", ActionAborted, fmt.Errorf("%w: %s", ErrConflict, dst)
+	default:
+		alt, same, err := findAlternateName(srcFS, src, dstFS, dst)
+		if err != nil {
+			return "", ActionAborted, err
+		}
+		if same {
+			return "", ActionSkippedIdentical, nil
+		}
+		return alt, ActionKeptBoth, nil
+	}
+}
+
+// findAlternateName returns the first free "name_N.ext" path next to dst.
+// If an earlier suffixed copy already has the same content, that path is returned
+// together with identical set to true.
+func findAlternateName(srcFS storage.FS, src string, dstFS storage.FS, dst string) (string, bool, error) {
+	ext := filepath.Ext(dst)
+	base := strings.TrimSuffix(dst, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if _, err := dstFS.Stat(candidate); errors.Is(err, fs.ErrNotExist) {
+			return candidate, false, nil
+		} else if err != nil {
+			return "", false, fmt.Errorf("failed to check destination file: %w", err)
+		}
+
+		same, err := identical(srcFS, src, dstFS, candidate)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to compare %s with %s: %w", src, candidate, err)
+		}
+		if same {
+			return candidate, true, nil
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package workflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+func setupConflictDirs(t *testing.T) (string, string) {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "merge-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	srcDir := filepath.Join(tmpDir, "source", "2025-12-31")
+	dstDir := filepath.Join(tmpDir, "destination", "2025-12-31")
+	for _, dir := range []string{srcDir, dstDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	files := map[string]string{
+		filepath.Join(srcDir, "DSC00001.JPG"): "new photo",
+		filepath.Join(dstDir, "DSC00001.JPG"): "old photo",
+		filepath.Join(srcDir, "DSC00002.JPG"): "same photo",
+		filepath.Join(dstDir, "DSC00002.JPG"): "same photo",
+		filepath.Join(srcDir, "DSC00003.JPG"): "fresh photo",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	return filepath.Join(tmpDir, "source"), filepath.Join(tmpDir, "destination")
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    ConflictPolicy
+		shouldError bool
+	}{
+		{"", ConflictKeepBoth, false},
+		{"keep-both", ConflictKeepBoth, false},
+		{"Overwrite", ConflictOverwrite, false},
+		{"skip", ConflictSkip, false},
+		{"abort", ConflictAbort, false},
+		{"rename", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := ParseConflictPolicy(tt.input)
+			if tt.shouldError {
+				if err == nil {
+					t.Errorf("ParseConflictPolicy(%q) expected error, got nil", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConflictPolicy(%q) unexpected error: %v", tt.input, err)
+			}
+			if result != tt.expected {
+				t.Errorf("ParseConflictPolicy(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMergeDirKeepBoth(t *testing.T) {
+	src, dst := setupConflictDirs(t)
+	day := filepath.Join(dst, "2025-12-31")
+
+	summary := &Summary{}
+	if err := MergeDir(t.Context(), storage.Local{}, src, storage.Local{}, dst, MergeOptions{Policy: ConflictKeepBoth, Summary: summary}, false); err != nil {
+		t.Fatalf("MergeDir failed: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(day, "DSC00001.JPG")); got != "old photo" {
+		t.Errorf("Existing file was modified: %q", got)
+	}
+	if got := readFile(t, filepath.Join(day, "DSC00001_1.JPG")); got != "new photo" {
+		t.Errorf("Suffixed copy has wrong content: %q", got)
+	}
+	if got := readFile(t, filepath.Join(day, "DSC00003.JPG")); got != "fresh photo" {
+		t.Errorf("New file has wrong content: %q", got)
+	}
+
+	if summary.Count(ActionKeptBoth) != 1 || summary.Count(ActionSkippedIdentical) != 1 || summary.Count(ActionCopied) != 1 {
+		t.Errorf("Unexpected summary: %+v", summary.Decisions)
+	}
+
+	// A second merge must recognise the suffixed copy instead of creating DSC00001_2.JPG
+	second := &Summary{}
+	if err := MergeDir(t.Context(), storage.Local{}, src, storage.Local{}, dst, MergeOptions{Policy: ConflictKeepBoth, Summary: second}, false); err != nil {
+		t.Fatalf("Second MergeDir failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(day, "DSC00001_2.JPG")); !os.IsNotExist(err) {
+		t.Error("Second merge should not create another suffixed copy")
+	}
+	if second.Count(ActionSkippedIdentical) != 3 {
+		t.Errorf("Expected 3 identical skips on second merge, got %+v", second.Decisions)
+	}
+}
+
+func TestMergeDirOverwrite(t *testing.T) {
+	src, dst := setupConflictDirs(t)
+
+	summary := &Summary{}
+	if err := MergeDir(t.Context(), storage.Local{}, src, storage.Local{}, dst, MergeOptions{Policy: ConflictOverwrite, Summary: summary}, false); err != nil {
+		t.Fatalf("MergeDir failed: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(dst, "2025-12-31", "DSC00001.JPG")); got != "new photo" {
+		t.Errorf("File was not overwritten: %q", got)
+	}
+	if summary.Count(ActionOverwritten) != 1 {
+		t.Errorf("Expected 1 overwrite, got %+v", summary.Decisions)
+	}
+}
+
+func TestMergeDirSkip(t *testing.T) {
+	src, dst := setupConflictDirs(t)
+
+	summary := &Summary{}
+	if err := MergeDir(t.Context(), storage.Local{}, src, storage.Local{}, dst, MergeOptions{Policy: ConflictSkip, Summary: summary}, false); err != nil {
+		t.Fatalf("MergeDir failed: %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(dst, "2025-12-31", "DSC00001.JPG")); got != "old photo" {
+		t.Errorf("Existing file was modified: %q", got)
+	}
+	if summary.Count(ActionSkippedConflict) != 1 {
+		t.Errorf("Expected 1 skipped conflict, got %+v", summary.Decisions)
+	}
+}
+
+func TestMergeDirAbort(t *testing.T) {
+	src, dst := setupConflictDirs(t)
+
+	summary := &Summary{}
+	err := MergeDir(t.Context(), storage.Local{}, src, storage.Local{}, dst, MergeOptions{Policy: ConflictAbort, Summary: summary}, false)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(dst, "2025-12-31", "DSC00001.JPG")); got != "old photo" {
+		t.Errorf("Existing file was modified: %q", got)
+	}
+	if summary.Count(ActionAborted) != 1 {
+		t.Errorf("Expected 1 aborted decision, got %+v", summary.Decisions)
+	}
+}
+
+func TestMergeDirSkipsArchivedContent(t *testing.T) {
+	src, dst := setupConflictDirs(t)
+
+	// The same photo is already archived under another day and name
+	other := filepath.Join(dst, "2025-12-30")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "IMG_0001.JPG"), []byte("fresh photo"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	idx, err := index.Load(dst, filepath.Join(dst, index.DefaultFileName))
+	if err != nil {
+		t.Fatalf("Failed to load index: %v", err)
+	}
+	if err := idx.Refresh(t.Context()); err != nil {
+		t.Fatalf("Failed to refresh index: %v", err)
+	}
+
+	summary := &Summary{}
+	if err := MergeDir(t.Context(), storage.Local{}, src, storage.Local{}, dst, MergeOptions{Policy: ConflictKeepBoth, Index: idx, Summary: summary}, false); err != nil {
+		t.Fatalf("MergeDir failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "2025-12-31", "DSC00003.JPG")); !os.IsNotExist(err) {
+		t.Error("Archived content should not be copied again")
+	}
+	if summary.Count(ActionSkippedArchived) != 1 {
+		t.Errorf("Expected 1 skipped-archived decision, got %+v", summary.Decisions)
+	}
+	if summary.Count(ActionKeptBoth) != 1 {
+		t.Errorf("Expected 1 kept-both decision, got %+v", summary.Decisions)
+	}
+
+	// Files written during the merge are indexed immediately
+	if idx.Len() != 4 {
+		t.Errorf("Expected 4 indexed files after merge, got %d", idx.Len())
+	}
+}
+
+func TestRunSourcesSkipKeepsConflictsOnCard(t *testing.T) {
+	ejector := useRecordingEjector(t)
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		ConflictPolicy:  string(ConflictSkip),
+	}
+	writeTree(t, cfg.DestinationPath, map[string]string{"2025-12-31/DSC00001.JPG": "old photo"})
+	writeTree(t, cfg.TargetPath, map[string]string{
+		"DCIM/02512310/DSC00001.JPG": "new photo",
+		"DCIM/02512310/DSC00002.JPG": "fresh photo",
+	})
+
+	_, err := RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), false)
+	if !errors.Is(err, ErrSkippedConflicts) {
+		t.Fatalf("RunSources() error = %v, want ErrSkippedConflicts", err)
+	}
+	for _, name := range []string{"DSC00001.JPG", "DSC00002.JPG"} {
+		if _, err := os.Stat(filepath.Join(cfg.TargetPath, "DCIM", "02512310", name)); err != nil {
+			t.Errorf("%s should still be on the card: %v", name, err)
+		}
+	}
+	if got := readFile(t, filepath.Join(cfg.DestinationPath, "2025-12-31", "DSC00001.JPG")); got != "old photo" {
+		t.Errorf("Archived file was modified: %q", got)
+	}
+	if len(ejector.ejected) != 0 {
+		t.Errorf("Card with unarchived files was ejected: %v", ejector.ejected)
+	}
+}
@@ -0,0 +1,143 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/filter"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// cardFile describes a file on the card mounted at root for filtering.
+// Files in a Sony date folder are dated by the folder, others by their modification time.
+func cardFile(root, path string, info fs.FileInfo) filter.File {
+	file := filter.File{RelPath: path, Size: info.Size(), Date: info.ModTime()}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return file
+	}
+	file.RelPath = rel
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) >= 3 && parts[0] == "DCIM" && rename.IsValidDateDir(parts[1]) {
+		century := fmt.Sprintf("%d", time.Now().Year())[:2]
+		if date, err := rename.ParseDirName(parts[1], century); err == nil {
+			file.Date = date
+		}
+	}
+	return file
+}
+
+// copySelected copies the DCIM files accepted by the filter and not imported before
+// to the staging directory and records them in state.Imported
+func copySelected(ctx context.Context, state *RunState) error {
+	skipped, previous := 0, 0
+	err := storage.WalkDir(state.Card, state.SourceDCIM, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !state.Filter.Match(cardFile(state.Source.Path, path, info)) {
+			skipped++
+			return nil
+		}
+		imported, err := alreadyImported(state, path, info)
+		if err != nil {
+			return err
+		}
+		if imported {
+			previous++
+			return nil
+		}
+
+		rel, err := filepath.Rel(state.SourceDCIM, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(state.TmpDir, rel)
+		state.Imported = append(state.Imported, path)
+		if state.DryRun {
+			log.Printf("[DRY RUN] Would copy file: %s -> %s", path, target)
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		return copyFile(ctx, state.Card, path, storage.Local{}, target)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy files to temp directory: %w", err)
+	}
+
+	log.Printf("Selected %d files, skipped %d by filter and %d imported earlier", len(state.Imported), skipped, previous)
+	return nil
+}
+
+// deleteImported removes the files copied by copySelected from the card,
+// then removes directories of DCIM that became empty
+func deleteImported(state *RunState) error {
+	for _, path := range state.Imported {
+		if state.DryRun {
+			log.Printf("[DRY RUN] Would delete: %s", path)
+			continue
+		}
+		if err := state.Card.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	if state.DryRun {
+		return nil
+	}
+	return removeEmptyDirs(state.Card, state.SourceDCIM, state.SourceDCIM)
+}
+
+// filterBackup drops the files rejected by the filter from a backup check,
+// so they are neither deleted nor reported as unmatched
+func filterBackup(state *RunState, check *BackupCheck) error {
+	if state.Filter.Empty() {
+		return nil
+	}
+
+	match := func(path string) (bool, error) {
+		info, err := state.Card.Stat(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		return state.Filter.Match(cardFile(state.Source.Path, path, info)), nil
+	}
+
+	for path := range check.Archived {
+		ok, err := match(path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			delete(check.Archived, path)
+		}
+	}
+
+	unmatched := check.Unmatched[:0]
+	for _, path := range check.Unmatched {
+		ok, err := match(path)
+		if err != nil {
+			return err
+		}
+		if ok {
+			unmatched = append(unmatched, path)
+		}
+	}
+	check.Unmatched = unmatched
+	return nil
+}
@@ -0,0 +1,88 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestRunWithFilter(t *testing.T) {
+	useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "filter-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		Filter:          config.FilterConfig{Extensions: []string{"arw", "mp4"}, From: "2025-12-31"},
+		Pipeline: config.PipelineConfig{
+			Main: []string{StageCopy, StageVerify, StageRename, StageArchive, StageDelete, StageCleanup},
+		},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{
+		"DCIM/02512310/DSC00001.ARW":       "raw",
+		"DCIM/02512310/DSC00001.JPG":       "jpeg",
+		"DCIM/02512300/DSC00000.ARW":       "older raw",
+		"PRIVATE/M4ROOT/CLIP/C0001.MP4":    "video",
+		"PRIVATE/M4ROOT/CLIP/C0001M01.XML": `<NonRealTimeMeta><CreationDate value="2025-12-31T10:00:00+09:00"/></NonRealTimeMeta>`,
+	})
+
+	if err := Run(t.Context(), cfg, false); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	for _, name := range []string{"2025-12-31/DSC00001.ARW", "2025-12-31/C0001.MP4", "2025-12-31/C0001M01.XML"} {
+		if _, err := os.Stat(filepath.Join(cfg.DestinationPath, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s in archive: %v", name, err)
+		}
+	}
+	for _, name := range []string{"2025-12-31/DSC00001.JPG", "2025-12-30"} {
+		if _, err := os.Stat(filepath.Join(cfg.DestinationPath, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("Filtered file %s should not be archived", name)
+		}
+	}
+
+	// Filtered-out files stay on the card, imported ones are gone
+	for name, kept := range map[string]bool{
+		"DCIM/02512310/DSC00001.ARW":    false,
+		"DCIM/02512310/DSC00001.JPG":    true,
+		"DCIM/02512300/DSC00000.ARW":    true,
+		"PRIVATE/M4ROOT/CLIP/C0001.MP4": false,
+	} {
+		_, err := os.Stat(filepath.Join(cfg.TargetPath, filepath.FromSlash(name)))
+		if kept && err != nil {
+			t.Errorf("Filtered-out file %s must not be deleted from the card", name)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("Imported file %s should have been deleted from the card", name)
+		}
+	}
+}
+
+func TestBackupCleanupWithFilter(t *testing.T) {
+	cfg := setupBackupCard(t, map[string]string{"2025-12-31/DSC00001.ARW": "raw"}, map[string]string{
+		"02512310/DSC00001.ARW": "raw",
+		"02512310/DSC00001.JPG": "jpeg not archived",
+	})
+	cfg.Filter = config.FilterConfig{Extensions: []string{"arw"}}
+	useRecordingEjector(t)
+
+	if err := RunBackupCleanup(t.Context(), cfg, false); err != nil {
+		t.Fatalf("Files rejected by the filter should not block the cleanup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupPath, "DCIM", "02512310", "DSC00001.JPG")); err != nil {
+		t.Error("Filtered-out file must stay on the backup card")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupPath, "DCIM", "02512310", "DSC00001.ARW")); !os.IsNotExist(err) {
+		t.Error("Archived file should have been deleted")
+	}
+}
@@ -0,0 +1,99 @@
+package workflow
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/hooks"
+)
+
+// Stage names used for hooks
+const (
+	StageCopy    = "copy"
+	StageRename  = "rename"
+	StageArchive = "archive"
+	StageVerify  = "verify"
+	StageDelete  = "delete"
+	StageCatalog = "catalog"
+	StageCleanup = "cleanup"
+	StageEject   = "eject"
+	StageUpload  = "upload"
+	StageParity  = "parity"
+)
+
+// ValidateHooks checks that hooks are only configured for known stages
+func ValidateHooks(cfg *config.Config) error {
+	knownStages := stageNames()
+	for stage, stageHooks := range cfg.Hooks {
+		if !contains(knownStages, stage) {
+			return fmt.Errorf("hooks configured for unknown stage %q (known stages: %s)", stage, strings.Join(knownStages, ", "))
+		}
+		for _, hook := range append(stageHooks.Pre, stageHooks.Post...) {
+			if strings.TrimSpace(hook.Command) == "" {
+				return fmt.Errorf("empty hook command for stage %q", stage)
+			}
+		}
+	}
+	return nil
+}
+
+// newRunID returns an identifier for one workflow run, e.g. 20251231-101500-1a2b3c
+func newRunID() string {
+	buf := make([]byte, 3)
+	rand.Read(buf)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(buf)
+}
+
+// stageRunner runs the stages of one card with the hooks configured around them
+type stageRunner struct {
+	hooks   map[string]config.StageHooks
+	payload hooks.Payload
+	summary *Summary
+}
+
+func newStageRunner(cfg *config.Config, runID string, src config.Source, dryRun bool) *stageRunner {
+	return &stageRunner{
+		hooks: cfg.Hooks,
+		payload: hooks.Payload{
+			RunID:    runID,
+			Source:   src.Name,
+			Body:     src.Body,
+			Role:     NormalizeRole(src.Role),
+			CardPath: src.Path,
+			DryRun:   dryRun,
+		},
+	}
+}
+
+// run executes fn between the pre and post hooks of stage.
+// A failing pre hook aborts the stage; post hooks also run when the stage failed
+// or was interrupted, bounded only by their own timeout.
+func (r *stageRunner) run(ctx context.Context, stage string, fn func() error) error {
+	stageHooks := r.hooks[stage]
+
+	payload := r.payload
+	payload.Stage = stage
+	payload.Phase = hooks.PhasePre
+	payload.Counts = r.summary.Counts()
+	if err := hooks.RunPhase(ctx, stageHooks.Pre, payload); err != nil {
+		return fmt.Errorf("%s stage aborted by hook: %w", stage, err)
+	}
+
+	err := fn()
+
+	payload.Phase = hooks.PhasePost
+	payload.Counts = r.summary.Counts()
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	if hookErr := hooks.RunPhase(context.WithoutCancel(ctx), stageHooks.Post, payload); hookErr != nil {
+		log.Printf("Warning: %v", hookErr)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestValidateHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		hooks   map[string]config.StageHooks
+		wantErr bool
+	}{
+		{"no hooks", nil, false},
+		{"known stage", map[string]config.StageHooks{StageArchive: {Post: []config.Hook{{Command: "true"}}}}, false},
+		{"unknown stage", map[string]config.StageHooks{"print": {Pre: []config.Hook{{Command: "true"}}}}, true},
+		{"empty command", map[string]config.StageHooks{StageCopy: {Pre: []config.Hook{{Command: " "}}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHooks(&config.Config{Hooks: tt.hooks})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateHooks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSourcesHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands use sh")
+	}
+	ejector := useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "hooks-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logFile := filepath.Join(tmpDir, "hooks.log")
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources: []config.Source{
+			{Name: "a7iv", Path: filepath.Join(tmpDir, "card"), Role: "main"},
+		},
+		Hooks: map[string]config.StageHooks{
+			StageArchive: {Post: []config.Hook{{Command: `echo "$SONY_PHOTOS_STAGE $SONY_PHOTOS_COUNT_COPIED" >> ` + logFile}}},
+			StageDelete:  {Pre: []config.Hook{{Command: "exit 3"}}},
+		},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+
+	report, err := RunSources(t.Context(), cfg, cfg.Sources, false)
+	if err == nil || !strings.Contains(err.Error(), "delete stage aborted by hook") {
+		t.Fatalf("Expected the pre-delete hook to abort the run, got %v", err)
+	}
+	if report.RunID == "" {
+		t.Error("Expected a run ID in the report")
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Post-archive hook did not run: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "archive 1" {
+		t.Errorf("Unexpected hook output: %q", data)
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG")); err != nil {
+		t.Error("Photos must stay on the card when the delete stage is aborted")
+	}
+	if len(ejector.ejected) != 0 {
+		t.Errorf("Card should not be ejected, got %v", ejector.ejected)
+	}
+}
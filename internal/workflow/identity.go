@@ -0,0 +1,159 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/discovery"
+)
+
+// ErrWrongCard is returned when the mounted card is not the one the configuration expects
+var ErrWrongCard = errors.New("unexpected card")
+
+// VerifyCard checks that the card mounted at mountPoint may be used in the given role
+// for the given camera body (empty matches any body).
+// Unregistered cards are only accepted while no card is registered for role and the
+// configuration names no camera body.
+func VerifyCard(cfg *config.Config, mountPoint, role, body string) error {
+	registry, err := card.LoadRegistry(cfg.RegistryPath())
+	if err != nil {
+		return err
+	}
+
+	entry, registered, err := lookupCard(registry, mountPoint)
+	if err != nil {
+		return err
+	}
+	if !registered {
+		if body != "" {
+			return fmt.Errorf("%w: card at %s is not registered for %s (use -register-card)", ErrWrongCard, mountPoint, body)
+		}
+		if registry.HasRole(role) {
+			return fmt.Errorf("%w: card at %s is not registered as a %s card (use -register-card)", ErrWrongCard, mountPoint, role)
+		}
+		return nil
+	}
+
+	if entry.Role != role {
+		return fmt.Errorf("%w: card at %s is registered as a %s card, expected a %s card", ErrWrongCard, mountPoint, entry.Role, role)
+	}
+	if body != "" && entry.Body != body {
+		return fmt.Errorf("%w: card at %s belongs to %q, expected %q", ErrWrongCard, mountPoint, entry.Body, body)
+	}
+
+	log.Printf("Verified %s card %q for %s", entry.Role, entry.Label, entry.Body)
+	return nil
+}
+
+// RegisterCard writes an identity file to the card at mountPoint (if it has none)
+// and records its role and body in the registry
+func RegisterCard(cfg *config.Config, mountPoint, role, body string) (card.Identity, error) {
+	registry, err := card.LoadRegistry(cfg.RegistryPath())
+	if err != nil {
+		return card.Identity{}, err
+	}
+
+	if err := card.ValidateRole(role); err != nil {
+		return card.Identity{}, err
+	}
+
+	id, err := card.EnsureIdentity(mountPoint)
+	if err != nil {
+		return card.Identity{}, err
+	}
+	entry := card.Entry{Role: role, Body: body, Label: filepath.Base(mountPoint)}
+	if err := registry.Register(id.ID, entry); err != nil {
+		return card.Identity{}, err
+	}
+	if err := registry.Save(cfg.RegistryPath()); err != nil {
+		return card.Identity{}, err
+	}
+
+	return id, nil
+}
+
+// selectCard picks the card to use for role among the detected cards.
+// Cards registered for role (and body) are preferred; an unregistered card is only picked
+// while no card is registered for role. A card registered for another role or body is
+// never picked.
+func selectCard(cfg *config.Config, cards []discovery.Card, role, body string) (discovery.Card, error) {
+	registry, err := card.LoadRegistry(cfg.RegistryPath())
+	if err != nil {
+		return discovery.Card{}, err
+	}
+
+	var matching, unregistered []discovery.Card
+	for _, c := range cards {
+		entry, registered, err := lookupCard(registry, c.MountPoint)
+		if err != nil {
+			return discovery.Card{}, err
+		}
+		switch {
+		case !registered:
+			unregistered = append(unregistered, c)
+		case entry.Role == role && (body == "" || entry.Body == body):
+			matching = append(matching, c)
+		}
+	}
+	if len(matching) == 0 {
+		if len(cards) > 0 && (len(unregistered) == 0 || registry.HasRole(role)) {
+			return discovery.Card{}, fmt.Errorf("%w: no mounted card may be used as a %s card", ErrWrongCard, role)
+		}
+		return discovery.SelectOne(unregistered)
+	}
+	return discovery.SelectOne(matching)
+}
+
+func lookupCard(registry *card.Registry, mountPoint string) (card.Entry, bool, error) {
+	id, err := card.ReadIdentity(mountPoint)
+	if errors.Is(err, card.ErrNoIdentity) {
+		return card.Entry{}, false, nil
+	}
+	if err != nil {
+		return card.Entry{}, false, err
+	}
+	entry, ok := registry.Lookup(id.ID)
+	return entry, ok, nil
+}
+
+// RegisteredCard returns the registry entry of the Sony card mounted at mountPoint.
+// ok is false for volumes that are not Sony cards or not registered (for the configured body).
+func RegisteredCard(cfg *config.Config, mountPoint string) (entry card.Entry, ok bool, err error) {
+	if _, isCard := discovery.Inspect(mountPoint); !isCard {
+		return card.Entry{}, false, nil
+	}
+
+	registry, err := card.LoadRegistry(cfg.RegistryPath())
+	if err != nil {
+		return card.Entry{}, false, err
+	}
+	entry, registered, err := lookupCard(registry, mountPoint)
+	if err != nil || !registered {
+		return card.Entry{}, false, err
+	}
+	if cfg.Body != "" && entry.Body != cfg.Body {
+		return card.Entry{}, false, nil
+	}
+	return entry, true, nil
+}
+
+// ImportCard processes the registered card at mountPoint according to its role:
+// main cards are imported and backup cards are verified and cleared
+func ImportCard(ctx context.Context, cfg *config.Config, mountPoint string, dryRun bool) error {
+	entry, ok, err := RegisteredCard(cfg, mountPoint)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s is not a registered card", ErrWrongCard, mountPoint)
+	}
+
+	report, err := RunSources(ctx, cfg, []config.Source{sourceForCard(cfg, mountPoint, entry)}, dryRun)
+	report.Log()
+	return err
+}
@@ -0,0 +1,142 @@
+package workflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/discovery"
+)
+
+func setupRegisteredCards(t *testing.T) (*config.Config, string, string, string) {
+	t.Helper()
+
+	tmpDir, err := os.MkdirTemp("", "identity-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	cfg := &config.Config{CardRegistry: filepath.Join(tmpDir, "cards.yaml")}
+	main := filepath.Join(tmpDir, "1-1")
+	backup := filepath.Join(tmpDir, "1-2")
+	unknown := filepath.Join(tmpDir, "other")
+	for _, dir := range []string{main, backup, unknown} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	if _, err := RegisterCard(cfg, main, card.RoleMain, "a7iii"); err != nil {
+		t.Fatalf("RegisterCard failed: %v", err)
+	}
+	if _, err := RegisterCard(cfg, backup, card.RoleBackup, "a7iii"); err != nil {
+		t.Fatalf("RegisterCard failed: %v", err)
+	}
+
+	return cfg, main, backup, unknown
+}
+
+func TestVerifyCard(t *testing.T) {
+	cfg, main, backup, unknown := setupRegisteredCards(t)
+
+	if err := VerifyCard(cfg, main, card.RoleMain, cfg.Body); err != nil {
+		t.Errorf("Main card should be accepted: %v", err)
+	}
+	if err := VerifyCard(cfg, backup, card.RoleMain, cfg.Body); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Backup card should be refused as main card, got %v", err)
+	}
+	if err := VerifyCard(cfg, unknown, card.RoleMain, cfg.Body); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Unregistered card should be refused once main cards are registered, got %v", err)
+	}
+	empty := &config.Config{CardRegistry: filepath.Join(t.TempDir(), "cards.yaml")}
+	if err := VerifyCard(empty, unknown, card.RoleMain, ""); err != nil {
+		t.Errorf("Unregistered card should be accepted without registered cards or body: %v", err)
+	}
+	if err := VerifyCard(empty, unknown, card.RoleMain, "a7iii"); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Unregistered card should be refused when its source names a body, got %v", err)
+	}
+	empty.Body = "a7iii"
+	if err := VerifyCard(empty, unknown, card.RoleMain, ""); err != nil {
+		t.Errorf("Only the body of the source should be checked, got %v", err)
+	}
+
+	cfg.Body = "a7iii"
+	if err := VerifyCard(cfg, unknown, card.RoleMain, cfg.Body); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Unregistered card should be refused when a body is configured, got %v", err)
+	}
+
+	cfg.Body = "a7iv"
+	if err := VerifyCard(cfg, main, card.RoleMain, cfg.Body); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Card of another body should be refused, got %v", err)
+	}
+
+	if _, err := RegisterCard(cfg, unknown, "spare", "a7iii"); err == nil {
+		t.Error("Expected error for invalid role")
+	}
+	if _, err := os.Stat(filepath.Join(unknown, card.IdentityFileName)); !os.IsNotExist(err) {
+		t.Error("No identity file should be written for an invalid role")
+	}
+}
+
+func TestResolveCardPathByRole(t *testing.T) {
+	cfg, main, backup, _ := setupRegisteredCards(t)
+
+	original := FindCards
+	defer func() { FindCards = original }()
+	FindCards = func() ([]discovery.Card, error) {
+		return []discovery.Card{{MountPoint: main}, {MountPoint: backup}}, nil
+	}
+
+	path, err := ResolveCardPath(cfg, config.AutoDetect, card.RoleBackup, "")
+	if err != nil {
+		t.Fatalf("ResolveCardPath failed: %v", err)
+	}
+	if path != backup {
+		t.Errorf("Expected backup card %s, got %s", backup, path)
+	}
+
+	path, err = ResolveCardPath(cfg, config.AutoDetect, card.RoleMain, "")
+	if err != nil {
+		t.Fatalf("ResolveCardPath failed: %v", err)
+	}
+	if path != main {
+		t.Errorf("Expected main card %s, got %s", main, path)
+	}
+}
+
+func TestResolveCardPathNeverUsesCardOfOtherRole(t *testing.T) {
+	cfg, main, _, unknown := setupRegisteredCards(t)
+
+	original := FindCards
+	defer func() { FindCards = original }()
+	FindCards = func() ([]discovery.Card, error) {
+		return []discovery.Card{{MountPoint: main}}, nil
+	}
+	if _, err := ResolveCardPath(cfg, config.AutoDetect, card.RoleBackup, ""); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Main card must not be picked as backup card, got %v", err)
+	}
+
+	FindCards = func() ([]discovery.Card, error) {
+		return []discovery.Card{{MountPoint: main}, {MountPoint: unknown}}, nil
+	}
+	if _, err := ResolveCardPath(cfg, config.AutoDetect, card.RoleBackup, ""); !errors.Is(err, ErrWrongCard) {
+		t.Errorf("Unregistered card must not be picked once backup cards are registered, got %v", err)
+	}
+
+	// Without registered backup cards, the unregistered one is used
+	cfg.CardRegistry = filepath.Join(t.TempDir(), "cards.yaml")
+	if _, err := RegisterCard(cfg, main, card.RoleMain, "a7iii"); err != nil {
+		t.Fatalf("RegisterCard failed: %v", err)
+	}
+	path, err := ResolveCardPath(cfg, config.AutoDetect, card.RoleBackup, "")
+	if err != nil {
+		t.Fatalf("ResolveCardPath failed: %v", err)
+	}
+	if path != unknown {
+		t.Errorf("Expected unregistered card %s, got %s", unknown, path)
+	}
+}
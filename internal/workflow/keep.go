@@ -0,0 +1,81 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/cardstate"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+// LoadCardState reads the import history of the card mounted at mountPoint.
+// With create, a card without identity file gets one; otherwise it has an empty history.
+func LoadCardState(cfg *config.Config, mountPoint string, create bool) (*cardstate.State, error) {
+	id, err := card.ReadIdentity(mountPoint)
+	if errors.Is(err, card.ErrNoIdentity) {
+		if !create {
+			return cardstate.New("", ""), nil
+		}
+		id, err = card.EnsureIdentity(mountPoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cardstate.Load(cfg.CardStatePath(id.ID), id.ID)
+}
+
+// ResetCardState forgets which files of the card at mountPoint were imported
+func ResetCardState(cfg *config.Config, mountPoint string) (string, error) {
+	id, err := card.ReadIdentity(mountPoint)
+	if err != nil {
+		return "", err
+	}
+	return id.ID, cardstate.Reset(cfg.CardStatePath(id.ID))
+}
+
+// alreadyImported reports whether a file of the card was imported by an earlier run
+func alreadyImported(state *RunState, path string, info os.FileInfo) (bool, error) {
+	if state.CardState == nil {
+		return false, nil
+	}
+	rel, err := filepath.Rel(state.Source.Path, path)
+	if err != nil {
+		return false, err
+	}
+	return state.CardState.Imported(rel, path, info)
+}
+
+// recordImported adds the files copied in this run to the card's import history
+func recordImported(state *RunState) error {
+	if state.CardState == nil || state.DryRun {
+		return nil
+	}
+
+	files := append([]string{}, state.Imported...)
+	for file := range state.StagedClips {
+		files = append(files, file)
+	}
+	for _, path := range files {
+		info, err := state.Card.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat imported file: %w", err)
+		}
+		rel, err := filepath.Rel(state.Source.Path, path)
+		if err != nil {
+			return err
+		}
+		if err := state.CardState.Record(rel, path, info); err != nil {
+			return fmt.Errorf("failed to record imported file: %w", err)
+		}
+	}
+
+	if err := state.CardState.Save(); err != nil {
+		return err
+	}
+	log.Printf("Recorded %d newly imported files for card %s", len(files), state.CardState.CardID)
+	return nil
+}
@@ -0,0 +1,86 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestRunKeepOnCard(t *testing.T) {
+	ejector := useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "keep-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		CardStateDir:    filepath.Join(tmpDir, "state"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		KeepOnCard:      true,
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00001.JPG": "day one"})
+
+	run := func() *Report {
+		t.Helper()
+		report, err := RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), false)
+		if err != nil {
+			t.Fatalf("RunSources failed: %v", err)
+		}
+		return report
+	}
+
+	// First evening: everything is new and stays on the card
+	report := run()
+	if n := len(report.Cards[0].Summary.Decisions); n != 1 {
+		t.Errorf("Expected 1 imported file, got %d", n)
+	}
+	first := filepath.Join(cfg.TargetPath, "DCIM", "02512310", "DSC00001.JPG")
+	if _, err := os.Stat(first); err != nil {
+		t.Fatal("Photo should stay on the card in keep-on-card mode")
+	}
+	if len(ejector.ejected) != 1 {
+		t.Errorf("Card should still be ejected, got %v", ejector.ejected)
+	}
+
+	// Second evening: only the new photo is imported, even if the old one was touched
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02601010/DSC00002.JPG": "day two"})
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(first, later, later); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	report = run()
+	decisions := report.Cards[0].Summary.Decisions
+	if len(decisions) != 1 || filepath.Base(decisions[0].Destination) != "DSC00002.JPG" {
+		t.Errorf("Expected only the new photo to be imported, got %+v", decisions)
+	}
+	if got := readFile(t, filepath.Join(cfg.DestinationPath, "2026-01-01", "DSC00002.JPG")); got != "day two" {
+		t.Errorf("New photo has content %q", got)
+	}
+
+	state, err := LoadCardState(cfg, cfg.TargetPath, false)
+	if err != nil {
+		t.Fatalf("LoadCardState failed: %v", err)
+	}
+	if state.Len() != 2 {
+		t.Errorf("Expected 2 files in the card state, got %d", state.Len())
+	}
+
+	// After a reset every file is considered again
+	if _, err := ResetCardState(cfg, cfg.TargetPath); err != nil {
+		t.Fatalf("ResetCardState failed: %v", err)
+	}
+	report = run()
+	if n := len(report.Cards[0].Summary.Decisions); n != 2 {
+		t.Errorf("Expected 2 files after reset, got %d", n)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package workflow
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on f without waiting. The lock is released when f
+// is closed or its process dies, so a lock that can be taken proves its owner ended.
+func lockFile(f *os.File, created bool) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return errRunLocked
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/parity"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// parityStage writes the parity files of the date folders archived from the card.
+// Folders that already had files get their parity rewritten over all of them, once
+// the files not written by this run are checked against the old parity file and
+// repaired, so that damage is never taken into the new parity.
+type parityStage struct{}
+
+func (parityStage) Name() string { return StageParity }
+
+func (parityStage) Run(ctx context.Context, state *RunState) error {
+	if state.DryRun {
+		log.Printf("[DRY RUN] Would write parity files for the folders archived in %s", state.Destination)
+		return nil
+	}
+	entries, err := storage.Local{}.ReadDir(state.TmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+
+	written := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		folder := filepath.Join(state.Destination, entry.Name())
+		if _, err := state.Archive.Stat(folder); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := repairBeforeCreate(ctx, state, folder); err != nil {
+			return err
+		}
+		if err := parity.Create(ctx, state.Archive, folder, state.Config.Parity.Redundancy); err != nil {
+			return fmt.Errorf("failed to write parity for %s: %w", folder, err)
+		}
+		written++
+	}
+	log.Printf("Wrote parity files for %d folders", written)
+	return nil
+}
+
+// repairBeforeCreate checks the files of folder that this run did not write against
+// its existing parity file and repairs the damaged ones. It fails when a file cannot
+// be rebuilt, keeping the old parity file.
+func repairBeforeCreate(ctx context.Context, state *RunState, folder string) error {
+	if _, err := state.Archive.Stat(filepath.Join(folder, parity.FileName)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	written := make(map[string]bool)
+	if state.Merge.Summary != nil {
+		for _, d := range state.Merge.Summary.Decisions {
+			switch d.Action {
+			case ActionCopied, ActionKeptBoth, ActionOverwritten:
+				if rel, err := filepath.Rel(folder, d.Destination); err == nil {
+					written[filepath.ToSlash(rel)] = true
+				}
+			}
+		}
+	}
+
+	result, err := parity.Repair(ctx, state.Archive, folder)
+	if err != nil {
+		return fmt.Errorf("failed to check %s against its parity: %w", folder, err)
+	}
+	defer result.Cleanup()
+	for _, rel := range result.Damaged {
+		if written[rel] {
+			continue
+		}
+		path := filepath.Join(folder, filepath.FromSlash(rel))
+		tmp, ok := result.Repaired[rel]
+		if !ok {
+			return fmt.Errorf("%s is damaged and cannot be rebuilt from parity; keeping the old parity file", path)
+		}
+		log.Printf("Repairing: %s", path)
+		if err := state.Archive.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := copyFile(ctx, storage.Local{}, tmp, state.Archive, path); err != nil {
+			return fmt.Errorf("failed to repair %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// RepairReport summarizes a check of the archive against its parity files
+type RepairReport struct {
+	// Folders is the number of folders with a parity file
+	Folders int
+	// Damaged lists the files that no longer match the parity manifest
+	Damaged []string
+	// Repaired lists the damaged files rebuilt from parity
+	Repaired []string
+	// Lost lists the damaged files that could not be rebuilt
+	Lost []string
+}
+
+// RepairArchive checks every folder of the archive that has a parity file and replaces
+// the damaged files with their content rebuilt from parity. A folder whose parity file
+// cannot be read is reported and the others are still checked.
+func RepairArchive(ctx context.Context, cfg *config.Config, dryRun bool) (*RepairReport, error) {
+	if err := CheckDirectoryExists(storage.Local{}, cfg.DestinationPath); err != nil {
+		return nil, fmt.Errorf("destination check failed: %w", err)
+	}
+
+	var folders []string
+	err := storage.WalkDir(storage.Local{}, cfg.DestinationPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != cfg.DestinationPath && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == parity.FileName {
+			folders = append(folders, filepath.Dir(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan archive: %w", err)
+	}
+
+	report := &RepairReport{}
+	var errs []error
+	for _, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Folders++
+		if err := repairFolder(ctx, folder, report, dryRun); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return report, ctxErr
+			}
+			log.Printf("Warning: failed to check %s: %v", folder, err)
+			errs = append(errs, fmt.Errorf("%s: %w", folder, err))
+		}
+	}
+	if len(report.Lost) > 0 {
+		errs = append(errs, fmt.Errorf("%d damaged files could not be repaired", len(report.Lost)))
+	}
+	return report, errors.Join(errs...)
+}
+
+// repairFolder checks one folder and moves the rebuilt files into place
+func repairFolder(ctx context.Context, folder string, report *RepairReport, dryRun bool) error {
+	archive := storage.Local{}
+	result, err := parity.Repair(ctx, archive, folder)
+	if err != nil {
+		return err
+	}
+	defer result.Cleanup()
+
+	for _, rel := range result.Damaged {
+		path := filepath.Join(folder, filepath.FromSlash(rel))
+		report.Damaged = append(report.Damaged, path)
+		tmp, ok := result.Repaired[rel]
+		if !ok {
+			log.Printf("Cannot repair %s: too much of the folder is damaged", path)
+			report.Lost = append(report.Lost, path)
+			continue
+		}
+		if dryRun {
+			log.Printf("[DRY RUN] Would repair: %s", path)
+			continue
+		}
+
+		log.Printf("Repairing: %s", path)
+		if err := archive.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if err := copyFile(ctx, storage.Local{}, tmp, archive, path); err != nil {
+			return fmt.Errorf("failed to repair %s: %w", path, err)
+		}
+		report.Repaired = append(report.Repaired, path)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/parity"
+)
+
+func TestRunSourcesParity(t *testing.T) {
+	useRecordingEjector(t)
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources:         []config.Source{{Name: "main", Path: filepath.Join(tmpDir, "card"), Role: "main"}},
+		Pipeline: config.PipelineConfig{
+			Main: []string{StageCopy, StageRename, StageArchive, StageParity, StageDelete},
+		},
+		Parity: config.ParityConfig{Redundancy: 50},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{
+		"DCIM/02512310/DSC00001.JPG": "photo 1",
+		"DCIM/02512310/DSC00002.ARW": "raw 2",
+	})
+
+	if _, err := RunSources(t.Context(), cfg, cfg.Sources, false); err != nil {
+		t.Fatalf("Failed to run sources: %v", err)
+	}
+	folder := filepath.Join(cfg.DestinationPath, "2025-12-31")
+	if _, err := os.Stat(filepath.Join(folder, parity.FileName)); err != nil {
+		t.Fatalf("Archived folder has no parity file: %v", err)
+	}
+
+	photo := filepath.Join(folder, "DSC00001.JPG")
+	os.WriteFile(photo, []byte("phXto 1"), 0644)
+
+	report, err := RepairArchive(t.Context(), cfg, true)
+	if err != nil || report.Folders != 1 || len(report.Damaged) != 1 || len(report.Repaired) != 0 {
+		t.Fatalf("Dry run repair = %+v, %v", report, err)
+	}
+	if data, _ := os.ReadFile(photo); string(data) != "phXto 1" {
+		t.Errorf("Dry run changed the damaged photo to %q", data)
+	}
+
+	report, err = RepairArchive(t.Context(), cfg, false)
+	if err != nil || len(report.Repaired) != 1 || report.Repaired[0] != photo {
+		t.Fatalf("Repair = %+v, %v", report, err)
+	}
+	if data, _ := os.ReadFile(photo); string(data) != "photo 1" {
+		t.Errorf("Repaired photo = %q, want %q", data, "photo 1")
+	}
+	if report, err := RepairArchive(t.Context(), cfg, false); err != nil || len(report.Damaged) != 0 {
+		t.Errorf("Repairing an intact archive = %+v, %v", report, err)
+	}
+
+	// A later import into the folder repairs the old files before writing the new parity
+	os.WriteFile(photo, []byte("phXto 1"), 0644)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00003.JPG": "photo 3"})
+	if _, err := RunSources(t.Context(), cfg, cfg.Sources, false); err != nil {
+		t.Fatalf("Failed to run sources again: %v", err)
+	}
+	if data, _ := os.ReadFile(photo); string(data) != "photo 1" {
+		t.Errorf("Damaged photo was not repaired before the parity was rewritten: %q", data)
+	}
+	os.WriteFile(filepath.Join(folder, "DSC00003.JPG"), []byte("phXto 3"), 0644)
+	if report, err := RepairArchive(t.Context(), cfg, false); err != nil || len(report.Repaired) != 1 {
+		t.Errorf("The new parity should cover the new photo: %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,333 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/cardstate"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/clip"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/filter"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// Stage is one step of the workflow run on a card
+type Stage interface {
+	Name() string
+	// Run performs the stage. Stages must not modify anything when state.DryRun is set
+	// and should return ctx.Err() soon after ctx is cancelled, leaving no partial file behind.
+	Run(ctx context.Context, state *RunState) error
+}
+
+// RunState is shared by the stages of one card
+type RunState struct {
+	Config *config.Config
+	Source config.Source
+	RunID  string
+	DryRun bool
+	// Card is the storage holding the card; nil means local disk.
+	// Quarantine and keep-on-card history need a card on local disk.
+	Card storage.FS
+	// Archive is the storage holding Destination; nil means local disk.
+	// The archive index needs an archive on local disk.
+	Archive storage.FS
+	// SourceDCIM is the DCIM directory of the card
+	SourceDCIM string
+	// TmpDir is the staging directory of the card, always on local disk
+	TmpDir string
+	// Destination is the archive directory receiving the card's folders
+	Destination string
+	// Destinations receive further copies of the card's folders
+	Destinations []Destination
+	// FolderDates maps the staged date folders to their dates once they are renamed
+	FolderDates map[string]time.Time
+	// Merge holds the conflict policy, the archive index and the per-file summary
+	Merge MergeOptions
+	// Backup is set by the verify stage of a backup card
+	Backup *BackupCheck
+	// StagedClips maps the video files on the card to their copies in TmpDir
+	StagedClips map[string]string
+	// Clips are the clips of the card staged by the copy stage
+	Clips []clip.Clip
+	// Filter selects the files that are imported and deleted
+	Filter *filter.Filter
+	// Imported lists the DCIM files copied by a selective copy stage
+	Imported []string
+	// CardState is the import history of a card kept in keep-on-card mode
+	CardState *cardstate.State
+}
+
+// selective reports whether only some files of the card are imported,
+// either because of a filter or because earlier imports are skipped
+func (s *RunState) selective() bool {
+	return !s.Filter.Empty() || s.CardState != nil
+}
+
+// StageResult reports the outcome of one stage
+type StageResult struct {
+	Name     string
+	Duration time.Duration
+	// Counts holds the file actions recorded by this stage
+	Counts map[string]int
+	Err    error
+	// Skipped is set for the stages not run after an earlier stage failed or the run was interrupted
+	Skipped bool
+}
+
+// DefaultPipelines are the stages run for each card role when the configuration does not override them
+var DefaultPipelines = map[string][]string{
+	card.RoleMain:   {StageCopy, StageRename, StageArchive, StageDelete, StageCleanup, StageEject},
+	card.RoleBackup: {StageVerify, StageDelete, StageEject},
+}
+
+// stageOrder lists, per role, pairs of stages that must run in this order when both are listed.
+// Upload and parity read the staging directory, which cleanup empties.
+var stageOrder = map[string][][2]string{
+	card.RoleMain: {
+		{StageVerify, StageRename}, {StageRename, StageUpload}, {StageUpload, StageDelete},
+		{StageUpload, StageCleanup}, {StageParity, StageCleanup},
+	},
+}
+
+// stageRequirements lists, per role and stage, the stages that must run earlier
+var stageRequirements = map[string]map[string][]string{
+	card.RoleMain: {
+		StageVerify:  {StageCopy},
+		StageRename:  {StageCopy},
+		StageArchive: {StageCopy},
+		StageCatalog: {StageArchive},
+		StageDelete:  {StageArchive},
+		StageCleanup: {StageArchive},
+		StageUpload:  {StageCopy},
+		StageParity:  {StageArchive},
+	},
+	card.RoleBackup: {
+		StageDelete:  {StageVerify},
+		StageCatalog: {StageVerify},
+	},
+}
+
+var stageRegistry = map[string]map[string]func() Stage{
+	card.RoleMain: {
+		StageCopy:    func() Stage { return copyStage{} },
+		StageVerify:  func() Stage { return verifyCopyStage{} },
+		StageRename:  func() Stage { return renameStage{} },
+		StageArchive: func() Stage { return archiveStage{} },
+		StageCatalog: func() Stage { return catalogStage{} },
+		StageDelete:  func() Stage { return deleteStage{} },
+		StageCleanup: func() Stage { return cleanupStage{} },
+		StageEject:   func() Stage { return ejectStage{} },
+		StageUpload:  func() Stage { return uploadStage{} },
+		StageParity:  func() Stage { return parityStage{} },
+	},
+	card.RoleBackup: {
+		StageVerify:  func() Stage { return verifyBackupStage{} },
+		StageCatalog: func() Stage { return catalogStage{} },
+		StageDelete:  func() Stage { return deleteArchivedStage{} },
+		StageEject:   func() Stage { return ejectStage{} },
+	},
+}
+
+// RegisterStage makes a stage available to the pipelines of the given role
+func RegisterStage(role, name string, factory func() Stage) {
+	if stageRegistry[role] == nil {
+		stageRegistry[role] = map[string]func() Stage{}
+	}
+	stageRegistry[role][name] = factory
+}
+
+// stageNames returns the names of all registered stages
+func stageNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, stages := range stageRegistry {
+		for name := range stages {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline is the ordered list of stages run on a card
+type Pipeline struct {
+	Role   string
+	Stages []Stage
+}
+
+// PipelineNames returns the configured stage names for role, or the default pipeline.
+// The default main pipeline uploads after archiving when further destinations are configured.
+func PipelineNames(cfg *config.Config, role string) []string {
+	var names []string
+	switch role {
+	case card.RoleMain:
+		names = cfg.Pipeline.Main
+	case card.RoleBackup:
+		names = cfg.Pipeline.Backup
+	}
+	if len(names) > 0 {
+		return names
+	}
+	if role == card.RoleMain && hasDestinations(cfg) {
+		var withUpload []string
+		for _, name := range DefaultPipelines[role] {
+			withUpload = append(withUpload, name)
+			if name == StageArchive {
+				withUpload = append(withUpload, StageUpload)
+			}
+		}
+		return withUpload
+	}
+	return DefaultPipelines[role]
+}
+
+// NewPipeline builds the pipeline of role from stage names.
+// It refuses unknown and repeated stages and orders that would lose photos,
+// such as deleting a card before its photos are archived.
+func NewPipeline(role string, names []string) (*Pipeline, error) {
+	registry := stageRegistry[role]
+	if registry == nil {
+		return nil, card.ValidateRole(role)
+	}
+
+	pipeline := &Pipeline{Role: role}
+	seen := map[string]bool{}
+	for _, name := range names {
+		factory, ok := registry[name]
+		if !ok {
+			known := make([]string, 0, len(registry))
+			for n := range registry {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown %s stage %q (known stages: %s)", role, name, strings.Join(known, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s stage %q is listed twice", role, name)
+		}
+		for _, required := range stageRequirements[role][name] {
+			if !seen[required] {
+				return nil, fmt.Errorf("%s stage %q must come after %q", role, name, required)
+			}
+		}
+		for _, pair := range stageOrder[role] {
+			if name == pair[1] && !seen[pair[0]] && contains(names, pair[0]) {
+				return nil, fmt.Errorf("%s stage %q must come before %q", role, pair[0], pair[1])
+			}
+		}
+		seen[name] = true
+		pipeline.Stages = append(pipeline.Stages, factory())
+	}
+	return pipeline, nil
+}
+
+// ValidatePipelines checks the configured pipelines of both roles
+func ValidatePipelines(cfg *config.Config) error {
+	for _, role := range []string{card.RoleMain, card.RoleBackup} {
+		if _, err := NewPipeline(role, PipelineNames(cfg, role)); err != nil {
+			return fmt.Errorf("invalid pipeline: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkStorage refuses the features that read the card or the archive from local disk
+// when the run uses another storage for them
+func checkStorage(state *RunState) error {
+	if _, local := state.Card.(storage.Local); !local {
+		if state.CardState != nil {
+			return fmt.Errorf("keep-on-card mode needs a card on local disk")
+		}
+		if state.Config.Quarantine.Location != "" {
+			return fmt.Errorf("quarantine needs a card on local disk")
+		}
+	}
+	if _, local := state.Archive.(storage.Local); !local && state.Merge.Index != nil {
+		return fmt.Errorf("the archive index needs an archive on local disk")
+	}
+	return nil
+}
+
+// Run executes the stages in order with their hooks and stops at the first failure.
+// Once ctx is cancelled no further stage is started, so an interrupted import never
+// reaches the stages that delete from the card.
+func (p *Pipeline) Run(ctx context.Context, state *RunState) ([]StageResult, error) {
+	if state.Card == nil {
+		state.Card = storage.Local{}
+	}
+	if state.Archive == nil {
+		state.Archive = storage.Local{}
+	}
+	if err := checkStorage(state); err != nil {
+		return nil, err
+	}
+
+	stages := newStageRunner(state.Config, state.RunID, state.Source, state.DryRun)
+	stages.payload.TmpDir = state.TmpDir
+	stages.payload.Destination = state.Destination
+	stages.summary = state.Merge.Summary
+
+	var results []StageResult
+	for i, stage := range p.Stages {
+		if err := ctx.Err(); err != nil {
+			return skipStages(results, p.Stages[i:]), fmt.Errorf("interrupted before %s stage: %w", stage.Name(), err)
+		}
+
+		started := time.Now()
+		before := state.Merge.Summary.Counts()
+
+		log.Printf("Stage %s: %s", stage.Name(), state.Source.Name)
+		err := stages.run(ctx, stage.Name(), func() error { return stage.Run(ctx, state) })
+
+		result := StageResult{
+			Name:     stage.Name(),
+			Duration: time.Since(started),
+			Counts:   countsSince(before, state.Merge.Summary.Counts()),
+			Err:      err,
+		}
+		results = append(results, result)
+		if err != nil {
+			return skipStages(results, p.Stages[i+1:]), err
+		}
+	}
+	return results, nil
+}
+
+// skipStages appends a skipped result for each of stages
+func skipStages(results []StageResult, stages []Stage) []StageResult {
+	for _, stage := range stages {
+		results = append(results, StageResult{Name: stage.Name(), Skipped: true})
+	}
+	return results
+}
+
+// countsSince returns the counters that changed between two snapshots
+func countsSince(before, after map[string]int) map[string]int {
+	var delta map[string]int
+	for name, count := range after {
+		if diff := count - before[name]; diff != 0 {
+			if delta == nil {
+				delta = map[string]int{}
+			}
+			delta[name] = diff
+		}
+	}
+	return delta
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,365 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/cardstate"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+func TestNewPipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    string
+		stages  []string
+		wantErr bool
+	}{
+		{"default main", card.RoleMain, DefaultPipelines[card.RoleMain], false},
+		{"default backup", card.RoleBackup, DefaultPipelines[card.RoleBackup], false},
+		{"verified import without eject", card.RoleMain, []string{StageCopy, StageVerify, StageRename, StageArchive, StageCatalog, StageDelete}, false},
+		{"unknown stage", card.RoleMain, []string{StageCopy, "print"}, true},
+		{"repeated stage", card.RoleMain, []string{StageCopy, StageCopy}, true},
+		{"delete before archive", card.RoleMain, []string{StageCopy, StageDelete, StageArchive}, true},
+		{"rename without copy", card.RoleMain, []string{StageRename}, true},
+		{"verify after rename", card.RoleMain, []string{StageCopy, StageRename, StageVerify, StageArchive}, true},
+		{"backup delete without verify", card.RoleBackup, []string{StageDelete, StageEject}, true},
+		{"copy on backup card", card.RoleBackup, []string{StageCopy}, true},
+		{"unknown role", "spare", []string{StageCopy}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := NewPipeline(tt.role, tt.stages)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPipeline() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(pipeline.Stages) != len(tt.stages) {
+				t.Errorf("Expected %d stages, got %d", len(tt.stages), len(pipeline.Stages))
+			}
+		})
+	}
+}
+
+func TestRunSourcesCustomPipeline(t *testing.T) {
+	ejector := useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "pipeline-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		Pipeline: config.PipelineConfig{
+			Main: []string{StageCopy, StageVerify, StageRename, StageArchive, StageCatalog, StageDelete},
+		},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+
+	report, err := RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), false)
+	if err != nil {
+		t.Fatalf("RunSources failed: %v", err)
+	}
+
+	stages := report.Cards[0].Stages
+	if len(stages) != 6 {
+		t.Fatalf("Expected 6 stage results, got %+v", stages)
+	}
+	if stages[3].Name != StageArchive || stages[3].Counts[string(ActionCopied)] != 1 {
+		t.Errorf("Archive stage should report one copied file: %+v", stages[3])
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.DestinationPath, "2025-12-31", "DSC00001.JPG")); err != nil {
+		t.Errorf("Photo was not archived: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.TargetPath, "DCIM", "02512310")); !os.IsNotExist(err) {
+		t.Error("Card should have been cleared")
+	}
+	if len(ejector.ejected) != 0 {
+		t.Errorf("Pipeline without eject stage ejected %v", ejector.ejected)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(cfg.DestinationPath, CatalogDirName, report.RunID+"_main.json"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("Expected one catalog file, got %v (%v)", matches, err)
+	}
+	data, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatalf("Failed to read catalog: %v", err)
+	}
+	var entry catalog
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Failed to parse catalog: %v", err)
+	}
+	if len(entry.Files) != 1 || entry.Files[0].Action != ActionCopied {
+		t.Errorf("Unexpected catalog: %+v", entry)
+	}
+}
+
+// markerStage creates a file in the staging directory
+type markerStage struct{}
+
+func (markerStage) Name() string { return "marker" }
+
+func (markerStage) Run(ctx context.Context, state *RunState) error {
+	if state.DryRun {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(state.TmpDir, "marker.txt"), []byte(state.RunID), 0644)
+}
+
+func TestRegisterStage(t *testing.T) {
+	RegisterStage(card.RoleMain, "marker", func() Stage { return markerStage{} })
+	defer delete(stageRegistry[card.RoleMain], "marker")
+
+	pipeline, err := NewPipeline(card.RoleMain, []string{StageCopy, "marker"})
+	if err != nil {
+		t.Fatalf("NewPipeline failed: %v", err)
+	}
+
+	tmpDir := t.TempDir()
+	state := &RunState{
+		Config:     &config.Config{},
+		Source:     config.Source{Name: "main"},
+		RunID:      "run-1",
+		SourceDCIM: filepath.Join(tmpDir, "card", "DCIM"),
+		TmpDir:     filepath.Join(tmpDir, "tmp"),
+	}
+	writeTree(t, state.SourceDCIM, map[string]string{"02512310/DSC00001.JPG": "photo"})
+
+	results, err := pipeline.Run(t.Context(), state)
+	if err != nil {
+		t.Fatalf("Pipeline failed: %v", err)
+	}
+	if len(results) != 2 || results[1].Name != "marker" {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+	if _, err := os.Stat(filepath.Join(state.TmpDir, "marker.txt")); err != nil {
+		t.Errorf("Registered stage did not run: %v", err)
+	}
+}
+
+// cancelStage cancels the run as a signal would
+type cancelStage struct {
+	cancel context.CancelFunc
+}
+
+func (cancelStage) Name() string { return "interrupt" }
+
+func (s cancelStage) Run(ctx context.Context, state *RunState) error {
+	s.cancel()
+	return nil
+}
+
+func TestRunSourcesInterrupted(t *testing.T) {
+	ejector := useRecordingEjector(t)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	RegisterStage(card.RoleMain, "interrupt", func() Stage { return cancelStage{cancel: cancel} })
+	defer delete(stageRegistry[card.RoleMain], "interrupt")
+
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources: []config.Source{
+			{Name: "first", Path: filepath.Join(tmpDir, "first"), Role: "main"},
+			{Name: "second", Path: filepath.Join(tmpDir, "second"), Role: "main"},
+		},
+		Pipeline: config.PipelineConfig{
+			Main: []string{StageCopy, "interrupt", StageRename, StageArchive, StageDelete, StageCleanup, StageEject},
+		},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	for _, src := range cfg.Sources {
+		writeTree(t, src.Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+	}
+
+	report, err := RunSources(ctx, cfg, cfg.Sources, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if !report.Interrupted() || len(report.Cards) != 2 {
+		t.Fatalf("Unexpected report: %+v", report.Cards)
+	}
+
+	first := report.Cards[0]
+	if len(first.Stages) != 7 {
+		t.Fatalf("Expected 7 stage results, got %+v", first.Stages)
+	}
+	for _, stage := range first.Stages[2:] {
+		if !stage.Skipped {
+			t.Errorf("Stage %s should be skipped after the interruption", stage.Name)
+		}
+	}
+	state := first.state()
+	for _, want := range []string{"stopped before rename", "card not modified", "staged files kept in " + first.TmpDir} {
+		if !strings.Contains(state, want) {
+			t.Errorf("State %q should mention %q", state, want)
+		}
+	}
+	if second := report.Cards[1]; len(second.Stages) != 0 || !errors.Is(second.Err, context.Canceled) {
+		t.Errorf("Second card should not be started: %+v", second)
+	}
+
+	for _, src := range cfg.Sources {
+		if _, err := os.Stat(filepath.Join(src.Path, "DCIM", "02512310", "DSC00001.JPG")); err != nil {
+			t.Errorf("Photos on %s must not be deleted after an interruption: %v", src.Name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(first.TmpDir, "02512310", "DSC00001.JPG")); err != nil {
+		t.Errorf("Staged copy should be kept: %v", err)
+	}
+	if len(ejector.ejected) != 0 {
+		t.Errorf("No card should be ejected, got %v", ejector.ejected)
+	}
+}
+
+func TestPipelineOnStorage(t *testing.T) {
+	errFault := errors.New("injected fault")
+	photo := filepath.FromSlash("/card/DCIM/02512310/DSC00001.JPG")
+	archived := filepath.FromSlash("/archive/2025-12-31/DSC00001.JPG")
+
+	tests := []struct {
+		name      string
+		cardFault func(op storage.Op, name string) error
+		dstFault  func(op storage.Op, name string) error
+		failed    string
+	}{
+		{"success", nil, nil, ""},
+		{"card read fault", func(op storage.Op, name string) error {
+			if op == storage.OpRead {
+				return errFault
+			}
+			return nil
+		}, nil, StageCopy},
+		{"archive write fault", nil, func(op storage.Op, name string) error {
+			if op == storage.OpWrite {
+				return errFault
+			}
+			return nil
+		}, StageArchive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := NewPipeline(card.RoleMain, []string{StageCopy, StageVerify, StageRename, StageArchive, StageDelete})
+			if err != nil {
+				t.Fatalf("NewPipeline failed: %v", err)
+			}
+
+			cardFS, archiveFS := storage.NewMem(), storage.NewMem()
+			cardFS.AddFile(photo, []byte("photo"), time.Now())
+			archiveFS.MkdirAll(filepath.FromSlash("/archive"), 0755)
+			cardFS.Fault, archiveFS.Fault = tt.cardFault, tt.dstFault
+
+			state := &RunState{
+				Config:      &config.Config{},
+				Source:      config.Source{Name: "main"},
+				RunID:       "run-1",
+				SourceDCIM:  filepath.FromSlash("/card/DCIM"),
+				TmpDir:      filepath.Join(t.TempDir(), "tmp"),
+				Destination: filepath.FromSlash("/archive"),
+				Card:        cardFS,
+				Archive:     archiveFS,
+			}
+
+			results, err := pipeline.Run(t.Context(), state)
+			if tt.failed == "" {
+				if err != nil {
+					t.Fatalf("Pipeline failed: %v", err)
+				}
+				if data, err := storage.ReadFile(archiveFS, archived); err != nil || string(data) != "photo" {
+					t.Errorf("Archived photo = %q, %v", data, err)
+				}
+				if _, err := cardFS.Stat(photo); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Photo should be deleted from the card: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, errFault) {
+				t.Fatalf("Expected injected fault, got %v", err)
+			}
+			for _, result := range results {
+				if result.Name == tt.failed && result.Err == nil {
+					t.Errorf("Stage %s should have failed", tt.failed)
+				}
+				if result.Name == StageDelete && !result.Skipped {
+					t.Errorf("Delete should be skipped after a failure: %+v", result)
+				}
+			}
+			cardFS.Fault = nil
+			if _, err := cardFS.Stat(photo); err != nil {
+				t.Errorf("Photo should stay on the card: %v", err)
+			}
+
+			// No partially written file may be left in staging or the archive
+			for _, tree := range []struct {
+				fsys storage.FS
+				root string
+			}{{storage.Local{}, state.TmpDir}, {archiveFS, state.Destination}} {
+				storage.WalkDir(tree.fsys, tree.root, func(path string, d fs.DirEntry, err error) error {
+					if err == nil && strings.Contains(d.Name(), partialMarker) {
+						t.Errorf("Partial file left behind: %s", path)
+					}
+					return nil
+				})
+			}
+		})
+	}
+}
+
+func TestPipelineRefusesLocalOnlyFeatures(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(state *RunState)
+	}{
+		{"keep-on-card", func(state *RunState) { state.CardState = cardstate.New("", "") }},
+		{"quarantine", func(state *RunState) { state.Config.Quarantine.Location = QuarantineLocal }},
+		{"index", func(state *RunState) {
+			state.Card = storage.Local{}
+			state.Archive = storage.NewMem()
+			state.Merge.Index = &index.Index{}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := NewPipeline(card.RoleMain, []string{StageCopy})
+			if err != nil {
+				t.Fatalf("NewPipeline failed: %v", err)
+			}
+			state := &RunState{
+				Config:     &config.Config{},
+				Source:     config.Source{Name: "main"},
+				SourceDCIM: filepath.FromSlash("/card/DCIM"),
+				TmpDir:     filepath.Join(t.TempDir(), "tmp"),
+				Card:       storage.NewMem(),
+			}
+			tt.setup(state)
+
+			results, err := pipeline.Run(t.Context(), state)
+			if err == nil || len(results) != 0 {
+				t.Errorf("Expected the run to be refused before any stage, got %v, %+v", err, results)
+			}
+		})
+	}
+}
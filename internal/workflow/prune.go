@@ -0,0 +1,122 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/trash"
+)
+
+// TrashContents moves all contents of dir to the desktop trash, keeping dir itself
+func TrashContents(dir string, dryRun bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	if dryRun {
+		log.Printf("[DRY RUN] Would move contents of %s to the trash", dir)
+		return nil
+	}
+
+	t, err := trash.New()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := t.Put(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanDir empties dir through the trash when the configuration asks for it
+func cleanDir(cfg *config.Config, dir string, dryRun bool) error {
+	if cfg.UseTrash {
+		return TrashContents(dir, dryRun)
+	}
+	return RemoveContents(storage.Local{}, dir, dryRun)
+}
+
+var datedFolder = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})`)
+
+// Prune removes the date folders of the archive dated before the given day.
+// Folders are dated by a leading yyyy-mm-dd in their name; they are moved to the
+// trash when UseTrash is set and deleted otherwise. It returns the pruned folders,
+// and stops between two folders once ctx is cancelled.
+func Prune(ctx context.Context, cfg *config.Config, before time.Time, dryRun bool) ([]string, error) {
+	if err := CheckDirectoryExists(storage.Local{}, cfg.DestinationPath); err != nil {
+		return nil, fmt.Errorf("destination check failed: %w", err)
+	}
+	cutoff := before.Format("2006-01-02")
+
+	var folders []string
+	err := storage.WalkDir(storage.Local{}, cfg.DestinationPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == cfg.DestinationPath {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		match := datedFolder.FindStringSubmatch(d.Name())
+		if match == nil {
+			return nil
+		}
+		day := match[1] + "-" + match[2] + "-" + match[3]
+		if _, err := time.Parse("2006-01-02", day); err == nil && day < cutoff {
+			folders = append(folders, path)
+		}
+		// Date folders are pruned as a whole
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan archive: %w", err)
+	}
+	sort.Strings(folders)
+
+	var t *trash.Trash
+	if cfg.UseTrash && !dryRun {
+		if t, err = trash.New(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, folder := range folders {
+		if err := ctx.Err(); err != nil {
+			return folders[:i], err
+		}
+		switch {
+		case dryRun && cfg.UseTrash:
+			log.Printf("[DRY RUN] Would move to trash: %s", folder)
+		case dryRun:
+			log.Printf("[DRY RUN] Would delete: %s", folder)
+		case t != nil:
+			log.Printf("Moving to trash: %s", folder)
+			err = t.Put(folder)
+		default:
+			log.Printf("Deleting: %s", folder)
+			err = os.RemoveAll(folder)
+		}
+		if err != nil {
+			return folders[:i], fmt.Errorf("failed to prune %s: %w", folder, err)
+		}
+	}
+	return folders, nil
+}
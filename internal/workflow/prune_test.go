@@ -0,0 +1,83 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name     string
+		useTrash bool
+		dryRun   bool
+	}{
+		{"delete", false, false},
+		{"trash", true, false},
+		{"dry run", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			t.Setenv("XDG_DATA_HOME", filepath.Join(tmpDir, "data"))
+
+			cfg := &config.Config{DestinationPath: filepath.Join(tmpDir, "archive"), UseTrash: tt.useTrash}
+			writeTree(t, cfg.DestinationPath, map[string]string{
+				"2024-06-15/DSC00001.JPG":        "old",
+				"a7iv/2024-12-31_a7iv/C0001.MP4": "old video",
+				"2025-01-01/DSC00002.JPG":        "kept",
+				"misc/notes.txt":                 "kept",
+				".catalog/2023-01-01.json":       "hidden",
+			})
+
+			pruned, err := Prune(t.Context(), cfg, time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local), tt.dryRun)
+			if err != nil {
+				t.Fatalf("Prune failed: %v", err)
+			}
+			if len(pruned) != 2 {
+				t.Fatalf("Expected 2 pruned folders, got %v", pruned)
+			}
+
+			for name, kept := range map[string]bool{
+				"2024-06-15":               tt.dryRun,
+				"a7iv/2024-12-31_a7iv":     tt.dryRun,
+				"2025-01-01":               true,
+				"misc":                     true,
+				".catalog/2023-01-01.json": true,
+			} {
+				_, err := os.Stat(filepath.Join(cfg.DestinationPath, filepath.FromSlash(name)))
+				if (err == nil) != kept {
+					t.Errorf("%s exists = %v, want %v", name, err == nil, kept)
+				}
+			}
+
+			_, err = os.Stat(filepath.Join(tmpDir, "data", "Trash", "files", "2024-06-15", "DSC00001.JPG"))
+			if inTrash := err == nil; inTrash != (tt.useTrash && !tt.dryRun) {
+				t.Errorf("Folder in trash = %v", inTrash)
+			}
+		})
+	}
+}
+
+func TestCleanupStageUsesTrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", filepath.Join(tmpDir, "data"))
+
+	state := &RunState{Config: &config.Config{UseTrash: true}, TmpDir: filepath.Join(tmpDir, "tmp")}
+	writeTree(t, state.TmpDir, map[string]string{"2025-12-31/DSC00001.JPG": "staged"})
+
+	if err := (cleanupStage{}).Run(t.Context(), state); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	entries, err := os.ReadDir(state.TmpDir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Temporary directory should be empty, got %v (%v)", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "data", "Trash", "files", "2025-12-31", "DSC00001.JPG")); err != nil {
+		t.Errorf("Staged files should be in the trash: %v", err)
+	}
+}
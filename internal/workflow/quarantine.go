@@ -0,0 +1,217 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/quarantine"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// Quarantine locations
+const (
+	QuarantineCard  = "card"
+	QuarantineLocal = "local"
+)
+
+// ValidateQuarantine checks the quarantine settings
+func ValidateQuarantine(cfg *config.Config) error {
+	switch cfg.Quarantine.Location {
+	case "", QuarantineCard, QuarantineLocal:
+	default:
+		return fmt.Errorf("invalid quarantine location %q (valid: %s, %s)", cfg.Quarantine.Location, QuarantineCard, QuarantineLocal)
+	}
+	if cfg.Quarantine.RetentionDays < 0 {
+		return fmt.Errorf("quarantine retention_days must not be negative")
+	}
+	return nil
+}
+
+// cardQuarantine returns the quarantine area used for the card at mountPoint
+// and the batches in it that came from this card
+func cardQuarantine(cfg *config.Config, mountPoint string) (*quarantine.Store, []quarantine.Batch, error) {
+	if cfg.Quarantine.Location == QuarantineCard {
+		store := quarantine.Open(filepath.Join(mountPoint, quarantine.CardDirName))
+		batches, err := store.Batches()
+		return store, batches, err
+	}
+
+	store := quarantine.Open(cfg.QuarantineDir())
+	all, err := store.Batches()
+	if err != nil {
+		return nil, nil, err
+	}
+	cardID := cardIdentity(mountPoint)
+	var batches []quarantine.Batch
+	for _, b := range all {
+		if (cardID != "" && b.CardID == cardID) || (b.CardID == "" && filepath.Clean(b.CardPath) == filepath.Clean(mountPoint)) {
+			batches = append(batches, b)
+		}
+	}
+	return store, batches, nil
+}
+
+// cardIdentity returns the ID of the card at mountPoint, or "" for an unregistered card
+func cardIdentity(mountPoint string) string {
+	id, err := card.ReadIdentity(mountPoint)
+	if err != nil {
+		return ""
+	}
+	return id.ID
+}
+
+// quarantineFiles purges expired batches of the card, then moves files from the card
+// into a new batch and removes the directories of DCIM that became empty
+func quarantineFiles(state *RunState, files []string) error {
+	if err := purgeQuarantine(state.Config, state.Source.Path, state.Merge.Index, state.DryRun); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	store, _, err := cardQuarantine(state.Config, state.Source.Path)
+	if err != nil {
+		return err
+	}
+	manifest := quarantine.Manifest{
+		RunID:  state.RunID,
+		Source: unsafeNameChars.ReplaceAllString(state.Source.Name, "_"),
+		CardID: cardIdentity(state.Source.Path),
+	}
+	batch, err := store.Move(manifest, state.Source.Path, files, state.DryRun)
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %d files from %s to quarantine: %s", len(batch.Files), state.Source.Path, batch.Dir)
+
+	if state.DryRun {
+		return nil
+	}
+	return removeEmptyDirs(state.Card, state.SourceDCIM, state.SourceDCIM)
+}
+
+// purgeQuarantine deletes the batches of the card at mountPoint that are older than the
+// retention period or, with PurgeVerified, whose files are all archived
+func purgeQuarantine(cfg *config.Config, mountPoint string, idx *index.Index, dryRun bool) error {
+	if !purgeEnabled(cfg) {
+		return nil
+	}
+	store, batches, err := cardQuarantine(cfg, mountPoint)
+	if err != nil {
+		return err
+	}
+	return purgeBatches(cfg, store, batches, idx, dryRun)
+}
+
+// PurgeLocalQuarantine applies the retention policy to every batch of the quarantine on
+// local disk, so that batches of cards that are never imported again do not stay forever.
+// Batches kept on the cards themselves are purged when their card is imported.
+func PurgeLocalQuarantine(cfg *config.Config, idx *index.Index, dryRun bool) error {
+	if cfg.Quarantine.Location != QuarantineLocal || !purgeEnabled(cfg) {
+		return nil
+	}
+	store := quarantine.Open(cfg.QuarantineDir())
+	batches, err := store.Batches()
+	if err != nil {
+		return err
+	}
+	return purgeBatches(cfg, store, batches, idx, dryRun)
+}
+
+func purgeEnabled(cfg *config.Config) bool {
+	return cfg.Quarantine.RetentionDays > 0 || cfg.Quarantine.PurgeVerified
+}
+
+// purgeBatches deletes the batches that are older than the retention period or,
+// with PurgeVerified, whose files are all archived
+func purgeBatches(cfg *config.Config, store *quarantine.Store, batches []quarantine.Batch, idx *index.Index, dryRun bool) error {
+	policy := cfg.Quarantine
+	for _, b := range batches {
+		reason := ""
+		if policy.RetentionDays > 0 && time.Since(b.Created) > time.Duration(policy.RetentionDays)*24*time.Hour {
+			reason = fmt.Sprintf("older than %d days", policy.RetentionDays)
+		} else if policy.PurgeVerified && idx != nil {
+			verified, err := batchArchived(b, idx)
+			if err != nil {
+				return err
+			}
+			if verified {
+				reason = "all files verified in the archive"
+			}
+		}
+		if reason == "" {
+			continue
+		}
+
+		log.Printf("Purging quarantine batch %s (%s)", b.Dir, reason)
+		if err := store.Purge(b, dryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchArchived reports whether every file of b has an identical copy in the archive
+func batchArchived(b quarantine.Batch, idx *index.Index) (bool, error) {
+	for _, path := range b.Paths() {
+		hash, err := checksum.File(path)
+		if err != nil {
+			return false, err
+		}
+		archived, err := archivedCopy(idx, hash)
+		if err != nil || archived == "" {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// RestoreQuarantine moves the quarantined files of the card at mountPoint back to the card.
+// It returns the number of restored files.
+func RestoreQuarantine(ctx context.Context, cfg *config.Config, mountPoint string, dryRun bool) (int, error) {
+	if err := ValidateQuarantine(cfg); err != nil {
+		return 0, err
+	}
+	if cfg.Quarantine.Location == "" {
+		return 0, fmt.Errorf("quarantine is not enabled in the configuration")
+	}
+
+	store, batches, err := cardQuarantine(cfg, mountPoint)
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, b := range batches {
+		log.Printf("Restoring %d files quarantined by run %s", len(b.Files), b.RunID)
+		if err := store.Restore(ctx, b, mountPoint, dryRun); err != nil {
+			return restored, err
+		}
+		restored += len(b.Files)
+	}
+	return restored, nil
+}
+
+// dcimFiles lists every file below the DCIM directory of the card
+func dcimFiles(state *RunState) ([]string, error) {
+	var files []string
+	err := storage.WalkDir(state.Card, state.SourceDCIM, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source files: %w", err)
+	}
+	return files, nil
+}
@@ -0,0 +1,152 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/quarantine"
+)
+
+func TestRunQuarantine(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+	}{
+		{"on the card", QuarantineCard},
+		{"local", QuarantineLocal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRecordingEjector(t)
+			tmpDir := t.TempDir()
+
+			cfg := &config.Config{
+				DestinationPath: filepath.Join(tmpDir, "archive"),
+				TmpDir:          filepath.Join(tmpDir, "tmp"),
+				CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+				TargetPath:      filepath.Join(tmpDir, "card"),
+				Quarantine:      config.QuarantineConfig{Location: tt.location, Dir: filepath.Join(tmpDir, "quarantine")},
+			}
+			writeTree(t, cfg.DestinationPath, nil)
+			writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+			photo := filepath.Join(cfg.TargetPath, "DCIM", "02512310", "DSC00001.JPG")
+
+			if err := Run(t.Context(), cfg, false); err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if _, err := os.Stat(photo); !os.IsNotExist(err) {
+				t.Fatal("Photo should have been removed from the card")
+			}
+			_, batches, err := cardQuarantine(cfg, cfg.TargetPath)
+			if err != nil || len(batches) != 1 {
+				t.Fatalf("Expected one quarantine batch, got %v (%v)", batches, err)
+			}
+			if tt.location == QuarantineCard && filepath.Dir(batches[0].Dir) != filepath.Join(cfg.TargetPath, quarantine.CardDirName) {
+				t.Errorf("Batch should be on the card, got %s", batches[0].Dir)
+			}
+
+			restored, err := RestoreQuarantine(t.Context(), cfg, cfg.TargetPath, false)
+			if err != nil || restored != 1 {
+				t.Fatalf("RestoreQuarantine() = %d, %v", restored, err)
+			}
+			if got := readFile(t, photo); got != "photo" {
+				t.Errorf("Restored photo has content %q", got)
+			}
+		})
+	}
+}
+
+func TestPurgeQuarantine(t *testing.T) {
+	useRecordingEjector(t)
+	tmpDir := t.TempDir()
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		Quarantine:      config.QuarantineConfig{Location: QuarantineCard, PurgeVerified: true},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00001.JPG": "first"})
+	if err := Run(t.Context(), cfg, false); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	// The next run verifies the first batch against the archive and purges it
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00002.JPG": "second"})
+	if err := Run(t.Context(), cfg, false); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	_, batches, err := cardQuarantine(cfg, cfg.TargetPath)
+	if err != nil {
+		t.Fatalf("cardQuarantine failed: %v", err)
+	}
+	if len(batches) != 1 || batches[0].Files[0] != "DCIM/02512310/DSC00002.JPG" {
+		t.Fatalf("Only the batch of the last run should remain, got %+v", batches)
+	}
+
+	// Retention purges batches regardless of the archive
+	cfg.Quarantine = config.QuarantineConfig{Location: QuarantineCard, RetentionDays: 1}
+	old := time.Now().Add(-48 * time.Hour)
+	batches[0].Created = old
+	data := []byte(`{"run_id":"` + batches[0].RunID + `","source":"main","card_path":"` + cfg.TargetPath + `","created":"` + old.UTC().Format(time.RFC3339) + `","files":["DCIM/02512310/DSC00002.JPG"]}`)
+	if err := os.WriteFile(filepath.Join(batches[0].Dir, quarantine.ManifestFileName), data, 0644); err != nil {
+		t.Fatalf("Failed to age manifest: %v", err)
+	}
+	if err := purgeQuarantine(cfg, cfg.TargetPath, nil, false); err != nil {
+		t.Fatalf("purgeQuarantine failed: %v", err)
+	}
+	if _, batches, _ := cardQuarantine(cfg, cfg.TargetPath); len(batches) != 0 {
+		t.Errorf("Expired batch should have been purged, got %+v", batches)
+	}
+}
+
+func TestValidateQuarantine(t *testing.T) {
+	if err := ValidateQuarantine(&config.Config{Quarantine: config.QuarantineConfig{Location: "cloud"}}); err == nil {
+		t.Error("Expected error for an unknown location")
+	}
+	if err := ValidateQuarantine(&config.Config{Quarantine: config.QuarantineConfig{Location: QuarantineLocal}}); err != nil {
+		t.Errorf("ValidateQuarantine failed: %v", err)
+	}
+}
+
+func TestRunPurgesLocalQuarantineOfOtherCards(t *testing.T) {
+	useRecordingEjector(t)
+	tmpDir := t.TempDir()
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+		Quarantine:      config.QuarantineConfig{Location: QuarantineLocal, Dir: filepath.Join(tmpDir, "quarantine"), RetentionDays: 1},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+
+	// A batch of a card that is never imported again
+	gone := filepath.Join(tmpDir, "gone")
+	writeTree(t, gone, map[string]string{"DCIM/02512310/DSC00009.JPG": "old"})
+	store := quarantine.Open(cfg.QuarantineDir())
+	batch, err := store.Move(quarantine.Manifest{RunID: "old-run", Source: "gone"}, gone, []string{filepath.Join(gone, "DCIM", "02512310", "DSC00009.JPG")}, false)
+	if err != nil {
+		t.Fatalf("Failed to quarantine: %v", err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	data := []byte(`{"run_id":"old-run","source":"gone","card_path":"` + gone + `","created":"` + old.UTC().Format(time.RFC3339) + `","files":["DCIM/02512310/DSC00009.JPG"]}`)
+	if err := os.WriteFile(filepath.Join(batch.Dir, quarantine.ManifestFileName), data, 0644); err != nil {
+		t.Fatalf("Failed to age manifest: %v", err)
+	}
+
+	if err := Run(t.Context(), cfg, false); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, err := os.Stat(batch.Dir); !os.IsNotExist(err) {
+		t.Errorf("Expired batch of another card should have been purged: %v", err)
+	}
+}
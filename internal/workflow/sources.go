@@ -0,0 +1,455 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/filter"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/parity"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// NormalizeRole maps the role of a source to card.RoleMain or card.RoleBackup.
+// An empty role and "primary" mean a main card.
+func NormalizeRole(role string) string {
+	switch strings.ToLower(strings.TrimSpace(role)) {
+	case "", "primary", card.RoleMain:
+		return card.RoleMain
+	default:
+		return strings.ToLower(strings.TrimSpace(role))
+	}
+}
+
+// Sources returns the configured cards with the given role.
+// Without a sources list, TargetPath and BackupPath describe a single main and backup card.
+func Sources(cfg *config.Config, role string) []config.Source {
+	if len(cfg.Sources) == 0 {
+		if role == card.RoleBackup {
+			return []config.Source{{Name: card.RoleBackup, Path: cfg.BackupPath, Body: cfg.Body, Role: card.RoleBackup}}
+		}
+		return []config.Source{{Name: card.RoleMain, Path: cfg.TargetPath, Body: cfg.Body, Role: card.RoleMain}}
+	}
+
+	var sources []config.Source
+	for i, src := range cfg.Sources {
+		if src.Name == "" {
+			src.Name = fmt.Sprintf("source-%d", i+1)
+		}
+		if NormalizeRole(src.Role) == role {
+			sources = append(sources, src)
+		}
+	}
+	return sources
+}
+
+// sourceForCard returns the configured source describing the registered card at mountPoint,
+// falling back to a source built from the registry entry
+func sourceForCard(cfg *config.Config, mountPoint string, entry card.Entry) config.Source {
+	candidates := Sources(cfg, entry.Role)
+	for _, src := range candidates {
+		if filepath.Clean(src.Path) == filepath.Clean(mountPoint) {
+			return src
+		}
+	}
+	for _, src := range candidates {
+		if src.Path == config.AutoDetect && (src.Body == "" || src.Body == entry.Body) {
+			src.Path = mountPoint
+			return src
+		}
+	}
+	return config.Source{Name: entry.Label, Path: mountPoint, Body: entry.Body, Role: entry.Role}
+}
+
+// CardResult is the outcome of processing one card
+type CardResult struct {
+	Source config.Source
+	// Path is the resolved mount point of the card
+	Path string
+	// Summary holds the per-file decisions of a main card import
+	Summary *Summary
+	// Backup holds the verification result of a backup card
+	Backup *BackupCheck
+	// Stages reports the timing and outcome of each pipeline stage
+	Stages []StageResult
+	// TmpDir is the staging directory of the card
+	TmpDir   string
+	Duration time.Duration
+	Err      error
+}
+
+// Report is the consolidated result of a run over several cards
+type Report struct {
+	RunID string
+	Cards []CardResult
+}
+
+// Interrupted reports whether the run was cancelled before all cards were processed
+func (r *Report) Interrupted() bool {
+	for _, c := range r.Cards {
+		if errors.Is(c.Err, context.Canceled) {
+			return true
+		}
+	}
+	return false
+}
+
+// Failed returns the number of cards that could not be processed completely
+func (r *Report) Failed() int {
+	failed := 0
+	for _, c := range r.Cards {
+		if c.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Log prints one line per card followed by the decisions of each import
+func (r *Report) Log() {
+	if r == nil || len(r.Cards) == 0 {
+		return
+	}
+
+	log.Printf("=== Card results (run %s) ===", r.RunID)
+	for _, c := range r.Cards {
+		status := "ok"
+		if errors.Is(c.Err, context.Canceled) {
+			status = "INTERRUPTED"
+		} else if c.Err != nil {
+			status = "FAILED: " + c.Err.Error()
+		}
+		detail := ""
+		switch {
+		case c.Summary != nil:
+			detail = fmt.Sprintf("%d copied, %d skipped", c.Summary.Count(ActionCopied)+c.Summary.Count(ActionKeptBoth)+c.Summary.Count(ActionOverwritten),
+				c.Summary.Count(ActionSkippedIdentical)+c.Summary.Count(ActionSkippedArchived)+c.Summary.Count(ActionSkippedConflict))
+		case c.Backup != nil:
+			detail = fmt.Sprintf("%d archived, %d unmatched", len(c.Backup.Archived), len(c.Backup.Unmatched))
+		}
+		log.Printf("%-12s %-7s %-10s %-30s %-28s %6s  %s",
+			c.Source.Name, NormalizeRole(c.Source.Role), c.Source.Body, c.Path, detail, c.Duration.Round(time.Second), status)
+	}
+
+	for _, c := range r.Cards {
+		for _, stage := range c.Stages {
+			status := "ok"
+			switch {
+			case stage.Skipped:
+				status = "skipped"
+			case errors.Is(stage.Err, context.Canceled):
+				status = "interrupted"
+			case stage.Err != nil:
+				status = "failed"
+			}
+			log.Printf("  %-12s %-8s %8s  %s", c.Source.Name, stage.Name, stage.Duration.Round(time.Millisecond), status)
+		}
+	}
+
+	if r.Interrupted() {
+		log.Println("=== Run interrupted ===")
+		for _, c := range r.Cards {
+			log.Printf("%-12s %s", c.Source.Name, c.state())
+		}
+	}
+
+	for _, c := range r.Cards {
+		if c.Summary != nil && len(r.Cards) > 1 {
+			log.Printf("--- %s ---", c.Source.Name)
+		}
+		if c.Summary != nil {
+			c.Summary.Log()
+		}
+	}
+}
+
+// state describes what a card was left with, for the report of an interrupted run
+func (c CardResult) state() string {
+	if c.Err == nil {
+		return "completed"
+	}
+
+	var done []string
+	step, copied, deleted, cleaned := "", false, false, false
+	for _, stage := range c.Stages {
+		switch {
+		case stage.Skipped:
+			if step == "" {
+				step = "before " + stage.Name
+			}
+			continue
+		case stage.Err != nil:
+			step = "in " + stage.Name
+		default:
+			done = append(done, stage.Name)
+			cleaned = cleaned || stage.Name == StageCleanup
+		}
+		copied = copied || stage.Name == StageCopy
+		deleted = deleted || stage.Name == StageDelete
+	}
+	if len(c.Stages) == 0 {
+		return "not processed; card not modified"
+	}
+
+	parts := []string{"stopped " + step}
+	if len(done) > 0 {
+		parts = append(parts, "completed "+strings.Join(done, ", "))
+	}
+	if deleted {
+		parts = append(parts, "archived files may have been removed from the card")
+	} else {
+		parts = append(parts, "card not modified")
+	}
+	if copied && !cleaned && c.TmpDir != "" {
+		parts = append(parts, "staged files kept in "+c.TmpDir)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// RunSources imports every main source and then clears every backup source,
+// so backup cards are verified against the files imported in the same run.
+// A failing card does not stop the others; all errors are returned together.
+// Once ctx is cancelled the current file is finished or rolled back,
+// no further stage or card is started, and the archive index is still saved.
+func RunSources(ctx context.Context, cfg *config.Config, sources []config.Source, dryRun bool) (*Report, error) {
+	report := &Report{RunID: newRunID()}
+	if len(sources) == 0 {
+		return report, fmt.Errorf("no sources configured")
+	}
+
+	if err := ValidateHooks(cfg); err != nil {
+		return report, err
+	}
+
+	if err := ValidateQuarantine(cfg); err != nil {
+		return report, err
+	}
+
+	var mains, backups []config.Source
+	for _, src := range sources {
+		switch role := NormalizeRole(src.Role); role {
+		case card.RoleMain:
+			mains = append(mains, src)
+		case card.RoleBackup:
+			backups = append(backups, src)
+		default:
+			return report, fmt.Errorf("source %s: %w", src.Name, card.ValidateRole(role))
+		}
+	}
+
+	if err := ValidateSourceNames(sources); err != nil {
+		return report, err
+	}
+
+	// Only main cards are staged
+	if len(mains) > 0 {
+		if err := ValidateTmpDir(cfg); err != nil {
+			return report, err
+		}
+	}
+
+	pipelines := map[string]*Pipeline{}
+	for _, role := range []string{card.RoleMain, card.RoleBackup} {
+		pipeline, err := NewPipeline(role, PipelineNames(cfg, role))
+		if err != nil {
+			return report, fmt.Errorf("invalid pipeline: %w", err)
+		}
+		pipelines[role] = pipeline
+	}
+
+	policy, err := ParseConflictPolicy(cfg.ConflictPolicy)
+	if err != nil {
+		return report, err
+	}
+
+	fileFilter, err := filter.New(cfg.Filter)
+	if err != nil {
+		return report, err
+	}
+
+	if err := parity.ValidateRedundancy(cfg.Parity.Redundancy); err != nil {
+		return report, err
+	}
+
+	// Only main cards are uploaded; backup cards are verified against the archive alone
+	var dests []Destination
+	if len(mains) > 0 {
+		if dests, err = OpenDestinations(cfg); err != nil {
+			return report, err
+		}
+		defer CloseDestinations(dests)
+	}
+
+	if err := CheckDirectoryExists(storage.Local{}, cfg.DestinationPath); err != nil {
+		return report, fmt.Errorf("destination check failed: %w", err)
+	}
+
+	if _, err := CleanPartialFiles(storage.Local{}, cfg.DestinationPath, dryRun); err != nil {
+		return report, err
+	}
+	for _, dest := range dests {
+		if _, ok := dest.FS.(storage.Local); ok {
+			if _, err := CleanPartialFiles(dest.FS, dest.Root, dryRun); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	// The index is needed to import for real and to verify backup cards, even in dry-run mode
+	var idx *index.Index
+	if !dryRun || len(backups) > 0 {
+		if idx, err = OpenIndex(ctx, cfg); err != nil {
+			return report, err
+		}
+	}
+
+	if err := PurgeLocalQuarantine(cfg, idx, dryRun); err != nil {
+		return report, err
+	}
+
+	var lock *runLock
+	if len(mains) > 0 {
+		if err := cleanStaleRuns(cfg, report.RunID, dryRun); err != nil {
+			return report, err
+		}
+		if lock, err = createRunDir(cfg, report.RunID, dryRun); err != nil {
+			return report, err
+		}
+	}
+
+	used := make(map[string]string)
+	for _, src := range mains {
+		result := processSource(ctx, cfg, src, card.RoleMain, used, func(resolved config.Source) (CardResult, error) {
+			state := newRunState(cfg, resolved, report.RunID, dryRun)
+			state.Filter = fileFilter
+			state.Merge = MergeOptions{Policy: policy, Index: idx, Summary: &Summary{}}
+			state.Destinations = dests
+			if cfg.KeepOnCard {
+				cardState, err := LoadCardState(cfg, resolved.Path, !dryRun)
+				if err != nil {
+					return CardResult{}, err
+				}
+				log.Printf("Keep-on-card mode: %d files of %s were imported before", cardState.Len(), resolved.Name)
+				state.CardState = cardState
+			}
+			stages, err := runCard(ctx, pipelines[card.RoleMain], state)
+			return CardResult{Summary: state.Merge.Summary, Stages: stages, TmpDir: state.TmpDir}, err
+		})
+		report.Cards = append(report.Cards, result)
+	}
+
+	for _, src := range backups {
+		result := processSource(ctx, cfg, src, card.RoleBackup, used, func(resolved config.Source) (CardResult, error) {
+			state := newRunState(cfg, resolved, report.RunID, dryRun)
+			state.Destination = cfg.DestinationPath
+			state.Filter = fileFilter
+			state.Merge = MergeOptions{Policy: policy, Index: idx}
+			stages, err := runCard(ctx, pipelines[card.RoleBackup], state)
+			return CardResult{Backup: state.Backup, Stages: stages}, err
+		})
+		report.Cards = append(report.Cards, result)
+	}
+
+	if len(mains) > 0 {
+		// The staging of every card is done; the lock file must go before the directory
+		lock.Unlock()
+		if err := removeRunDir(cfg, report.RunID, dryRun); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	if idx != nil && !dryRun {
+		if err := idx.Save(); err != nil {
+			return report, fmt.Errorf("failed to save archive index: %w", err)
+		}
+	}
+
+	var errs []error
+	for _, c := range report.Cards {
+		if c.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Source.Name, c.Err))
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// newRunState returns the state shared by the stages of one card
+func newRunState(cfg *config.Config, src config.Source, runID string, dryRun bool) *RunState {
+	return &RunState{
+		Config:      cfg,
+		Source:      src,
+		RunID:       runID,
+		DryRun:      dryRun,
+		SourceDCIM:  filepath.Join(src.Path, "DCIM"),
+		TmpDir:      stagingDir(cfg, runID, src),
+		Destination: filepath.Join(cfg.DestinationPath, src.Subfolder),
+		Card:        storage.Local{},
+		Archive:     storage.Local{},
+	}
+}
+
+// runCard checks the card and runs the pipeline on it
+func runCard(ctx context.Context, pipeline *Pipeline, state *RunState) ([]StageResult, error) {
+	if err := CheckDirectoryExists(state.Card, state.SourceDCIM); err != nil {
+		return nil, fmt.Errorf("source DCIM check failed: %w", err)
+	}
+	return pipeline.Run(ctx, state)
+}
+
+// processSource resolves and verifies the card of src, then runs fn on it.
+// A card already used by another source of the run, recorded in used, is refused.
+// Nothing is done once ctx is cancelled.
+func processSource(ctx context.Context, cfg *config.Config, src config.Source, role string, used map[string]string, fn func(config.Source) (CardResult, error)) CardResult {
+	started := time.Now()
+	result := CardResult{Source: src}
+	if err := ctx.Err(); err != nil {
+		result.Err = fmt.Errorf("not started: %w", err)
+		return result
+	}
+
+	path, err := ResolveCardPath(cfg, src.Path, role, src.Body)
+	if err == nil {
+		if other, ok := used[filepath.Clean(path)]; ok {
+			err = fmt.Errorf("%w: card at %s is already used by source %s", ErrWrongCard, path, other)
+		} else {
+			used[filepath.Clean(path)] = src.Name
+			err = VerifyCard(cfg, path, role, src.Body)
+		}
+	}
+	if err == nil {
+		log.Printf("Processing %s card %s (%s)", role, src.Name, path)
+		src.Path = path
+		result, err = fn(src)
+		result.Source = src
+	}
+
+	result.Path = path
+	result.Err = err
+	result.Duration = time.Since(started)
+	return result
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// ValidateSourceNames refuses sources whose names give the same staging directory,
+// catalog file or quarantine batch name, which would let their cards share files
+func ValidateSourceNames(sources []config.Source) error {
+	seen := make(map[string]string)
+	for _, src := range sources {
+		// Case-insensitive file systems do not tell "Card A" from "card a"
+		key := strings.ToLower(unsafeNameChars.ReplaceAllString(src.Name, "_"))
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("sources %q and %q would share the file name %q; rename one of them", other, src.Name, key)
+		}
+		seen[key] = src.Name
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package workflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/discovery"
+)
+
+// recordingEjector remembers the volumes it was asked to eject
+type recordingEjector struct {
+	ejected []string
+}
+
+func (e *recordingEjector) Eject(mountPoint string) error {
+	e.ejected = append(e.ejected, mountPoint)
+	return nil
+}
+
+func useRecordingEjector(t *testing.T) *recordingEjector {
+	t.Helper()
+	original := Ejector
+	fake := &recordingEjector{}
+	Ejector = fake
+	t.Cleanup(func() { Ejector = original })
+	return fake
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+}
+
+func TestSourcesLegacy(t *testing.T) {
+	cfg := &config.Config{TargetPath: "/Volumes/1-1", BackupPath: "/Volumes/1-2", Body: "a7iii"}
+
+	mains := Sources(cfg, card.RoleMain)
+	if len(mains) != 1 || mains[0].Path != "/Volumes/1-1" || mains[0].Body != "a7iii" {
+		t.Errorf("Unexpected main sources: %+v", mains)
+	}
+	backups := Sources(cfg, card.RoleBackup)
+	if len(backups) != 1 || backups[0].Path != "/Volumes/1-2" {
+		t.Errorf("Unexpected backup sources: %+v", backups)
+	}
+
+	if dir := stagingDir(cfg, "run-1", mains[0]); dir != filepath.Join(cfg.TmpDir, "run-1", "main") {
+		t.Errorf("Unexpected staging directory: %s", dir)
+	}
+}
+
+func TestSourcesConfigured(t *testing.T) {
+	cfg := &config.Config{
+		TmpDir: "/tmp/photos",
+		Sources: []config.Source{
+			{Name: "a7iii main", Role: "primary"},
+			{Role: "main"},
+			{Name: "a7iii backup", Role: "backup"},
+		},
+	}
+
+	var names []string
+	for _, src := range Sources(cfg, card.RoleMain) {
+		names = append(names, src.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"a7iii main", "source-2"}) {
+		t.Errorf("Unexpected main sources: %v", names)
+	}
+	if len(Sources(cfg, card.RoleBackup)) != 1 {
+		t.Errorf("Expected one backup source")
+	}
+
+	if dir := stagingDir(cfg, "run-1", cfg.Sources[0]); dir != filepath.Join("/tmp/photos", "run-1", "a7iii_main") {
+		t.Errorf("Unexpected staging directory: %s", dir)
+	}
+}
+
+func TestValidateSourceNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []string
+		wantErr bool
+	}{
+		{"distinct", []string{"Card A", "Card B"}, false},
+		{"same after replacing spaces", []string{"Card A", "Card_A"}, true},
+		{"same but for case", []string{"card a", "Card A"}, true},
+		{"same after replacing symbols", []string{"a7iv/main", "a7iv:main"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sources []config.Source
+			for _, name := range tt.sources {
+				sources = append(sources, config.Source{Name: name})
+			}
+			if err := ValidateSourceNames(sources); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateSourceNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunMultipleSources(t *testing.T) {
+	ejector := useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "sources-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources: []config.Source{
+			{Name: "a7iii", Path: filepath.Join(tmpDir, "a7iii-1"), Body: "a7iii", Role: "primary"},
+			{Name: "a7iv", Path: filepath.Join(tmpDir, "a7iv-1"), Body: "a7iv", Role: "primary",
+				FolderTemplate: "{yyyy}-{mm}-{dd}_{body}", Subfolder: "a7iv"},
+			{Name: "a7iii-backup", Path: filepath.Join(tmpDir, "a7iii-2"), Body: "a7iii", Role: "backup"},
+			{Name: "missing", Path: filepath.Join(tmpDir, "missing"), Role: "primary"},
+		},
+	}
+
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "a7iii photo"})
+	writeTree(t, cfg.Sources[1].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "a7iv photo"})
+	writeTree(t, cfg.Sources[2].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "a7iii photo"})
+	for _, src := range cfg.Sources[:3] {
+		if _, err := RegisterCard(cfg, src.Path, NormalizeRole(src.Role), src.Body); err != nil {
+			t.Fatalf("RegisterCard failed: %v", err)
+		}
+	}
+
+	report, err := RunSources(t.Context(), cfg, cfg.Sources, false)
+	if err == nil {
+		t.Fatal("Expected an error for the missing card")
+	}
+	if len(report.Cards) != 4 || report.Failed() != 1 {
+		t.Fatalf("Unexpected report: %+v", report.Cards)
+	}
+	if report.Cards[3].Source.Name != "a7iii-backup" || report.Cards[3].Err != nil {
+		t.Errorf("Backup card should be processed last and succeed: %+v", report.Cards[3])
+	}
+
+	expected := map[string]string{
+		"2025-12-31/DSC00001.JPG":           "a7iii photo",
+		"a7iv/2025-12-31_a7iv/DSC00001.JPG": "a7iv photo",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(filepath.Join(cfg.DestinationPath, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("Expected %s in archive: %v", name, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s has content %q, want %q", name, data, content)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(cfg.Sources[2].Path, "DCIM", "02512310", "DSC00001.JPG")); !os.IsNotExist(err) {
+		t.Error("Backup file imported in the same run should have been cleared")
+	}
+
+	if len(ejector.ejected) != 3 {
+		t.Errorf("Expected 3 ejected cards, got %v", ejector.ejected)
+	}
+}
+
+func TestRunSourcesRefusesWrongCard(t *testing.T) {
+	useRecordingEjector(t)
+
+	tmpDir, err := os.MkdirTemp("", "sources-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources: []config.Source{
+			{Name: "a7iv", Path: filepath.Join(tmpDir, "card"), Body: "a7iv", Role: "main"},
+		},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+	if _, err := RegisterCard(cfg, cfg.Sources[0].Path, card.RoleMain, "a7iii"); err != nil {
+		t.Fatalf("RegisterCard failed: %v", err)
+	}
+
+	_, err = RunSources(t.Context(), cfg, cfg.Sources, false)
+	if !errors.Is(err, ErrWrongCard) {
+		t.Fatalf("Expected ErrWrongCard, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG")); err != nil {
+		t.Error("Photos on a refused card must not be touched")
+	}
+}
+
+func TestRunSourcesRefusesCardUsedTwice(t *testing.T) {
+	useRecordingEjector(t)
+
+	tmpDir := t.TempDir()
+	cardPath := filepath.Join(tmpDir, "card")
+	cfg := &config.Config{
+		TargetPath:      config.AutoDetect,
+		BackupPath:      config.AutoDetect,
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cardPath, map[string]string{"DCIM/10000101/DSC00001.JPG": "photo"})
+
+	original := FindCards
+	defer func() { FindCards = original }()
+	FindCards = func() ([]discovery.Card, error) {
+		return []discovery.Card{{MountPoint: cardPath}}, nil
+	}
+
+	sources := append(Sources(cfg, card.RoleMain), Sources(cfg, card.RoleBackup)...)
+	report, err := RunSources(t.Context(), cfg, sources, true)
+	if !errors.Is(err, ErrWrongCard) {
+		t.Fatalf("Expected ErrWrongCard, got %v", err)
+	}
+	if len(report.Cards) != 2 || report.Cards[0].Err != nil || report.Cards[1].Err == nil {
+		t.Errorf("Only the backup source should be refused: %+v", report.Cards)
+	}
+}
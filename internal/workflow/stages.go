@@ -0,0 +1,331 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// CatalogDirName is the directory inside the destination that receives the catalog of each run
+const CatalogDirName = ".rename-sony-photos-catalog"
+
+// copyStage copies the card's DCIM directory to the staging directory
+type copyStage struct{}
+
+func (copyStage) Name() string { return StageCopy }
+
+func (copyStage) Run(ctx context.Context, state *RunState) error {
+	// Create temporary directory
+	if !state.DryRun {
+		if err := os.MkdirAll(state.TmpDir, 0755); err != nil {
+			return fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+	} else {
+		log.Printf("[DRY RUN] Would create temporary directory: %s", state.TmpDir)
+	}
+
+	log.Printf("Copying photos from %s to %s", state.SourceDCIM, state.TmpDir)
+	if state.selective() {
+		if err := copySelected(ctx, state); err != nil {
+			return err
+		}
+	} else if err := CopyDir(ctx, state.Card, state.SourceDCIM, storage.Local{}, state.TmpDir, state.DryRun); err != nil {
+		return fmt.Errorf("failed to copy files to temp directory: %w", err)
+	}
+	return stageClips(ctx, state)
+}
+
+// verifyCopyStage checks that every file on the card has an identical copy in the staging directory
+type verifyCopyStage struct{}
+
+func (verifyCopyStage) Name() string { return StageVerify }
+
+func (verifyCopyStage) Run(ctx context.Context, state *RunState) error {
+	if state.DryRun {
+		log.Printf("[DRY RUN] Would verify %s against %s", state.TmpDir, state.SourceDCIM)
+		return nil
+	}
+
+	log.Printf("Verifying copied photos in %s", state.TmpDir)
+	staged := func(path string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(state.SourceDCIM, path)
+		if err != nil {
+			return err
+		}
+		return verifyCopy(state.Card, path, filepath.Join(state.TmpDir, rel))
+	}
+
+	if state.selective() {
+		for _, path := range state.Imported {
+			if err := staged(path); err != nil {
+				return err
+			}
+		}
+	} else {
+		err := storage.WalkDir(state.Card, state.SourceDCIM, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			return staged(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for file, staged := range state.StagedClips {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := verifyCopy(state.Card, file, staged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyCopy checks that staged is identical to the card file original
+func verifyCopy(card storage.FS, original, staged string) error {
+	same, err := identical(card, original, storage.Local{}, staged)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", original, err)
+	}
+	if !same {
+		return fmt.Errorf("copy of %s differs from the card", original)
+	}
+	return nil
+}
+
+// renameStage renames the staged date folders with the source's folder template
+type renameStage struct{}
+
+func (renameStage) Name() string { return StageRename }
+
+func (renameStage) Run(ctx context.Context, state *RunState) error {
+	log.Printf("Renaming directories in %s", state.TmpDir)
+	if state.DryRun {
+		log.Printf("[DRY RUN] Would rename directories in: %s", state.TmpDir)
+		return nil
+	}
+	folders, err := dateFolders(state.TmpDir)
+	if err != nil {
+		return err
+	}
+	vars := templateVars(state.Source)
+	if err := rename.DirectoriesWithTemplate(ctx, state.TmpDir, state.Source.FolderTemplate, vars); err != nil {
+		return fmt.Errorf("failed to rename directories: %w", err)
+	}
+
+	// Destinations with their own folder template rename the folders from their dates
+	state.FolderDates = map[string]time.Time{}
+	for day := range folders {
+		date, _ := time.Parse("2006-01-02", day)
+		state.FolderDates[rename.FormatName(state.Source.FolderTemplate, date, vars)] = date
+	}
+	return nil
+}
+
+// templateVars returns the placeholders of folder templates for the cards of src
+func templateVars(src config.Source) map[string]string {
+	return map[string]string{"body": src.Body, "name": src.Name}
+}
+
+// archiveStage merges the staged folders into the destination
+type archiveStage struct{}
+
+func (archiveStage) Name() string { return StageArchive }
+
+func (archiveStage) Run(ctx context.Context, state *RunState) error {
+	log.Printf("Copying renamed directories to %s", state.Destination)
+	if err := MergeDir(ctx, storage.Local{}, state.TmpDir, state.Archive, state.Destination, state.Merge, state.DryRun); err != nil {
+		return fmt.Errorf("failed to copy to destination: %w", err)
+	}
+	return recordImported(state)
+}
+
+// catalogStage writes the file decisions of the card to the catalog directory of the destination
+type catalogStage struct{}
+
+func (catalogStage) Name() string { return StageCatalog }
+
+// catalog is the file written by the catalog stage
+type catalog struct {
+	RunID     string         `json:"run_id"`
+	Source    string         `json:"source"`
+	Body      string         `json:"body,omitempty"`
+	Created   time.Time      `json:"created"`
+	Files     []FileDecision `json:"files,omitempty"`
+	Archived  []string       `json:"archived,omitempty"`
+	Unmatched []string       `json:"unmatched,omitempty"`
+}
+
+func (catalogStage) Run(ctx context.Context, state *RunState) error {
+	dir := filepath.Join(state.Config.DestinationPath, CatalogDirName)
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s.json", state.RunID, unsafeNameChars.ReplaceAllString(state.Source.Name, "_")))
+	if state.DryRun {
+		log.Printf("[DRY RUN] Would write catalog: %s", path)
+		return nil
+	}
+
+	entry := catalog{RunID: state.RunID, Source: state.Source.Name, Body: state.Source.Body, Created: time.Now()}
+	if state.Merge.Summary != nil {
+		entry.Files = state.Merge.Summary.Decisions
+	}
+	if state.Backup != nil {
+		for path := range state.Backup.Archived {
+			entry.Archived = append(entry.Archived, path)
+		}
+		sort.Strings(entry.Archived)
+		entry.Unmatched = state.Backup.Unmatched
+	}
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog: %w", err)
+	}
+	if err := state.Archive.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create catalog directory: %w", err)
+	}
+	if err := storage.WriteFile(state.Archive, path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	log.Printf("Wrote catalog: %s", path)
+	return nil
+}
+
+// deleteStage clears the card's DCIM directory and removes the imported clips.
+// It fails with ErrSkippedConflicts, deleting nothing, when files were left out of the archive by ConflictSkip.
+type deleteStage struct{}
+
+func (deleteStage) Name() string { return StageDelete }
+
+func (deleteStage) Run(ctx context.Context, state *RunState) error {
+	if state.CardState != nil {
+		log.Printf("Keeping photos on card: %s", state.Source.Path)
+		return nil
+	}
+
+	// Files skipped by the conflict policy exist only on the card
+	if skipped := state.Merge.Summary.Count(ActionSkippedConflict); skipped > 0 {
+		return fmt.Errorf("%w: %d files kept on %s", ErrSkippedConflicts, skipped, state.Source.Path)
+	}
+
+	if state.Config.Quarantine.Location != "" {
+		files := state.Imported
+		if !state.selective() {
+			var err error
+			if files, err = dcimFiles(state); err != nil {
+				return err
+			}
+		}
+		for file := range state.StagedClips {
+			files = append(files, file)
+		}
+		if err := forgetClips(state); err != nil {
+			return err
+		}
+		return quarantineFiles(state, files)
+	}
+
+	log.Printf("Deleting photos from source: %s", state.SourceDCIM)
+	if !state.Filter.Empty() {
+		// Files rejected by the filter stay on the card
+		if err := deleteImported(state); err != nil {
+			return fmt.Errorf("failed to delete source files: %w", err)
+		}
+	} else if err := RemoveContents(state.Card, state.SourceDCIM, state.DryRun); err != nil {
+		return fmt.Errorf("failed to delete source files: %w", err)
+	}
+	return deleteClips(state)
+}
+
+// cleanupStage empties the staging directory
+type cleanupStage struct{}
+
+func (cleanupStage) Name() string { return StageCleanup }
+
+func (cleanupStage) Run(ctx context.Context, state *RunState) error {
+	log.Printf("Cleaning up temporary directory: %s", state.TmpDir)
+	if err := cleanDir(state.Config, state.TmpDir, state.DryRun); err != nil {
+		return fmt.Errorf("failed to clean temporary directory: %w", err)
+	}
+	return nil
+}
+
+// ejectStage ejects the card; a failure is only a warning
+type ejectStage struct{}
+
+func (ejectStage) Name() string { return StageEject }
+
+func (ejectStage) Run(ctx context.Context, state *RunState) error {
+	log.Printf("Ejecting volume: %s", state.Source.Path)
+	if err := EjectVolume(state.Source.Path, state.DryRun); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
+
+// verifyBackupStage matches the files of a backup card against the archive index
+type verifyBackupStage struct{}
+
+func (verifyBackupStage) Name() string { return StageVerify }
+
+func (verifyBackupStage) Run(ctx context.Context, state *RunState) error {
+	log.Printf("Verifying backup files in %s against %s", state.SourceDCIM, state.Config.DestinationPath)
+	check, err := VerifyBackup(ctx, state.Card, state.SourceDCIM, state.Merge.Index)
+	if err != nil {
+		return err
+	}
+	if err := filterBackup(state, check); err != nil {
+		return err
+	}
+	state.Backup = check
+	return nil
+}
+
+// deleteArchivedStage removes the archived files from a backup card.
+// It fails with ErrNotArchived when files without an archived copy remain, which stops the pipeline before eject.
+type deleteArchivedStage struct{}
+
+func (deleteArchivedStage) Name() string { return StageDelete }
+
+func (deleteArchivedStage) Run(ctx context.Context, state *RunState) error {
+	check := state.Backup
+	if state.Config.Quarantine.Location != "" {
+		files := make([]string, 0, len(check.Archived))
+		for path := range check.Archived {
+			files = append(files, path)
+		}
+		if err := quarantineFiles(state, files); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Deleting %d archived photos from backup: %s", len(check.Archived), state.SourceDCIM)
+		if err := RemoveArchived(ctx, state.Card, state.SourceDCIM, check, state.DryRun); err != nil {
+			return fmt.Errorf("failed to delete backup files: %w", err)
+		}
+	}
+
+	if len(check.Unmatched) > 0 {
+		log.Printf("%d files have no identical copy in the archive and were left on the card:", len(check.Unmatched))
+		for _, path := range check.Unmatched {
+			log.Printf("  %s", path)
+		}
+		log.Printf("Not ejecting backup volume: %s", state.Source.Path)
+		return fmt.Errorf("%w: %d files left on %s", ErrNotArchived, len(check.Unmatched), state.Source.Path)
+	}
+	return nil
+}
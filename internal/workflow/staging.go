@@ -0,0 +1,211 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+)
+
+// StagingMarker marks the temporary directory, and the directory of each run in it,
+// as created by this tool. Only run directories holding it are ever removed.
+const StagingMarker = ".rename-sony-photos-staging"
+
+const stagingMarkerContent = "Created by rename-sony-photos-directories to stage imports.\n"
+
+// runLockName is the file of a run directory locked by the run using it
+const runLockName = ".rename-sony-photos-lock"
+
+// errRunLocked is returned when another run holds the lock of a run directory
+var errRunLocked = errors.New("run directory is in use by another run")
+
+// runLock is held by a run on its staging directory while the run uses it
+type runLock struct {
+	f *os.File
+}
+
+// lockRunDir locks the lock file of the run directory dir, creating the file with create
+func lockRunDir(dir string, create bool) (*runLock, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE | os.O_EXCL
+	}
+	f, err := os.OpenFile(filepath.Join(dir, runLockName), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, create); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &runLock{f: f}, nil
+}
+
+// Unlock releases the lock and removes the lock file, which may already be gone with its directory
+func (l *runLock) Unlock() {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
+
+// ValidateTmpDir refuses a temporary directory that already holds files this tool
+// did not create, so that a misconfigured tmp_dir never has its contents removed
+func ValidateTmpDir(cfg *config.Config) error {
+	if cfg.TmpDir == "" {
+		return fmt.Errorf("tmp_dir is not set")
+	}
+	entries, err := os.ReadDir(cfg.TmpDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tmp_dir: %w", err)
+	}
+	if len(entries) == 0 || hasStagingMarker(cfg.TmpDir) {
+		return nil
+	}
+	return fmt.Errorf("tmp_dir %s is not empty and was not created by this tool; use a new or empty directory", cfg.TmpDir)
+}
+
+// runDir returns the staging directory of one run
+func runDir(cfg *config.Config, runID string) string {
+	return filepath.Join(cfg.TmpDir, runID)
+}
+
+// stagingDir returns the temporary directory used for a source during a run.
+// Each source gets its own subdirectory of the run directory.
+func stagingDir(cfg *config.Config, runID string, src config.Source) string {
+	return filepath.Join(runDir(cfg, runID), unsafeNameChars.ReplaceAllString(src.Name, "_"))
+}
+
+// createRunDir creates the marked staging directory of a run, marking tmp_dir as well,
+// and locks it for the run. The lock is taken before the directory is marked, so that
+// other runs never see it unlocked.
+func createRunDir(cfg *config.Config, runID string, dryRun bool) (*runLock, error) {
+	dir := runDir(cfg, runID)
+	if dryRun {
+		log.Printf("[DRY RUN] Would create staging directory: %s", dir)
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	lock, err := lockRunDir(dir, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock staging directory: %w", err)
+	}
+	for _, d := range []string{cfg.TmpDir, dir} {
+		if hasStagingMarker(d) {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(d, StagingMarker), []byte(stagingMarkerContent), 0644); err != nil {
+			lock.Unlock()
+			return nil, fmt.Errorf("failed to mark staging directory: %w", err)
+		}
+	}
+	return lock, nil
+}
+
+// removeRunDir removes the staging directory of a run once every card has cleaned up,
+// keeping it while staged files remain. A directory without the marker is left alone.
+func removeRunDir(cfg *config.Config, runID string, dryRun bool) error {
+	dir := runDir(cfg, runID)
+	if dryRun || !hasStagingMarker(dir) {
+		return nil
+	}
+
+	staged := false
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path != filepath.Join(dir, StagingMarker) && path != filepath.Join(dir, runLockName) {
+			staged = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+	if staged {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove staging directory: %w", err)
+	}
+	return nil
+}
+
+// cleanStaleRuns tidies the run directories left in tmp_dir by runs that ended. Their partial
+// files are removed, and so are the directories themselves when the main pipeline cleans
+// up its staging, as the interrupted run would have done; otherwise only the directories
+// left without staged files go. Directories without the marker, and those whose run still
+// holds its lock, are never touched.
+func cleanStaleRuns(cfg *config.Config, runID string, dryRun bool) error {
+	entries, err := os.ReadDir(cfg.TmpDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read tmp_dir: %w", err)
+	}
+
+	cleanup := contains(PipelineNames(cfg, card.RoleMain), StageCleanup)
+	for _, entry := range entries {
+		dir := filepath.Join(cfg.TmpDir, entry.Name())
+		if !entry.IsDir() || entry.Name() == runID || !hasStagingMarker(dir) {
+			continue
+		}
+		if err := cleanStaleRun(cfg, dir, cleanup, dryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanStaleRun tidies the run directory dir while holding its lock
+func cleanStaleRun(cfg *config.Config, dir string, cleanup, dryRun bool) error {
+	// A directory without lock file belongs to a run that ended
+	lock, err := lockRunDir(dir, false)
+	if errors.Is(err, errRunLocked) {
+		log.Printf("Keeping staging directory of a run still in progress: %s", dir)
+		return nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to lock staging directory %s: %w", dir, err)
+	}
+	defer lock.Unlock()
+
+	if _, err := CleanPartialFiles(storage.Local{}, dir, dryRun); err != nil {
+		return err
+	}
+	if !cleanup {
+		return removeRunDir(cfg, filepath.Base(dir), dryRun)
+	}
+
+	log.Printf("Removing staging directory of an earlier run: %s", dir)
+	if err := cleanDir(cfg, dir, dryRun); err != nil {
+		return fmt.Errorf("failed to clean staging directory %s: %w", dir, err)
+	}
+	if !dryRun {
+		if err := os.Remove(dir); err != nil {
+			return fmt.Errorf("failed to remove staging directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// hasStagingMarker reports whether dir was created by this tool
+func hasStagingMarker(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, StagingMarker))
+	return err == nil && info.Mode().IsRegular()
+}
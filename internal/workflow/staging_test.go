@@ -0,0 +1,175 @@
+package workflow
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+)
+
+func TestValidateTmpDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr bool
+	}{
+		{"missing", nil, false},
+		{"empty", map[string]string{}, false},
+		{"created by the tool", map[string]string{StagingMarker: "", "20251231-100000-abcdef/main/2025-12-31/DSC00001.JPG": "staged"}, false},
+		{"unrelated files", map[string]string{"vacation/DSC00001.JPG": "keep me"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{TmpDir: filepath.Join(t.TempDir(), "tmp")}
+			if tt.files != nil {
+				writeTree(t, cfg.TmpDir, tt.files)
+			}
+			if err := ValidateTmpDir(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTmpDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := ValidateTmpDir(&config.Config{}); err == nil {
+		t.Error("An unset tmp_dir should be refused")
+	}
+}
+
+func TestRunSourcesStaging(t *testing.T) {
+	useRecordingEjector(t)
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "Pictures"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		TargetPath:      filepath.Join(tmpDir, "card"),
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+	writeTree(t, cfg.TmpDir, map[string]string{"vacation/DSC00001.JPG": "keep me"})
+
+	// A tmp_dir pointing at unrelated photos is refused before the card is touched
+	if _, err := RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), false); err == nil {
+		t.Fatal("RunSources should refuse a tmp_dir with unrelated files")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.TargetPath, "DCIM", "02512310", "DSC00001.JPG")); err != nil {
+		t.Errorf("Card was modified: %v", err)
+	}
+
+	// Staging happens in a run directory that is removed once the card is cleaned up
+	cfg.TmpDir = filepath.Join(tmpDir, "tmp")
+	writeTree(t, cfg.TmpDir, map[string]string{StagingMarker: "", "earlier-run/main/2025-12-30/DSC00001.JPG": "kept"})
+	report, err := RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), false)
+	if err != nil {
+		t.Fatalf("RunSources failed: %v", err)
+	}
+	if report.Cards[0].TmpDir != filepath.Join(cfg.TmpDir, report.RunID, "main") {
+		t.Errorf("Card staged in %s", report.Cards[0].TmpDir)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.TmpDir, report.RunID)); !os.IsNotExist(err) {
+		t.Errorf("Run directory should be removed: %v", err)
+	}
+	for _, name := range []string{StagingMarker, "earlier-run/main/2025-12-30/DSC00001.JPG"} {
+		if _, err := os.Stat(filepath.Join(cfg.TmpDir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s should be kept: %v", name, err)
+		}
+	}
+
+	// Without a cleanup stage the staged files stay in their run directory
+	cfg.Pipeline.Main = []string{StageCopy, StageRename, StageArchive}
+	writeTree(t, cfg.TargetPath, map[string]string{"DCIM/02601010/DSC00002.JPG": "photo 2"})
+	report, err = RunSources(t.Context(), cfg, Sources(cfg, card.RoleMain), false)
+	if err != nil {
+		t.Fatalf("RunSources failed: %v", err)
+	}
+	run := filepath.Join(cfg.TmpDir, report.RunID)
+	for _, name := range []string{StagingMarker, "main/2026-01-01/DSC00002.JPG"} {
+		if _, err := os.Stat(filepath.Join(run, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s should be kept in the run directory: %v", name, err)
+		}
+	}
+}
+
+func TestCleanStaleRuns(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline []string
+		dryRun   bool
+		want     []string
+	}{
+		{"default pipeline", nil, false, []string{
+			StagingMarker, "current/" + StagingMarker, "unrelated/.DSC00003.JPG.partial-1",
+		}},
+		{"without cleanup", []string{StageCopy, StageRename, StageArchive}, false, []string{
+			StagingMarker, "current/" + StagingMarker, "staged/" + StagingMarker, "staged/main/2025-12-31/DSC00001.JPG",
+			"unrelated/.DSC00003.JPG.partial-1",
+		}},
+		{"dry run", nil, true, []string{
+			StagingMarker, "current/" + StagingMarker, "partial/" + StagingMarker, "partial/main/2025-12-31/.DSC00002.JPG.partial-1",
+			"staged/" + StagingMarker, "staged/main/2025-12-31/.DSC00001.JPG.partial-1", "staged/main/2025-12-31/DSC00001.JPG",
+			"unrelated/.DSC00003.JPG.partial-1",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{TmpDir: t.TempDir(), Pipeline: config.PipelineConfig{Main: tt.pipeline}}
+			writeTree(t, cfg.TmpDir, map[string]string{
+				StagingMarker:                                     "",
+				"current/" + StagingMarker:                        "",
+				"partial/" + StagingMarker:                        "",
+				"partial/main/2025-12-31/.DSC00002.JPG.partial-1": "half",
+				"staged/" + StagingMarker:                         "",
+				"staged/main/2025-12-31/.DSC00001.JPG.partial-1":  "half",
+				"staged/main/2025-12-31/DSC00001.JPG":             "photo",
+				"unrelated/.DSC00003.JPG.partial-1":               "not ours",
+			})
+
+			if err := cleanStaleRuns(cfg, "current", tt.dryRun); err != nil {
+				t.Fatalf("cleanStaleRuns failed: %v", err)
+			}
+			var got []string
+			filepath.WalkDir(cfg.TmpDir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(cfg.TmpDir, path)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Files left = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanStaleRunsKeepsLockedRuns(t *testing.T) {
+	cfg := &config.Config{TmpDir: t.TempDir()}
+	running, err := createRunDir(cfg, "running", false)
+	if err != nil {
+		t.Fatalf("Failed to create run directory: %v", err)
+	}
+	staged := filepath.Join(runDir(cfg, "running"), "main", "2025-12-31", "DSC00001.JPG")
+	writeTree(t, filepath.Dir(staged), map[string]string{"DSC00001.JPG": "photo"})
+
+	if err := cleanStaleRuns(cfg, "current", false); err != nil {
+		t.Fatalf("cleanStaleRuns failed: %v", err)
+	}
+	if _, err := os.Stat(staged); err != nil {
+		t.Fatalf("Staging of a run in progress must be kept: %v", err)
+	}
+
+	// Once the run ends, its directory is stale
+	running.Unlock()
+	if err := cleanStaleRuns(cfg, "current", false); err != nil {
+		t.Fatalf("cleanStaleRuns failed: %v", err)
+	}
+	if _, err := os.Stat(runDir(cfg, "running")); !os.IsNotExist(err) {
+		t.Errorf("Staging directory of an ended run should be removed: %v", err)
+	}
+}
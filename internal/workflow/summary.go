@@ -0,0 +1,88 @@
+package workflow
+
+import "log"
+
+// Action describes what happened to a single file during a merge
+type Action string
+
+const (
+	// ActionCopied means the file did not exist in the destination and was copied
+	ActionCopied Action = "copied"
+	// ActionSkippedIdentical means an identical file already existed in the destination
+	ActionSkippedIdentical Action = "skipped-identical"
+	// ActionSkippedArchived means the same content is already archived under another path
+	ActionSkippedArchived Action = "skipped-archived"
+	// ActionKeptBoth means the file was copied under a suffixed name next to a different file
+	ActionKeptBoth Action = "kept-both"
+	// ActionOverwritten means a different existing file was replaced
+	ActionOverwritten Action = "overwritten"
+	// ActionSkippedConflict means a different existing file was left in place and the file was not copied
+	ActionSkippedConflict Action = "skipped-conflict"
+	// ActionAborted means the workflow stopped at this file
+	ActionAborted Action = "aborted"
+)
+
+// FileDecision records the action taken for one source file
+type FileDecision struct {
+	Source      string
+	Destination string
+	Action      Action
+}
+
+// Summary collects per-file decisions made during a workflow run
+type Summary struct {
+	Decisions []FileDecision
+}
+
+// record appends a decision and logs it unless it is a plain copy
+func (s *Summary) record(src, dst string, action Action) {
+	if s == nil {
+		return
+	}
+	s.Decisions = append(s.Decisions, FileDecision{Source: src, Destination: dst, Action: action})
+	if action != ActionCopied {
+		log.Printf("%s: %s -> %s", action, src, dst)
+	}
+}
+
+// Count returns the number of decisions with the given action
+func (s *Summary) Count(action Action) int {
+	if s == nil {
+		return 0
+	}
+	count := 0
+	for _, d := range s.Decisions {
+		if d.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// Counts returns the number of decisions per action, for hook payloads
+func (s *Summary) Counts() map[string]int {
+	if s == nil || len(s.Decisions) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, d := range s.Decisions {
+		counts[string(d.Action)]++
+	}
+	return counts
+}
+
+// Log prints the totals for each action
+func (s *Summary) Log() {
+	log.Println("=== Run summary ===")
+	for _, action := range []Action{
+		ActionCopied,
+		ActionSkippedIdentical,
+		ActionSkippedArchived,
+		ActionKeptBoth,
+		ActionOverwritten,
+		ActionSkippedConflict,
+		ActionAborted,
+	} {
+		log.Printf("%-18s %d", action+":", s.Count(action))
+	}
+}
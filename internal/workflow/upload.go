@@ -0,0 +1,314 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/crypt"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/s3"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/sftp"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/webdav"
+)
+
+// Destination is a further copy of the imported folders written by the upload stage
+type Destination struct {
+	Name string
+	FS   storage.FS
+	// Root is the directory of FS receiving the folders; cards with a subfolder use Root/subfolder
+	Root string
+	// FolderTemplate renames the date folders for this destination; empty keeps the staged names
+	FolderTemplate string
+	Optional       bool
+}
+
+// destinationConfigs returns the configured destinations, starting with the s3, sftp and webdav shorthands
+func destinationConfigs(cfg *config.Config) []config.DestinationConfig {
+	var dests []config.DestinationConfig
+	if cfg.S3 != nil {
+		dests = append(dests, config.DestinationConfig{Name: "s3", S3: cfg.S3})
+	}
+	if cfg.SFTP != nil {
+		dests = append(dests, config.DestinationConfig{Name: "sftp", SFTP: cfg.SFTP})
+	}
+	if cfg.WebDAV != nil {
+		dests = append(dests, config.DestinationConfig{Name: "webdav", WebDAV: cfg.WebDAV})
+	}
+	return append(dests, cfg.Destinations...)
+}
+
+// hasDestinations reports whether further destinations are configured
+func hasDestinations(cfg *config.Config) bool {
+	return len(destinationConfigs(cfg)) > 0
+}
+
+// OpenDestinations returns the storage of every configured destination. Optional destinations
+// that cannot be opened, such as an external drive that is not mounted, are left out with a
+// warning; a required one fails. Connected storages must be closed with CloseDestinations.
+// It also refuses pipelines that would upload without a destination or delete the card
+// without writing the required destinations.
+func OpenDestinations(cfg *config.Config) ([]Destination, error) {
+	configs := destinationConfigs(cfg)
+	names := PipelineNames(cfg, card.RoleMain)
+	if len(configs) == 0 && contains(names, StageUpload) {
+		return nil, fmt.Errorf("the %s stage requires a destination", StageUpload)
+	}
+	for _, dc := range configs {
+		if !dc.Optional && contains(names, StageDelete) && !contains(names, StageUpload) {
+			return nil, fmt.Errorf("the %s stage requires the %s stage to write the destinations first", StageDelete, StageUpload)
+		}
+	}
+
+	var dests []Destination
+	for _, dc := range configs {
+		dest, err := openDestination(dc)
+		if err != nil && dc.Optional {
+			log.Printf("Warning: skipping optional destination %s: %v", dest.Name, err)
+			continue
+		}
+		if err != nil {
+			CloseDestinations(dests)
+			return nil, fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+		dests = append(dests, dest)
+	}
+	return dests, nil
+}
+
+// openDestination opens the storage of dc; the returned Destination is named even on failure
+func openDestination(dc config.DestinationConfig) (Destination, error) {
+	dest := Destination{Name: dc.Name, Root: string(filepath.Separator), FolderTemplate: dc.FolderTemplate, Optional: dc.Optional}
+
+	kinds := 0
+	for _, set := range []bool{dc.Path != "", dc.S3 != nil, dc.SFTP != nil, dc.WebDAV != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		dest.Name = destinationName(dc)
+		return dest, fmt.Errorf("set exactly one of path, s3, sftp and webdav")
+	}
+
+	dest.Name = destinationName(dc)
+	var err error
+	switch {
+	case dc.Path != "":
+		dest.FS, dest.Root = storage.Local{}, dc.Path
+		err = CheckDirectoryExists(storage.Local{}, dc.Path)
+	case dc.S3 != nil:
+		if dest.FS, err = s3.New(*dc.S3); err != nil {
+			err = fmt.Errorf("invalid s3 destination: %w", err)
+		}
+	case dc.SFTP != nil:
+		if dest.FS, err = sftp.Dial(*dc.SFTP); err != nil {
+			err = fmt.Errorf("failed to open sftp destination: %w", err)
+		}
+	case dc.WebDAV != nil:
+		if dest.FS, err = webdav.New(*dc.WebDAV); err != nil {
+			err = fmt.Errorf("invalid webdav destination: %w", err)
+		}
+	}
+	if err != nil || dc.Encryption == nil {
+		return dest, err
+	}
+
+	encrypted, err := crypt.New(dest.FS, dest.Root, *dc.Encryption)
+	if err != nil {
+		CloseDestinations([]Destination{dest})
+		return dest, fmt.Errorf("failed to open encrypted destination: %w", err)
+	}
+	dest.FS, dest.Root = encrypted, string(filepath.Separator)
+	return dest, nil
+}
+
+// destinationName returns the name of dc, defaulting to its path or kind
+func destinationName(dc config.DestinationConfig) string {
+	switch {
+	case dc.Name != "":
+		return dc.Name
+	case dc.Path != "":
+		return dc.Path
+	case dc.S3 != nil:
+		return "s3"
+	case dc.SFTP != nil:
+		return "sftp"
+	case dc.WebDAV != nil:
+		return "webdav"
+	}
+	return "(unnamed)"
+}
+
+// CloseDestinations ends the connections of the destinations that hold one
+func CloseDestinations(dests []Destination) {
+	for _, dest := range dests {
+		if closer, ok := dest.FS.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Warning: failed to close destination %s: %v", dest.Name, err)
+			}
+		}
+	}
+}
+
+// uploadStage copies the staged folders to every destination and verifies each copy.
+// It fails when a required destination could not be written completely, which stops
+// the pipeline before the card is deleted; failed optional destinations are reported only.
+type uploadStage struct{}
+
+func (uploadStage) Name() string { return StageUpload }
+
+func (uploadStage) Run(ctx context.Context, state *RunState) error {
+	var errs []error
+	for _, dest := range state.Destinations {
+		err := uploadTo(ctx, state, dest)
+		if err == nil {
+			continue
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if dest.Optional {
+			log.Printf("Warning: optional destination %s failed: %v", dest.Name, err)
+			continue
+		}
+		errs = append(errs, fmt.Errorf("destination %s: %w", dest.Name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// uploadTo merges the staged folders into dest, naming them with its folder template,
+// then checks that every copied file is identical to the staged one. Files left out
+// by ConflictSkip fail the upload, since dest then lacks them. Destinations that
+// buffer their changes, such as encrypted ones, are flushed even when a copy failed, so
+// the files written so far are recognized by the next run.
+func uploadTo(ctx context.Context, state *RunState, dest Destination) (err error) {
+	if flusher, ok := dest.FS.(storage.Flusher); ok {
+		defer func() {
+			if flushErr := flusher.Flush(); flushErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to save %s: %w", dest.Name, flushErr))
+			}
+		}()
+	}
+
+	dir := filepath.Join(dest.Root, state.Source.Subfolder)
+	log.Printf("Uploading renamed directories to %s: %s", dest.Name, dir)
+	if state.DryRun {
+		return MergeDir(ctx, storage.Local{}, state.TmpDir, dest.FS, dir, MergeOptions{Policy: state.Merge.Policy}, true)
+	}
+
+	entries, err := storage.Local{}.ReadDir(state.TmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to read staging directory: %w", err)
+	}
+	summary := &Summary{}
+	opts := MergeOptions{Policy: state.Merge.Policy, Summary: summary}
+	if err := dest.FS.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	for _, entry := range entries {
+		src := filepath.Join(state.TmpDir, entry.Name())
+		if entry.IsDir() {
+			err = MergeDir(ctx, storage.Local{}, src, dest.FS, filepath.Join(dir, destinationFolder(state, dest, entry.Name())), opts, false)
+		} else {
+			err = mergeFile(ctx, storage.Local{}, src, dest.FS, filepath.Join(dir, entry.Name()), opts)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to upload: %w", err)
+		}
+	}
+
+	// A file skipped by the conflict policy is missing from this destination
+	if skipped := summary.Count(ActionSkippedConflict); skipped > 0 {
+		return fmt.Errorf("%w: %d files differ from those already in %s", ErrSkippedConflicts, skipped, dest.Name)
+	}
+
+	// An empty staging directory after an import means the files are gone, not that nothing is to upload
+	if state.Merge.Summary != nil && len(summary.Decisions) == 0 && len(state.Merge.Summary.Decisions) > 0 {
+		return fmt.Errorf("staging directory %s is empty but %d files were archived", state.TmpDir, len(state.Merge.Summary.Decisions))
+	}
+
+	for _, decision := range summary.Decisions {
+		switch decision.Action {
+		case ActionCopied, ActionKeptBoth, ActionOverwritten:
+		default:
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		same, err := identical(storage.Local{}, decision.Source, dest.FS, decision.Destination)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %w", decision.Destination, err)
+		}
+		if !same {
+			return fmt.Errorf("copy of %s in %s differs from the staged file", decision.Destination, dest.Name)
+		}
+	}
+
+	uploaded := summary.Count(ActionCopied) + summary.Count(ActionKeptBoth) + summary.Count(ActionOverwritten)
+	log.Printf("Uploaded and verified %d files in %s, %d were already stored", uploaded, dest.Name, summary.Count(ActionSkippedIdentical))
+	return nil
+}
+
+// destinationFolder returns the name of the staged date folder name in dest
+func destinationFolder(state *RunState, dest Destination, name string) string {
+	if dest.FolderTemplate == "" {
+		return name
+	}
+	date, ok := state.FolderDates[name]
+	if !ok {
+		// Without a rename stage the staged folders keep their Sony names
+		if !rename.IsValidDateDir(name) {
+			return name
+		}
+		parsed, err := rename.ParseDirName(name, fmt.Sprintf("%d", time.Now().Year())[:2])
+		if err != nil {
+			return name
+		}
+		date = parsed
+	}
+	return rename.FormatName(dest.FolderTemplate, date, templateVars(state.Source))
+}
+
+// RestoreDestination copies the folders stored in the destination name back to dir,
+// decrypting them when the destination is encrypted. Files already in dir with the same
+// content are skipped and differing ones are kept next to them. It returns the number of
+// restored files.
+func RestoreDestination(ctx context.Context, cfg *config.Config, name, dir string, dryRun bool) (int, error) {
+	var found *config.DestinationConfig
+	for _, dc := range destinationConfigs(cfg) {
+		if destinationName(dc) == name {
+			found = &dc
+			break
+		}
+	}
+	if found == nil {
+		return 0, fmt.Errorf("no destination named %q", name)
+	}
+
+	dest, err := openDestination(*found)
+	if err != nil {
+		return 0, fmt.Errorf("destination %s: %w", name, err)
+	}
+	defer CloseDestinations([]Destination{dest})
+
+	log.Printf("Restoring %s to %s", dest.Name, dir)
+	summary := &Summary{}
+	err = MergeDir(ctx, dest.FS, dest.Root, storage.Local{}, dir, MergeOptions{Policy: ConflictKeepBoth, Summary: summary}, dryRun)
+	restored := summary.Count(ActionCopied) + summary.Count(ActionKeptBoth)
+	if err != nil {
+		return restored, fmt.Errorf("failed to restore %s: %w", dest.Name, err)
+	}
+	if skipped := summary.Count(ActionSkippedIdentical); skipped > 0 {
+		log.Printf("%d files were already in %s", skipped, dir)
+	}
+	return restored, nil
+}
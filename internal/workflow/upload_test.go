@@ -0,0 +1,456 @@
+package workflow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/s3/s3test"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/sftp/sftptest"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/webdav/webdavtest"
+)
+
+func TestRunSourcesUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]string
+		fault    bool
+		wantErr  bool
+		keys     []string
+	}{
+		{"upload", nil, false, false, []string{"photos/a7iv/2025-12-31/DSC00001.JPG"}},
+		{"identical object kept", map[string]string{"photos/a7iv/2025-12-31/DSC00001.JPG": "photo"}, false, false,
+			[]string{"photos/a7iv/2025-12-31/DSC00001.JPG"}},
+		{"failed upload keeps card", nil, true, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRecordingEjector(t)
+			server := s3test.NewServer("archive", "test-key")
+			defer server.Close()
+			for key, content := range tt.existing {
+				server.PutObject(key, []byte(content))
+			}
+			if tt.fault {
+				server.Fault = func(r *http.Request) error {
+					if r.Method == http.MethodPut {
+						return errors.New("disk full")
+					}
+					return nil
+				}
+			}
+
+			tmpDir := t.TempDir()
+			cfg := &config.Config{
+				DestinationPath: filepath.Join(tmpDir, "archive"),
+				TmpDir:          filepath.Join(tmpDir, "tmp"),
+				CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+				Sources:         []config.Source{{Name: "main", Path: filepath.Join(tmpDir, "card"), Role: "main", Subfolder: "a7iv"}},
+				S3: &config.S3Config{
+					Endpoint: server.URL, Bucket: "archive", Prefix: "photos",
+					AccessKeyID: "test-key", SecretAccessKey: "secret",
+				},
+			}
+			writeTree(t, cfg.DestinationPath, nil)
+			writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+
+			_, err := RunSources(t.Context(), cfg, cfg.Sources, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if keys := server.Keys(); !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("Bucket keys = %v, want %v", keys, tt.keys)
+			}
+			if _, err := os.Stat(filepath.Join(cfg.DestinationPath, "a7iv", "2025-12-31", "DSC00001.JPG")); err != nil {
+				t.Errorf("Photo should be archived locally: %v", err)
+			}
+			_, err = os.Stat(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG"))
+			if tt.wantErr != (err == nil) {
+				t.Errorf("Photo on card: %v, expected kept only after a failed upload", err)
+			}
+			if obj, ok := server.Object("photos/a7iv/2025-12-31/DSC00001.JPG"); ok && obj.Meta.Get("X-Amz-Meta-Sha256") == "" && tt.existing == nil {
+				t.Errorf("Uploaded object should record its digest: %v", obj.Meta)
+			}
+		})
+	}
+}
+
+func TestRunSourcesUploadSFTP(t *testing.T) {
+	useRecordingEjector(t)
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "id_ed25519")
+	public, err := sftptest.GenerateKey(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	server, err := sftptest.NewServer(public)
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Close()
+	knownHosts := filepath.Join(tmpDir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(server.KnownHostsLine()+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	nas := filepath.Join(tmpDir, "nas")
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources:         []config.Source{{Name: "main", Path: filepath.Join(tmpDir, "card"), Role: "main", Subfolder: "a7iv"}},
+		SFTP:            &config.SFTPConfig{Host: server.Addr, User: "photos", KeyFile: keyFile, KnownHosts: knownHosts, Path: filepath.ToSlash(nas)},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, nas, nil)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+	mtime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG"), mtime, mtime)
+
+	if _, err := RunSources(t.Context(), cfg, cfg.Sources, false); err != nil {
+		t.Fatalf("RunSources failed: %v", err)
+	}
+
+	uploaded := filepath.Join(nas, "a7iv", "2025-12-31", "DSC00001.JPG")
+	if data, err := os.ReadFile(uploaded); err != nil || string(data) != "photo" {
+		t.Errorf("Uploaded file = %q, %v", data, err)
+	}
+	if info, err := os.Stat(uploaded); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("Uploaded file should keep its modification time: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(uploaded)); len(entries) != 1 {
+		t.Errorf("Temporary files left on the server: %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG")); !os.IsNotExist(err) {
+		t.Errorf("Photo should be deleted from the card after the upload: %v", err)
+	}
+}
+
+func TestRunSourcesUploadWebDAV(t *testing.T) {
+	useRecordingEjector(t)
+	server := webdavtest.NewServer("alice", "secret")
+	defer server.Close()
+	var gets atomic.Int32
+	server.Fault = func(r *http.Request) error {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		return nil
+	}
+
+	tmpDir := t.TempDir()
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources:         []config.Source{{Name: "main", Path: filepath.Join(tmpDir, "card"), Role: "main", Subfolder: "a7iv"}},
+		WebDAV:          &config.WebDAVConfig{URL: server.FilesURL(), User: "alice", Password: "secret"},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	photo := filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG")
+	mtime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC)
+
+	// The upload is read back once; the second import of the same photo finds it by
+	// size and ETag without downloading it
+	for run, wantGets := range []int32{1, 0} {
+		gets.Store(0)
+		writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+		os.Chtimes(photo, mtime, mtime)
+		if _, err := RunSources(t.Context(), cfg, cfg.Sources, false); err != nil {
+			t.Fatalf("RunSources failed: %v", err)
+		}
+		if data, ok := server.File("a7iv/2025-12-31/DSC00001.JPG"); !ok || string(data) != "photo" {
+			t.Errorf("Uploaded file = %q, %v", data, ok)
+		}
+		if _, err := os.Stat(photo); !os.IsNotExist(err) {
+			t.Errorf("Photo should be deleted from the card after the upload: %v", err)
+		}
+		if n := gets.Load(); n != wantGets {
+			t.Errorf("Run %d downloaded %d files, want %d", run+1, n, wantGets)
+		}
+	}
+	if names := server.Names(webdavtest.FilesPath); !reflect.DeepEqual(names, []string{"a7iv/2025-12-31/DSC00001.JPG"}) {
+		t.Errorf("Unexpected files on the server: %v", names)
+	}
+}
+
+func TestUploadPipeline(t *testing.T) {
+	cfg := &config.Config{S3: &config.S3Config{}}
+	names := PipelineNames(cfg, card.RoleMain)
+	if strings.Join(names, ",") != "copy,rename,archive,upload,delete,cleanup,eject" {
+		t.Errorf("Unexpected default pipeline with s3: %v", names)
+	}
+	if _, err := NewPipeline(card.RoleMain, []string{StageCopy, StageRename, StageArchive, StageDelete, StageUpload}); err == nil {
+		t.Error("Deleting before the upload should be refused")
+	}
+	if _, err := NewPipeline(card.RoleMain, []string{StageCopy, StageUpload, StageRename, StageArchive}); err == nil {
+		t.Error("Uploading before the rename should be refused")
+	}
+	if _, err := NewPipeline(card.RoleMain, []string{StageCopy, StageRename, StageArchive, StageCleanup, StageUpload, StageDelete}); err == nil {
+		t.Error("Uploading after the cleanup should be refused")
+	}
+	if _, err := NewPipeline(card.RoleMain, []string{StageCopy, StageRename, StageArchive, StageCleanup, StageParity}); err == nil {
+		t.Error("Writing parity after the cleanup should be refused")
+	}
+
+	if _, err := OpenDestinations(&config.Config{Pipeline: config.PipelineConfig{Main: []string{StageCopy, StageUpload}}}); err == nil {
+		t.Error("The upload stage without a destination should be refused")
+	}
+	drive := t.TempDir()
+	if _, err := OpenDestinations(&config.Config{
+		Destinations: []config.DestinationConfig{{Path: drive}},
+		Pipeline:     config.PipelineConfig{Main: []string{StageCopy, StageArchive, StageDelete}},
+	}); err == nil {
+		t.Error("Deleting without writing a required destination should be refused")
+	}
+	if _, err := OpenDestinations(&config.Config{Destinations: []config.DestinationConfig{{Path: drive, S3: &config.S3Config{}}}}); err == nil {
+		t.Error("A destination with two kinds should be refused")
+	}
+	if _, err := OpenDestinations(&config.Config{Destinations: []config.DestinationConfig{{Path: filepath.Join(drive, "missing")}}}); err == nil {
+		t.Error("A missing required drive should be refused")
+	}
+
+	dests, err := OpenDestinations(&config.Config{Destinations: []config.DestinationConfig{
+		{Path: drive}, {Name: "spare", Path: filepath.Join(drive, "missing"), Optional: true},
+	}})
+	if err != nil || len(dests) != 1 || dests[0].Name != drive || dests[0].Root != drive {
+		t.Errorf("A missing optional drive should be skipped: %+v, %v", dests, err)
+	}
+}
+
+func TestRunSourcesDestinations(t *testing.T) {
+	tests := []struct {
+		name         string
+		optionalDAV  bool
+		davFault     bool
+		wantErr      bool
+		wantOnCard   bool
+		wantDAVFiles []string
+	}{
+		{"all destinations written", false, false, false, false, []string{"a7iv/2025-12-31_A7IV/DSC00001.JPG"}},
+		{"failed optional destination", true, true, false, false, nil},
+		{"failed required destination keeps card", false, true, true, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRecordingEjector(t)
+			server := webdavtest.NewServer("alice", "secret")
+			defer server.Close()
+			if tt.davFault {
+				server.Fault = func(r *http.Request) error {
+					if r.Method == http.MethodPut {
+						return errors.New("quota exceeded")
+					}
+					return nil
+				}
+			}
+
+			tmpDir := t.TempDir()
+			drive := filepath.Join(tmpDir, "drive")
+			cfg := &config.Config{
+				DestinationPath: filepath.Join(tmpDir, "archive"),
+				TmpDir:          filepath.Join(tmpDir, "tmp"),
+				CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+				Sources: []config.Source{{
+					Name: "main", Path: filepath.Join(tmpDir, "card"), Role: "main", Subfolder: "a7iv", Body: "A7IV",
+				}},
+				Destinations: []config.DestinationConfig{
+					{Name: "drive", Path: drive, FolderTemplate: "{yyyy}/{mm}-{dd}"},
+					{Name: "cloud", WebDAV: &config.WebDAVConfig{URL: server.FilesURL(), User: "alice", Password: "secret"},
+						FolderTemplate: "{yyyy}-{mm}-{dd}_{body}", Optional: tt.optionalDAV},
+				},
+			}
+			writeTree(t, cfg.DestinationPath, nil)
+			writeTree(t, drive, nil)
+			writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo"})
+			if _, err := RegisterCard(cfg, cfg.Sources[0].Path, card.RoleMain, "A7IV"); err != nil {
+				t.Fatalf("RegisterCard failed: %v", err)
+			}
+
+			_, err := RunSources(t.Context(), cfg, cfg.Sources, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if data, err := os.ReadFile(filepath.Join(cfg.DestinationPath, "a7iv", "2025-12-31", "DSC00001.JPG")); err != nil || string(data) != "photo" {
+				t.Errorf("Archived file = %q, %v", data, err)
+			}
+			if data, err := os.ReadFile(filepath.Join(drive, "a7iv", "2025", "12-31", "DSC00001.JPG")); err != nil || string(data) != "photo" {
+				t.Errorf("Drive file = %q, %v", data, err)
+			}
+			if names := server.Names(webdavtest.FilesPath); !reflect.DeepEqual(names, tt.wantDAVFiles) {
+				t.Errorf("WebDAV files = %v, want %v", names, tt.wantDAVFiles)
+			}
+			_, err = os.Stat(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG"))
+			if onCard := err == nil; onCard != tt.wantOnCard {
+				t.Errorf("Photo on card = %v, want %v", onCard, tt.wantOnCard)
+			}
+		})
+	}
+}
+
+// corruptingFS stores upper-cased content, like a drive returning bad data
+type corruptingFS struct {
+	*storage.Mem
+}
+
+func (c corruptingFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	w, err := c.Mem.Create(name, perm)
+	return corruptingWriter{w}, err
+}
+
+type corruptingWriter struct {
+	io.WriteCloser
+}
+
+func (w corruptingWriter) Write(p []byte) (int, error) {
+	return w.WriteCloser.Write(bytes.ToUpper(p))
+}
+
+func TestUploadVerifiesCopies(t *testing.T) {
+	for _, optional := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		writeTree(t, tmpDir, map[string]string{"2025-12-31/DSC00001.JPG": "photo"})
+		state := &RunState{
+			TmpDir:       tmpDir,
+			Destinations: []Destination{{Name: "drive", FS: corruptingFS{storage.NewMem()}, Root: "/", Optional: optional}},
+		}
+
+		err := uploadStage{}.Run(t.Context(), state)
+		if optional && err != nil {
+			t.Errorf("A corrupted optional destination should only be reported: %v", err)
+		}
+		if !optional && (err == nil || !strings.Contains(err.Error(), "differs")) {
+			t.Errorf("A corrupted required destination should fail the stage, got %v", err)
+		}
+	}
+}
+
+func TestUploadRefusesEmptyStaging(t *testing.T) {
+	summary := &Summary{}
+	summary.record("/tmp/2025-12-31/DSC00001.JPG", "/archive/2025-12-31/DSC00001.JPG", ActionCopied)
+	state := &RunState{
+		TmpDir:       t.TempDir(),
+		Merge:        MergeOptions{Summary: summary},
+		Destinations: []Destination{{Name: "drive", FS: storage.NewMem(), Root: "/"}},
+	}
+	if err := (uploadStage{}).Run(t.Context(), state); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("Uploading an emptied staging directory after an import = %v, want an error", err)
+	}
+}
+
+func TestUploadSkippedConflicts(t *testing.T) {
+	for _, optional := range []bool{false, true} {
+		tmpDir := t.TempDir()
+		writeTree(t, tmpDir, map[string]string{"2025-12-31/DSC00001.JPG": "new photo"})
+		drive := storage.NewMem()
+		drive.AddFile("/2025-12-31/DSC00001.JPG", []byte("old photo"), time.Now())
+		state := &RunState{
+			TmpDir:       tmpDir,
+			Merge:        MergeOptions{Policy: ConflictSkip},
+			Destinations: []Destination{{Name: "drive", FS: drive, Root: "/", Optional: optional}},
+		}
+
+		err := uploadStage{}.Run(t.Context(), state)
+		if optional && err != nil {
+			t.Errorf("A conflict on an optional destination should only be reported: %v", err)
+		}
+		if !optional && !errors.Is(err, ErrSkippedConflicts) {
+			t.Errorf("A conflict on a required destination error = %v, want ErrSkippedConflicts", err)
+		}
+	}
+}
+
+func TestRunSourcesEncryptedDestination(t *testing.T) {
+	useRecordingEjector(t)
+	tmpDir := t.TempDir()
+	drive := filepath.Join(tmpDir, "drive")
+	cfg := &config.Config{
+		DestinationPath: filepath.Join(tmpDir, "archive"),
+		TmpDir:          filepath.Join(tmpDir, "tmp"),
+		CardRegistry:    filepath.Join(tmpDir, "cards.yaml"),
+		Sources: []config.Source{{
+			Name: "main", Path: filepath.Join(tmpDir, "card"), Role: "main", Subfolder: "a7iv",
+		}},
+		Destinations: []config.DestinationConfig{{
+			Name: "vault", Path: drive, Encryption: &config.EncryptionConfig{Passphrase: "client work"},
+		}},
+	}
+	writeTree(t, cfg.DestinationPath, nil)
+	writeTree(t, drive, nil)
+	writeTree(t, cfg.Sources[0].Path, map[string]string{
+		"DCIM/02512310/DSC00001.JPG": "photo 1",
+		"DCIM/02512310/DSC00002.ARW": "raw 2",
+	})
+	modTime := time.Date(2025, 12, 31, 10, 0, 0, 0, time.Local)
+	os.Chtimes(filepath.Join(cfg.Sources[0].Path, "DCIM", "02512310", "DSC00001.JPG"), modTime, modTime)
+
+	if _, err := RunSources(t.Context(), cfg, cfg.Sources, false); err != nil {
+		t.Fatalf("Failed to run sources: %v", err)
+	}
+	filepath.WalkDir(drive, func(path string, d fs.DirEntry, err error) error {
+		if strings.Contains(path, "DSC") || strings.Contains(path, "2025") {
+			t.Errorf("Encrypted destination reveals the name %s", path)
+		}
+		if data, _ := os.ReadFile(path); strings.Contains(string(data), "photo") {
+			t.Errorf("Encrypted destination reveals the content in %s", path)
+		}
+		return nil
+	})
+
+	// A second import of the same photos recognizes them in the encrypted destination
+	writeTree(t, cfg.Sources[0].Path, map[string]string{"DCIM/02512310/DSC00001.JPG": "photo 1"})
+	if _, err := RunSources(t.Context(), cfg, cfg.Sources, false); err != nil {
+		t.Fatalf("Failed to run sources again: %v", err)
+	}
+
+	restoreDir := filepath.Join(tmpDir, "restored")
+	if _, err := RestoreDestination(t.Context(), cfg, "vault", restoreDir, false); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	want := map[string]string{
+		"a7iv/2025-12-31/DSC00001.JPG": "photo 1",
+		"a7iv/2025-12-31/DSC00002.ARW": "raw 2",
+	}
+	got := make(map[string]string)
+	filepath.WalkDir(restoreDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(restoreDir, path)
+			data, _ := os.ReadFile(path)
+			got[filepath.ToSlash(rel)] = string(data)
+		}
+		return nil
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Restored files = %v, want %v", got, want)
+	}
+	if info, err := os.Stat(filepath.Join(restoreDir, "a7iv", "2025-12-31", "DSC00001.JPG")); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("Restored file time = %v, %v, want %v", info, err, modTime)
+	}
+
+	if restored, err := RestoreDestination(t.Context(), cfg, "vault", restoreDir, false); err != nil || restored != 0 {
+		t.Errorf("Restoring again = %d, %v, want nothing restored", restored, err)
+	}
+	cfg.Destinations[0].Encryption.Passphrase = "guess"
+	if _, err := RestoreDestination(t.Context(), cfg, "vault", restoreDir, false); err == nil {
+		t.Error("Restoring with a wrong passphrase should fail")
+	}
+	if _, err := RestoreDestination(t.Context(), cfg, "missing", restoreDir, false); err == nil {
+		t.Error("Restoring an unknown destination should fail")
+	}
+}
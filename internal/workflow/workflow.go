@@ -2,31 +2,41 @@
 package workflow
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/checksum"
 	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
-	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/rename"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/discovery"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/index"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/volume"
 )
 
-// copyDir recursively copies a directory tree
-func CopyDir(src, dst string, dryRun bool) error {
+// CopyDir recursively copies the directory src of srcFS to dst of dstFS.
+// When ctx is cancelled the file being copied is rolled back and ctx.Err() is returned.
+func CopyDir(ctx context.Context, srcFS storage.FS, src string, dstFS storage.FS, dst string, dryRun bool) error {
 	if dryRun {
 		log.Printf("[DRY RUN] Would copy directory: %s -> %s", src, dst)
 		return nil
 	}
-	entries, err := os.ReadDir(src)
+	entries, err := srcFS.ReadDir(src)
 	if err != nil {
 		return fmt.Errorf("failed to read source directory: %w", err)
 	}
 
 	// Create destination directory if it doesn't exist
-	if err := os.MkdirAll(dst, 0755); err != nil {
+	if err := dstFS.MkdirAll(dst, 0755); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
@@ -35,11 +45,11 @@ func CopyDir(src, dst string, dryRun bool) error {
 		dstPath := filepath.Join(dst, entry.Name())
 
 		if entry.IsDir() {
-			if err := CopyDir(srcPath, dstPath, false); err != nil {
+			if err := CopyDir(ctx, srcFS, srcPath, dstFS, dstPath, false); err != nil {
 				return err
 			}
 		} else {
-			if err := copyFile(srcPath, dstPath); err != nil {
+			if err := copyFile(ctx, srcFS, srcPath, dstFS, dstPath); err != nil {
 				return err
 			}
 		}
@@ -48,51 +58,213 @@ func CopyDir(src, dst string, dryRun bool) error {
 	return nil
 }
 
-// copyFile copies a single file
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+// partialMarker is part of the temporary name used while a file is being written
+const partialMarker = ".partial-"
+
+// copyFile copies a single file atomically, keeping its permissions and modification time.
+// The content is written to a hidden temporary file in the destination directory,
+// made durable and only then renamed to dst, so dst is either absent or complete.
+// Stores implementing storage.Uploader receive dst directly with its digest.
+// A cancelled ctx interrupts the copy and removes the temporary file.
+func copyFile(ctx context.Context, srcFS storage.FS, src string, dstFS storage.FS, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sourceInfo, err := srcFS.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to get source file info: %w", err)
+	}
+	sourceFile, err := srcFS.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open source file: %w", err)
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(dst)
+	if uploader, ok := dstFS.(storage.Uploader); ok {
+		hash, err := hashFile(srcFS, src)
+		if err != nil {
+			return err
+		}
+		meta := storage.FileMeta{ModTime: sourceInfo.ModTime(), SHA256: hash}
+		if err := uploader.Upload(ctx, dst, contextReader{ctx: ctx, r: sourceFile}, meta); err != nil {
+			return fmt.Errorf("failed to upload file: %w", err)
+		}
+		return nil
+	}
+
+	tmpPath := partialName(dst)
+	destFile, err := dstFS.Create(tmpPath, sourceInfo.Mode().Perm())
 	if err != nil {
 		return fmt.Errorf("failed to create destination file: %w", err)
 	}
-	defer destFile.Close()
+	closed, committed := false, false
+	defer func() {
+		if !committed {
+			if !closed {
+				destFile.Close()
+			}
+			dstFS.Remove(tmpPath)
+		}
+	}()
 
-	if _, err := io.Copy(destFile, sourceFile); err != nil {
+	if _, err := io.Copy(destFile, contextReader{ctx: ctx, r: sourceFile}); err != nil {
 		return fmt.Errorf("failed to copy file content: %w", err)
 	}
 
-	// Copy file permissions
-	sourceInfo, err := os.Stat(src)
-	if err != nil {
-		return fmt.Errorf("failed to get source file info: %w", err)
+	closed = true
+	if err := destFile.Close(); err != nil {
+		return fmt.Errorf("failed to close destination file: %w", err)
 	}
 
-	if err := os.Chmod(dst, sourceInfo.Mode()); err != nil {
-		return fmt.Errorf("failed to set file permissions: %w", err)
+	if err := dstFS.Chtimes(tmpPath, sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+		return fmt.Errorf("failed to set file times: %w", err)
 	}
 
+	if err := dstFS.Rename(tmpPath, dst); err != nil {
+		return fmt.Errorf("failed to move destination file into place: %w", err)
+	}
+	committed = true
 	return nil
 }
 
-// RemoveContents removes all contents of a directory but keeps the directory itself
-func RemoveContents(dir string, dryRun bool) error {
+// partialName returns a unique temporary name next to dst
+func partialName(dst string) string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+partialMarker+hex.EncodeToString(buf))
+}
+
+// contextReader fails reads once ctx is cancelled, so long copies stop between two buffers
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// hashFile returns the SHA-256 digest of the file name of fsys
+func hashFile(fsys storage.FS, name string) (string, error) {
+	if hasher, ok := fsys.(storage.Hasher); ok {
+		if hash, err := hasher.SHA256(name); err != nil || hash != "" {
+			return hash, err
+		}
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file for hashing: %w", err)
+	}
+	defer f.Close()
+
+	hash, err := checksum.Reader(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash file %s: %w", name, err)
+	}
+	return hash, nil
+}
+
+// archivedCopy returns an archived file with the given hash, or "" when there is none.
+// The index only notices changes to the size or time of a file, so the copies it lists
+// are hashed again before a card file is given up for them.
+func archivedCopy(idx *index.Index, hash string) (string, error) {
+	for _, path := range idx.Lookup(hash) {
+		got, err := hashFile(storage.Local{}, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if got == hash {
+			return path, nil
+		}
+		log.Printf("Warning: %s no longer matches the archive index", path)
+	}
+	return "", nil
+}
+
+// identical reports whether a of aFS and b of bFS have the same size and SHA-256 digest
+func identical(aFS storage.FS, a string, bFS storage.FS, b string) (bool, error) {
+	infoA, err := aFS.Stat(a)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", a, err)
+	}
+	infoB, err := bFS.Stat(b)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", b, err)
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	hashA, err := hashFile(aFS, a)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := hashFile(bFS, b)
+	if err != nil {
+		return false, err
+	}
+	return hashA == hashB, nil
+}
+
+// isPartialFile reports whether name is a temporary file left behind by copyFile
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, partialMarker)
+}
+
+// CleanPartialFiles removes temporary files left under root of fsys by an interrupted copy.
+// It returns the number of files removed (or that would be removed in dry-run mode).
+func CleanPartialFiles(fsys storage.FS, root string, dryRun bool) (int, error) {
+	removed := 0
+	err := storage.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == root {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || !isPartialFile(d.Name()) {
+			return nil
+		}
+
+		removed++
+		if dryRun {
+			log.Printf("[DRY RUN] Would remove partial file: %s", path)
+			return nil
+		}
+		log.Printf("Removing partial file from an interrupted copy: %s", path)
+		if err := fsys.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove partial file %s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to clean partial files in %s: %w", root, err)
+	}
+	return removed, nil
+}
+
+// RemoveContents removes all contents of a directory of fsys but keeps the directory itself
+func RemoveContents(fsys storage.FS, dir string, dryRun bool) error {
 	if dryRun {
 		log.Printf("[DRY RUN] Would remove contents of: %s", dir)
 		return nil
 	}
-	entries, err := os.ReadDir(dir)
+	entries, err := fsys.ReadDir(dir)
 	if err != nil {
 		return fmt.Errorf("failed to read directory: %w", err)
 	}
 
 	for _, entry := range entries {
 		path := filepath.Join(dir, entry.Name())
-		if err := os.RemoveAll(path); err != nil {
+		if err := fsys.RemoveAll(path); err != nil {
 			return fmt.Errorf("failed to remove %s: %w", path, err)
 		}
 	}
@@ -100,30 +272,28 @@ func RemoveContents(dir string, dryRun bool) error {
 	return nil
 }
 
-// EjectVolume ejects a volume (macOS only)
-func EjectVolume(volumeName string, dryRun bool) error {
+// Ejector releases card volumes at the end of a run. Tests may replace it.
+var Ejector volume.Ejector = volume.NewEjector(runtime.GOOS, volume.ExecRunner{})
+
+// EjectVolume unmounts and ejects the volume mounted at mountPoint
+func EjectVolume(mountPoint string, dryRun bool) error {
 	if dryRun {
-		log.Printf("[DRY RUN] Would eject volume: %s", volumeName)
-		return nil
-	}
-	if runtime.GOOS != "darwin" {
-		log.Printf("Eject not supported on %s, skipping", runtime.GOOS)
+		log.Printf("[DRY RUN] Would eject volume: %s", mountPoint)
 		return nil
 	}
 
-	cmd := exec.Command("diskutil", "eject", volumeName)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to eject volume %s: %w\nOutput: %s", volumeName, err, string(output))
+	if err := Ejector.Eject(mountPoint); err != nil {
+		return err
 	}
 
-	log.Printf("Successfully ejected volume: %s", volumeName)
+	log.Printf("Successfully ejected volume: %s", mountPoint)
 	return nil
 }
 
-// CheckDirectoryExists checks if a directory exists
-func CheckDirectoryExists(path string) error {
-	info, err := os.Stat(path)
-	if os.IsNotExist(err) {
+// CheckDirectoryExists checks if a directory of fsys exists
+func CheckDirectoryExists(fsys storage.FS, path string) error {
+	info, err := fsys.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("directory does not exist: %s", path)
 	}
 	if err != nil {
@@ -135,92 +305,81 @@ func CheckDirectoryExists(path string) error {
 	return nil
 }
 
-// runWorkflow executes the copy-rename-delete workflow
-func Run(config *config.Config, dryRun bool) error {
-	tmpDir := config.TmpDir
-	sourceDCIM := filepath.Join(config.TargetPath, "DCIM")
-
-	// Check if source directory exists
-	if err := CheckDirectoryExists(config.DestinationPath); err != nil {
-		return fmt.Errorf("destination check failed: %w", err)
-	}
-
-	if err := CheckDirectoryExists(sourceDCIM); err != nil {
-		return fmt.Errorf("source DCIM check failed: %w", err)
-	}
-
-	// Create temporary directory
-	if !dryRun {
-		if err := os.MkdirAll(tmpDir, 0755); err != nil {
-			return fmt.Errorf("failed to create temporary directory: %w", err)
-		}
-	} else {
-		log.Printf("[DRY RUN] Would create temporary directory: %s", tmpDir)
+// IndexPath returns the location of the archive's content-hash index
+func IndexPath(config *config.Config) string {
+	if config.IndexPath != "" {
+		return config.IndexPath
 	}
+	return filepath.Join(config.DestinationPath, index.DefaultFileName)
+}
 
-	log.Printf("Copying photos from %s to %s", sourceDCIM, tmpDir)
-	if err := CopyDir(sourceDCIM, tmpDir, dryRun); err != nil {
-		return fmt.Errorf("failed to copy files to temp directory: %w", err)
+// OpenIndex loads the archive index and refreshes it against DestinationPath
+func OpenIndex(ctx context.Context, config *config.Config) (*index.Index, error) {
+	idx, err := index.Load(config.DestinationPath, IndexPath(config))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load archive index: %w", err)
 	}
 
-	log.Printf("Renaming directories in %s", tmpDir)
-	if !dryRun {
-		if err := rename.Directories(tmpDir); err != nil {
-			return fmt.Errorf("failed to rename directories: %w", err)
-		}
-	} else {
-		log.Printf("[DRY RUN] Would rename directories in: %s", tmpDir)
+	log.Printf("Refreshing archive index for %s", config.DestinationPath)
+	if err := idx.Refresh(ctx); err != nil {
+		return nil, fmt.Errorf("failed to refresh archive index: %w", err)
 	}
 
-	log.Printf("Copying renamed directories to %s", config.DestinationPath)
-	if err := CopyDir(tmpDir, config.DestinationPath, dryRun); err != nil {
-		return fmt.Errorf("failed to copy to destination: %w", err)
-	}
+	return idx, nil
+}
 
-	log.Printf("Deleting photos from source: %s", sourceDCIM)
-	if err := RemoveContents(sourceDCIM, dryRun); err != nil {
-		return fmt.Errorf("failed to delete source files: %w", err)
+// RunDedupe refreshes the archive index and reports files that are stored more than once
+func RunDedupe(ctx context.Context, config *config.Config) ([][]string, error) {
+	if err := CheckDirectoryExists(storage.Local{}, config.DestinationPath); err != nil {
+		return nil, fmt.Errorf("destination check failed: %w", err)
 	}
 
-	log.Printf("Cleaning up temporary directory: %s", tmpDir)
-	if err := RemoveContents(tmpDir, dryRun); err != nil {
-		return fmt.Errorf("failed to clean temporary directory: %w", err)
+	idx, err := OpenIndex(ctx, config)
+	if err != nil {
+		return nil, err
 	}
-
-	// Extract volume name from path (e.g., "/Volumes/1-1" -> "1-1")
-	volumeName := filepath.Base(config.TargetPath)
-	log.Printf("Ejecting volume: %s", volumeName)
-	if err := EjectVolume(volumeName, dryRun); err != nil {
-		log.Printf("Warning: %v", err)
+	if err := idx.Save(); err != nil {
+		return nil, fmt.Errorf("failed to save archive index: %w", err)
 	}
 
-	return nil
+	groups := idx.Duplicates()
+	log.Printf("Scanned %d archived files, found %d groups of duplicates", idx.Len(), len(groups))
+	return groups, nil
 }
 
-// runBackupCleanup deletes all files from backup SD card and ejects it
-func RunBackupCleanup(config *config.Config, dryRun bool) error {
-	backupDCIM := filepath.Join(config.BackupPath, "DCIM")
+// FindCards lists the mounted Sony cards. It is replaced in tests.
+var FindCards = discovery.Find
 
-	// Check if backup directory exists
-	if err := CheckDirectoryExists(config.BackupPath); err != nil {
-		return fmt.Errorf("backup path check failed: %w", err)
+// ResolveCardPath returns path, or the mount point of the mounted Sony card for role
+// and body when path is config.AutoDetect
+func ResolveCardPath(cfg *config.Config, path, role, body string) (string, error) {
+	if path != config.AutoDetect {
+		return path, nil
 	}
 
-	if err := CheckDirectoryExists(backupDCIM); err != nil {
-		return fmt.Errorf("backup DCIM check failed: %w", err)
+	cards, err := FindCards()
+	if err != nil {
+		return "", fmt.Errorf("failed to detect card: %w", err)
 	}
-
-	log.Printf("Deleting photos from backup: %s", backupDCIM)
-	if err := RemoveContents(backupDCIM, dryRun); err != nil {
-		return fmt.Errorf("failed to delete backup files: %w", err)
+	detected, err := selectCard(cfg, cards, role, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to detect card: %w", err)
 	}
 
-	// Extract volume name from path
-	volumeName := filepath.Base(config.BackupPath)
-	log.Printf("Ejecting backup volume: %s", volumeName)
-	if err := EjectVolume(volumeName, dryRun); err != nil {
-		log.Printf("Warning: %v", err)
-	}
+	log.Printf("Detected card %s at %s (%d photos)", detected.Label, detected.MountPoint, detected.PhotoCount)
+	return detected.MountPoint, nil
+}
 
-	return nil
+// Run executes the copy-rename-delete workflow for every main card
+func Run(ctx context.Context, cfg *config.Config, dryRun bool) error {
+	report, err := RunSources(ctx, cfg, Sources(cfg, card.RoleMain), dryRun)
+	report.Log()
+	return err
+}
+
+// runBackupCleanup deletes files from the backup SD cards that are proven to be archived and ejects them
+func RunBackupCleanup(ctx context.Context, cfg *config.Config, dryRun bool) error {
+	report, err := RunSources(ctx, cfg, Sources(cfg, card.RoleBackup), dryRun)
+	report.Log()
+	return err
 }
@@ -2,9 +2,16 @@ package workflow
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/card"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/config"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/discovery"
+	"github.com/shunichi-ikebuchi/rename-sony-photos-directories/internal/storage"
 )
 
 func TestCopyFile(t *testing.T) {
@@ -24,7 +31,7 @@ func TestCopyFile(t *testing.T) {
 
 	// Copy file
 	dstFile := filepath.Join(tmpDir, "destination.txt")
-	if err := copyFile(srcFile, dstFile); err != nil {
+	if err := copyFile(t.Context(), storage.Local{}, srcFile, storage.Local{}, dstFile); err != nil {
 		t.Fatalf("copyFile failed: %v", err)
 	}
 
@@ -39,6 +46,132 @@ func TestCopyFile(t *testing.T) {
 	}
 }
 
+func TestCopyFileCancelled(t *testing.T) {
+	tmpDir := t.TempDir()
+	srcFile := filepath.Join(tmpDir, "source.txt")
+	if err := os.WriteFile(srcFile, bytes.Repeat([]byte("x"), 1<<20), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	dstFile := filepath.Join(tmpDir, "destination.txt")
+	if err := copyFile(ctx, storage.Local{}, srcFile, storage.Local{}, dstFile); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Cancelled copy should leave no file behind, found %d entries", len(entries))
+	}
+
+	// A running copy stops at the next read after cancellation
+	ctx, cancel = context.WithCancel(t.Context())
+	reader := contextReader{ctx: ctx, r: bytes.NewReader(make([]byte, 10))}
+	buf := make([]byte, 4)
+	if _, err := reader.Read(buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	cancel()
+	if _, err := reader.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled after cancel, got %v", err)
+	}
+}
+
+func TestCopyFileReplacesAtomically(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "copy-atomic-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcFile := filepath.Join(tmpDir, "source.txt")
+	dstFile := filepath.Join(tmpDir, "destination.txt")
+	if err := os.WriteFile(srcFile, []byte("new content"), 0644); err != nil {
+		t.Fatalf("Failed to create source file: %v", err)
+	}
+	if err := os.WriteFile(dstFile, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to create destination file: %v", err)
+	}
+
+	if err := copyFile(t.Context(), storage.Local{}, srcFile, storage.Local{}, dstFile); err != nil {
+		t.Fatalf("copyFile failed: %v", err)
+	}
+
+	dstContent, err := os.ReadFile(dstFile)
+	if err != nil {
+		t.Fatalf("Failed to read destination file: %v", err)
+	}
+	if string(dstContent) != "new content" {
+		t.Errorf("Content mismatch: got %q", string(dstContent))
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	for _, entry := range entries {
+		if isPartialFile(entry.Name()) {
+			t.Errorf("Temporary file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestCleanPartialFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "clean-partial-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	subDir := filepath.Join(tmpDir, "2025-12-31")
+	if err := os.MkdirAll(subDir, 0755); err != nil {
+		t.Fatalf("Failed to create subdir: %v", err)
+	}
+
+	partial := filepath.Join(subDir, ".DSC00001.JPG.partial-12345")
+	complete := filepath.Join(subDir, "DSC00002.JPG")
+	for _, path := range []string{partial, complete} {
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	// Dry run reports but keeps the file
+	removed, err := CleanPartialFiles(storage.Local{}, tmpDir, true)
+	if err != nil {
+		t.Fatalf("CleanPartialFiles with dry-run failed: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 partial file, got %d", removed)
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Error("Partial file should still exist in dry-run mode")
+	}
+
+	removed, err = CleanPartialFiles(storage.Local{}, tmpDir, false)
+	if err != nil {
+		t.Fatalf("CleanPartialFiles failed: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 removed file, got %d", removed)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("Partial file should have been removed")
+	}
+	if _, err := os.Stat(complete); err != nil {
+		t.Error("Complete file should not have been removed")
+	}
+
+	// A missing directory is not an error
+	if _, err := CleanPartialFiles(storage.Local{}, filepath.Join(tmpDir, "missing"), false); err != nil {
+		t.Errorf("CleanPartialFiles failed for missing directory: %v", err)
+	}
+}
+
 func TestCopyDir(t *testing.T) {
 	// Create temporary directory structure
 	tmpDir, err := os.MkdirTemp("", "copy-dir-test-*")
@@ -70,7 +203,7 @@ func TestCopyDir(t *testing.T) {
 
 	// Copy directory
 	dstDir := filepath.Join(tmpDir, "destination")
-	if err := CopyDir(srcDir, dstDir, false); err != nil {
+	if err := CopyDir(t.Context(), storage.Local{}, srcDir, storage.Local{}, dstDir, false); err != nil {
 		t.Fatalf("CopyDir failed: %v", err)
 	}
 
@@ -102,7 +235,7 @@ func TestCopyDirDryRun(t *testing.T) {
 	dstDir := filepath.Join(tmpDir, "destination")
 
 	// Run CopyDir with dry-run
-	if err := CopyDir(srcDir, dstDir, true); err != nil {
+	if err := CopyDir(t.Context(), storage.Local{}, srcDir, storage.Local{}, dstDir, true); err != nil {
 		t.Fatalf("CopyDir with dry-run failed: %v", err)
 	}
 
@@ -137,7 +270,7 @@ func TestRemoveContents(t *testing.T) {
 	}
 
 	// Remove contents
-	if err := RemoveContents(testDir, false); err != nil {
+	if err := RemoveContents(storage.Local{}, testDir, false); err != nil {
 		t.Fatalf("RemoveContents failed: %v", err)
 	}
 
@@ -170,7 +303,7 @@ func TestRemoveContentsDryRun(t *testing.T) {
 	}
 
 	// Run RemoveContents with dry-run
-	if err := RemoveContents(tmpDir, true); err != nil {
+	if err := RemoveContents(storage.Local{}, tmpDir, true); err != nil {
 		t.Fatalf("RemoveContents with dry-run failed: %v", err)
 	}
 
@@ -189,13 +322,13 @@ func TestCheckDirectoryExists(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	// Test existing directory
-	if err := CheckDirectoryExists(tmpDir); err != nil {
+	if err := CheckDirectoryExists(storage.Local{}, tmpDir); err != nil {
 		t.Errorf("CheckDirectoryExists failed for existing directory: %v", err)
 	}
 
 	// Test non-existent directory
 	nonExistent := filepath.Join(tmpDir, "nonexistent")
-	if err := CheckDirectoryExists(nonExistent); err == nil {
+	if err := CheckDirectoryExists(storage.Local{}, nonExistent); err == nil {
 		t.Error("CheckDirectoryExists should fail for non-existent directory")
 	}
 
@@ -205,7 +338,38 @@ func TestCheckDirectoryExists(t *testing.T) {
 		t.Fatalf("Failed to create test file: %v", err)
 	}
 
-	if err := CheckDirectoryExists(testFile); err == nil {
+	if err := CheckDirectoryExists(storage.Local{}, testFile); err == nil {
 		t.Error("CheckDirectoryExists should fail for file")
 	}
 }
+
+func TestResolveCardPath(t *testing.T) {
+	original := FindCards
+	defer func() { FindCards = original }()
+
+	cfg := &config.Config{CardRegistry: filepath.Join(t.TempDir(), "cards.yaml")}
+
+	// Explicit paths are returned unchanged
+	path, err := ResolveCardPath(cfg, "/Volumes/1-1", card.RoleMain, "")
+	if err != nil || path != "/Volumes/1-1" {
+		t.Errorf("ResolveCardPath() = %q, %v", path, err)
+	}
+
+	FindCards = func() ([]discovery.Card, error) {
+		return []discovery.Card{{MountPoint: "/run/media/alice/SONY"}}, nil
+	}
+	path, err = ResolveCardPath(cfg, config.AutoDetect, card.RoleMain, "")
+	if err != nil {
+		t.Fatalf("ResolveCardPath failed: %v", err)
+	}
+	if path != "/run/media/alice/SONY" {
+		t.Errorf("Expected detected mount point, got %s", path)
+	}
+
+	FindCards = func() ([]discovery.Card, error) {
+		return []discovery.Card{{MountPoint: "/Volumes/1-1"}, {MountPoint: "/Volumes/1-2"}}, nil
+	}
+	if _, err := ResolveCardPath(cfg, config.AutoDetect, card.RoleMain, ""); err == nil {
+		t.Error("Expected error when several cards are mounted")
+	}
+}